@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/admin"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/audit"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/autoscaler"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/ratelimit"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/leader"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/metrics"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/provider/ec2"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/provider/gce"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/provider/nomad"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/provider/process"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/provider/ssh"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/provider/vmss"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/statestore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// openAuditor opens the configured audit sinks. With none configured changes
+// are not recorded.
+func openAuditor(cfg config.Audit) (ports.Auditor, error) {
+	var auditor audit.Multi
+
+	if cfg.File != "" {
+		file, err := audit.OpenFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+
+		auditor = append(auditor, file)
+	}
+
+	if cfg.Stdout {
+		auditor = append(auditor, audit.NewWriter(os.Stdout))
+	}
+
+	return auditor, nil
+}
+
+// openProviders creates the configured providers, keyed by name for the
+// pools referring to them.
+func openProviders(ctx context.Context, cfgs []config.Provider) (map[string]ports.Provider, error) {
+	providers := make(map[string]ports.Provider, len(cfgs))
+
+	for _, cfg := range cfgs {
+		switch cfg.Type {
+		case config.ProviderEC2:
+			provider, err := ec2.Open(ctx, cfg.Name, *cfg.EC2)
+			if err != nil {
+				return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+			}
+
+			providers[cfg.Name] = provider
+		case config.ProviderGCE:
+			provider, err := gce.Open(ctx, cfg.Name, *cfg.GCE)
+			if err != nil {
+				return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+			}
+
+			providers[cfg.Name] = provider
+		case config.ProviderVMSS:
+			provider, err := vmss.Open(ctx, cfg.Name, *cfg.VMSS)
+			if err != nil {
+				return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+			}
+
+			providers[cfg.Name] = provider
+		case config.ProviderNomad:
+			provider, err := nomad.Open(ctx, cfg.Name, *cfg.Nomad)
+			if err != nil {
+				return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+			}
+
+			providers[cfg.Name] = provider
+		case config.ProviderProcess:
+			provider, err := process.New(cfg.Name, *cfg.Process)
+			if err != nil {
+				return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+			}
+
+			providers[cfg.Name] = provider
+		case config.ProviderSSH:
+			provider, err := ssh.Open(ctx, cfg.Name, *cfg.SSH)
+			if err != nil {
+				return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+			}
+
+			providers[cfg.Name] = provider
+		default:
+			return nil, fmt.Errorf("provider %q: unknown type %q", cfg.Name, cfg.Type)
+		}
+	}
+
+	return providers, nil
+}
+
+// serviceAccountNamespace holds the namespace of the pod when running in
+// Kubernetes.
+const serviceAccountNamespace string = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// openStateStore opens the state file, or keeps state in memory if none is
+// configured.
+func openStateStore(path string) (ports.StateStore, error) {
+	if path == "" {
+		return statestore.NewMemory(), nil
+	}
+
+	return statestore.OpenBolt(path)
+}
+
+// newLeaderElector returns the configured elector, or one that always leads
+// when leader election is disabled.
+func newLeaderElector(cfg config.LeaderElection) (ports.LeaderElector, error) {
+	switch cfg.Backend {
+	case config.LeaderElectionKubernetes:
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load in-cluster kubernetes config: %w", err)
+		}
+
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+		}
+
+		if cfg.Namespace == "" {
+			cfg.Namespace = "default"
+
+			if raw, err := os.ReadFile(serviceAccountNamespace); err == nil {
+				cfg.Namespace = strings.TrimSpace(string(raw))
+			}
+		}
+
+		return leader.NewKubernetes(client, cfg), nil
+	case config.LeaderElectionFile:
+		return leader.NewFile(cfg)
+	default:
+		hostname, _ := os.Hostname()
+
+		return leader.NewAlways(hostname), nil
+	}
+}
+
+const readHeaderTimeout time.Duration = 5 * time.Second
+
+func main() {
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && (args[0] == "plan" || args[0] == "apply") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+
+	switch command {
+	case "plan":
+		err = runPlan(args, logger)
+	case "apply":
+		err = runApply(args)
+	default:
+		err = serve(args, logger)
+	}
+
+	if err != nil {
+		logger.Error("autoscaler stopped", "command", command, "error", err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the autoscaler until it is interrupted.
+func serve(args []string, logger *slog.Logger) error {
+	flags := flag.NewFlagSet("autoscaler", flag.ExitOnError)
+	configPath := flags.String("config", "config.yaml", "path to the autoscaler configuration")
+	listenAddr := flags.String("listen", ":9090", "address serving /metrics and the admin API")
+
+	_ = flags.Parse(args)
+
+	return run(*configPath, *listenAddr, logger)
+}
+
+func run(configPath, listenAddr string, logger *slog.Logger) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+
+	store, err := openStateStore(cfg.StateFile)
+	if err != nil {
+		return err
+	}
+
+	defer store.Close()
+
+	elector, err := newLeaderElector(cfg.LeaderElection)
+	if err != nil {
+		return err
+	}
+
+	auditor, err := openAuditor(cfg.Audit)
+	if err != nil {
+		return err
+	}
+
+	defer auditor.Close()
+
+	providers, err := openProviders(ctx, cfg.Providers)
+	if err != nil {
+		return err
+	}
+
+	workspaces, err := buildWorkspaces(ctx, cfg, providers, store, auditor, elector, logger, m)
+	if err != nil {
+		return err
+	}
+
+	manager := autoscaler.NewManager(workspaces, cfg.Interval, logger, m)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Handle("/api/", admin.NewHandler(manager, elector, cfg.Admin.Token))
+
+	server := &http.Server{Addr: listenAddr, Handler: mux, ReadHeaderTimeout: readHeaderTimeout}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("http server failed", "error", err)
+		}
+	}()
+
+	logger.Info(
+		"autoscaler started",
+		"workspaces", len(workspaces), "interval", cfg.Interval, "identity", elector.Identity(),
+	)
+
+	// Followers keep serving metrics and the admin API; only the leader
+	// reconciles.
+	err = elector.Run(ctx, func(ctx context.Context) {
+		logger.Info("started leading")
+		m.Leader.Set(1)
+
+		manager.Run(ctx)
+
+		m.Leader.Set(0)
+		logger.Info("stopped leading")
+	})
+
+	return errors.Join(err, server.Shutdown(context.Background()))
+}
+
+// buildWorkspaces gives every configured workspace its own client and token
+// source. Workspace slugs are resolved to UUIDs by the first reconcile of
+// their workspace, so that one failing lookup does not stop the others.
+func buildWorkspaces(
+	ctx context.Context,
+	cfg *config.Config,
+	providers map[string]ports.Provider,
+	store ports.StateStore,
+	auditor ports.Auditor,
+	elector ports.LeaderElector,
+	logger *slog.Logger,
+	m *metrics.Metrics,
+) ([]*autoscaler.Workspace, error) {
+	workspaces := make([]*autoscaler.Workspace, 0, len(cfg.Workspaces))
+
+	for i := range cfg.Workspaces {
+		wc := &cfg.Workspaces[i]
+
+		pools := make([]*autoscaler.Pool, 0, len(wc.Pools))
+
+		for _, pc := range wc.Pools {
+			chain := pc.ProviderChain()
+			poolProviders := make([]ports.Provider, 0, len(chain))
+
+			for _, entry := range chain {
+				p, ok := providers[entry.Name]
+				if !ok {
+					return nil, fmt.Errorf("workspace %q pool %q: unknown provider %q", wc.Name, pc.Name, entry.Name)
+				}
+
+				// The consistency check needs every workload of the pool, so
+				// a provider that cannot list them is a configuration error.
+				if _, ok := p.(ports.WorkloadLister); !ok && pc.Consistency != nil {
+					return nil, fmt.Errorf(
+						"workspace %q pool %q: provider %q cannot list its workloads", wc.Name, pc.Name, entry.Name,
+					)
+				}
+
+				poolProviders = append(poolProviders, p)
+			}
+
+			pool, err := autoscaler.NewPool(pc, poolProviders...)
+			if err != nil {
+				return nil, fmt.Errorf("workspace %q: %w", wc.Name, err)
+			}
+
+			pools = append(pools, pool)
+		}
+
+		// Every Bitbucket call of the workspace, including the slug lookup,
+		// spends from the same budget.
+		httpClient := ratelimit.New(
+			ctx,
+			bitbucketclient.NewOAuthHTTPClient(wc.AccessTokenURL, wc.ClientID, wc.ClientSecret),
+			ratelimit.Config{
+				Budget:  wc.RateLimit.Budget,
+				Period:  wc.RateLimit.Period,
+				Burst:   wc.RateLimit.Burst,
+				Reserve: wc.RateLimit.Reserve,
+			},
+			m.RateLimitBudget.WithLabelValues(wc.Name),
+			m.RateLimited.WithLabelValues(wc.Name),
+		)
+
+		workspace := wc.UUID
+		if workspace == "" {
+			workspace = wc.Slug
+		}
+
+		// A slug is looked up by the first reconcile, so a failed lookup is
+		// retried with the backoff of the workspace.
+		client := autoscaler.NewLeaderOnlyClient(
+			bitbucketclient.NewCachedClient(
+				bitbucketclient.NewForWorkspace(bitbucketclient.NewETagClient(httpClient), wc.BaseURL, workspace),
+				wc.CacheTTL,
+			),
+			elector,
+		)
+
+		workspaces = append(workspaces, autoscaler.NewWorkspace(wc.Name, client, store, auditor, pools, logger, m))
+	}
+
+	return workspaces, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"syscall"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/admin"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/audit"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/autoscaler"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/leader"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/metrics"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/statestore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const planFileMode = 0o600
+
+// runPlan prints what the autoscaler would do right now, and optionally
+// saves it for apply. Nothing is changed: state is kept in memory, so a
+// running autoscaler keeps its state file.
+func runPlan(args []string, logger *slog.Logger) error {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	configPath := flags.String("config", "config.yaml", "path to the autoscaler configuration")
+	format := flags.String("format", "text", "output format, text or json")
+	out := flags.String("out", "", "save the plan to this file for apply")
+
+	_ = flags.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	manager, err := oneShotManager(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	plan, err := manager.Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *out != "" {
+		raw, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(*out, raw, planFileMode); err != nil {
+			return fmt.Errorf("failed to save plan: %w", err)
+		}
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(plan)
+	}
+
+	return plan.WriteText(os.Stdout)
+}
+
+// applyTokenEnv holds the admin token apply presents to the autoscaler.
+const applyTokenEnv string = "AUTOSCALER_ADMIN_TOKEN"
+
+// runApply sends a plan saved by runPlan to the leading autoscaler, which
+// executes it workspace by workspace, skipping workspaces whose runners
+// changed since. Running it there keeps it clear of the reconciles.
+func runApply(args []string) error {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	addr := flags.String("addr", "http://localhost:9090", "admin API of the leading autoscaler")
+
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: autoscaler apply [-addr http://localhost:9090] plan.json")
+	}
+
+	raw, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %w", err)
+	}
+
+	var plan autoscaler.Plan
+
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		return fmt.Errorf("failed to parse plan: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *addr+admin.ApplyPath, bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv(applyTokenEnv))
+	req.Header.Set(admin.ActorHeader, cliActor())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send plan: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s does not accept plans, set admin.token", *addr)
+	}
+
+	var result admin.ApplyResult
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to read apply result: %s", resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to apply plan: %s", result.Error)
+	}
+
+	return nil
+}
+
+// oneShotManager builds the workspaces of the configuration for a single
+// plan. State is kept in memory and nothing is audited, as planning makes no
+// changes.
+func oneShotManager(ctx context.Context, cfg *config.Config, logger *slog.Logger) (*autoscaler.Manager, error) {
+	hostname, _ := os.Hostname()
+	elector := leader.NewAlways(hostname)
+	m := metrics.New(prometheus.NewRegistry())
+
+	providers, err := openProviders(ctx, cfg.Providers)
+	if err != nil {
+		return nil, err
+	}
+
+	workspaces, err := buildWorkspaces(ctx, cfg, providers, statestore.NewMemory(), audit.Multi{}, elector, logger, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return autoscaler.NewManager(workspaces, cfg.Interval, logger, m), nil
+}
+
+// cliActor names the user applying a plan, which the leader records as
+// claimed.
+func cliActor() string {
+	name := "unknown"
+
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+
+	return "cli:" + name
+}
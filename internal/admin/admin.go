@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/audit"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/autoscaler"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+const (
+	PoolsPath   string = "/api/v1/pools"
+	RunnersPath string = "/api/v1/runners"
+	LeaderPath  string = "/api/v1/leader"
+	ApplyPath   string = "/api/v1/apply"
+	// ActorHeader names who applies a plan. The caller sets it, so the audit
+	// trail records it as claimed rather than as the actor.
+	ActorHeader string = "X-Autoscaler-Actor"
+
+	// maxPlanBytes bounds the plans ApplyPath reads.
+	maxPlanBytes int64 = 1 << 20
+	// apiActor is the actor of plans applied through the admin API: holders
+	// of the token are all the API can tell apart.
+	apiActor string = "api"
+)
+
+// Source is the autoscaler behind the admin API. It reports the state of the
+// pools and runners it manages, and applies plans.
+type Source interface {
+	Status() []autoscaler.PoolStatus
+	Runners() []autoscaler.RunnerStatus
+	Apply(ctx context.Context, plan *autoscaler.Plan) error
+}
+
+// LeaderStatus tells whether the replica answering is the leader. Pools and
+// runners are only reported by the leader.
+type LeaderStatus struct {
+	Identity string `json:"identity"`
+	Leader   bool   `json:"leader"`
+}
+
+// ApplyResult is the answer to a plan sent to ApplyPath.
+type ApplyResult struct {
+	Error string `json:"error,omitempty"`
+}
+
+// NewHandler returns the admin API. It is read-only unless token is set:
+// then ApplyPath applies plans for callers presenting token as a bearer
+// token, as long as this replica leads.
+func NewHandler(source Source, elector ports.LeaderElector, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+PoolsPath, func(w http.ResponseWriter, _ *http.Request) {
+		statuses := source.Status()
+		if statuses == nil {
+			statuses = []autoscaler.PoolStatus{}
+		}
+
+		writeJSON(w, http.StatusOK, statuses)
+	})
+
+	mux.HandleFunc("GET "+RunnersPath, func(w http.ResponseWriter, _ *http.Request) {
+		runners := source.Runners()
+		if runners == nil {
+			runners = []autoscaler.RunnerStatus{}
+		}
+
+		writeJSON(w, http.StatusOK, runners)
+	})
+
+	mux.HandleFunc("GET "+LeaderPath, func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, LeaderStatus{Identity: elector.Identity(), Leader: elector.IsLeader()})
+	})
+
+	if token != "" {
+		mux.HandleFunc("POST "+ApplyPath, func(w http.ResponseWriter, r *http.Request) {
+			apply(w, r, source, elector, token)
+		})
+	}
+
+	return mux
+}
+
+// apply runs a plan on the leader, so that it never races the reconciles.
+func apply(w http.ResponseWriter, r *http.Request, source Source, elector ports.LeaderElector, token string) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, ApplyResult{Error: "invalid token"})
+
+		return
+	}
+
+	if !elector.IsLeader() {
+		writeJSON(w, http.StatusConflict, ApplyResult{Error: elector.Identity() + " is not the leader"})
+
+		return
+	}
+
+	var plan autoscaler.Plan
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPlanBytes)).Decode(&plan); err != nil {
+		status := http.StatusBadRequest
+
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		writeJSON(w, status, ApplyResult{Error: "invalid plan: " + err.Error()})
+
+		return
+	}
+
+	actor := apiActor
+	if claimed := r.Header.Get(ActorHeader); claimed != "" {
+		actor += " (claimed " + claimed + ")"
+	}
+
+	if err := source.Apply(audit.WithActor(r.Context(), actor), &plan); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, ApplyResult{Error: err.Error()})
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ApplyResult{})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(v)
+}
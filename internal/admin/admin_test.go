@@ -0,0 +1,262 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/audit"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/autoscaler"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticSource struct {
+	applyErr error
+	applied  *autoscaler.Plan
+	actor    string
+	pools    []autoscaler.PoolStatus
+	runners  []autoscaler.RunnerStatus
+}
+
+func (s *staticSource) Status() []autoscaler.PoolStatus {
+	return s.pools
+}
+
+func (s *staticSource) Runners() []autoscaler.RunnerStatus {
+	return s.runners
+}
+
+func (s *staticSource) Apply(ctx context.Context, plan *autoscaler.Plan) error {
+	s.applied = plan
+	s.actor = audit.Actor(ctx)
+
+	return s.applyErr
+}
+
+func TestPools(t *testing.T) {
+	updatedAt := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	tables := []struct {
+		name         string
+		method       string
+		expectedBody string
+		source       staticSource
+		expectedCode int
+	}{
+		{
+			name:         "no pools reconciled yet",
+			method:       http.MethodGet,
+			expectedCode: http.StatusOK,
+			expectedBody: "[]\n",
+		},
+		{
+			name:   "pool with active profile",
+			method: http.MethodGet,
+			source: staticSource{pools: []autoscaler.PoolStatus{{
+				UpdatedAt: updatedAt, Workspace: "acme", Pool: "linux", Profile: "working-hours",
+				Min: 10, Max: 30, Warm: 2, Desired: 10, Runners: 8, Busy: 3,
+			}}},
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"updated_at":"2024-12-02T08:00:00Z","workspace":"acme","pool":"linux","profile":"working-hours",` +
+				`"min":10,"max":30,"warm":2,"desired":10,"runners":8,"busy":3}]` + "\n",
+		},
+		{
+			name:         "read only",
+			method:       http.MethodPost,
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			NewHandler(&table.source, &mocks.LeaderElector{}, "").ServeHTTP(rec, httptest.NewRequest(table.method, PoolsPath, nil))
+
+			assert.Equal(t, table.expectedCode, rec.Code)
+
+			if table.expectedBody != "" {
+				assert.Equal(t, table.expectedBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRunners(t *testing.T) {
+	at := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+	transition := lifecycle.Transition{
+		At: at, Pool: "linux", Runner: "linux-0a1b2c3d", RunnerUUID: "{1}",
+		From: lifecycle.StateProvisioning, To: lifecycle.StateFailed, Reason: "timed out in provisioning after 10m0s",
+	}
+
+	source := staticSource{runners: []autoscaler.RunnerStatus{{
+		Workspace: "acme",
+		Runner: lifecycle.Runner{
+			Since: at, Pool: "linux", Name: "linux-0a1b2c3d", UUID: "{1}",
+			State: lifecycle.StateFailed, Reason: transition.Reason, History: []lifecycle.Transition{transition},
+		},
+	}}}
+
+	rec := httptest.NewRecorder()
+
+	NewHandler(&source, &mocks.LeaderElector{}, "").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, RunnersPath, nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{
+		"workspace": "acme", "since": "2024-12-02T08:00:00Z", "pool": "linux", "name": "linux-0a1b2c3d", "uuid": "{1}",
+		"state": "failed", "reason": "timed out in provisioning after 10m0s",
+		"history": [{
+			"at": "2024-12-02T08:00:00Z", "pool": "linux", "runner": "linux-0a1b2c3d", "runner_uuid": "{1}",
+			"from": "provisioning", "to": "failed", "reason": "timed out in provisioning after 10m0s"
+		}]
+	}]`, rec.Body.String())
+}
+
+func TestLeader(t *testing.T) {
+	tables := []struct {
+		name         string
+		expectedBody string
+		leader       bool
+	}{
+		{
+			name:         "leader",
+			leader:       true,
+			expectedBody: `{"identity":"autoscaler-0","leader":true}`,
+		},
+		{
+			name:         "follower",
+			expectedBody: `{"identity":"autoscaler-0","leader":false}`,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			elector := &mocks.LeaderElector{}
+			elector.On("Identity").Return("autoscaler-0")
+			elector.On("IsLeader").Return(table.leader)
+
+			rec := httptest.NewRecorder()
+
+			NewHandler(&staticSource{}, elector, "").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, LeaderPath, nil))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.JSONEq(t, table.expectedBody, rec.Body.String())
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	plan := `{"created_at":"2024-12-02T08:00:00Z","workspaces":[{"workspace":"acme","state":"abc","pools":null}]}`
+
+	tables := []struct {
+		applyErr      error
+		name          string
+		token         string
+		authorization string
+		body          string
+		expectedBody  string
+		expectedActor string
+		expectedCode  int
+		leader        bool
+	}{
+		{
+			name:          "read only without token",
+			authorization: "Bearer secret",
+			body:          plan,
+			leader:        true,
+			expectedCode:  http.StatusNotFound,
+		},
+		{
+			name:          "invalid token",
+			token:         "secret",
+			authorization: "Bearer guess",
+			body:          plan,
+			leader:        true,
+			expectedCode:  http.StatusUnauthorized,
+			expectedBody:  `{"error":"invalid token"}`,
+		},
+		{
+			name:          "follower",
+			token:         "secret",
+			authorization: "Bearer secret",
+			body:          plan,
+			expectedCode:  http.StatusConflict,
+			expectedBody:  `{"error":"autoscaler-0 is not the leader"}`,
+		},
+		{
+			name:          "invalid plan",
+			token:         "secret",
+			authorization: "Bearer secret",
+			body:          "{",
+			leader:        true,
+			expectedCode:  http.StatusBadRequest,
+			expectedBody:  `{"error":"invalid plan: unexpected EOF"}`,
+		},
+		{
+			name:          "plan too large",
+			token:         "secret",
+			authorization: "Bearer secret",
+			body:          `{"workspaces":[` + strings.Repeat(`{"workspace":"acme"},`, 1<<16) + `{}]}`,
+			leader:        true,
+			expectedCode:  http.StatusRequestEntityTooLarge,
+			expectedBody:  `{"error":"invalid plan: http: request body too large"}`,
+		},
+		{
+			name:          "drifted",
+			token:         "secret",
+			authorization: "Bearer secret",
+			body:          plan,
+			leader:        true,
+			applyErr:      errors.New("workspace acme: runners changed since the plan was made"),
+			expectedCode:  http.StatusUnprocessableEntity,
+			expectedBody:  `{"error":"workspace acme: runners changed since the plan was made"}`,
+			expectedActor: "api (claimed cli:alice)",
+		},
+		{
+			name:          "applied",
+			token:         "secret",
+			authorization: "Bearer secret",
+			body:          plan,
+			leader:        true,
+			expectedCode:  http.StatusOK,
+			expectedBody:  `{}`,
+			expectedActor: "api (claimed cli:alice)",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			elector := &mocks.LeaderElector{}
+			elector.On("Identity").Return("autoscaler-0")
+			elector.On("IsLeader").Return(table.leader)
+
+			source := &staticSource{applyErr: table.applyErr}
+
+			req := httptest.NewRequest(http.MethodPost, ApplyPath, strings.NewReader(table.body))
+			req.Header.Set("Authorization", table.authorization)
+			req.Header.Set(ActorHeader, "cli:alice")
+
+			rec := httptest.NewRecorder()
+
+			NewHandler(source, elector, table.token).ServeHTTP(rec, req)
+
+			assert.Equal(t, table.expectedCode, rec.Code)
+
+			if table.expectedBody != "" {
+				assert.JSONEq(t, table.expectedBody, rec.Body.String())
+			}
+
+			assert.Equal(t, table.expectedActor, source.actor)
+
+			if table.expectedActor != "" {
+				assert.Equal(t, "acme", source.applied.Workspaces[0].Workspace)
+			}
+		})
+	}
+}
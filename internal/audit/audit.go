@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// ActorReconciler is the actor of calls made by the reconcile loop.
+const ActorReconciler string = "reconciler"
+
+const fileMode = 0o600
+
+type actorKey struct{}
+
+// WithActor returns a context whose calls are audited as made by actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Actor returns the actor set by WithActor, the reconciler by default.
+func Actor(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+
+	return ActorReconciler
+}
+
+// Writer writes one JSON record per line. Records are written whole, so
+// concurrent workspaces never interleave.
+type Writer struct {
+	closer  io.Closer
+	encoder *json.Encoder
+	mu      sync.Mutex
+}
+
+// NewWriter writes records to out, for example os.Stdout.
+func NewWriter(out io.Writer) *Writer {
+	return &Writer{encoder: json.NewEncoder(out)}
+}
+
+// OpenFile appends records to the file at path, creating it if needed.
+func OpenFile(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, fileMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	w := NewWriter(file)
+	w.closer = file
+
+	return w, nil
+}
+
+func (w *Writer) Record(record ports.AuditRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.encoder.Encode(record); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+
+	return nil
+}
+
+func (w *Writer) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+
+	return w.closer.Close()
+}
+
+// Multi sends every record to all of auditors.
+type Multi []ports.Auditor
+
+func (m Multi) Record(record ports.AuditRecord) error {
+	var errs []error
+
+	for _, auditor := range m {
+		errs = append(errs, auditor.Record(record))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m Multi) Close() error {
+	var errs []error
+
+	for _, auditor := range m {
+		errs = append(errs, auditor.Close())
+	}
+
+	return errors.Join(errs...)
+}
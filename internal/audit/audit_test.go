@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	at := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	// Records survive restarts: a reopened file is appended to.
+	for _, runnerUUID := range []string{"{1}", "{2}"} {
+		w, err := OpenFile(path)
+		require.NoError(t, err)
+
+		require.NoError(t, Multi{w}.Record(ports.AuditRecord{
+			Time: at, Actor: ActorReconciler, Operation: "bitbucket.delete_runner",
+			Workspace: "acme", Pool: "linux", RunnerUUID: runnerUUID, Reason: "scale down", Outcome: "success",
+		}))
+		require.NoError(t, w.Close())
+	}
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer file.Close()
+
+	var lines []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{
+		"time": "2024-12-02T08:00:00Z", "actor": "reconciler", "operation": "bitbucket.delete_runner",
+		"workspace": "acme", "pool": "linux", "runner_uuid": "{1}", "reason": "scale down", "outcome": "success"
+	}`, lines[0])
+
+	var second ports.AuditRecord
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, "{2}", second.RunnerUUID)
+}
+
+func TestActor(t *testing.T) {
+	tables := []struct {
+		ctx           context.Context
+		name          string
+		expectedActor string
+	}{
+		{
+			name:          "reconciler by default",
+			ctx:           context.Background(),
+			expectedActor: ActorReconciler,
+		},
+		{
+			name:          "set by the caller",
+			ctx:           WithActor(context.Background(), "cli:alice"),
+			expectedActor: "cli:alice",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expectedActor, Actor(table.ctx))
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package autoscaler
+
+type ActionType string
+
+const (
+	ActionCreate ActionType = "create"
+	ActionDelete ActionType = "delete"
+	// ActionUpdateLabels rewrites the labels of an existing runner.
+	ActionUpdateLabels ActionType = "update-labels"
+)
+
+// Action is a single change the autoscaler wants to make to a pool.
+type Action struct {
+	Type       ActionType `json:"type"`
+	Pool       string     `json:"pool"`
+	RunnerUUID string     `json:"runner_uuid,omitempty"`
+	RunnerName string     `json:"runner_name,omitempty"`
+	Reason     string     `json:"reason"`
+	Labels     []string   `json:"labels,omitempty"`
+}
@@ -0,0 +1,37 @@
+package autoscaler
+
+import (
+	"context"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/audit"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// Audited operations.
+const (
+	operationPostRunner      string = "bitbucket.post_runner"
+	operationDeleteRunner    string = "bitbucket.delete_runner"
+	operationUpdateRunner    string = "bitbucket.update_runner"
+	operationPutRunnerStatus string = "bitbucket.put_runner_status"
+	operationProvision       string = "provider.provision"
+	operationDeprovision     string = "provider.deprovision"
+)
+
+// audit records a call that changed runners or compute, with its outcome.
+// The call already happened, so failing to record it is only logged.
+func (w *Workspace) audit(ctx context.Context, record ports.AuditRecord, err error) {
+	record.Time = time.Now()
+	record.Actor = audit.Actor(ctx)
+	record.Workspace = w.name
+	record.Outcome = "success"
+
+	if err != nil {
+		record.Outcome = "error"
+		record.Error = err.Error()
+	}
+
+	if err := w.auditor.Record(record); err != nil {
+		w.logger.Error("failed to record audit trail", "operation", record.Operation, "error", err)
+	}
+}
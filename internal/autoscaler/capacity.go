@@ -0,0 +1,174 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+const (
+	// unlimited is the headroom of a provider that reports no capacity.
+	unlimited int = -1
+
+	// placementBackoff is how long a pool waits before creating runners
+	// again after the first provisioning failure. It doubles with every
+	// further failure, up to maxPlacementBackoff.
+	placementBackoff    time.Duration = 30 * time.Second
+	maxPlacementBackoff time.Duration = 10 * time.Minute
+)
+
+// capacityLedger holds the capacity pools have claimed on the providers that
+// report it and not placed yet. Pools sharing a provider, in any workspace of
+// the manager, work out their capacity one at a time and leave out what the
+// others claimed, so they do not all count on the same free capacity.
+type capacityLedger struct {
+	claimed map[ports.Provider]int
+	mu      sync.Mutex
+}
+
+func newCapacityLedger() *capacityLedger {
+	return &capacityLedger{claimed: map[ports.Provider]int{}}
+}
+
+// lock holds the ledger while pool works out its capacity and claims it.
+// Pools whose providers do not report capacity need not wait.
+func (l *capacityLedger) lock(pool *Pool) func() {
+	if !slices.ContainsFunc(pool.providers, func(provider *poolProvider) bool {
+		_, ok := provider.Provider.(ports.CapacityReporter)
+
+		return ok
+	}) {
+		return func() {}
+	}
+
+	l.mu.Lock()
+
+	return l.mu.Unlock
+}
+
+// claim takes the capacity for the runners actions create from the providers
+// of pool, in the order they are tried, and returns the func handing it back
+// once the runners were placed. The ledger must be locked.
+func (l *capacityLedger) claim(pool *Pool, actions []Action) func() {
+	creates := 0
+
+	for _, action := range actions {
+		if action.Type == ActionCreate {
+			creates++
+		}
+	}
+
+	claims := map[ports.Provider]int{}
+
+	for _, provider := range pool.providers {
+		if creates == 0 || provider.headroom < 0 {
+			break
+		}
+
+		n := min(creates, provider.headroom)
+		claims[provider.Provider] += n
+		creates -= n
+	}
+
+	for provider, n := range claims {
+		l.claimed[provider] += n
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		for provider, n := range claims {
+			if l.claimed[provider] -= n; l.claimed[provider] <= 0 {
+				delete(l.claimed, provider)
+			}
+		}
+	}
+}
+
+// capacity works out how many runners the pool providers can still place,
+// less what other pools claimed. A pool backing off from a provisioning
+// failure places none, so no further registrations are made that would never
+// come online. A provider whose capacity cannot be queried is tried
+// regardless. The ledger must be locked.
+func (w *Workspace) capacity(ctx context.Context, pool *Pool) error {
+	pool.headroom = unlimited
+
+	for _, provider := range pool.providers {
+		provider.headroom = unlimited
+	}
+
+	if pool.now().Before(pool.retryPlacement) {
+		pool.headroom = 0
+
+		return nil
+	}
+
+	var errs []error
+
+	total := 0
+
+	for _, provider := range pool.providers {
+		reporter, ok := provider.Provider.(ports.CapacityReporter)
+		if !ok {
+			continue
+		}
+
+		available, err := reporter.Capacity(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to query capacity of %s: %w", provider.name, err))
+
+			continue
+		}
+
+		provider.headroom = max(available-w.ledger.claimed[provider.Provider], 0)
+		total += provider.headroom
+	}
+
+	if len(pool.providers) > 0 && !slices.ContainsFunc(pool.providers, func(p *poolProvider) bool {
+		return p.headroom < 0
+	}) {
+		pool.headroom = total
+	}
+
+	return errors.Join(errs...)
+}
+
+// room reports whether a provider of the pool can place another runner.
+func (p *Pool) room() bool {
+	return len(p.providers) == 0 || slices.ContainsFunc(p.providers, func(provider *poolProvider) bool {
+		return provider.headroom != 0
+	})
+}
+
+// placeable clamps desired to the runners the provider can place and returns
+// the runners left over, which are demand that cannot be scheduled.
+func (p *Pool) placeable(status poolStatus, desired int) (int, int) {
+	current := len(status.runners)
+
+	if p.headroom < 0 || desired <= current+p.headroom {
+		return desired, 0
+	}
+
+	return current + p.headroom, desired - current - p.headroom
+}
+
+// placementFailed backs the pool off creating runners, twice as long as
+// after the previous failure in a row.
+func (p *Pool) placementFailed() {
+	wait := placementBackoff << min(p.placementFailures, 5) //nolint:mnd
+	p.placementFailures++
+	p.retryPlacement = p.now().Add(min(wait, maxPlacementBackoff))
+	p.headroom = 0
+}
+
+// placed resets the backoff once the provider placed a runner.
+func (p *Pool) placed() {
+	p.placementFailures = 0
+	p.retryPlacement = time.Time{}
+}
@@ -0,0 +1,73 @@
+package autoscaler
+
+import (
+	"errors"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// ErrNotLeader is returned for calls that change runners made by a replica
+// that is not the leader.
+var ErrNotLeader = errors.New("not the leader")
+
+// RunnerClient is the subset of the Bitbucket API the autoscaler relies on.
+// It is satisfied by *bitbucketclient.BitbucketClient.
+type RunnerClient interface {
+	WorkspaceUUID() (string, error)
+	GetRunners() (*bitbucketclient.GetRunnersResponse, error)
+	GetRunner(runnerUUID string) (*bitbucketclient.Runner, error)
+	PostRunner(requestBody bitbucketclient.PostRunnerRequest) (*bitbucketclient.Runner, error)
+	DeleteRunner(runnerUUID string) error
+	UpdateRunner(runnerUUID string, requestBody bitbucketclient.UpdateRunnerRequest) (*bitbucketclient.Runner, error)
+	PutRunnerStatus(runnerUUID, newStatus string) error
+}
+
+// leaderOnlyClient lets reads through but refuses changes unless elector
+// reports this replica as the leader, so that a replica which lost the
+// election mid-reconcile cannot race the new leader.
+type leaderOnlyClient struct {
+	RunnerClient
+	elector ports.LeaderElector
+}
+
+// NewLeaderOnlyClient wraps client so that only the leader can change
+// runners.
+func NewLeaderOnlyClient(client RunnerClient, elector ports.LeaderElector) RunnerClient {
+	return &leaderOnlyClient{RunnerClient: client, elector: elector}
+}
+
+func (c *leaderOnlyClient) PostRunner(requestBody bitbucketclient.PostRunnerRequest) (*bitbucketclient.Runner, error) {
+	if !c.elector.IsLeader() {
+		return nil, ErrNotLeader
+	}
+
+	return c.RunnerClient.PostRunner(requestBody)
+}
+
+func (c *leaderOnlyClient) DeleteRunner(runnerUUID string) error {
+	if !c.elector.IsLeader() {
+		return ErrNotLeader
+	}
+
+	return c.RunnerClient.DeleteRunner(runnerUUID)
+}
+
+func (c *leaderOnlyClient) UpdateRunner(
+	runnerUUID string,
+	requestBody bitbucketclient.UpdateRunnerRequest,
+) (*bitbucketclient.Runner, error) {
+	if !c.elector.IsLeader() {
+		return nil, ErrNotLeader
+	}
+
+	return c.RunnerClient.UpdateRunner(runnerUUID, requestBody)
+}
+
+func (c *leaderOnlyClient) PutRunnerStatus(runnerUUID, newStatus string) error {
+	if !c.elector.IsLeader() {
+		return ErrNotLeader
+	}
+
+	return c.RunnerClient.PutRunnerStatus(runnerUUID, newStatus)
+}
@@ -0,0 +1,64 @@
+package autoscaler
+
+import (
+	"testing"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderOnlyClient(t *testing.T) {
+	tables := []struct {
+		expectedError error
+		name          string
+		expectedCalls int
+		leader        bool
+	}{
+		{
+			name:          "leader changes runners",
+			leader:        true,
+			expectedCalls: 1,
+		},
+		{
+			name:          "follower only reads",
+			expectedError: ErrNotLeader,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			fake := newFakeRunnerClient(bitbucketclient.Runner{UUID: "{1}", Name: "linux-00000001"})
+
+			elector := &mocks.LeaderElector{}
+			elector.On("IsLeader").Return(table.leader)
+
+			client := NewLeaderOnlyClient(fake, elector)
+
+			_, err := client.GetRunners()
+			assert.NoError(t, err)
+
+			_, err = client.GetRunner("{1}")
+			assert.NoError(t, err)
+
+			_, err = client.UpdateRunner("{1}", bitbucketclient.UpdateRunnerRequest{Name: "linux-00000001"})
+			assert.ErrorIs(t, err, table.expectedError)
+
+			err = client.PutRunnerStatus("{1}", bitbucketclient.RunnerStatusDisabled)
+			assert.ErrorIs(t, err, table.expectedError)
+
+			err = client.DeleteRunner("{1}")
+			assert.ErrorIs(t, err, table.expectedError)
+
+			_, err = client.PostRunner(bitbucketclient.PostRunnerRequest{Name: "linux-00000002"})
+			assert.ErrorIs(t, err, table.expectedError)
+
+			for _, method := range []string{"PostRunner", "DeleteRunner", "UpdateRunner", "PutRunnerStatus"} {
+				assert.Equal(t, table.expectedCalls, fake.called(method), method)
+			}
+
+			assert.Equal(t, 1, fake.called("GetRunners"))
+			assert.Equal(t, 1, fake.called("GetRunner"))
+		})
+	}
+}
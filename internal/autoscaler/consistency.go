@@ -0,0 +1,302 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+)
+
+// Classes of mismatch between the registrations of a pool and the compute
+// of its providers.
+const (
+	// classUnbacked is a registration without compute.
+	classUnbacked string = "unbacked"
+	// classOrphaned is compute without a registration.
+	classOrphaned string = "orphaned"
+	// classOffline is a runner offline for too long although its compute
+	// is there.
+	classOffline string = "offline"
+)
+
+// mismatch is a runner whose registration and compute disagree. Orphaned
+// compute has no runner and unbacked registrations no workload.
+type mismatch struct {
+	runner   *bitbucketclient.Runner
+	workload *ports.Workload
+	class    string
+	action   string
+}
+
+// key identifies the mismatch across reconciles.
+func (m *mismatch) key() string {
+	if m.runner != nil {
+		return m.class + " " + bitbucketclient.NormalizeUUID(m.runner.UUID)
+	}
+
+	return m.class + " " + m.workload.Provider + " " + m.workload.ID + " " + m.workload.RunnerUUID
+}
+
+// checkConsistency joins the runners registered for pool with the workloads
+// its providers list, by runner UUID, and fixes every mismatch with the
+// action configured for its class. It returns runners without the
+// registrations it deleted. Pools whose providers cannot all list their
+// workloads are not checked.
+func (w *Workspace) checkConsistency(
+	ctx context.Context, pool *Pool, runners []bitbucketclient.Runner,
+) ([]bitbucketclient.Runner, error) {
+	if pool.config.Consistency == nil {
+		return runners, nil
+	}
+
+	workloads, ok, err := w.workloads(ctx, pool)
+	if err != nil || !ok {
+		return runners, err
+	}
+
+	mismatches := pool.classify(runners, workloads)
+	counts := map[string]int{classUnbacked: 0, classOrphaned: 0, classOffline: 0}
+	seen := make(map[string]struct{}, len(mismatches))
+	deleted := map[string]struct{}{}
+
+	var errs []error
+
+	for i := range mismatches {
+		m := &mismatches[i]
+		counts[m.class]++
+		seen[m.key()] = struct{}{}
+
+		if _, known := pool.mismatches[m.key()]; !known {
+			w.logMismatch(pool, m)
+		}
+
+		if m.action == config.ConsistencyIgnore {
+			continue
+		}
+
+		err := w.resolve(ctx, pool, m)
+
+		result := "success"
+		if err != nil {
+			result = "error"
+
+			errs = append(errs, err)
+		} else if m.action == config.ConsistencyDeleteRegistration {
+			deleted[m.runner.UUID] = struct{}{}
+		}
+
+		w.metrics.ConsistencyActions.WithLabelValues(w.name, pool.Name(), m.class, m.action, result).Inc()
+	}
+
+	pool.mismatches = seen
+
+	for class, n := range counts {
+		w.metrics.ConsistencyMismatches.WithLabelValues(w.name, pool.Name(), class).Set(float64(n))
+	}
+
+	if len(deleted) > 0 {
+		runners = slices.DeleteFunc(slices.Clone(runners), func(runner bitbucketclient.Runner) bool {
+			_, ok := deleted[runner.UUID]
+
+			return ok
+		})
+	}
+
+	return runners, errors.Join(errs...)
+}
+
+// workloads lists the workloads of every provider of pool. It reports false
+// if a provider cannot list them.
+func (w *Workspace) workloads(ctx context.Context, pool *Pool) ([]ports.Workload, bool, error) {
+	var workloads []ports.Workload
+
+	for _, provider := range pool.providers {
+		lister, ok := provider.Provider.(ports.WorkloadLister)
+		if !ok {
+			return nil, false, nil
+		}
+
+		found, err := lister.Workloads(ctx, w.name, pool.Name())
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to list workloads of %s: %w", provider.name, err)
+		}
+
+		for i := range found {
+			found[i].Provider = provider.name
+		}
+
+		workloads = append(workloads, found...)
+	}
+
+	return workloads, len(pool.providers) > 0, nil
+}
+
+// classify sorts out the registrations and workloads of the pool that do not
+// match. Runners the autoscaler is creating or removing, busy runners and
+// anything younger than the grace period are left alone.
+func (p *Pool) classify(runners []bitbucketclient.Runner, workloads []ports.Workload) []mismatch {
+	cfg := p.config.Consistency
+	now := p.now()
+
+	backed := make(map[string]*ports.Workload, len(workloads))
+
+	for i := range workloads {
+		backed[bitbucketclient.NormalizeUUID(workloads[i].RunnerUUID)] = &workloads[i]
+	}
+
+	registered := map[string]struct{}{}
+
+	var mismatches []mismatch
+
+	for i := range runners {
+		runner := &runners[i]
+
+		if !p.Owns(runner) {
+			continue
+		}
+
+		registered[bitbucketclient.NormalizeUUID(runner.UUID)] = struct{}{}
+
+		if record, ok := p.lifecycle.Get(runner.Name); ok &&
+			record.State != lifecycle.StateProvisioning && record.State != lifecycle.StateOnline {
+			continue
+		}
+
+		if isBusy(runner) || now.Sub(runner.CreatedOn) < cfg.Grace {
+			continue
+		}
+
+		workload, ok := backed[bitbucketclient.NormalizeUUID(runner.UUID)]
+
+		switch {
+		case !ok:
+			mismatches = append(mismatches, mismatch{runner: runner, class: classUnbacked, action: cfg.Unbacked})
+		case runner.State.Status == bitbucketclient.RunnerStatusOffline && now.Sub(offlineSince(runner)) > cfg.OfflineAfter:
+			mismatches = append(mismatches, mismatch{
+				runner: runner, workload: workload, class: classOffline, action: cfg.Offline,
+			})
+		}
+	}
+
+	for i := range workloads {
+		workload := &workloads[i]
+
+		if _, ok := registered[bitbucketclient.NormalizeUUID(workload.RunnerUUID)]; ok {
+			continue
+		}
+
+		if !workload.CreatedAt.IsZero() && now.Sub(workload.CreatedAt) < cfg.Grace {
+			continue
+		}
+
+		mismatches = append(mismatches, mismatch{workload: workload, class: classOrphaned, action: cfg.Orphaned})
+	}
+
+	return mismatches
+}
+
+// resolve carries out the action of m. Reprovisioned runners are marked
+// failed, so they are drained and replaced on this reconcile like any failed
+// runner.
+func (w *Workspace) resolve(ctx context.Context, pool *Pool, m *mismatch) error {
+	reason := "consistency: " + m.class
+
+	switch m.action {
+	case config.ConsistencyReprovision:
+		if state := pool.track(m.runner); state == lifecycle.StateProvisioning || state == lifecycle.StateOnline {
+			w.transition(pool, m.runner.Name, lifecycle.StateFailed, reason)
+		}
+
+		return nil
+	case config.ConsistencyDeleteRegistration:
+		pool.track(m.runner)
+		w.transition(pool, m.runner.Name, lifecycle.StateDraining, reason)
+
+		err := w.client.DeleteRunner(m.runner.UUID)
+
+		w.audit(ctx, ports.AuditRecord{
+			Operation:  operationDeleteRunner,
+			Pool:       pool.Name(),
+			RunnerUUID: m.runner.UUID,
+			RunnerName: m.runner.Name,
+			Reason:     reason,
+		}, err)
+
+		if err != nil {
+			w.transition(pool, m.runner.Name, lifecycle.StateFailed, err.Error())
+
+			return fmt.Errorf("failed to delete registration %s: %w", m.runner.UUID, err)
+		}
+
+		w.transition(pool, m.runner.Name, lifecycle.StateDeprovisioning, "registration deleted")
+		w.transition(pool, m.runner.Name, lifecycle.StateDeleted, "compute left to the consistency check")
+
+		return nil
+	case config.ConsistencyDestroyWorkload:
+		return w.destroy(ctx, pool, m.workload, reason)
+	default:
+		return fmt.Errorf("unknown consistency action %q", m.action)
+	}
+}
+
+// destroy tears down workload with the provider that listed it.
+func (w *Workspace) destroy(ctx context.Context, pool *Pool, workload *ports.Workload, reason string) error {
+	i := slices.IndexFunc(pool.providers, func(p *poolProvider) bool { return p.name == workload.Provider })
+	if i < 0 {
+		return fmt.Errorf("unknown provider %q", workload.Provider)
+	}
+
+	runnerUUID := bitbucketclient.NormalizeUUID(workload.RunnerUUID)
+	err := pool.providers[i].Deprovision(ctx, runnerUUID)
+
+	w.audit(ctx, ports.AuditRecord{
+		Operation:  operationDeprovision,
+		Pool:       pool.Name(),
+		RunnerUUID: runnerUUID,
+		Reason:     reason,
+		Request:    map[string]any{"provider": workload.Provider, "workload": workload.ID},
+	}, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to destroy workload %s: %w", workload.ID, err)
+	}
+
+	delete(pool.workloads, runnerUUID)
+
+	return nil
+}
+
+// logMismatch records a mismatch the first time it is found.
+func (w *Workspace) logMismatch(pool *Pool, m *mismatch) {
+	attrs := []any{"pool", pool.Name(), "class", m.class, "action", m.action}
+
+	if m.runner != nil {
+		attrs = append(attrs, "runner", m.runner.UUID, "name", m.runner.Name, "status", m.runner.State.Status)
+	}
+
+	if m.workload != nil {
+		attrs = append(attrs, "provider", m.workload.Provider, "workload", m.workload.ID)
+
+		if m.runner == nil {
+			attrs = append(attrs, "runner", m.workload.RunnerUUID)
+		}
+	}
+
+	w.logger.Warn("runner registration and compute disagree", attrs...)
+}
+
+// offlineSince returns when the state of runner last changed, falling back
+// to its creation time.
+func offlineSince(runner *bitbucketclient.Runner) time.Time {
+	if !runner.State.UpdatedOn.IsZero() {
+		return runner.State.UpdatedOn
+	}
+
+	return runner.CreatedOn
+}
@@ -0,0 +1,83 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+)
+
+// reasonDrainTimeout is given for runners removed while still busy because
+// they outlasted the draining timeout.
+const reasonDrainTimeout string = "draining timed out"
+
+// drainRunner starts removing a runner: it is disabled in Bitbucket so that
+// no further steps land on it, and deleted by drain once seen idle.
+func (w *Workspace) drainRunner(ctx context.Context, pool *Pool, action Action) error {
+	record, _ := pool.lifecycle.Find(action.RunnerUUID)
+
+	if record.State != lifecycle.StateDraining {
+		w.transition(pool, record.Name, lifecycle.StateDraining, action.Reason)
+	}
+
+	// Interrupted runners were cordoned when the notice came.
+	if _, ok := pool.interrupted[bitbucketclient.NormalizeUUID(action.RunnerUUID)]; ok {
+		return nil
+	}
+
+	return w.cordon(ctx, pool, action.RunnerUUID, record.Name, action.Reason)
+}
+
+// drain deletes the draining runners Bitbucket lists idle and no longer
+// online, and those still busy past the draining timeout. Runners the
+// listing shows online are disabled again. It returns runners without the
+// deleted ones.
+func (w *Workspace) drain(
+	ctx context.Context, pool *Pool, runners []bitbucketclient.Runner,
+) ([]bitbucketclient.Runner, error) {
+	now := pool.now()
+	timeout := pool.config.Timeouts.Draining
+	deleted := map[string]struct{}{}
+
+	var errs []error
+
+	for i := range runners {
+		runner := &runners[i]
+
+		if !pool.Owns(runner) {
+			continue
+		}
+
+		record, ok := pool.lifecycle.Get(runner.Name)
+		if !ok || record.State != lifecycle.StateDraining {
+			continue
+		}
+
+		reason := record.Reason
+
+		switch {
+		case timeout > 0 && now.Sub(record.Since) > timeout:
+			reason = reasonDrainTimeout
+		case runner.State.Status == bitbucketclient.RunnerStatusOnline:
+			errs = append(errs, w.cordon(ctx, pool, runner.UUID, runner.Name, reason))
+
+			continue
+		case isBusy(runner):
+			continue
+		}
+
+		if err := w.deleteRunner(ctx, pool, runner.Name, runner.UUID, reason); err != nil {
+			errs = append(errs, err)
+		}
+
+		deleted[runner.UUID] = struct{}{}
+	}
+
+	return slices.DeleteFunc(slices.Clone(runners), func(runner bitbucketclient.Runner) bool {
+		_, ok := deleted[runner.UUID]
+
+		return ok
+	}), errors.Join(errs...)
+}
@@ -0,0 +1,249 @@
+package autoscaler
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/audit"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRunnerClient is an in-memory stand-in for the Bitbucket runners API.
+type fakeRunnerClient struct {
+	err error
+	// putErr fails PutRunnerStatus alone.
+	putErr  error
+	runners map[string]bitbucketclient.Runner
+	calls   map[string]int
+	// uuid is the workspace UUID, {uuid} unless set.
+	uuid  string
+	order []string
+	next  int
+	// pagelen truncates GetRunners like a listing that missed runners.
+	pagelen int
+	mu      sync.Mutex
+}
+
+func newFakeRunnerClient(runners ...bitbucketclient.Runner) *fakeRunnerClient {
+	f := &fakeRunnerClient{
+		runners: map[string]bitbucketclient.Runner{},
+		calls:   map[string]int{},
+		uuid:    "{uuid}",
+	}
+
+	for _, r := range runners {
+		f.runners[r.UUID] = r
+		f.order = append(f.order, r.UUID)
+	}
+
+	return f
+}
+
+func (f *fakeRunnerClient) called(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[method]
+}
+
+func (f *fakeRunnerClient) list() []bitbucketclient.Runner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	runners := make([]bitbucketclient.Runner, 0, len(f.order))
+
+	for _, id := range f.order {
+		if r, ok := f.runners[id]; ok {
+			runners = append(runners, r)
+		}
+	}
+
+	return runners
+}
+
+func (f *fakeRunnerClient) WorkspaceUUID() (string, error) {
+	return f.uuid, nil
+}
+
+func (f *fakeRunnerClient) GetRunners() (*bitbucketclient.GetRunnersResponse, error) {
+	f.mu.Lock()
+	f.calls["GetRunners"]++
+	err := f.err
+	f.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	runners := f.list()
+	size := len(runners)
+
+	if f.pagelen > 0 && len(runners) > f.pagelen {
+		runners = runners[:f.pagelen]
+	}
+
+	return &bitbucketclient.GetRunnersResponse{Values: runners, Size: size}, nil
+}
+
+func (f *fakeRunnerClient) GetRunner(runnerUUID string) (*bitbucketclient.Runner, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["GetRunner"]++
+
+	r, ok := f.runners[runnerUUID]
+	if !ok {
+		return nil, fmt.Errorf("failed to fetch runner, status: 404, body: {}")
+	}
+
+	return &r, nil
+}
+
+func (f *fakeRunnerClient) PostRunner(requestBody bitbucketclient.PostRunnerRequest) (*bitbucketclient.Runner, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["PostRunner"]++
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	f.next++
+
+	r := bitbucketclient.Runner{
+		UUID:      fmt.Sprintf("{00000000-0000-0000-0000-%012d}", f.next),
+		Name:      requestBody.Name,
+		Labels:    requestBody.Labels,
+		CreatedOn: time.Now(),
+		State:     bitbucketclient.State{Status: bitbucketclient.RunnerStatusUnregistered},
+		OauthClient: bitbucketclient.OauthClient{
+			ID:     fmt.Sprintf("client-%d", f.next),
+			Secret: "secret",
+		},
+	}
+
+	f.runners[r.UUID] = r
+	f.order = append(f.order, r.UUID)
+
+	return &r, nil
+}
+
+func (f *fakeRunnerClient) DeleteRunner(runnerUUID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["DeleteRunner"]++
+
+	if _, ok := f.runners[runnerUUID]; !ok {
+		return fmt.Errorf("failed to delete runner, status: 404, body: {}")
+	}
+
+	delete(f.runners, runnerUUID)
+
+	return nil
+}
+
+func (f *fakeRunnerClient) UpdateRunner(
+	runnerUUID string,
+	requestBody bitbucketclient.UpdateRunnerRequest,
+) (*bitbucketclient.Runner, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["UpdateRunner"]++
+
+	r, ok := f.runners[runnerUUID]
+	if !ok {
+		return nil, fmt.Errorf("failed to update runner, status: 404, body: {}")
+	}
+
+	r.Name = requestBody.Name
+	r.Labels = requestBody.Labels
+	f.runners[runnerUUID] = r
+
+	return &r, nil
+}
+
+func (f *fakeRunnerClient) PutRunnerStatus(runnerUUID, newStatus string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["PutRunnerStatus"]++
+
+	if f.putErr != nil {
+		return f.putErr
+	}
+
+	r, ok := f.runners[runnerUUID]
+	if !ok {
+		return fmt.Errorf("failed to update runner status, status: 404, body: {}")
+	}
+
+	r.State.Status = newStatus
+	f.runners[runnerUUID] = r
+
+	return nil
+}
+
+// setState changes the state of a runner as Bitbucket would when the runner
+// connects or picks up a step.
+func (f *fakeRunnerClient) setState(runnerUUID, status string, busy bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := f.runners[runnerUUID]
+	r.State.Status = status
+	r.State.Step = nil
+
+	if busy {
+		r.State.Step = &bitbucketclient.Step{UUID: "{step-" + runnerUUID + "}"}
+	}
+
+	f.runners[runnerUUID] = r
+}
+
+func testRunner(uuid, name, status string, busy bool) bitbucketclient.Runner {
+	r := bitbucketclient.Runner{
+		UUID:      uuid,
+		Name:      name,
+		CreatedOn: time.Date(2024, 11, 16, 9, 55, 35, 0, time.UTC),
+		State:     bitbucketclient.State{Status: status},
+	}
+
+	if busy {
+		r.State.Step = &bitbucketclient.Step{UUID: "{step-" + uuid + "}"}
+	}
+
+	return r
+}
+
+func newTestPool(t *testing.T, cfg config.Pool, provider ports.Provider) *Pool {
+	t.Helper()
+
+	pool, err := NewPool(cfg, provider)
+	require.NoError(t, err)
+
+	return pool
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func testAuditor() ports.Auditor {
+	return audit.Multi{}
+}
+
+func testMetrics() *metrics.Metrics {
+	return metrics.New(prometheus.NewRegistry())
+}
@@ -0,0 +1,136 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+)
+
+// reasonInterrupted is given for runners whose compute is being reclaimed.
+const reasonInterrupted string = "compute interrupted"
+
+// interrupt handles the interruption notices of the pool provider. Each
+// interrupted runner is cordoned, so Bitbucket schedules no further steps on
+// it, and left out of the pool so that its replacement starts on this
+// reconcile. A busy runner keeps its step until the compute goes away.
+func (w *Workspace) interrupt(ctx context.Context, pool *Pool, runners []bitbucketclient.Runner) error {
+	var (
+		notices []ports.Interruption
+		errs    []error
+	)
+
+	for _, provider := range pool.providers {
+		source, ok := provider.Provider.(ports.InterruptionSource)
+		if !ok {
+			continue
+		}
+
+		found, err := source.Interruptions(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list interruptions of %s: %w", provider.name, err))
+
+			continue
+		}
+
+		notices = append(notices, found...)
+	}
+
+	owned := make(map[string]*bitbucketclient.Runner, len(runners))
+
+	for i := range runners {
+		if pool.Owns(&runners[i]) {
+			owned[bitbucketclient.NormalizeUUID(runners[i].UUID)] = &runners[i]
+		}
+	}
+
+	for _, notice := range notices {
+		runnerUUID := bitbucketclient.NormalizeUUID(notice.RunnerUUID)
+
+		runner, ok := owned[runnerUUID]
+		if !ok {
+			continue
+		}
+
+		if _, seen := pool.interrupted[runnerUUID]; seen {
+			continue
+		}
+
+		// An uncordoned runner stays in the pool, so that the notice is
+		// handled again on the next reconcile.
+		if err := w.cordon(ctx, pool, runner.UUID, runner.Name, reasonInterrupted); err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		pool.interrupted[runnerUUID] = notice
+		pool.replacements++
+
+		w.metrics.Interruptions.WithLabelValues(w.name, pool.Name(), string(notice.Kind)).Inc()
+		w.logger.Warn("runner compute interrupted",
+			"pool", pool.Name(), "runner", runner.UUID, "name", runner.Name,
+			"workload", notice.WorkloadID, "kind", notice.Kind, "busy", isBusy(runner))
+
+		switch state := pool.track(runner); state {
+		case lifecycle.StateProvisioning, lifecycle.StateOnline:
+			w.transition(pool, runner.Name, lifecycle.StateFailed, fmt.Sprintf("%s (%s)", reasonInterrupted, notice.Kind))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ackInterruptions tells the providers of pool that its interruption notices
+// are saved.
+func (w *Workspace) ackInterruptions(ctx context.Context, pool *Pool) error {
+	if len(pool.interrupted) == 0 {
+		return nil
+	}
+
+	notices := slices.SortedFunc(maps.Values(pool.interrupted), func(a, b ports.Interruption) int {
+		return strings.Compare(a.RunnerUUID, b.RunnerUUID)
+	})
+
+	var errs []error
+
+	for _, provider := range pool.providers {
+		source, ok := provider.Provider.(ports.InterruptionSource)
+		if !ok {
+			continue
+		}
+
+		if err := source.AckInterruptions(ctx, notices); err != nil {
+			errs = append(errs, fmt.Errorf("failed to acknowledge interruptions of %s: %w", provider.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// cordon disables a runner in Bitbucket so that no further steps are
+// scheduled on it.
+func (w *Workspace) cordon(ctx context.Context, pool *Pool, runnerUUID, name, reason string) error {
+	err := w.client.PutRunnerStatus(runnerUUID, bitbucketclient.RunnerStatusDisabled)
+
+	w.audit(ctx, ports.AuditRecord{
+		Operation:  operationPutRunnerStatus,
+		Pool:       pool.Name(),
+		RunnerUUID: runnerUUID,
+		RunnerName: name,
+		Reason:     reason,
+		Request:    map[string]any{"status": bitbucketclient.RunnerStatusDisabled},
+	}, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to cordon runner %s: %w", runnerUUID, err)
+	}
+
+	return nil
+}
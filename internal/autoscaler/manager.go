@@ -0,0 +1,146 @@
+package autoscaler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/metrics"
+)
+
+// maxBackoffFactor caps how far a failing workspace backs off, as a multiple
+// of the reconcile interval.
+const maxBackoffFactor int = 10
+
+// Manager runs every workspace in its own loop. A workspace that keeps
+// failing, for example because its credentials were revoked, backs off on its
+// own schedule and never delays the others.
+type Manager struct {
+	logger     *slog.Logger
+	metrics    *metrics.Metrics
+	workspaces []*Workspace
+	interval   time.Duration
+	// terms counts the runs, one per leadership term.
+	terms int
+}
+
+// NewManager returns a manager running workspaces. Their pools share a
+// capacity ledger, as they may share providers.
+func NewManager(workspaces []*Workspace, interval time.Duration, logger *slog.Logger, m *metrics.Metrics) *Manager {
+	ledger := newCapacityLedger()
+
+	for _, workspace := range workspaces {
+		workspace.ledger = ledger
+	}
+
+	return &Manager{
+		logger:     logger,
+		metrics:    m,
+		workspaces: workspaces,
+		interval:   interval,
+	}
+}
+
+// Status returns the last observed state of every pool of every workspace.
+func (m *Manager) Status() []PoolStatus {
+	var statuses []PoolStatus
+
+	for _, workspace := range m.workspaces {
+		statuses = append(statuses, workspace.Status()...)
+	}
+
+	return statuses
+}
+
+// Runners returns the lifecycle of every runner tracked in every workspace.
+func (m *Manager) Runners() []RunnerStatus {
+	var runners []RunnerStatus
+
+	for _, workspace := range m.workspaces {
+		runners = append(runners, workspace.Runners()...)
+	}
+
+	return runners
+}
+
+// Run blocks until ctx is cancelled. The first run starts from the saved
+// state. Later runs are later leadership terms, after another replica may
+// have led, so they forget what this one knew and adopt the runners afresh.
+func (m *Manager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	m.terms++
+
+	for _, workspace := range m.workspaces {
+		if m.terms > 1 {
+			workspace.forget()
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			m.runWorkspace(ctx, workspace)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (m *Manager) runWorkspace(ctx context.Context, workspace *Workspace) {
+	logger := m.logger.With("workspace", workspace.Name())
+	failures := 0
+
+	for {
+		if err := m.reconcile(ctx, workspace); err != nil {
+			failures++
+
+			logger.Error("reconcile failed", "error", err, "consecutive_failures", failures)
+		} else {
+			failures = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.backoff(failures)):
+		}
+	}
+}
+
+func (m *Manager) reconcile(ctx context.Context, workspace *Workspace) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+
+	start := time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic during reconcile: %v", r)
+		}
+
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+
+		m.metrics.Reconciles.WithLabelValues(workspace.Name(), result).Inc()
+		m.metrics.ReconcileDuration.WithLabelValues(workspace.Name()).Observe(time.Since(start).Seconds())
+	}()
+
+	return workspace.Reconcile(ctx)
+}
+
+// backoff doubles the wait after each consecutive failure.
+func (m *Manager) backoff(failures int) time.Duration {
+	if failures == 0 {
+		return m.interval
+	}
+
+	factor := 1 << min(failures, maxBackoffFactor)
+
+	return m.interval * time.Duration(min(factor, maxBackoffFactor))
+}
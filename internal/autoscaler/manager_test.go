@@ -0,0 +1,76 @@
+package autoscaler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/statestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestManagerIsolatesFailingWorkspace(t *testing.T) {
+	broken := newFakeRunnerClient()
+	broken.err = fmt.Errorf("oauth2: cannot fetch token: 401 Unauthorized")
+
+	healthy := newFakeRunnerClient()
+
+	pool := config.Pool{Name: "linux", Min: 1, Max: 1, TargetUtilization: 1}
+	m := testMetrics()
+
+	manager := NewManager([]*Workspace{
+		NewWorkspace("broken", broken, statestore.NewMemory(), testAuditor(), []*Pool{newTestPool(t, pool, nil)}, testLogger(), m),
+		NewWorkspace("healthy", healthy, statestore.NewMemory(), testAuditor(), []*Pool{newTestPool(t, pool, nil)}, testLogger(), m),
+	}, 10*time.Millisecond, testLogger(), m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	manager.Run(ctx)
+
+	assert.Greater(t, healthy.called("GetRunners"), broken.called("GetRunners"))
+	assert.Equal(t, 1, healthy.called("PostRunner"))
+	assert.Equal(t, 0, broken.called("PostRunner"))
+}
+
+func TestManagerRestoresOnce(t *testing.T) {
+	store := &mocks.StateStore{}
+	store.On("List", "workspace/acme").Return(map[string][]byte{}, nil).Once()
+	store.On("Put", "workspace/acme", "linux", mock.Anything).Return(nil).Maybe()
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Min: 0, Max: 1, TargetUtilization: 1}, nil)
+	m := testMetrics()
+
+	manager := NewManager([]*Workspace{
+		NewWorkspace("acme", newFakeRunnerClient(), store, testAuditor(), []*Pool{pool}, testLogger(), m),
+	}, 10*time.Millisecond, testLogger(), m)
+
+	for term := range 2 {
+		// Another replica may have led between the two terms, so what the
+		// first one knew is forgotten rather than trusted.
+		if term > 0 {
+			pool.workloads["{2}"] = ports.Workload{ID: "i-2"}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		manager.Run(ctx)
+		cancel()
+	}
+
+	assert.Empty(t, pool.workloads)
+	store.AssertExpectations(t)
+}
+
+func TestBackoff(t *testing.T) {
+	m := NewManager(nil, time.Second, testLogger(), testMetrics())
+
+	assert.Equal(t, time.Second, m.backoff(0))
+	assert.Equal(t, 2*time.Second, m.backoff(1))
+	assert.Equal(t, 8*time.Second, m.backoff(3))
+	assert.Equal(t, 10*time.Second, m.backoff(50))
+}
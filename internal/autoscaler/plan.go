@@ -0,0 +1,307 @@
+package autoscaler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+)
+
+// ErrPlanDrifted is returned when applying a plan to runners that changed
+// since the plan was made.
+var ErrPlanDrifted = errors.New("runners changed since the plan was made")
+
+// ErrNotReconciled is returned when applying a plan to a workspace whose
+// state was not restored by a reconcile yet.
+var ErrNotReconciled = errors.New("workspace has not reconciled yet")
+
+// Plan is what the autoscaler would do to every workspace, computed without
+// changing anything so that it can be reviewed and applied later.
+type Plan struct {
+	CreatedAt  time.Time       `json:"created_at"`
+	Workspaces []WorkspacePlan `json:"workspaces"`
+}
+
+// WorkspacePlan holds the actions planned for the pools of a workspace.
+type WorkspacePlan struct {
+	Workspace string `json:"workspace"`
+	// State fingerprints the runners the plan was computed from.
+	State string     `json:"state"`
+	Pools []PoolPlan `json:"pools"`
+}
+
+// PoolPlan is the state of a pool when planned and the actions bringing it
+// to its desired size.
+type PoolPlan struct {
+	Actions []Action `json:"actions"`
+	PoolStatus
+}
+
+// Plan lists the runners and works out what a reconcile would do, without
+// any call that changes runners or compute.
+func (w *Workspace) Plan(ctx context.Context) (WorkspacePlan, error) {
+	w.busy.Lock()
+	defer w.busy.Unlock()
+
+	resp, err := w.listRunners()
+	if err != nil {
+		return WorkspacePlan{}, err
+	}
+
+	if _, err := w.load(); err != nil {
+		return WorkspacePlan{}, err
+	}
+
+	names := make(map[string]string, len(resp.Values))
+
+	for _, runner := range resp.Values {
+		names[runner.UUID] = runner.Name
+	}
+
+	plan := WorkspacePlan{Workspace: w.name, State: w.fingerprint(resp.Values)}
+
+	for _, pool := range w.pools {
+		status := pool.observe(resp.Values)
+		bounds := pool.bounds()
+		desired := pool.stabilize(status, pool.desired(status, bounds, pool.forecast(status)), bounds)
+
+		unlock := w.ledger.lock(pool)
+		err := w.capacity(ctx, pool)
+		unlock()
+
+		if err != nil {
+			return WorkspacePlan{}, fmt.Errorf("pool %s: %w", pool.Name(), err)
+		}
+
+		desired, unschedulable := pool.placeable(status, desired)
+		actions := pool.plan(status, desired)
+
+		for i := range actions {
+			if actions[i].RunnerName == "" {
+				actions[i].RunnerName = names[actions[i].RunnerUUID]
+			}
+		}
+
+		plan.Pools = append(plan.Pools, PoolPlan{
+			Actions:    actions,
+			PoolStatus: w.poolStatus(pool, status, bounds, desired, unschedulable),
+		})
+	}
+
+	return plan, nil
+}
+
+// Apply executes a plan made by Plan, unless the runners changed in the
+// meantime. It works on the live state of the pools, kept by the reconciles,
+// and refuses actions on runners a pool does not track.
+func (w *Workspace) Apply(ctx context.Context, plan WorkspacePlan) error {
+	w.busy.Lock()
+	defer w.busy.Unlock()
+
+	if !w.restored {
+		return ErrNotReconciled
+	}
+
+	resp, err := w.listRunners()
+	if err != nil {
+		return err
+	}
+
+	if w.fingerprint(resp.Values) != plan.State {
+		return ErrPlanDrifted
+	}
+
+	pools := make(map[string]*Pool, len(w.pools))
+
+	for _, pool := range w.pools {
+		pools[pool.Name()] = pool
+	}
+
+	var errs []error
+
+	for _, poolPlan := range plan.Pools {
+		pool, ok := pools[poolPlan.Pool]
+		if !ok {
+			errs = append(errs, fmt.Errorf("pool %s: not configured", poolPlan.Pool))
+
+			continue
+		}
+
+		if err := pool.tracks(poolPlan.Actions); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Name(), err))
+
+			continue
+		}
+
+		if err := w.apply(ctx, pool, poolPlan.Actions); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// tracks checks that every action on an existing runner refers to one the
+// pool tracks, so a plan cannot reach runners of other pools.
+func (p *Pool) tracks(actions []Action) error {
+	for _, action := range actions {
+		if action.Type == ActionCreate {
+			continue
+		}
+
+		record, ok := p.lifecycle.Find(action.RunnerUUID)
+		if !ok || (action.RunnerName != "" && action.RunnerName != record.Name) {
+			return fmt.Errorf("runner %s is not tracked by the pool", action.RunnerUUID)
+		}
+	}
+
+	return nil
+}
+
+// fingerprint summarizes the runners of the workspace pools, so that a plan
+// can tell whether it still applies.
+func (w *Workspace) fingerprint(runners []bitbucketclient.Runner) string {
+	var lines []string
+
+	for i := range runners {
+		runner := &runners[i]
+
+		if !slices.ContainsFunc(w.pools, func(pool *Pool) bool { return pool.Owns(runner) }) {
+			continue
+		}
+
+		lines = append(lines, strings.Join([]string{
+			runner.UUID,
+			runner.Name,
+			runner.State.Status,
+			strconv.FormatBool(isBusy(runner)),
+			strings.Join(slices.Sorted(slices.Values(runner.Labels)), ","),
+		}, " "))
+	}
+
+	slices.Sort(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Plan works out the actions of every workspace. A workspace that cannot be
+// listed fails the whole plan, as a partial plan would be misleading.
+func (m *Manager) Plan(ctx context.Context) (*Plan, error) {
+	plan := &Plan{CreatedAt: time.Now()}
+
+	for _, workspace := range m.workspaces {
+		workspacePlan, err := workspace.Plan(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("workspace %s: %w", workspace.Name(), err)
+		}
+
+		plan.Workspaces = append(plan.Workspaces, workspacePlan)
+	}
+
+	return plan, nil
+}
+
+// Apply executes plan workspace by workspace. Like reconciles, workspaces
+// are independent: one whose runners drifted is left alone and reported, the
+// others are applied.
+func (m *Manager) Apply(ctx context.Context, plan *Plan) error {
+	workspaces := make(map[string]*Workspace, len(m.workspaces))
+
+	for _, workspace := range m.workspaces {
+		workspaces[workspace.Name()] = workspace
+	}
+
+	var errs []error
+
+	for _, workspacePlan := range plan.Workspaces {
+		workspace, ok := workspaces[workspacePlan.Workspace]
+		if !ok {
+			errs = append(errs, fmt.Errorf("workspace %s: not configured", workspacePlan.Workspace))
+
+			continue
+		}
+
+		if err := workspace.Apply(ctx, workspacePlan); err != nil {
+			errs = append(errs, fmt.Errorf("workspace %s: %w", workspace.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// WriteText renders plan as a diff: + for runners to create, - for runners to
+// delete and ~ for runners to change.
+func (p *Plan) WriteText(out io.Writer) error {
+	var b strings.Builder
+
+	counts := map[ActionType]int{}
+
+	for _, workspace := range p.Workspaces {
+		fmt.Fprintf(&b, "workspace %s\n", workspace.Workspace)
+
+		for _, pool := range workspace.Pools {
+			fmt.Fprintf(&b, "  pool %s (profile %s): %d runners, %d busy, desired %d",
+				pool.Pool, pool.Profile, pool.Runners, pool.Busy, pool.Desired)
+
+			if pool.Unschedulable > 0 {
+				fmt.Fprintf(&b, ", %d unschedulable", pool.Unschedulable)
+			}
+
+			b.WriteString("\n")
+
+			if len(pool.Actions) == 0 {
+				b.WriteString("    no changes\n")
+			}
+
+			for i := 0; i < len(pool.Actions); {
+				action := pool.Actions[i]
+				n := 1
+
+				// Runners created for the same reason are shown once.
+				for i+n < len(pool.Actions) && action.Type == ActionCreate &&
+					pool.Actions[i+n].Type == ActionCreate && pool.Actions[i+n].Reason == action.Reason {
+					n++
+				}
+
+				counts[action.Type] += n
+				i += n
+
+				writeAction(&b, action, n)
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "\nPlan: %d to create, %d to delete, %d to update.\n",
+		counts[ActionCreate], counts[ActionDelete], counts[ActionUpdateLabels])
+
+	_, err := io.WriteString(out, b.String())
+
+	return err
+}
+
+func writeAction(b *strings.Builder, action Action, n int) {
+	switch action.Type {
+	case ActionCreate:
+		noun := "runners"
+		if n == 1 {
+			noun = "runner"
+		}
+
+		fmt.Fprintf(b, "    + create %d %s with labels %v (%s)\n", n, noun, action.Labels, action.Reason)
+	case ActionDelete:
+		fmt.Fprintf(b, "    - delete runner %s %s (%s)\n", action.RunnerName, action.RunnerUUID, action.Reason)
+	case ActionUpdateLabels:
+		fmt.Fprintf(b, "    ~ update runner %s %s labels to %v (%s)\n",
+			action.RunnerName, action.RunnerUUID, action.Labels, action.Reason)
+	}
+}
@@ -0,0 +1,135 @@
+package autoscaler
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/statestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanAndApply(t *testing.T) {
+	tables := []struct {
+		change          func(client *fakeRunnerClient, plan *Plan)
+		expectedErr     error
+		name            string
+		expectedError   string
+		expectedCreated int
+		expectedDrained int
+		unreconciled    bool
+	}{
+		{
+			name:            "unchanged runners",
+			change:          func(_ *fakeRunnerClient, _ *Plan) {},
+			expectedCreated: 2,
+			expectedDrained: 1,
+		},
+		{
+			name: "runner picked up a step since the plan",
+			change: func(client *fakeRunnerClient, _ *Plan) {
+				client.setState("{9}", bitbucketclient.RunnerStatusOnline, true)
+			},
+			expectedErr:   ErrPlanDrifted,
+			expectedError: "workspace acme: runners changed since the plan was made",
+		},
+		{
+			name: "runner of another pool",
+			change: func(_ *fakeRunnerClient, plan *Plan) {
+				linux := &plan.Workspaces[0].Pools[0]
+				linux.Actions = append(linux.Actions, Action{
+					Type: ActionDelete, Pool: "linux", RunnerUUID: "{9}", Reason: "scale down",
+				})
+			},
+			expectedError:   "workspace acme: pool linux: runner {9} is not tracked by the pool",
+			expectedDrained: 1,
+		},
+		{
+			name:          "leader not reconciled yet",
+			change:        func(_ *fakeRunnerClient, _ *Plan) {},
+			unreconciled:  true,
+			expectedErr:   ErrNotReconciled,
+			expectedError: "workspace acme: workspace has not reconciled yet",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			client := newFakeRunnerClient(
+				testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false),
+				testRunner("{9}", "mac-00000009", bitbucketclient.RunnerStatusOnline, false),
+			)
+
+			// The live manager keeps both runners, the planning one wants
+			// three linux runners and no mac runner.
+			newManager := func(linuxMin, macMin int) (*Manager, *Workspace) {
+				pools := []*Pool{
+					newTestPool(t, config.Pool{
+						Name: "linux", Labels: []string{"linux"}, Min: linuxMin, Max: 5, TargetUtilization: 1,
+					}, nil),
+					newTestPool(t, config.Pool{Name: "mac", Min: macMin, Max: 2, TargetUtilization: 1}, nil),
+				}
+
+				workspace := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), pools, testLogger(), testMetrics())
+
+				return NewManager([]*Workspace{workspace}, 0, testLogger(), testMetrics()), workspace
+			}
+
+			planner, _ := newManager(3, 0)
+
+			plan, err := planner.Plan(context.Background())
+			require.NoError(t, err)
+
+			for _, method := range []string{"PostRunner", "DeleteRunner", "UpdateRunner", "PutRunnerStatus"} {
+				assert.Equal(t, 0, client.called(method), method)
+			}
+
+			var text strings.Builder
+
+			require.NoError(t, plan.WriteText(&text))
+			assert.Equal(t, `workspace acme
+  pool linux (profile default): 1 runners, 0 busy, desired 3
+    + create 2 runners with labels [linux] (scale up)
+  pool mac (profile default): 1 runners, 0 busy, desired 0
+    - delete runner mac-00000009 {9} (scale down)
+
+Plan: 2 to create, 1 to delete, 0 to update.
+`, text.String())
+
+			// Plans are saved as JSON and applied by another process.
+			raw, err := json.Marshal(plan)
+			require.NoError(t, err)
+
+			var saved Plan
+
+			require.NoError(t, json.Unmarshal(raw, &saved))
+
+			live, workspace := newManager(1, 1)
+
+			if !table.unreconciled {
+				require.NoError(t, workspace.Reconcile(context.Background()))
+			}
+
+			table.change(client, &saved)
+
+			err = live.Apply(context.Background(), &saved)
+
+			if table.expectedError != "" {
+				if table.expectedErr != nil {
+					assert.ErrorIs(t, err, table.expectedErr)
+				}
+
+				assert.EqualError(t, err, table.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, table.expectedCreated, client.called("PostRunner"))
+			assert.Equal(t, table.expectedDrained, client.called("PutRunnerStatus"))
+		})
+	}
+}
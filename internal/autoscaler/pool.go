@@ -0,0 +1,665 @@
+package autoscaler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/predictor"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/schedule"
+)
+
+const (
+	runnerNameSuffixLen int    = 8
+	selfHostedLabel     string = "self.hosted"
+
+	reasonScaleUp   string = "scale up"
+	reasonScaleDown string = "scale down"
+	reasonRecycle   string = "max idle age"
+	reasonFinished  string = "step finished"
+	reasonFailed    string = "failed"
+	reasonReplace   string = "replace interrupted runner"
+)
+
+// Pool is a group of identical runners managed together. Runners are matched
+// to their pool by name rather than labels, so a pool keeps owning its runners
+// even when their labels drift from the configuration.
+type Pool struct {
+	lastScale time.Time
+	// retryPlacement is when runners are created again after the provider
+	// failed to place one.
+	retryPlacement time.Time
+	lifecycle      *lifecycle.Machine
+	schedule       *schedule.Schedule
+	predictor      *predictor.Predictor
+	// timezone is where the predictor counts hours and weekdays.
+	timezone *time.Location
+	now      func() time.Time
+	// used holds the ephemeral runners seen running a step.
+	used map[string]struct{}
+	// workloads maps runner UUIDs to the compute the provider started.
+	workloads map[string]ports.Workload
+	// interrupted holds the interruption notices of runners still
+	// registered, keyed by normalized runner UUID.
+	interrupted map[string]ports.Interruption
+	// mismatches holds the consistency mismatches found on the last check,
+	// so each is only logged once.
+	mismatches map[string]struct{}
+	// recommendations are the desired runner counts still inside the longest
+	// stabilization window, oldest first.
+	recommendations []recommendation
+	// providers start the compute of new runners, tried in order.
+	providers []*poolProvider
+	config    config.Pool
+	// placementFailures counts the provisioning failures in a row.
+	placementFailures int
+	// headroom is how many more runners the providers can place on this
+	// reconcile, negative when they are not limited.
+	headroom int
+	// replacements counts the runners interrupted since the last observe.
+	replacements int
+}
+
+// poolProvider is a provider of a pool, with the cost and priority its
+// runners are ranked by for removal.
+type poolProvider struct {
+	ports.Provider
+	name     string
+	cost     float64
+	priority int
+	// headroom is how many more runners the provider can place on this
+	// reconcile, negative when it is not limited.
+	headroom int
+}
+
+// recommendation is the desired runner count computed at a point in time.
+type recommendation struct {
+	at      time.Time
+	desired int
+}
+
+// NewPool returns a pool backed by providers, given in the order of the
+// provider chain of cfg. Without providers the pool only manages Bitbucket
+// registrations and the compute is started elsewhere.
+func NewPool(cfg config.Pool, providers ...ports.Provider) (*Pool, error) {
+	sched, err := schedule.New(cfg.Schedule, schedule.Bounds{Min: cfg.Min, Max: cfg.Max, Warm: cfg.Warm})
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", cfg.Name, err)
+	}
+
+	pool := &Pool{
+		schedule:    sched,
+		now:         time.Now,
+		used:        map[string]struct{}{},
+		workloads:   map[string]ports.Workload{},
+		interrupted: map[string]ports.Interruption{},
+		config:      cfg,
+		headroom:    unlimited,
+	}
+
+	chain := cfg.ProviderChain()
+
+	for i, provider := range providers {
+		if provider == nil {
+			continue
+		}
+
+		entry := &poolProvider{Provider: provider, priority: i, headroom: unlimited}
+
+		if i < len(chain) {
+			entry.name, entry.cost = chain[i].Name, chain[i].Cost
+		}
+
+		pool.providers = append(pool.providers, entry)
+	}
+
+	pool.lifecycle = lifecycle.NewMachine(cfg.Name, cfg.Timeouts, func() time.Time { return pool.now() })
+
+	if cfg.Prediction != nil {
+		location, err := time.LoadLocation(cfg.Prediction.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: invalid prediction timezone: %w", cfg.Name, err)
+		}
+
+		pool.timezone = location
+		pool.predictor = predictor.New(cfg.Prediction.Alpha, location)
+	}
+
+	return pool, nil
+}
+
+func (p *Pool) Name() string {
+	return p.config.Name
+}
+
+// Owns reports whether runner was created by this pool.
+func (p *Pool) Owns(runner *bitbucketclient.Runner) bool {
+	suffix, ok := strings.CutPrefix(runner.Name, p.config.Name+"-")
+	if !ok || len(suffix) != runnerNameSuffixLen {
+		return false
+	}
+
+	_, err := hex.DecodeString(suffix)
+
+	return err == nil
+}
+
+func (p *Pool) newRunnerName() string {
+	b := make([]byte, runnerNameSuffixLen/2)
+	_, _ = rand.Read(b)
+
+	return p.config.Name + "-" + hex.EncodeToString(b)
+}
+
+// poolStatus is a snapshot of the runners owned by a pool. Draining runners
+// are left out. Finished ephemeral runners, failed runners and idle
+// interrupted runners are only listed in finished, failed and interrupted,
+// as they are about to go. Busy
+// interrupted runners are left out of runners but counted as busy, so they
+// are replaced while finishing their step.
+type poolStatus struct {
+	runners     []bitbucketclient.Runner
+	idle        []bitbucketclient.Runner
+	drifted     []bitbucketclient.Runner
+	finished    []bitbucketclient.Runner
+	failed      []bitbucketclient.Runner
+	interrupted []bitbucketclient.Runner
+	busy        int
+	// replacing is how many runners were interrupted since the last
+	// snapshot. Their replacements skip the scaling behavior.
+	replacing int
+}
+
+// observe sorts the runners of the pool and tracks their lifecycle.
+func (p *Pool) observe(runners []bitbucketclient.Runner) poolStatus {
+	status := poolStatus{replacing: p.replacements}
+	p.replacements = 0
+
+	registered := make(map[string]struct{}, len(runners))
+
+	for i := range runners {
+		registered[runners[i].Name] = struct{}{}
+	}
+
+	// Records of runners still registered are kept.
+	p.lifecycle.Expire(func(name string) bool {
+		_, ok := registered[name]
+
+		return ok
+	})
+
+	used := make(map[string]struct{}, len(p.used))
+	interrupted := make(map[string]ports.Interruption, len(p.interrupted))
+	present := make(map[string]struct{}, len(runners))
+
+	for i := range runners {
+		if !p.Owns(&runners[i]) {
+			continue
+		}
+
+		present[runners[i].UUID] = struct{}{}
+		state := p.track(&runners[i])
+
+		notice, isInterrupted := p.interrupted[bitbucketclient.NormalizeUUID(runners[i].UUID)]
+		if isInterrupted {
+			interrupted[bitbucketclient.NormalizeUUID(runners[i].UUID)] = notice
+		}
+
+		// Draining runners are on their way out and no longer count.
+		if state == lifecycle.StateDraining {
+			continue
+		}
+
+		if isInterrupted {
+			if isBusy(&runners[i]) {
+				status.busy++
+			} else {
+				status.interrupted = append(status.interrupted, runners[i])
+			}
+
+			continue
+		}
+
+		if state == lifecycle.StateFailed && !isBusy(&runners[i]) {
+			status.failed = append(status.failed, runners[i])
+
+			continue
+		}
+
+		if p.config.Ephemeral {
+			_, ok := p.used[runners[i].UUID]
+
+			switch {
+			case isBusy(&runners[i]):
+				used[runners[i].UUID] = struct{}{}
+			case ok:
+				status.finished = append(status.finished, runners[i])
+
+				continue
+			}
+		}
+
+		status.runners = append(status.runners, runners[i])
+
+		if p.drifted(&runners[i]) {
+			status.drifted = append(status.drifted, runners[i])
+		}
+
+		if isBusy(&runners[i]) {
+			status.busy++
+		} else {
+			status.idle = append(status.idle, runners[i])
+		}
+	}
+
+	// Only runners still busy or registered need remembering: finished ones
+	// are deleted on this reconcile and gone ones will not come back.
+	p.used = used
+	p.interrupted = interrupted
+
+	p.trackMissing(present)
+
+	return status
+}
+
+// track updates the lifecycle of runner from what Bitbucket reports and
+// returns its state. Runners created before the autoscaler started are
+// adopted.
+func (p *Pool) track(runner *bitbucketclient.Runner) lifecycle.State {
+	online := runner.State.Status == bitbucketclient.RunnerStatusOnline
+
+	record, ok := p.lifecycle.Get(runner.Name)
+	if !ok {
+		state := lifecycle.StateProvisioning
+		if online {
+			state = lifecycle.StateOnline
+		}
+
+		p.lifecycle.Adopt(runner.Name, runner.UUID, state)
+
+		return state
+	}
+
+	if record.State == lifecycle.StateProvisioning && online {
+		_ = p.lifecycle.Transition(runner.Name, lifecycle.StateOnline, "runner connected")
+
+		return lifecycle.StateOnline
+	}
+
+	return record.State
+}
+
+// trackMissing fails runners whose registration disappeared without the
+// autoscaler removing it.
+func (p *Pool) trackMissing(present map[string]struct{}) {
+	for _, record := range p.lifecycle.Runners() {
+		if record.State != lifecycle.StateProvisioning && record.State != lifecycle.StateOnline {
+			continue
+		}
+
+		if _, ok := present[record.UUID]; !ok {
+			_ = p.lifecycle.Transition(record.Name, lifecycle.StateFailed, "registration removed outside the autoscaler")
+		}
+	}
+}
+
+// bounds returns the min and max runners in force right now, taking the pool
+// schedule into account.
+func (p *Pool) bounds() schedule.Bounds {
+	return p.schedule.At(p.now())
+}
+
+// forecast records the current demand and returns the demand expected one
+// lead time from now. It returns zero when prediction is disabled.
+func (p *Pool) forecast(status poolStatus) float64 {
+	if p.predictor == nil {
+		return 0
+	}
+
+	now := p.now()
+
+	p.predictor.Observe(now, float64(status.busy))
+
+	return p.predictor.Forecast(now.Add(p.config.Prediction.Lead))
+}
+
+// desired returns how many runners the pool should have so that busy runners,
+// or the forecast demand if higher, make up at most the configured target
+// utilization, and at least the warm runners are idle on top of busy ones.
+// Runners still starting count as warm, so a slow start does not pile up
+// more runners.
+func (p *Pool) desired(status poolStatus, bounds schedule.Bounds, forecast float64) int {
+	demand := max(float64(status.busy), forecast)
+	want := max(int(math.Ceil(demand/p.config.TargetUtilization)), status.busy+bounds.Warm)
+
+	return clamp(want, bounds.Min, bounds.Max)
+}
+
+// stabilize turns the desired runner count into the target for this
+// reconcile. Like the Kubernetes HPA it scales up only to the lowest
+// recommendation of the scale up window and down only to the highest of the
+// scale down window, then applies the cooldown and step limit of the
+// direction it is moving in.
+func (p *Pool) stabilize(status poolStatus, desired int, bounds schedule.Bounds) int {
+	now := p.now()
+	behavior := p.config.Behavior
+	horizon := max(behavior.ScaleUp.StabilizationWindow, behavior.ScaleDown.StabilizationWindow)
+
+	p.recommendations = append(p.recommendations, recommendation{at: now, desired: desired})
+	p.recommendations = slices.DeleteFunc(p.recommendations, func(r recommendation) bool {
+		return now.Sub(r.at) > horizon
+	})
+
+	upward, downward := desired, desired
+
+	for _, r := range p.recommendations {
+		if now.Sub(r.at) <= behavior.ScaleUp.StabilizationWindow {
+			upward = min(upward, r.desired)
+		}
+
+		if now.Sub(r.at) <= behavior.ScaleDown.StabilizationWindow {
+			downward = max(downward, r.desired)
+		}
+	}
+
+	// Recommendations made under an earlier schedule profile must not keep
+	// the pool outside the bounds in force now.
+	upward = clamp(upward, bounds.Min, bounds.Max)
+	downward = clamp(downward, bounds.Min, bounds.Max)
+
+	current := len(status.runners)
+
+	// Interrupted runners are replaced at once, whatever the stabilization
+	// window, cooldown and max step.
+	replaced := max(current, min(current+status.replacing, desired))
+
+	switch {
+	case upward > replaced:
+		return replaced + p.step(upward-replaced, behavior.ScaleUp, now)
+	case replaced > current:
+		return replaced
+	case downward < current:
+		return current - p.step(current-downward, behavior.ScaleDown, now)
+	default:
+		return current
+	}
+}
+
+// step returns how many runners may be added or removed now, out of want.
+func (p *Pool) step(want int, rules config.ScalingRules, now time.Time) int {
+	if !p.lastScale.IsZero() && now.Sub(p.lastScale) < rules.Cooldown {
+		return 0
+	}
+
+	if rules.MaxStep > 0 {
+		return min(want, rules.MaxStep)
+	}
+
+	return want
+}
+
+// scaled starts the cooldown if actions change the size of the pool.
+func (p *Pool) scaled(actions []Action) {
+	for _, action := range actions {
+		if action.Reason == reasonScaleUp || action.Reason == reasonScaleDown {
+			p.lastScale = p.now()
+
+			return
+		}
+	}
+}
+
+// removable returns the runners that are old enough to be removed.
+func (p *Pool) removable(runners []bitbucketclient.Runner) []bitbucketclient.Runner {
+	now := p.now()
+
+	return slices.DeleteFunc(slices.Clone(runners), func(runner bitbucketclient.Runner) bool {
+		return now.Sub(runner.CreatedOn) < p.config.Behavior.MinRunnerLifetime
+	})
+}
+
+// plan turns the difference between the observed and desired runner count
+// into actions. Busy runners and runners younger than the minimum lifetime are
+// never selected for removal.
+func (p *Pool) plan(status poolStatus, desired int) []Action {
+	current := len(status.runners)
+	removable := p.removable(status.idle)
+
+	var actions []Action
+
+	// Failed, interrupted and finished ephemeral runners are removed
+	// whatever the pool size. They are left out of current, so the creations
+	// below replace them.
+	for _, runner := range status.failed {
+		actions = append(actions, Action{
+			Type:       ActionDelete,
+			Pool:       p.config.Name,
+			RunnerUUID: runner.UUID,
+			Reason:     reasonFailed,
+		})
+	}
+
+	for _, runner := range status.interrupted {
+		actions = append(actions, Action{
+			Type:       ActionDelete,
+			Pool:       p.config.Name,
+			RunnerUUID: runner.UUID,
+			Reason:     reasonInterrupted,
+		})
+	}
+
+	for _, runner := range status.finished {
+		actions = append(actions, Action{
+			Type:       ActionDelete,
+			Pool:       p.config.Name,
+			RunnerUUID: runner.UUID,
+			Reason:     reasonFinished,
+		})
+	}
+
+	for i := current; i < desired; i++ {
+		reason := reasonScaleUp
+		if i < current+status.replacing {
+			reason = reasonReplace
+		}
+
+		actions = append(actions, Action{
+			Type:   ActionCreate,
+			Pool:   p.config.Name,
+			Labels: p.config.Labels,
+			Reason: reason,
+		})
+	}
+
+	if current > desired {
+		for _, runner := range p.removalOrder(removable)[:min(current-desired, len(removable))] {
+			actions = append(actions, Action{
+				Type:       ActionDelete,
+				Pool:       p.config.Name,
+				RunnerUUID: runner.UUID,
+				Reason:     reasonScaleDown,
+			})
+		}
+	}
+
+	actions = append(actions, p.planDrift(status, removable, actions)...)
+
+	return append(actions, p.planRecycle(removable, actions)...)
+}
+
+// planDrift brings runners whose labels no longer match the configuration back
+// in line, according to the pool label drift policy. Replacement happens one
+// runner per reconcile and only while the pool is not otherwise scaling and
+// the provider has room, so capacity never drops while runners are swapped.
+func (p *Pool) planDrift(status poolStatus, removable []bitbucketclient.Runner, scaling []Action) []Action {
+	switch p.config.LabelDrift {
+	case config.LabelDriftPatch:
+		actions := make([]Action, 0, len(status.drifted))
+
+		for _, runner := range status.drifted {
+			actions = append(actions, Action{
+				Type:       ActionUpdateLabels,
+				Pool:       p.config.Name,
+				RunnerUUID: runner.UUID,
+				RunnerName: runner.Name,
+				Labels:     p.config.Labels,
+				Reason:     "label drift",
+			})
+		}
+
+		return actions
+	case config.LabelDriftReplace:
+		if len(scaling) > 0 || p.headroom == 0 {
+			return nil
+		}
+
+		for _, runner := range p.removalOrder(removable) {
+			if !p.drifted(&runner) {
+				continue
+			}
+
+			return []Action{
+				{Type: ActionCreate, Pool: p.config.Name, Labels: p.config.Labels, Reason: "label drift"},
+				{Type: ActionDelete, Pool: p.config.Name, RunnerUUID: runner.UUID, Reason: "label drift"},
+			}
+		}
+	}
+
+	return nil
+}
+
+// planRecycle replaces one idle runner past the maximum idle age per
+// reconcile, so runners pick up fresh images. Like label drift replacement it
+// waits while the pool is otherwise adding or removing runners, or while the
+// provider has no room for the replacement.
+func (p *Pool) planRecycle(removable []bitbucketclient.Runner, planned []Action) []Action {
+	if p.headroom == 0 {
+		return nil
+	}
+
+	for _, action := range planned {
+		if action.Type == ActionCreate || action.Type == ActionDelete {
+			return nil
+		}
+	}
+
+	for _, runner := range p.removalOrder(removable) {
+		if runner.State.Status != bitbucketclient.RunnerStatusOnline || !p.stale(&runner) {
+			continue
+		}
+
+		return []Action{
+			{Type: ActionCreate, Pool: p.config.Name, Labels: p.config.Labels, Reason: reasonRecycle},
+			{Type: ActionDelete, Pool: p.config.Name, RunnerUUID: runner.UUID, Reason: reasonRecycle},
+		}
+	}
+
+	return nil
+}
+
+// stale reports whether runner is older than the maximum idle age.
+func (p *Pool) stale(runner *bitbucketclient.Runner) bool {
+	return p.config.MaxIdleAge > 0 && p.now().Sub(runner.CreatedOn) > p.config.MaxIdleAge
+}
+
+// drifted reports whether the labels of runner differ from the pool
+// configuration. Bitbucket always adds self.hosted, so it is ignored.
+func (p *Pool) drifted(runner *bitbucketclient.Runner) bool {
+	return !slices.Equal(labelSet(runner.Labels), labelSet(p.config.Labels))
+}
+
+// removalOrder sorts runners so the cheapest to lose come first: runners that
+// are not online, then runners with drifted labels or past the maximum idle
+// age, then, in pools with several providers, the runners of the most
+// expensive provider, and then the most recently created ones.
+func (p *Pool) removalOrder(runners []bitbucketclient.Runner) []bitbucketclient.Runner {
+	sorted := append([]bitbucketclient.Runner(nil), runners...)
+
+	rank := func(runner *bitbucketclient.Runner) int {
+		switch {
+		case runner.State.Status != bitbucketclient.RunnerStatusOnline:
+			return 0
+		case p.drifted(runner), p.stale(runner):
+			return 1
+		default:
+			return 2 //nolint:mnd
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if ri, rj := rank(&sorted[i]), rank(&sorted[j]); ri != rj {
+			return ri < rj
+		}
+
+		if pi, pj := p.backing(&sorted[i]), p.backing(&sorted[j]); len(p.providers) > 1 && pi != pj {
+			return pi.dearer(pj)
+		}
+
+		return sorted[i].CreatedOn.After(sorted[j].CreatedOn)
+	})
+
+	return sorted
+}
+
+// backing returns the provider that started the compute of runner, or nil
+// if it is not known.
+func (p *Pool) backing(runner *bitbucketclient.Runner) *poolProvider {
+	workload, ok := p.workloads[bitbucketclient.NormalizeUUID(runner.UUID)]
+	if !ok {
+		return nil
+	}
+
+	for _, provider := range p.providers {
+		if provider.name == workload.Provider {
+			return provider
+		}
+	}
+
+	return nil
+}
+
+// dearer reports whether runners of p cost more than those of other. Runners
+// of an unknown provider come last, as removing them is a guess.
+func (p *poolProvider) dearer(other *poolProvider) bool {
+	switch {
+	case p == nil:
+		return false
+	case other == nil:
+		return true
+	case p.cost != other.cost:
+		return p.cost > other.cost
+	default:
+		return p.priority > other.priority
+	}
+}
+
+func labelSet(labels []string) []string {
+	set := make([]string, 0, len(labels))
+
+	for _, label := range labels {
+		if label = strings.ToLower(strings.TrimSpace(label)); label != selfHostedLabel && !slices.Contains(set, label) {
+			set = append(set, label)
+		}
+	}
+
+	slices.Sort(set)
+
+	return set
+}
+
+func isBusy(runner *bitbucketclient.Runner) bool {
+	return runner.State.Step != nil
+}
+
+func clamp(v, lower, upper int) int {
+	return max(lower, min(v, upper))
+}
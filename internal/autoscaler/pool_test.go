@@ -0,0 +1,472 @@
+package autoscaler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/predictor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwns(t *testing.T) {
+	pool := newTestPool(t, config.Pool{Name: "linux"}, nil)
+
+	tables := []struct {
+		name       string
+		runnerName string
+		expected   bool
+	}{
+		{name: "runner created by the pool", runnerName: "linux-0a1b2c3d", expected: true},
+		{name: "runner of a pool sharing the prefix", runnerName: "linux-large-0a1b2c3d", expected: false},
+		{name: "suffix is not hexadecimal", runnerName: "linux-zzzzzzzz", expected: false},
+		{name: "manually created runner", runnerName: "linux", expected: false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expected, pool.Owns(&bitbucketclient.Runner{Name: table.runnerName}))
+		})
+	}
+
+	assert.True(t, pool.Owns(&bitbucketclient.Runner{Name: pool.newRunnerName()}))
+}
+
+func TestDesired(t *testing.T) {
+	tables := []struct {
+		name     string
+		forecast float64
+		busy     int
+		warm     int
+		expected int
+	}{
+		{name: "no demand falls back to min", busy: 0, expected: 1},
+		{name: "warm runners on top of busy ones", busy: 4, warm: 3, expected: 7},
+		{name: "warm runners above min", busy: 0, warm: 2, expected: 2},
+		{name: "warm runners capped at max", busy: 9, warm: 3, expected: 10},
+		{name: "headroom above busy runners", busy: 4, expected: 5},
+		{name: "capped at max", busy: 20, expected: 10},
+		{name: "forecast above current demand pre-warms runners", busy: 1, forecast: 6.4, expected: 8},
+		{name: "forecast below current demand is ignored", busy: 4, forecast: 2, expected: 5},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			pool := newTestPool(t, config.Pool{Name: "linux", Min: 1, Max: 10, Warm: table.warm, TargetUtilization: 0.8}, nil)
+
+			assert.Equal(t, table.expected, pool.desired(poolStatus{busy: table.busy}, pool.bounds(), table.forecast))
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	pool := newTestPool(t, config.Pool{Name: "linux", Labels: []string{"self.hosted", "linux"}, Min: 0, Max: 10}, nil)
+
+	online := testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false)
+	newer := testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, false)
+	newer.CreatedOn = newer.CreatedOn.Add(time.Hour)
+	offline := testRunner("{3}", "linux-00000003", bitbucketclient.RunnerStatusOffline, false)
+	busy := testRunner("{4}", "linux-00000004", bitbucketclient.RunnerStatusOnline, true)
+
+	status := pool.observe([]bitbucketclient.Runner{online, newer, offline, busy})
+
+	tables := []struct {
+		name     string
+		expected []Action
+		desired  int
+	}{
+		{
+			name:     "nothing to do",
+			desired:  4,
+			expected: nil,
+		},
+		{
+			name:    "scale up",
+			desired: 6,
+			expected: []Action{
+				{Type: ActionCreate, Pool: "linux", Labels: []string{"self.hosted", "linux"}, Reason: "scale up"},
+				{Type: ActionCreate, Pool: "linux", Labels: []string{"self.hosted", "linux"}, Reason: "scale up"},
+			},
+		},
+		{
+			name:    "scale down removes offline then newest idle runners",
+			desired: 2,
+			expected: []Action{
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{3}", Reason: "scale down"},
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{2}", Reason: "scale down"},
+			},
+		},
+		{
+			name:    "busy runners are never removed",
+			desired: 0,
+			expected: []Action{
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{3}", Reason: "scale down"},
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{2}", Reason: "scale down"},
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{1}", Reason: "scale down"},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expected, pool.plan(status, table.desired))
+		})
+	}
+}
+
+func TestPlanDrift(t *testing.T) {
+	labels := []string{"self.hosted", "linux", "large"}
+
+	matching := testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false)
+	matching.Labels = []string{"large", "linux"}
+
+	drifted := testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, false)
+	drifted.Labels = []string{"self.hosted", "linux"}
+
+	busyDrifted := testRunner("{3}", "linux-00000003", bitbucketclient.RunnerStatusOnline, true)
+	busyDrifted.Labels = []string{"self.hosted", "linux"}
+
+	runners := []bitbucketclient.Runner{matching, drifted, busyDrifted}
+
+	tables := []struct {
+		name     string
+		policy   string
+		expected []Action
+		desired  int
+	}{
+		{
+			name:    "patch updates every drifted runner",
+			policy:  config.LabelDriftPatch,
+			desired: 3,
+			expected: []Action{
+				{Type: ActionUpdateLabels, Pool: "linux", RunnerUUID: "{2}", RunnerName: "linux-00000002", Labels: labels, Reason: "label drift"},
+				{Type: ActionUpdateLabels, Pool: "linux", RunnerUUID: "{3}", RunnerName: "linux-00000003", Labels: labels, Reason: "label drift"},
+			},
+		},
+		{
+			name:    "replace swaps one idle drifted runner at a time",
+			policy:  config.LabelDriftReplace,
+			desired: 3,
+			expected: []Action{
+				{Type: ActionCreate, Pool: "linux", Labels: labels, Reason: "label drift"},
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{2}", Reason: "label drift"},
+			},
+		},
+		{
+			name:    "replace waits while the pool is scaling and scale down prefers drifted runners",
+			policy:  config.LabelDriftReplace,
+			desired: 2,
+			expected: []Action{
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{2}", Reason: "scale down"},
+			},
+		},
+		{
+			name:     "ignore leaves drifted runners alone",
+			policy:   config.LabelDriftIgnore,
+			desired:  3,
+			expected: nil,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			pool := newTestPool(t, config.Pool{Name: "linux", Labels: labels, Max: 10, LabelDrift: table.policy}, nil)
+
+			status := pool.observe(runners)
+
+			assert.Len(t, status.drifted, 2)
+			assert.Equal(t, table.expected, pool.plan(status, table.desired))
+		})
+	}
+}
+
+func TestForecast(t *testing.T) {
+	monday := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	pool := newTestPool(t, config.Pool{
+		Name:       "linux",
+		Max:        10,
+		Prediction: &config.Prediction{Lead: 15 * time.Minute, Alpha: 0.5},
+	}, nil)
+
+	// Last Monday the 08:00 hour peaked at 6 busy runners.
+	pool.predictor = predictor.Replay(0.5, time.UTC, []predictor.Sample{{Hour: monday.Add(-7 * 24 * time.Hour), Demand: 6}})
+
+	pool.now = func() time.Time { return monday.Add(-10 * time.Minute) }
+
+	assert.InDelta(t, 6, pool.forecast(poolStatus{busy: 0}), 0)
+
+	pool.now = func() time.Time { return monday.Add(-30 * time.Minute) }
+
+	assert.InDelta(t, 0, pool.forecast(poolStatus{busy: 0}), 0)
+}
+
+func TestStabilize(t *testing.T) {
+	start := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	// tick is one reconcile: the pool has current runners and demand alone
+	// would ask for desired.
+	type tick struct {
+		after     time.Duration
+		current   int
+		desired   int
+		expected  int
+		replacing int
+	}
+
+	tables := []struct {
+		name     string
+		ticks    []tick
+		behavior config.Behavior
+	}{
+		{
+			name: "zero behavior follows demand",
+			ticks: []tick{
+				{after: 0, current: 2, desired: 8, expected: 8},
+				{after: time.Second, current: 8, desired: 1, expected: 1},
+			},
+		},
+		{
+			name:     "scale down waits for the window to see lower demand only",
+			behavior: config.Behavior{ScaleDown: config.ScalingRules{StabilizationWindow: 5 * time.Minute}},
+			ticks: []tick{
+				{after: 0, current: 6, desired: 6, expected: 6},
+				{after: time.Minute, current: 6, desired: 2, expected: 6},
+				{after: 2 * time.Minute, current: 6, desired: 4, expected: 6},
+				{after: 5*time.Minute + time.Second, current: 6, desired: 2, expected: 4},
+				{after: 7*time.Minute + time.Second, current: 4, desired: 2, expected: 2},
+			},
+		},
+		{
+			name:     "scale up ignores a single spike",
+			behavior: config.Behavior{ScaleUp: config.ScalingRules{StabilizationWindow: time.Minute}},
+			ticks: []tick{
+				{after: 0, current: 2, desired: 2, expected: 2},
+				{after: 30 * time.Second, current: 2, desired: 9, expected: 2},
+				{after: 61 * time.Second, current: 2, desired: 5, expected: 5},
+			},
+		},
+		{
+			name:     "max step limits each reconcile",
+			behavior: config.Behavior{ScaleUp: config.ScalingRules{MaxStep: 3}, ScaleDown: config.ScalingRules{MaxStep: 1}},
+			ticks: []tick{
+				{after: 0, current: 0, desired: 8, expected: 3},
+				{after: time.Second, current: 3, desired: 8, expected: 6},
+				{after: 2 * time.Second, current: 6, desired: 0, expected: 5},
+			},
+		},
+		{
+			name:     "cooldown after scaling",
+			behavior: config.Behavior{ScaleDown: config.ScalingRules{Cooldown: 2 * time.Minute}},
+			ticks: []tick{
+				{after: 0, current: 0, desired: 4, expected: 4},
+				{after: time.Minute, current: 4, desired: 1, expected: 4},
+				{after: 90 * time.Second, current: 4, desired: 6, expected: 6},
+				{after: 3 * time.Minute, current: 6, desired: 1, expected: 6},
+				{after: 3*time.Minute + 31*time.Second, current: 6, desired: 1, expected: 1},
+			},
+		},
+		{
+			name: "interrupted runners are replaced at once",
+			behavior: config.Behavior{ScaleUp: config.ScalingRules{
+				StabilizationWindow: time.Minute, MaxStep: 1, Cooldown: 5 * time.Minute,
+			}},
+			ticks: []tick{
+				{after: 0, current: 2, desired: 4, expected: 3},
+				{after: 30 * time.Second, current: 1, desired: 4, replacing: 2, expected: 3},
+				{after: time.Minute, current: 3, desired: 4, expected: 3},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			pool := newTestPool(t, config.Pool{Name: "linux", Max: 10, Behavior: table.behavior}, nil)
+			bounds := pool.bounds()
+
+			for i, tick := range table.ticks {
+				pool.now = func() time.Time { return start.Add(tick.after) }
+
+				status := poolStatus{runners: make([]bitbucketclient.Runner, tick.current), replacing: tick.replacing}
+				target := pool.stabilize(status, tick.desired, bounds)
+
+				assert.Equal(t, tick.expected, target, "tick %d", i)
+
+				if target != tick.current {
+					pool.scaled([]Action{{Type: ActionCreate, Reason: reasonScaleUp}})
+				}
+			}
+		})
+	}
+}
+
+func TestPlanMinRunnerLifetime(t *testing.T) {
+	old := testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false)
+	young := testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusUnregistered, false)
+	young.CreatedOn = old.CreatedOn.Add(time.Hour)
+
+	pool := newTestPool(t, config.Pool{
+		Name:     "linux",
+		Max:      10,
+		Behavior: config.Behavior{MinRunnerLifetime: 10 * time.Minute},
+	}, nil)
+	pool.now = func() time.Time { return young.CreatedOn.Add(5 * time.Minute) }
+
+	status := pool.observe([]bitbucketclient.Runner{old, young})
+
+	assert.Equal(t, []Action{
+		{Type: ActionDelete, Pool: "linux", RunnerUUID: "{1}", Reason: "scale down"},
+	}, pool.plan(status, 0))
+}
+
+func TestObserveKeepsFailedRunnersWhileRegistered(t *testing.T) {
+	busy := testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, true)
+	now := busy.CreatedOn
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Max: 10}, nil)
+	pool.now = func() time.Time { return now }
+
+	pool.observe([]bitbucketclient.Runner{busy})
+	assert.NoError(t, pool.lifecycle.Transition(busy.Name, lifecycle.StateFailed, "compute interrupted"))
+
+	// A failed runner finishing a long step is not adopted as online again.
+	now = now.Add(2 * time.Hour)
+	pool.observe([]bitbucketclient.Runner{busy})
+
+	record, ok := pool.lifecycle.Get(busy.Name)
+	assert.True(t, ok)
+	assert.Equal(t, lifecycle.StateFailed, record.State)
+
+	// Once gone, it is forgotten.
+	pool.observe(nil)
+
+	_, ok = pool.lifecycle.Get(busy.Name)
+	assert.False(t, ok)
+}
+
+func TestPlanRecycle(t *testing.T) {
+	fresh := testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false)
+	fresh.CreatedOn = fresh.CreatedOn.Add(20 * time.Hour)
+	stale := testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, false)
+	busyStale := testRunner("{3}", "linux-00000003", bitbucketclient.RunnerStatusOnline, true)
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Max: 10, MaxIdleAge: 12 * time.Hour}, nil)
+	pool.now = func() time.Time { return fresh.CreatedOn.Add(time.Hour) }
+
+	status := pool.observe([]bitbucketclient.Runner{fresh, stale, busyStale})
+
+	tables := []struct {
+		name     string
+		expected []Action
+		desired  int
+	}{
+		{
+			name:    "one idle stale runner is replaced at a time",
+			desired: 3,
+			expected: []Action{
+				{Type: ActionCreate, Pool: "linux", Reason: "max idle age"},
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{2}", Reason: "max idle age"},
+			},
+		},
+		{
+			name:    "scale down removes stale runners first",
+			desired: 2,
+			expected: []Action{
+				{Type: ActionDelete, Pool: "linux", RunnerUUID: "{2}", Reason: "scale down"},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expected, pool.plan(status, table.desired))
+		})
+	}
+}
+
+func TestPlacementBackoff(t *testing.T) {
+	now := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Min: 1, Max: 5, TargetUtilization: 1}, nil)
+	pool.now = func() time.Time { return now }
+
+	tables := []struct {
+		expected time.Duration
+		failures int
+	}{
+		{failures: 1, expected: 30 * time.Second},
+		{failures: 2, expected: time.Minute},
+		{failures: 4, expected: 4 * time.Minute},
+		{failures: 20, expected: 10 * time.Minute},
+	}
+
+	for _, table := range tables {
+		pool.placementFailures = 0
+
+		for range table.failures {
+			pool.placementFailed()
+		}
+
+		assert.Equal(t, now.Add(table.expected), pool.retryPlacement, "%d failures", table.failures)
+	}
+
+	pool.placed()
+	assert.True(t, pool.retryPlacement.IsZero())
+	assert.Zero(t, pool.placementFailures)
+}
+
+func TestPlanRemovesExpensiveRunnersFirst(t *testing.T) {
+	tables := []struct {
+		name      string
+		providers []config.PoolProvider
+		expected  []string
+	}{
+		{
+			name:      "by cost",
+			providers: []config.PoolProvider{{Name: "k8s"}, {Name: "spot", Cost: 3}, {Name: "on-demand", Cost: 1}},
+			expected:  []string{"{2}", "{3}", "{1}"},
+		},
+		{
+			name:      "later providers first at equal cost",
+			providers: []config.PoolProvider{{Name: "k8s"}, {Name: "spot"}, {Name: "on-demand"}},
+			expected:  []string{"{3}", "{2}", "{1}"},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			pool, err := NewPool(
+				config.Pool{Name: "linux", Max: 10, Providers: table.providers},
+				&mocks.Provider{}, &mocks.Provider{}, &mocks.Provider{},
+			)
+			require.NoError(t, err)
+
+			// The runner on k8s is the newest and the fourth one's provider
+			// is unknown.
+			runners := []bitbucketclient.Runner{
+				testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false),
+				testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, false),
+				testRunner("{3}", "linux-00000003", bitbucketclient.RunnerStatusOnline, false),
+				testRunner("{4}", "linux-00000004", bitbucketclient.RunnerStatusOnline, false),
+			}
+			runners[0].CreatedOn = runners[0].CreatedOn.Add(time.Hour)
+
+			for i, provider := range []string{"k8s", "spot", "on-demand"} {
+				pool.workloads[runners[i].UUID] = ports.Workload{Provider: provider}
+			}
+
+			var removed []string
+
+			for _, action := range pool.plan(pool.observe(runners), 1) {
+				removed = append(removed, action.RunnerUUID)
+			}
+
+			assert.Equal(t, table.expected, removed)
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package autoscaler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/predictor"
+)
+
+// poolState is the bookkeeping a pool persists so a restart does not lose
+// track of runners halfway through a change.
+type poolState struct {
+	LastScale time.Time `json:"last_scale"`
+	// RetryPlacement is when runners are created again after a
+	// provisioning failure.
+	RetryPlacement time.Time `json:"retry_placement"`
+	// Workloads maps runner UUIDs to the compute backing them.
+	Workloads map[string]ports.Workload `json:"workloads"`
+	Runners   []lifecycle.Runner        `json:"runners"`
+	// Interrupted maps runner UUIDs to the interruption notice of their
+	// compute.
+	Interrupted map[string]ports.Interruption `json:"interrupted"`
+	// Used lists the ephemeral runners seen running their step.
+	Used []string `json:"used"`
+	// Demand is the hourly demand the predictor learnt from.
+	Demand []predictor.Sample `json:"demand,omitempty"`
+	// PlacementFailures counts the provisioning failures in a row.
+	PlacementFailures int `json:"placement_failures"`
+}
+
+func (p *Pool) snapshot() poolState {
+	state := poolState{
+		LastScale:         p.lastScale,
+		RetryPlacement:    p.retryPlacement,
+		PlacementFailures: p.placementFailures,
+		Workloads:         p.workloads,
+		Runners:           p.lifecycle.Runners(),
+		Interrupted:       p.interrupted,
+		Used:              make([]string, 0, len(p.used)),
+	}
+
+	for runnerUUID := range p.used {
+		state.Used = append(state.Used, runnerUUID)
+	}
+
+	if p.predictor != nil {
+		state.Demand = p.predictor.History()
+	}
+
+	return state
+}
+
+// restore replaces the bookkeeping of the pool with state. An empty state
+// forgets everything, as when starting afresh.
+func (p *Pool) restore(state poolState) {
+	p.lastScale = state.LastScale
+	p.retryPlacement = state.RetryPlacement
+	p.placementFailures = state.PlacementFailures
+	p.lifecycle.Restore(state.Runners)
+	p.workloads = map[string]ports.Workload{}
+	p.interrupted = map[string]ports.Interruption{}
+	p.used = make(map[string]struct{}, len(state.Used))
+
+	maps.Copy(p.workloads, state.Workloads)
+	maps.Copy(p.interrupted, state.Interrupted)
+
+	for _, runnerUUID := range state.Used {
+		p.used[runnerUUID] = struct{}{}
+	}
+
+	if p.predictor != nil {
+		p.predictor = predictor.Replay(p.config.Prediction.Alpha, p.timezone, state.Demand)
+	}
+}
+
+// namespace is where the workspace keeps its pools in the state store.
+func (w *Workspace) namespace() string {
+	return "workspace/" + w.name
+}
+
+// save persists the bookkeeping of pool and reports whether it succeeded. A
+// failure is only logged: scaling goes on, at the cost of a less informed
+// restart.
+func (w *Workspace) save(pool *Pool) bool {
+	raw, err := json.Marshal(pool.snapshot())
+	if err == nil {
+		err = w.store.Put(w.namespace(), pool.Name(), raw)
+	}
+
+	if err != nil {
+		w.logger.Error("failed to save pool state", "pool", pool.Name(), "error", err)
+	}
+
+	return err == nil
+}
+
+// load reads the pools saved by a previous run back into memory and reports
+// whether any state was found. Only a failure to read the store is returned:
+// the pools would otherwise start blank and overwrite what was saved.
+func (w *Workspace) load() (bool, error) {
+	saved, err := w.store.List(w.namespace())
+	if err != nil {
+		return false, fmt.Errorf("failed to load state: %w", err)
+	}
+
+	for _, pool := range w.pools {
+		raw, ok := saved[pool.Name()]
+		if !ok {
+			continue
+		}
+
+		var state poolState
+
+		if err := json.Unmarshal(raw, &state); err != nil {
+			w.logger.Error("failed to decode saved pool state, starting afresh", "pool", pool.Name(), "error", err)
+
+			continue
+		}
+
+		pool.restore(state)
+	}
+
+	return len(saved) > 0, nil
+}
+
+// restore loads the pools saved by a previous run and finishes what it left
+// halfway, checked against the runners Bitbucket lists now. It reports
+// whether any state was found.
+func (w *Workspace) restore(ctx context.Context, runners []bitbucketclient.Runner) (bool, error) {
+	found, err := w.load()
+	if err != nil || !found {
+		return found, err
+	}
+
+	registered := make(map[string]bitbucketclient.Runner, len(runners))
+
+	for _, runner := range runners {
+		registered[runner.Name] = runner
+	}
+
+	for _, pool := range w.pools {
+		if err := w.resume(ctx, pool, registered); err != nil {
+			w.logger.Error("failed to resume runners after restart", "pool", pool.Name(), "error", err)
+		}
+
+		w.recordTransitions(pool)
+		w.save(pool)
+	}
+
+	return true, nil
+}
+
+// forget drops the bookkeeping of every pool instead of loading the saved
+// state, which may be outdated. Runners are adopted from the next listing.
+func (w *Workspace) forget() {
+	w.busy.Lock()
+	defer w.busy.Unlock()
+
+	for _, pool := range w.pools {
+		pool.restore(poolState{})
+	}
+
+	w.restored = true
+}
+
+// reasonResumed is given for removals carried through after a restart.
+const reasonResumed string = "resumed after restart"
+
+// resume settles runners a previous run left in a transient state. Runners
+// caught while registering lost the OAuth secret needed to start them, so
+// they fail and are replaced. Interrupted removals are carried through:
+// draining runners are left to drain, except for those never disabled that
+// picked up a step meanwhile, which are adopted again.
+func (w *Workspace) resume(ctx context.Context, pool *Pool, registered map[string]bitbucketclient.Runner) error {
+	var errs []error
+
+	for _, record := range pool.lifecycle.Runners() {
+		runner, isRegistered := registered[record.Name]
+
+		switch record.State {
+		case lifecycle.StateRequested, lifecycle.StateRegistering:
+			if isRegistered && record.State == lifecycle.StateRegistering {
+				if err := pool.lifecycle.Registered(record.Name, runner.UUID); err != nil {
+					errs = append(errs, err)
+
+					continue
+				}
+			}
+
+			w.transition(pool, record.Name, lifecycle.StateFailed, "autoscaler restarted before the runner was provisioned")
+		case lifecycle.StateDraining:
+			if isRegistered && isBusy(&runner) && runner.State.Status != bitbucketclient.RunnerStatusDisabled {
+				w.transition(pool, record.Name, lifecycle.StateOnline, "running a step after restart")
+
+				continue
+			}
+
+			if isRegistered {
+				continue
+			}
+
+			w.transition(pool, record.Name, lifecycle.StateDeprovisioning, "registration already deleted")
+
+			errs = append(errs, w.deprovision(ctx, pool, record.Name, record.UUID, reasonResumed))
+		case lifecycle.StateDeprovisioning:
+			errs = append(errs, w.deprovision(ctx, pool, record.Name, record.UUID, reasonResumed))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,610 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/metrics"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/schedule"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Workspace reconciles the pools of a single Bitbucket workspace using its own
+// client, so credentials and failures never leak across workspaces.
+type Workspace struct {
+	client  RunnerClient
+	store   ports.StateStore
+	auditor ports.Auditor
+	logger  *slog.Logger
+	metrics *metrics.Metrics
+	// ledger is shared with the other workspaces of the manager.
+	ledger *capacityLedger
+	status map[string]PoolStatus
+	name   string
+	pools  []*Pool
+	mu     sync.RWMutex
+	// busy is held by Reconcile, Plan and Apply, which all change the pools.
+	busy sync.Mutex
+	// restored is set once the saved state was loaded, or forgotten.
+	restored bool
+}
+
+// PoolStatus is the state of a pool as of its last reconcile.
+type PoolStatus struct {
+	UpdatedAt time.Time `json:"updated_at"`
+	Workspace string    `json:"workspace"`
+	Pool      string    `json:"pool"`
+	Profile   string    `json:"profile"`
+	Min       int       `json:"min"`
+	Max       int       `json:"max"`
+	Warm      int       `json:"warm"`
+	Desired   int       `json:"desired"`
+	Runners   int       `json:"runners"`
+	Busy      int       `json:"busy"`
+	// Unschedulable is the runners wanted on top of Desired that the
+	// provider has no capacity for.
+	Unschedulable int `json:"unschedulable,omitempty"`
+}
+
+// RunnerStatus is the lifecycle of a runner and the workspace it belongs to.
+type RunnerStatus struct {
+	Workspace string `json:"workspace"`
+	lifecycle.Runner
+}
+
+// NewWorkspace returns a workspace that keeps its bookkeeping in store, so it
+// can pick up where it left off after a restart, and records every change it
+// makes to runners and compute with auditor.
+func NewWorkspace(
+	name string,
+	client RunnerClient,
+	store ports.StateStore,
+	auditor ports.Auditor,
+	pools []*Pool,
+	logger *slog.Logger,
+	m *metrics.Metrics,
+) *Workspace {
+	return &Workspace{
+		client:  client,
+		store:   store,
+		auditor: auditor,
+		logger:  logger.With("workspace", name),
+		metrics: m,
+		ledger:  newCapacityLedger(),
+		status:  map[string]PoolStatus{},
+		name:    name,
+		pools:   pools,
+	}
+}
+
+func (w *Workspace) Name() string {
+	return w.name
+}
+
+// Status returns the last observed state of every pool, in configuration
+// order. Pools that were never reconciled are omitted.
+func (w *Workspace) Status() []PoolStatus {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	statuses := make([]PoolStatus, 0, len(w.pools))
+
+	for _, pool := range w.pools {
+		if status, ok := w.status[pool.Name()]; ok {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// Reconcile fetches the workspace runners once and brings every pool towards
+// its desired size. A failing pool does not prevent the others from scaling.
+func (w *Workspace) Reconcile(ctx context.Context) error {
+	w.busy.Lock()
+	defer w.busy.Unlock()
+
+	resp, err := w.listRunners()
+	if err != nil {
+		return err
+	}
+
+	if !w.restored {
+		found, err := w.restore(ctx, resp.Values)
+		if err != nil {
+			return err
+		}
+
+		w.restored = true
+
+		// Resuming may have removed runners, so list them again.
+		if found {
+			if resp, err = w.listRunners(); err != nil {
+				return err
+			}
+		}
+	}
+
+	var errs []error
+
+	for _, pool := range w.pools {
+		if err := w.reconcilePool(ctx, pool, resp.Values); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (w *Workspace) reconcilePool(ctx context.Context, pool *Pool, runners []bitbucketclient.Runner) error {
+	interruptErr := w.interrupt(ctx, pool, runners)
+
+	runners, drainErr := w.drain(ctx, pool, runners)
+
+	runners, consistencyErr := w.checkConsistency(ctx, pool, runners)
+	if consistencyErr != nil {
+		consistencyErr = fmt.Errorf("consistency check: %w", consistencyErr)
+	}
+
+	status := pool.observe(runners)
+	bounds := pool.bounds()
+	forecast := pool.forecast(status)
+	desired := pool.stabilize(status, pool.desired(status, bounds, forecast), bounds)
+
+	unlock := w.ledger.lock(pool)
+	capacityErr := w.capacity(ctx, pool)
+	desired, unschedulable := pool.placeable(status, desired)
+	actions := pool.plan(status, desired)
+	release := w.ledger.claim(pool, actions)
+	unlock()
+
+	defer release()
+
+	w.recordStatus(pool, status, bounds, desired, unschedulable)
+	w.recordForecast(pool, status, forecast)
+
+	return errors.Join(interruptErr, drainErr, consistencyErr, capacityErr, w.apply(ctx, pool, actions))
+}
+
+// apply executes actions on pool and saves the outcome. Runners are not
+// created while the pool backs off from a provisioning failure, and a runner
+// is only replaced once its replacement was created.
+func (w *Workspace) apply(ctx context.Context, pool *Pool, actions []Action) error {
+	pool.scaled(actions)
+
+	var errs []error
+
+	// unplaced holds the reasons of the runners that could not be created.
+	unplaced := map[string]struct{}{}
+
+	for _, action := range actions {
+		_, replaced := unplaced[action.Reason]
+
+		var err error
+
+		result := "success"
+
+		switch {
+		case action.Type == ActionCreate && (pool.now().Before(pool.retryPlacement) || !pool.room()),
+			action.Type == ActionDelete && replaced:
+			result = "skipped"
+		default:
+			err = w.execute(ctx, pool, action)
+		}
+
+		if err != nil {
+			result = "error"
+
+			errs = append(errs, err)
+		}
+
+		if action.Type == ActionCreate && result != "success" {
+			unplaced[action.Reason] = struct{}{}
+		}
+
+		w.metrics.ScalingActions.WithLabelValues(w.name, pool.Name(), string(action.Type), result).Inc()
+	}
+
+	w.recordTransitions(pool)
+
+	if w.save(pool) {
+		errs = append(errs, w.ackInterruptions(ctx, pool))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Runners returns the lifecycle of every runner tracked by the workspace
+// pools.
+func (w *Workspace) Runners() []RunnerStatus {
+	var runners []RunnerStatus
+
+	for _, pool := range w.pools {
+		for _, runner := range pool.lifecycle.Runners() {
+			runners = append(runners, RunnerStatus{Workspace: w.name, Runner: runner})
+		}
+	}
+
+	return runners
+}
+
+func (w *Workspace) execute(ctx context.Context, pool *Pool, action Action) error {
+	logger := w.logger.With("pool", pool.Name(), "action", action.Type, "reason", action.Reason)
+
+	switch action.Type {
+	case ActionCreate:
+		runner, err := w.createRunner(ctx, pool, action)
+		if err != nil {
+			logger.Error("failed to create runner", "error", err)
+
+			return err
+		}
+
+		logger.Info("created runner", "runner", runner.UUID, "name", runner.Name)
+	case ActionDelete:
+		if err := w.drainRunner(ctx, pool, action); err != nil {
+			logger.Error("failed to drain runner", "runner", action.RunnerUUID, "error", err)
+
+			return err
+		}
+
+		logger.Info("draining runner", "runner", action.RunnerUUID)
+	case ActionUpdateLabels:
+		_, err := w.client.UpdateRunner(action.RunnerUUID, bitbucketclient.UpdateRunnerRequest{
+			Name:   action.RunnerName,
+			Labels: action.Labels,
+		})
+
+		w.audit(ctx, ports.AuditRecord{
+			Operation:  operationUpdateRunner,
+			Pool:       pool.Name(),
+			RunnerUUID: action.RunnerUUID,
+			RunnerName: action.RunnerName,
+			Reason:     action.Reason,
+			Request:    map[string]any{"name": action.RunnerName, "labels": action.Labels},
+		}, err)
+
+		if err != nil {
+			logger.Error("failed to update runner labels", "runner", action.RunnerUUID, "error", err)
+
+			return fmt.Errorf("failed to update labels of runner %s: %w", action.RunnerUUID, err)
+		}
+
+		logger.Info("updated runner labels", "runner", action.RunnerUUID, "labels", action.Labels)
+	default:
+		return fmt.Errorf("unknown action %q", action.Type)
+	}
+
+	return nil
+}
+
+// createRunner registers a runner and starts its compute. If the provider
+// fails the registration is removed again so it does not linger offline.
+func (w *Workspace) createRunner(ctx context.Context, pool *Pool, action Action) (*bitbucketclient.Runner, error) {
+	name := pool.newRunnerName()
+
+	if err := pool.lifecycle.Request(name, action.Reason); err != nil {
+		return nil, err
+	}
+
+	w.transition(pool, name, lifecycle.StateRegistering, "registering with Bitbucket")
+
+	runner, err := w.client.PostRunner(bitbucketclient.PostRunnerRequest{
+		Name:   name,
+		Labels: action.Labels,
+	})
+
+	record := ports.AuditRecord{
+		Operation:  operationPostRunner,
+		Pool:       pool.Name(),
+		RunnerName: name,
+		Reason:     action.Reason,
+		Request:    map[string]any{"name": name, "labels": action.Labels},
+	}
+
+	if runner != nil {
+		record.RunnerUUID = runner.UUID
+	}
+
+	w.audit(ctx, record, err)
+
+	if err != nil {
+		w.transition(pool, name, lifecycle.StateFailed, err.Error())
+
+		return nil, fmt.Errorf("failed to register runner: %w", err)
+	}
+
+	if err := pool.lifecycle.Registered(name, runner.UUID); err != nil {
+		w.logger.Warn("unexpected runner transition", "pool", pool.Name(), "error", err)
+	}
+
+	if len(pool.providers) == 0 {
+		return runner, nil
+	}
+
+	workload, err := w.place(ctx, pool, runner, action.Reason)
+	if err != nil {
+		pool.placementFailed()
+
+		w.logger.Warn("no provider could place runner, backing off",
+			"pool", pool.Name(), "failures", pool.placementFailures, "until", pool.retryPlacement)
+		w.transition(pool, name, lifecycle.StateFailed, err.Error())
+
+		delErr := w.client.DeleteRunner(runner.UUID)
+
+		w.audit(ctx, ports.AuditRecord{
+			Operation:  operationDeleteRunner,
+			Pool:       pool.Name(),
+			RunnerUUID: runner.UUID,
+			RunnerName: runner.Name,
+			Reason:     "provisioning failed",
+		}, delErr)
+
+		if delErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to remove registration %s: %w", runner.UUID, delErr))
+		} else {
+			w.transition(pool, name, lifecycle.StateDeleted, "registration removed after provisioning failed")
+		}
+
+		return nil, fmt.Errorf("failed to provision runner: %w", err)
+	}
+
+	pool.placed()
+	pool.workloads[bitbucketclient.NormalizeUUID(runner.UUID)] = *workload
+
+	if err := pool.lifecycle.Placed(name, workload.Provider); err != nil {
+		w.logger.Warn("unexpected runner transition", "pool", pool.Name(), "error", err)
+	}
+
+	return runner, nil
+}
+
+// place starts the compute of runner with the first provider of the pool
+// that has room. A provider that fails is not tried again on this
+// reconcile, and the runner spills over to the next one.
+func (w *Workspace) place(
+	ctx context.Context, pool *Pool, runner *bitbucketclient.Runner, reason string,
+) (*ports.Workload, error) {
+	workspaceUUID, err := w.client.WorkspaceUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := ports.ProvisionRequest{
+		Workspace:         w.name,
+		WorkspaceUUID:     workspaceUUID,
+		Pool:              pool.Name(),
+		RunnerUUID:        bitbucketclient.NormalizeUUID(runner.UUID),
+		RunnerName:        runner.Name,
+		OAuthClientID:     runner.OauthClient.ID,
+		OAuthClientSecret: runner.OauthClient.Secret,
+		TokenEndpoint:     runner.OauthClient.TokenEndpoint,
+		Audience:          runner.OauthClient.Audience,
+		Labels:            runner.Labels,
+	}
+
+	var errs []error
+
+	for _, provider := range pool.providers {
+		if provider.headroom == 0 {
+			continue
+		}
+
+		workload, err := provider.Provision(ctx, req)
+
+		w.audit(ctx, ports.AuditRecord{
+			Operation:  operationProvision,
+			Pool:       pool.Name(),
+			RunnerUUID: runner.UUID,
+			RunnerName: runner.Name,
+			Reason:     reason,
+			Request:    map[string]any{"provider": provider.name, "labels": runner.Labels},
+		}, err)
+
+		if err != nil {
+			provider.headroom = 0
+
+			w.logger.Warn("provider failed to place runner",
+				"pool", pool.Name(), "provider", provider.name, "runner", runner.UUID, "error", err)
+
+			errs = append(errs, fmt.Errorf("%s: %w", provider.name, err))
+
+			continue
+		}
+
+		if provider.headroom > 0 {
+			provider.headroom--
+		}
+
+		if workload == nil {
+			workload = &ports.Workload{CreatedAt: pool.now(), RunnerUUID: req.RunnerUUID, Pool: req.Pool}
+		}
+
+		workload.Provider = provider.name
+
+		return workload, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.New("no provider has room for the runner")
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// deleteRunner removes the registration of a drained runner, then tears down
+// its compute.
+func (w *Workspace) deleteRunner(ctx context.Context, pool *Pool, name, runnerUUID, reason string) error {
+	err := w.client.DeleteRunner(runnerUUID)
+
+	w.audit(ctx, ports.AuditRecord{
+		Operation:  operationDeleteRunner,
+		Pool:       pool.Name(),
+		RunnerUUID: runnerUUID,
+		RunnerName: name,
+		Reason:     reason,
+	}, err)
+
+	if err != nil {
+		w.transition(pool, name, lifecycle.StateFailed, err.Error())
+
+		return fmt.Errorf("failed to delete registration: %w", err)
+	}
+
+	w.transition(pool, name, lifecycle.StateDeprovisioning, "registration deleted")
+
+	return w.deprovision(ctx, pool, name, runnerUUID, reason)
+}
+
+// deprovision tears down the compute of a runner whose registration is gone,
+// with the provider that started it or, if that is not known, with every
+// provider of the pool.
+func (w *Workspace) deprovision(ctx context.Context, pool *Pool, name, runnerUUID, reason string) error {
+	key := bitbucketclient.NormalizeUUID(runnerUUID)
+
+	providers := pool.providers
+	if workload, ok := pool.workloads[key]; ok {
+		if i := slices.IndexFunc(providers, func(p *poolProvider) bool { return p.name == workload.Provider }); i >= 0 {
+			providers = providers[i : i+1]
+		}
+	}
+
+	var errs []error
+
+	for _, provider := range providers {
+		err := provider.Deprovision(ctx, key)
+
+		w.audit(ctx, ports.AuditRecord{
+			Operation:  operationDeprovision,
+			Pool:       pool.Name(),
+			RunnerUUID: runnerUUID,
+			RunnerName: name,
+			Reason:     reason,
+			Request:    map[string]any{"provider": provider.name},
+		}, err)
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		w.transition(pool, name, lifecycle.StateFailed, err.Error())
+
+		return fmt.Errorf("failed to deprovision runner: %w", err)
+	}
+
+	delete(pool.workloads, key)
+	w.transition(pool, name, lifecycle.StateDeleted, "compute removed")
+
+	return nil
+}
+
+// transition moves a runner of pool to another lifecycle state. The
+// autoscaler keeps working if the move is not allowed, as Bitbucket remains
+// the source of truth, but the surprise is logged.
+func (w *Workspace) transition(pool *Pool, name string, to lifecycle.State, reason string) {
+	if err := pool.lifecycle.Transition(name, to, reason); err != nil {
+		w.logger.Warn("unexpected runner transition", "pool", pool.Name(), "error", err)
+	}
+}
+
+// recordTransitions logs and counts the lifecycle transitions of pool since
+// the last reconcile.
+func (w *Workspace) recordTransitions(pool *Pool) {
+	for _, t := range pool.lifecycle.Drain() {
+		w.logger.Info("runner transition",
+			"pool", t.Pool, "runner", t.Runner, "runner_uuid", t.RunnerUUID,
+			"from", t.From, "to", t.To, "reason", t.Reason)
+
+		w.metrics.RunnerTransitions.WithLabelValues(w.name, t.Pool, string(t.From), string(t.To)).Inc()
+	}
+}
+
+func (w *Workspace) recordForecast(pool *Pool, status poolStatus, forecast float64) {
+	if pool.predictor == nil {
+		return
+	}
+
+	w.metrics.DemandForecast.WithLabelValues(w.name, pool.Name()).Set(forecast)
+	w.metrics.DemandActual.WithLabelValues(w.name, pool.Name()).Set(float64(status.busy))
+	w.metrics.DemandForecastError.WithLabelValues(w.name, pool.Name()).Set(pool.predictor.LastError())
+}
+
+func (w *Workspace) poolStatus(
+	pool *Pool, status poolStatus, bounds schedule.Bounds, desired, unschedulable int,
+) PoolStatus {
+	return PoolStatus{
+		UpdatedAt: pool.now(),
+		Workspace: w.name,
+		Pool:      pool.Name(),
+		Profile:   bounds.Profile,
+		Min:       bounds.Min,
+		Max:       bounds.Max,
+		Warm:      bounds.Warm,
+		Desired:   desired,
+		Runners:   len(status.runners),
+		Busy:      status.busy,
+
+		Unschedulable: unschedulable,
+	}
+}
+
+func (w *Workspace) recordStatus(pool *Pool, status poolStatus, bounds schedule.Bounds, desired, unschedulable int) {
+	w.mu.Lock()
+	previous := w.status[pool.Name()]
+	w.status[pool.Name()] = w.poolStatus(pool, status, bounds, desired, unschedulable)
+	w.mu.Unlock()
+
+	if unschedulable != previous.Unschedulable {
+		w.logger.Warn("unschedulable runners changed",
+			"pool", pool.Name(), "unschedulable", unschedulable, "desired", desired)
+	}
+
+	poolLabels := prometheus.Labels{"workspace": w.name, "pool": pool.Name()}
+
+	w.metrics.ActiveProfile.DeletePartialMatch(poolLabels)
+	w.metrics.ActiveProfile.WithLabelValues(w.name, pool.Name(), bounds.Profile).Set(1)
+	w.metrics.PoolBounds.WithLabelValues(w.name, pool.Name(), "min").Set(float64(bounds.Min))
+	w.metrics.PoolBounds.WithLabelValues(w.name, pool.Name(), "max").Set(float64(bounds.Max))
+	w.metrics.PoolBounds.WithLabelValues(w.name, pool.Name(), "warm").Set(float64(bounds.Warm))
+
+	w.metrics.Runners.DeletePartialMatch(poolLabels)
+
+	for i := range status.runners {
+		runner := &status.runners[i]
+
+		w.metrics.Runners.WithLabelValues(
+			w.name, pool.Name(), runner.State.Status, strconv.FormatBool(isBusy(runner)),
+		).Inc()
+	}
+
+	w.metrics.DesiredRunners.WithLabelValues(w.name, pool.Name()).Set(float64(desired))
+	w.metrics.UnschedulableRunners.WithLabelValues(w.name, pool.Name()).Set(float64(unschedulable))
+	w.metrics.LabelDrift.WithLabelValues(w.name, pool.Name()).Set(float64(len(status.drifted)))
+}
+
+// listRunners lists every runner of the workspace. A listing short of the
+// registered runners, such as one that changed while being paged through, is
+// an error: scaling on it would take unseen runners for gone.
+func (w *Workspace) listRunners() (*bitbucketclient.GetRunnersResponse, error) {
+	resp, err := w.client.GetRunners()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runners: %w", err)
+	}
+
+	if resp.Size > len(resp.Values) {
+		return nil, fmt.Errorf("failed to list runners: listed %d of %d", len(resp.Values), resp.Size)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,803 @@
+package autoscaler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/audit"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/client/bitbucketclient"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/lifecycle"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/predictor"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/statestore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWorkspaceReconcile(t *testing.T) {
+	const workspaceUUID = "{e2f9c256-1843-4fd6-8456-2f8a1d94f8b5}"
+
+	poolConfig := config.Pool{Name: "linux", Provider: "test", Labels: []string{"self.hosted"}, Min: 2, Max: 5, TargetUtilization: 1}
+
+	tables := []struct {
+		provider        func() *mocks.Provider
+		name            string
+		expectedError   string
+		runners         []bitbucketclient.Runner
+		expectedRunners int
+	}{
+		{
+			name: "scale up to min registers and provisions runners",
+			provider: func() *mocks.Provider {
+				m := mocks.Provider{}
+
+				m.On("Provision", mock.Anything, mock.MatchedBy(func(req ports.ProvisionRequest) bool {
+					return req.Workspace == "acme" && req.WorkspaceUUID == workspaceUUID &&
+						req.Pool == "linux" && req.OAuthClientSecret == "secret"
+				})).Return(&ports.Workload{}, nil).Twice()
+
+				return &m
+			},
+			expectedRunners: 2,
+		},
+		{
+			name: "scale down removes the offline runner and ignores foreign ones",
+			provider: func() *mocks.Provider {
+				m := mocks.Provider{}
+
+				m.On("Deprovision", mock.Anything, "{3}").Return(nil).Once()
+
+				return &m
+			},
+			runners: []bitbucketclient.Runner{
+				testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false),
+				testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, false),
+				testRunner("{3}", "linux-00000003", bitbucketclient.RunnerStatusOffline, false),
+				testRunner("{9}", "manual", bitbucketclient.RunnerStatusOnline, false),
+			},
+			expectedRunners: 2,
+		},
+		{
+			name: "provision failure removes the registration and backs off",
+			provider: func() *mocks.Provider {
+				m := mocks.Provider{}
+
+				m.On("Provision", mock.Anything, mock.Anything).Return((*ports.Workload)(nil), fmt.Errorf("no capacity")).Once()
+
+				return &m
+			},
+			expectedError:   "no capacity",
+			expectedRunners: 0,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			provider := table.provider()
+			client := newFakeRunnerClient(table.runners...)
+			client.uuid = workspaceUUID
+
+			w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{newTestPool(t, poolConfig, provider)}, testLogger(), testMetrics())
+
+			err := w.Reconcile(context.Background())
+
+			if table.expectedError != "" {
+				assert.ErrorContains(t, err, table.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// Runners drained by the first reconcile are deleted by the next.
+			assert.NoError(t, w.Reconcile(context.Background()))
+
+			owned := 0
+
+			for _, r := range client.list() {
+				if w.pools[0].Owns(&r) {
+					owned++
+				}
+			}
+
+			assert.Equal(t, table.expectedRunners, owned)
+
+			provider.AssertExpectations(t)
+		})
+	}
+}
+
+func TestWorkspaceReconcileIncompleteListing(t *testing.T) {
+	client := newFakeRunnerClient(
+		testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, true),
+		testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, true),
+	)
+	client.pagelen = 1
+
+	provider := &mocks.Provider{}
+	pool := newTestPool(t, config.Pool{Name: "linux", Provider: "test", Min: 3, Max: 3}, provider)
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), testMetrics())
+
+	// Scaling on part of the runners would take the others for gone.
+	assert.EqualError(t, w.Reconcile(context.Background()), "failed to list runners: listed 1 of 2")
+	assert.Equal(t, 0, client.called("PostRunner"))
+	assert.Equal(t, 0, client.called("DeleteRunner"))
+
+	_, err := w.Plan(context.Background())
+	assert.EqualError(t, err, "failed to list runners: listed 1 of 2")
+
+	provider.AssertExpectations(t)
+}
+
+func TestWorkspaceReconcileListError(t *testing.T) {
+	client := newFakeRunnerClient()
+	client.err = fmt.Errorf("failed to fetch runners, status: 401, body: {}")
+
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{newTestPool(t, config.Pool{Name: "linux", Max: 1}, nil)}, testLogger(), testMetrics())
+
+	assert.EqualError(t, w.Reconcile(context.Background()), "failed to list runners: failed to fetch runners, status: 401, body: {}")
+	assert.Equal(t, 0, client.called("PostRunner"))
+}
+
+func TestWorkspaceReconcilePatchesLabels(t *testing.T) {
+	runner := testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false)
+	runner.Labels = []string{"self.hosted", "linux"}
+
+	client := newFakeRunnerClient(runner)
+
+	pool := newTestPool(t, config.Pool{
+		Name:              "linux",
+		Labels:            []string{"self.hosted", "linux", "large"},
+		Min:               1,
+		Max:               1,
+		TargetUtilization: 1,
+		LabelDrift:        config.LabelDriftPatch,
+	}, nil)
+
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), testMetrics())
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, []string{"self.hosted", "linux", "large"}, client.list()[0].Labels)
+	assert.Equal(t, "linux-00000001", client.list()[0].Name)
+	assert.Equal(t, 0, client.called("PostRunner"))
+}
+
+func TestWorkspaceReconcileAppliesSchedule(t *testing.T) {
+	minRunners := 3
+
+	pool := newTestPool(t, config.Pool{
+		Name:              "linux",
+		Max:               5,
+		TargetUtilization: 1,
+		Schedule: &config.Schedule{
+			Timezone: "Europe/Rome",
+			Profiles: []config.Profile{{Name: "working-hours", Start: "0 8 * * MON-FRI", Duration: 11 * time.Hour, Min: &minRunners}},
+		},
+	}, nil)
+	pool.now = func() time.Time { return time.Date(2024, 12, 2, 9, 0, 0, 0, time.UTC) }
+
+	client := newFakeRunnerClient()
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), testMetrics())
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 3, client.called("PostRunner"))
+	assert.Equal(t, []PoolStatus{{
+		UpdatedAt: pool.now(),
+		Workspace: "acme",
+		Pool:      "linux",
+		Profile:   "working-hours",
+		Min:       3,
+		Max:       5,
+		Desired:   3,
+		Runners:   0,
+	}}, w.Status())
+	assert.InDelta(t, 1, testutil.ToFloat64(w.metrics.ActiveProfile.WithLabelValues("acme", "linux", "working-hours")), 0)
+}
+
+func TestWorkspaceReconcileEphemeral(t *testing.T) {
+	provider := &mocks.Provider{}
+	provider.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{}, nil).Twice()
+	provider.On("Deprovision", mock.Anything, "{00000000-0000-0000-0000-000000000001}").Return(nil).Once()
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Min: 1, Max: 2, TargetUtilization: 1, Ephemeral: true}, provider)
+	client := newFakeRunnerClient()
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), testMetrics())
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+
+	first := client.list()[0].UUID
+
+	// Idle before it was ever used: the runner is kept for its step.
+	client.setState(first, bitbucketclient.RunnerStatusOnline, false)
+	assert.NoError(t, w.Reconcile(context.Background()))
+
+	client.setState(first, bitbucketclient.RunnerStatusOnline, true)
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 1, client.called("PostRunner"))
+	assert.Equal(t, 0, client.called("DeleteRunner"))
+
+	// Step finished: the runner is drained and a fresh one takes its place.
+	client.setState(first, bitbucketclient.RunnerStatusOnline, false)
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 1, client.called("PutRunnerStatus"))
+	assert.Equal(t, 0, client.called("DeleteRunner"))
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+
+	runners := client.list()
+
+	assert.Equal(t, 2, client.called("PostRunner"))
+	assert.Equal(t, 1, client.called("DeleteRunner"))
+	assert.Len(t, runners, 1)
+	assert.NotEqual(t, first, runners[0].UUID)
+
+	provider.AssertExpectations(t)
+}
+
+func TestWorkspaceReconcileReplacesRunnerStuckProvisioning(t *testing.T) {
+	now := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	pool := newTestPool(t, config.Pool{
+		Name:              "linux",
+		Min:               1,
+		Max:               1,
+		TargetUtilization: 1,
+		Timeouts:          config.Timeouts{Provisioning: 10 * time.Minute},
+	}, nil)
+	pool.now = func() time.Time { return now }
+
+	client := newFakeRunnerClient()
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), testMetrics())
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+
+	stuck := client.list()[0]
+
+	now = now.Add(11 * time.Minute)
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 2, client.called("PostRunner"))
+	assert.Equal(t, 1, client.called("DeleteRunner"))
+
+	var states []lifecycle.State
+
+	for _, runner := range w.Runners() {
+		if runner.Name == stuck.Name {
+			for _, transition := range runner.History {
+				states = append(states, transition.To)
+			}
+		}
+	}
+
+	assert.Equal(t, []lifecycle.State{
+		lifecycle.StateRequested,
+		lifecycle.StateRegistering,
+		lifecycle.StateProvisioning,
+		lifecycle.StateFailed,
+		lifecycle.StateDraining,
+		lifecycle.StateDeprovisioning,
+		lifecycle.StateDeleted,
+	}, states)
+	assert.InDelta(t, 1, testutil.ToFloat64(w.metrics.RunnerTransitions.WithLabelValues("acme", "linux", "provisioning", "failed")), 0)
+}
+
+func TestWorkspaceReconcileDrains(t *testing.T) {
+	now := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	pool := newTestPool(t, config.Pool{
+		Name: "linux", Max: 2, TargetUtilization: 1, Timeouts: config.Timeouts{Draining: 5 * time.Minute},
+	}, nil)
+	pool.now = func() time.Time { return now }
+
+	client := newFakeRunnerClient(
+		testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false),
+		testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, false),
+	)
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), testMetrics())
+
+	// Scaling down disables both runners and deletes neither yet.
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 2, client.called("PutRunnerStatus"))
+	assert.Equal(t, 0, client.called("DeleteRunner"))
+
+	// One picked up a step before it was disabled: it keeps it.
+	client.setState("{1}", bitbucketclient.RunnerStatusDisabled, true)
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 1, client.called("DeleteRunner"))
+
+	record, _ := pool.lifecycle.Find("{1}")
+	assert.Equal(t, lifecycle.StateDraining, record.State)
+
+	// Past the draining timeout it goes anyway.
+	now = now.Add(6 * time.Minute)
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 2, client.called("DeleteRunner"))
+	assert.Equal(t, 0, client.called("PostRunner"))
+
+	record, _ = pool.lifecycle.Find("{1}")
+	assert.Equal(t, lifecycle.StateDeleted, record.State)
+}
+
+func TestWorkspaceReconcileResumesAfterRestart(t *testing.T) {
+	store := statestore.NewMemory()
+	client := newFakeRunnerClient()
+	poolConfig := config.Pool{Name: "linux", Provider: "test", Min: 3, Max: 3, TargetUtilization: 1}
+
+	provider := &mocks.Provider{}
+	provider.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{ID: "i-1", Provider: "test"}, nil).Times(3)
+
+	before := newTestPool(t, poolConfig, provider)
+	w := NewWorkspace("acme", client, store, testAuditor(), []*Pool{before}, testLogger(), testMetrics())
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+
+	runners := client.list()
+	draining, deprovisioning, busy := runners[0], runners[1], runners[2]
+
+	// The previous run stopped halfway through removing the runners: one
+	// still registered, one with only its compute left, and one that picked
+	// up a step since.
+	assert.NoError(t, before.lifecycle.Transition(draining.Name, lifecycle.StateDraining, "scale down"))
+	assert.NoError(t, before.lifecycle.Transition(busy.Name, lifecycle.StateDraining, "scale down"))
+	client.setState(busy.UUID, bitbucketclient.RunnerStatusOnline, true)
+	assert.NoError(t, before.lifecycle.Transition(deprovisioning.Name, lifecycle.StateDraining, "scale down"))
+	assert.NoError(t, client.DeleteRunner(deprovisioning.UUID))
+	assert.NoError(t, before.lifecycle.Transition(deprovisioning.Name, lifecycle.StateDeprovisioning, "registration deleted"))
+	w.save(before)
+
+	provider = &mocks.Provider{}
+	provider.On("Deprovision", mock.Anything, bitbucketclient.NormalizeUUID(draining.UUID)).Return(nil).Once()
+	provider.On("Deprovision", mock.Anything, bitbucketclient.NormalizeUUID(deprovisioning.UUID)).Return(nil).Once()
+	provider.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{ID: "i-2", Provider: "test"}, nil).Twice()
+
+	after := newTestPool(t, poolConfig, provider)
+	w = NewWorkspace("acme", client, store, testAuditor(), []*Pool{after}, testLogger(), testMetrics())
+
+	// The runner left draining is disabled, then deleted once seen idle.
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.NoError(t, w.Reconcile(context.Background()))
+
+	for _, name := range []string{draining.Name, deprovisioning.Name} {
+		record, ok := after.lifecycle.Get(name)
+
+		assert.True(t, ok)
+		assert.Equal(t, lifecycle.StateDeleted, record.State)
+	}
+
+	record, ok := after.lifecycle.Get(busy.Name)
+	assert.True(t, ok)
+	assert.Equal(t, lifecycle.StateOnline, record.State)
+
+	assert.Len(t, client.list(), 3)
+	assert.Len(t, after.workloads, 3)
+	provider.AssertExpectations(t)
+}
+
+func TestWorkspaceRestoresDemand(t *testing.T) {
+	monday := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+	store := statestore.NewMemory()
+	poolConfig := config.Pool{Name: "linux", Max: 10, Prediction: &config.Prediction{Lead: 15 * time.Minute, Alpha: 0.5}}
+
+	// Last Monday the 08:00 hour peaked at 6 busy runners.
+	before := newTestPool(t, poolConfig, nil)
+	before.predictor = predictor.Replay(0.5, time.UTC, []predictor.Sample{{Hour: monday.Add(-7 * 24 * time.Hour), Demand: 6}})
+
+	w := NewWorkspace("acme", newFakeRunnerClient(), store, testAuditor(), []*Pool{before}, testLogger(), testMetrics())
+	w.save(before)
+
+	after := newTestPool(t, poolConfig, nil)
+	after.now = func() time.Time { return monday.Add(-10 * time.Minute) }
+
+	w = NewWorkspace("acme", newFakeRunnerClient(), store, testAuditor(), []*Pool{after}, testLogger(), testMetrics())
+
+	found, err := w.load()
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, before.predictor.History(), after.predictor.History())
+	assert.InDelta(t, 6, after.forecast(poolStatus{busy: 0}), 0)
+}
+
+func TestWorkspaceReconcileAudits(t *testing.T) {
+	var records []ports.AuditRecord
+
+	auditor := &mocks.Auditor{}
+	auditor.On("Record", mock.Anything).Run(func(args mock.Arguments) {
+		records = append(records, args.Get(0).(ports.AuditRecord))
+	}).Return(nil)
+
+	provider := &mocks.Provider{}
+	provider.On("Provision", mock.Anything, mock.Anything).Return((*ports.Workload)(nil), fmt.Errorf("no capacity")).Once()
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Provider: "test", Labels: []string{"linux"}, Min: 1, Max: 1, TargetUtilization: 1}, provider)
+	client := newFakeRunnerClient()
+	w := NewWorkspace("acme", client, statestore.NewMemory(), auditor, []*Pool{pool}, testLogger(), testMetrics())
+
+	assert.ErrorContains(t, w.Reconcile(audit.WithActor(context.Background(), "cli:alice")), "no capacity")
+
+	tables := []struct {
+		operation       string
+		reason          string
+		expectedOutcome string
+	}{
+		{operation: "bitbucket.post_runner", reason: "scale up", expectedOutcome: "success"},
+		{operation: "provider.provision", reason: "scale up", expectedOutcome: "error"},
+		{operation: "bitbucket.delete_runner", reason: "provisioning failed", expectedOutcome: "success"},
+	}
+
+	assert.Len(t, records, len(tables))
+
+	for i, table := range tables {
+		record := records[i]
+
+		assert.Equal(t, table.operation, record.Operation)
+		assert.Equal(t, table.reason, record.Reason)
+		assert.Equal(t, table.expectedOutcome, record.Outcome)
+		assert.Equal(t, "cli:alice", record.Actor)
+		assert.Equal(t, "acme", record.Workspace)
+		assert.Equal(t, "linux", record.Pool)
+		assert.Equal(t, "{00000000-0000-0000-0000-000000000001}", record.RunnerUUID)
+	}
+
+	assert.Equal(t, "no capacity", records[1].Error)
+	assert.Equal(t, []string{"linux"}, records[0].Request["labels"])
+}
+
+func TestWorkspaceReconcileInterruptions(t *testing.T) {
+	provider := &mocks.InterruptibleProvider{}
+	provider.On("Interruptions", mock.Anything).Return([]ports.Interruption{
+		{RunnerUUID: "{1}", WorkloadID: "i-1", Kind: ports.InterruptionTermination},
+		{RunnerUUID: "{2}", WorkloadID: "i-2", Kind: ports.InterruptionRebalance},
+		{RunnerUUID: "{9}", WorkloadID: "i-9", Kind: ports.InterruptionTermination},
+	}, nil)
+	provider.On("AckInterruptions", mock.Anything, mock.Anything).Return(nil)
+	provider.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{}, nil).Twice()
+	provider.On("Deprovision", mock.Anything, "{2}").Return(nil).Once()
+	provider.On("Deprovision", mock.Anything, "{1}").Return(nil).Once()
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Provider: "test", Min: 2, Max: 5, TargetUtilization: 1}, provider)
+	client := newFakeRunnerClient(
+		testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, true),
+		testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, false),
+		testRunner("{9}", "manual", bitbucketclient.RunnerStatusOnline, false),
+	)
+	m := testMetrics()
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), m)
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+
+	// Both interrupted runners are cordoned and replaced at once. The idle
+	// one is drained, the busy one is left to finish its step.
+	assert.Equal(t, 2, client.called("PutRunnerStatus"))
+	assert.Equal(t, 2, client.called("PostRunner"))
+	assert.Equal(t, 0, client.called("DeleteRunner"))
+
+	runner, _ := client.GetRunner("{1}")
+	assert.Equal(t, bitbucketclient.RunnerStatusDisabled, runner.State.Status)
+
+	record, _ := pool.lifecycle.Find("{1}")
+	assert.Equal(t, lifecycle.StateFailed, record.State)
+	assert.Equal(t, "compute interrupted (termination)", record.Reason)
+
+	assert.InDelta(t, 1, testutil.ToFloat64(m.Interruptions.WithLabelValues("acme", "linux", "termination")), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(m.Interruptions.WithLabelValues("acme", "linux", "rebalance")), 0)
+
+	// The notices of the pool are acknowledged once saved.
+	provider.AssertCalled(t, "AckInterruptions", mock.Anything, []ports.Interruption{
+		{RunnerUUID: "{1}", WorkloadID: "i-1", Kind: ports.InterruptionTermination},
+		{RunnerUUID: "{2}", WorkloadID: "i-2", Kind: ports.InterruptionRebalance},
+	})
+
+	// Notices are repeated until the runner is gone, but handled once.
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 2, client.called("PutRunnerStatus"))
+	assert.Equal(t, 2, client.called("PostRunner"))
+	assert.Equal(t, 1, client.called("DeleteRunner"))
+
+	client.setState("{1}", bitbucketclient.RunnerStatusOffline, false)
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.NoError(t, w.Reconcile(context.Background()))
+
+	assert.Equal(t, 2, client.called("DeleteRunner"))
+	assert.Equal(t, 2, client.called("PostRunner"))
+	provider.AssertExpectations(t)
+}
+
+func TestWorkspaceReconcileRetriesCordon(t *testing.T) {
+	provider := &mocks.InterruptibleProvider{}
+	provider.On("Interruptions", mock.Anything).Return([]ports.Interruption{
+		{RunnerUUID: "{1}", WorkloadID: "i-1", Kind: ports.InterruptionTermination},
+	}, nil)
+	provider.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{}, nil).Once()
+	provider.On("Deprovision", mock.Anything, "{1}").Return(nil).Once()
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Provider: "test", Min: 1, Max: 5, TargetUtilization: 1}, provider)
+	client := newFakeRunnerClient(testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false))
+	client.putErr = fmt.Errorf("failed to update runner status, status: 500, body: {}")
+	m := testMetrics()
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), m)
+
+	// A runner that could not be cordoned keeps its place in the pool, and
+	// its notice is not acknowledged.
+	assert.ErrorContains(t, w.Reconcile(context.Background()), "failed to cordon runner {1}")
+	assert.Empty(t, pool.interrupted)
+	provider.AssertNotCalled(t, "AckInterruptions", mock.Anything, mock.Anything)
+	assert.Zero(t, client.called("PostRunner"))
+	assert.Zero(t, client.called("DeleteRunner"))
+	assert.Zero(t, testutil.ToFloat64(m.Interruptions.WithLabelValues("acme", "linux", "termination")))
+
+	client.putErr = nil
+
+	provider.On("AckInterruptions", mock.Anything, mock.Anything).Return(nil)
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 2, client.called("PutRunnerStatus"))
+	assert.Equal(t, 1, client.called("PostRunner"))
+	assert.Equal(t, 1, client.called("DeleteRunner"))
+	assert.InDelta(t, 1, testutil.ToFloat64(m.Interruptions.WithLabelValues("acme", "linux", "termination")), 0)
+	provider.AssertExpectations(t)
+}
+
+func TestWorkspaceReconcileCapacity(t *testing.T) {
+	now := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	provider := &mocks.LimitedProvider{}
+	provider.On("Capacity", mock.Anything).Return(1, nil).Once()
+	provider.On("Capacity", mock.Anything).Return(2, nil)
+	provider.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{}, nil).Once()
+	provider.On("Provision", mock.Anything, mock.Anything).Return((*ports.Workload)(nil), fmt.Errorf("quota exceeded")).Once()
+	provider.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{}, nil).Twice()
+
+	pool := newTestPool(t, config.Pool{Name: "linux", Provider: "test", Min: 3, Max: 5, TargetUtilization: 1}, provider)
+	pool.now = func() time.Time { return now }
+
+	client := newFakeRunnerClient()
+	m := testMetrics()
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), m)
+
+	// Only as many runners are registered as the provider can place, and
+	// the rest of the demand is reported.
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 1, client.called("PostRunner"))
+	assert.Equal(t, 2, w.Status()[0].Unschedulable)
+	assert.InDelta(t, 2, testutil.ToFloat64(m.UnschedulableRunners.WithLabelValues("acme", "linux")), 0)
+
+	// A placement failure stops the other creations of the reconcile.
+	assert.ErrorContains(t, w.Reconcile(context.Background()), "quota exceeded")
+	assert.Equal(t, 2, client.called("PostRunner"))
+	assert.Equal(t, 1, client.called("DeleteRunner"))
+
+	// The pool backs off without asking the provider.
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 2, client.called("PostRunner"))
+	assert.Equal(t, 2, w.Status()[0].Unschedulable)
+	provider.AssertNumberOfCalls(t, "Capacity", 2)
+
+	now = now.Add(placementBackoff)
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 4, client.called("PostRunner"))
+	assert.Zero(t, w.Status()[0].Unschedulable)
+	provider.AssertExpectations(t)
+}
+
+func TestWorkspaceReconcileSharedCapacity(t *testing.T) {
+	placing := make(chan struct{})
+	placed := make(chan struct{})
+
+	// The provider has room for two runners and only reports them taken
+	// once they are placed.
+	provider := &mocks.LimitedProvider{}
+	provider.On("Capacity", mock.Anything).Return(2, nil)
+	provider.On("Provision", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		placing <- struct{}{}
+		<-placed
+	}).Return(&ports.Workload{}, nil).Twice()
+
+	poolConfig := config.Pool{Name: "linux", Provider: "test", Min: 2, Max: 2, TargetUtilization: 1}
+	first := newFakeRunnerClient()
+	second := newFakeRunnerClient()
+	workspaces := []*Workspace{
+		NewWorkspace("acme", first, statestore.NewMemory(), testAuditor(),
+			[]*Pool{newTestPool(t, poolConfig, provider)}, testLogger(), testMetrics()),
+		NewWorkspace("globex", second, statestore.NewMemory(), testAuditor(),
+			[]*Pool{newTestPool(t, poolConfig, provider)}, testLogger(), testMetrics()),
+	}
+	NewManager(workspaces, time.Minute, testLogger(), testMetrics())
+
+	done := make(chan error)
+
+	go func() { done <- workspaces[0].Reconcile(context.Background()) }()
+
+	<-placing
+
+	// While the first workspace places its runners, the capacity it claimed
+	// is not counted on by the other.
+	assert.NoError(t, workspaces[1].Reconcile(context.Background()))
+	assert.Zero(t, second.called("PostRunner"))
+	assert.Equal(t, 2, workspaces[1].Status()[0].Unschedulable)
+
+	placed <- struct{}{}
+	<-placing
+	placed <- struct{}{}
+
+	assert.NoError(t, <-done)
+	assert.Equal(t, 2, first.called("PostRunner"))
+	assert.Empty(t, workspaces[0].ledger.claimed)
+	provider.AssertExpectations(t)
+}
+
+func TestWorkspaceReconcileFallback(t *testing.T) {
+	poolConfig := config.Pool{
+		Name:              "linux",
+		Providers:         []config.PoolProvider{{Name: "k8s"}, {Name: "spot"}, {Name: "on-demand"}},
+		Min:               4,
+		Max:               5,
+		TargetUtilization: 1,
+	}
+
+	// The cluster has room for one runner, spot capacity fails and on-demand
+	// takes the rest.
+	k8s := &mocks.LimitedProvider{}
+	k8s.On("Capacity", mock.Anything).Return(1, nil)
+	k8s.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{ID: "pod"}, nil).Once()
+
+	spot := &mocks.Provider{}
+	spot.On("Provision", mock.Anything, mock.Anything).
+		Return((*ports.Workload)(nil), fmt.Errorf("InsufficientInstanceCapacity")).Once()
+
+	onDemand := &mocks.Provider{}
+	onDemand.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{ID: "i-1"}, nil).Times(3)
+
+	pool, err := NewPool(poolConfig, k8s, spot, onDemand)
+	assert.NoError(t, err)
+
+	client := newFakeRunnerClient()
+	w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), testMetrics())
+
+	assert.NoError(t, w.Reconcile(context.Background()))
+	assert.Equal(t, 4, client.called("PostRunner"))
+	assert.Zero(t, client.called("DeleteRunner"))
+
+	placed := map[string]int{}
+
+	for _, runner := range pool.lifecycle.Runners() {
+		placed[runner.Provider]++
+		assert.Equal(t, runner.Provider, pool.workloads[runner.UUID].Provider)
+	}
+
+	assert.Equal(t, map[string]int{"k8s": 1, "on-demand": 3}, placed)
+
+	// Compute is torn down by the provider that started it, or by every
+	// provider when that is not known.
+	runner, _ := pool.lifecycle.Find("{00000000-0000-0000-0000-000000000001}")
+	k8s.On("Deprovision", mock.Anything, runner.UUID).Return(nil).Once()
+	assert.NoError(t, w.deprovision(context.Background(), pool, runner.Name, runner.UUID, "test"))
+
+	for _, provider := range []*mocks.Provider{&k8s.Provider, spot, onDemand} {
+		provider.On("Deprovision", mock.Anything, "{9}").Return(nil).Once()
+	}
+
+	assert.NoError(t, w.deprovision(context.Background(), pool, "linux-00000009", "{9}", "test"))
+
+	k8s.AssertExpectations(t)
+	spot.AssertExpectations(t)
+	onDemand.AssertExpectations(t)
+}
+
+func TestWorkspaceReconcileConsistency(t *testing.T) {
+	now := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	runners := []bitbucketclient.Runner{
+		testRunner("{1}", "linux-00000001", bitbucketclient.RunnerStatusOnline, false),
+		testRunner("{2}", "linux-00000002", bitbucketclient.RunnerStatusOnline, false),
+		testRunner("{3}", "linux-00000003", bitbucketclient.RunnerStatusOffline, false),
+		testRunner("{4}", "linux-00000004", bitbucketclient.RunnerStatusOnline, true),
+		testRunner("{9}", "manual", bitbucketclient.RunnerStatusOnline, false),
+	}
+
+	// {2} and the busy {4} have no compute, {7} has no registration and {8}
+	// is too young to tell.
+	workloads := []ports.Workload{
+		{RunnerUUID: "{1}", ID: "i-1", CreatedAt: now.Add(-time.Hour)},
+		{RunnerUUID: "{3}", ID: "i-3", CreatedAt: now.Add(-time.Hour)},
+		{RunnerUUID: "{7}", ID: "i-7", CreatedAt: now.Add(-time.Hour)},
+		{RunnerUUID: "{8}", ID: "i-8", CreatedAt: now.Add(-time.Minute)},
+	}
+
+	tables := []struct {
+		provider          func(m *mocks.ListingProvider)
+		expectedActions   map[string]string
+		name              string
+		consistency       config.Consistency
+		expectedDeletes   int
+		expectedPostCalls int
+	}{
+		{
+			name: "default actions",
+			consistency: config.Consistency{
+				Unbacked: config.ConsistencyReprovision,
+				Orphaned: config.ConsistencyDestroyWorkload,
+				Offline:  config.ConsistencyReprovision,
+			},
+			// Reprovisioned runners are replaced at once and drained.
+			provider: func(m *mocks.ListingProvider) {
+				m.On("Deprovision", mock.Anything, "{7}").Return(nil).Once()
+				m.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{}, nil).Twice()
+			},
+			expectedActions: map[string]string{
+				classUnbacked: config.ConsistencyReprovision,
+				classOrphaned: config.ConsistencyDestroyWorkload,
+				classOffline:  config.ConsistencyReprovision,
+			},
+			expectedDeletes:   0,
+			expectedPostCalls: 2,
+		},
+		{
+			name: "delete registrations and ignore the rest",
+			consistency: config.Consistency{
+				Unbacked: config.ConsistencyDeleteRegistration,
+				Orphaned: config.ConsistencyIgnore,
+				Offline:  config.ConsistencyIgnore,
+			},
+			provider: func(m *mocks.ListingProvider) {
+				m.On("Provision", mock.Anything, mock.Anything).Return(&ports.Workload{}, nil).Once()
+			},
+			expectedActions: map[string]string{
+				classUnbacked: config.ConsistencyDeleteRegistration,
+			},
+			expectedDeletes:   1,
+			expectedPostCalls: 1,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			consistency := table.consistency
+			consistency.Grace = 15 * time.Minute
+			consistency.OfflineAfter = 30 * time.Minute
+
+			provider := &mocks.ListingProvider{}
+			provider.On("Workloads", mock.Anything, "acme", "linux").Return(workloads, nil)
+			table.provider(provider)
+
+			pool := newTestPool(t, config.Pool{
+				Name: "linux", Provider: "test", Min: 4, Max: 5, TargetUtilization: 1, Consistency: &consistency,
+			}, provider)
+			pool.now = func() time.Time { return now }
+
+			client := newFakeRunnerClient(runners...)
+			m := testMetrics()
+			w := NewWorkspace("acme", client, statestore.NewMemory(), testAuditor(), []*Pool{pool}, testLogger(), m)
+
+			assert.NoError(t, w.Reconcile(context.Background()))
+			assert.Equal(t, table.expectedDeletes, client.called("DeleteRunner"))
+			assert.Equal(t, table.expectedPostCalls, client.called("PostRunner"))
+
+			for _, class := range []string{classUnbacked, classOrphaned, classOffline} {
+				assert.InDelta(t, 1, testutil.ToFloat64(m.ConsistencyMismatches.WithLabelValues("acme", "linux", class)), 0)
+
+				action, ok := table.expectedActions[class]
+				if !ok {
+					continue
+				}
+
+				assert.InDelta(t, 1, testutil.ToFloat64(
+					m.ConsistencyActions.WithLabelValues("acme", "linux", class, action, "success"),
+				), 0, class)
+			}
+
+			// The busy runner is left alone although nothing backs it.
+			_, err := client.GetRunner("{4}")
+			assert.NoError(t, err)
+
+			provider.AssertExpectations(t)
+		})
+	}
+}
@@ -7,8 +7,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
@@ -19,18 +23,36 @@ const (
 	DeleteRunnerPath                string = "/internal/workspaces/%s/pipelines-config/runners/%s"
 	PostRunnerPath                  string = "/internal/workspaces/%s/pipelines-config/runners"
 	PutRunnerStatusPath             string = "/internal/workspaces/%s/pipelines-config/runners/%s/state"
+	PutRunnerPath                   string = "/internal/workspaces/%s/pipelines-config/runners/%s"
 	contentTypeApplicationJSON      string = "application/json"
 	Pagelen                         int    = 100
+	// maxRunnerPages stops following a listing that does not end.
+	maxRunnerPages int = 100
+	// RequestTimeout bounds every request, so that a hung connection cannot
+	// hold a reconcile past its interval.
+	RequestTimeout time.Duration = 30 * time.Second
 )
 
 type BitbucketClient struct {
-	client        ports.HTTPClient
+	client ports.HTTPClient
+	// resolver looks up slug until workspaceUUID is known.
+	resolver      *WorkspaceResolver
 	baseURL       string
+	slug          string
 	workspaceUUID string
+	mu            sync.Mutex
 	// TODO: add logger
 }
 
 func NewBitbucketClient(workspaceUUID, baseURL, accessTokenURL, clientID, clientSecret string) *BitbucketClient {
+	return New(NewOAuthHTTPClient(accessTokenURL, clientID, clientSecret), baseURL, workspaceUUID)
+}
+
+// NewOAuthHTTPClient returns an HTTP client authenticated with the OAuth
+// client credentials flow. Every workspace should get its own client so that
+// tokens are never shared between workspaces. Requests, token requests
+// included, give up after RequestTimeout.
+func NewOAuthHTTPClient(accessTokenURL, clientID, clientSecret string) *http.Client {
 	config := &clientcredentials.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
@@ -38,23 +60,125 @@ func NewBitbucketClient(workspaceUUID, baseURL, accessTokenURL, clientID, client
 		Scopes:       []string{},
 	}
 
-	client := config.Client(context.Background())
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: RequestTimeout})
+
+	client := config.Client(ctx)
+	client.Timeout = RequestTimeout
 
-	return New(client, baseURL, workspaceUUID)
+	return client
 }
 
 func New(client ports.HTTPClient, baseURL, workspaceUUID string) *BitbucketClient {
 	return &BitbucketClient{
 		client:        client,
 		baseURL:       baseURL,
-		workspaceUUID: workspaceUUID,
+		workspaceUUID: pathUUID(workspaceUUID),
+	}
+}
+
+// NewForWorkspace returns a client for workspace, given by slug or UUID. A
+// slug is looked up on first use rather than here, and again after a failed
+// lookup, so that an unreachable API only fails the calls made meanwhile.
+func NewForWorkspace(client ports.HTTPClient, baseURL, workspace string) *BitbucketClient {
+	if IsUUID(workspace) {
+		return New(client, baseURL, workspace)
+	}
+
+	return &BitbucketClient{
+		client:   client,
+		resolver: NewWorkspaceResolver(client, baseURL),
+		baseURL:  baseURL,
+		slug:     workspace,
+	}
+}
+
+// WorkspaceUUID returns the normalised UUID of the workspace.
+func (c *BitbucketClient) WorkspaceUUID() (string, error) {
+	workspaceUUID, err := c.workspace()
+	if err != nil {
+		return "", err
+	}
+
+	return NormalizeUUID(workspaceUUID), nil
+}
+
+// workspace returns the UUID of the workspace as used in paths, looking up
+// the slug if it is not known yet.
+func (c *BitbucketClient) workspace() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.workspaceUUID == "" {
+		workspaceUUID, err := c.resolver.Resolve(c.slug)
+		if err != nil {
+			return "", err
+		}
+
+		c.workspaceUUID = pathUUID(workspaceUUID)
+	}
+
+	return c.workspaceUUID, nil
+}
+
+// GetRunners lists every runner of the workspace, following the pages of
+// the listing. Runners moving between pages while they are read are only
+// listed once.
+func (c *BitbucketClient) GetRunners() (*GetRunnersResponse, error) {
+	workspaceUUID, err := c.workspace()
+	if err != nil {
+		return nil, err
 	}
+
+	url := c.baseURL + fmt.Sprintf(GetRunnersPath, workspaceUUID, Pagelen)
+
+	var response *GetRunnersResponse
+
+	seen := map[string]struct{}{}
+
+	for pages := 0; url != ""; pages++ {
+		if pages == maxRunnerPages {
+			return nil, fmt.Errorf("failed to fetch runners: more than %d pages", maxRunnerPages)
+		}
+
+		page, err := c.getRunnersPage(url)
+		if err != nil {
+			return nil, err
+		}
+
+		// The token is sent along, so only pages of the same API are
+		// followed.
+		if page.Next != "" && !strings.HasPrefix(page.Next, c.baseURL+"/") {
+			return nil, fmt.Errorf("failed to fetch runners: unexpected next page %s", page.Next)
+		}
+
+		url = page.Next
+
+		values := page.Values
+		if response == nil {
+			response = page
+			response.Values = nil
+		}
+
+		for _, runner := range values {
+			if _, ok := seen[runner.UUID]; ok {
+				continue
+			}
+
+			seen[runner.UUID] = struct{}{}
+			response.Values = append(response.Values, runner)
+		}
+
+		response.Size = page.Size
+	}
+
+	response.Next = ""
+
+	return response, nil
 }
 
-func (c *BitbucketClient) GetRunners() (response *GetRunnersResponse, err error) {
-	resp, err := c.client.Get(c.baseURL + fmt.Sprintf(GetRunnersPath, c.workspaceUUID, Pagelen))
+func (c *BitbucketClient) getRunnersPage(url string) (*GetRunnersResponse, error) {
+	resp, err := c.client.Get(url)
 	if err != nil {
-		// TODO: log error
 		return nil, err
 	}
 
@@ -62,25 +186,29 @@ func (c *BitbucketClient) GetRunners() (response *GetRunnersResponse, err error)
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		// TODO: Error reading response body: err
-		return
+		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to fetch runners, status: %d, body: %s", resp.StatusCode, string(body))
 	}
 
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		// TODO: log Error unmarshalling response: err
-		return
+	var response GetRunnersResponse
+
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
 	}
 
-	return
+	return &response, nil
 }
 
 func (c *BitbucketClient) GetRunner(runnerUUID string) (*Runner, error) {
-	url := c.baseURL + fmt.Sprintf(GetRunnerPath, c.workspaceUUID, runnerUUID)
+	workspaceUUID, err := c.workspace()
+	if err != nil {
+		return nil, err
+	}
+
+	url := c.baseURL + fmt.Sprintf(GetRunnerPath, workspaceUUID, pathUUID(runnerUUID))
 
 	resp, err := c.client.Get(url)
 	if err != nil {
@@ -107,7 +235,12 @@ func (c *BitbucketClient) GetRunner(runnerUUID string) (*Runner, error) {
 }
 
 func (c *BitbucketClient) DeleteRunner(runnerUUID string) (err error) {
-	url := c.baseURL + fmt.Sprintf(DeleteRunnerPath, c.workspaceUUID, runnerUUID)
+	workspaceUUID, err := c.workspace()
+	if err != nil {
+		return err
+	}
+
+	url := c.baseURL + fmt.Sprintf(DeleteRunnerPath, workspaceUUID, pathUUID(runnerUUID))
 
 	req, _ := http.NewRequest(http.MethodDelete, url, nil)
 
@@ -127,7 +260,12 @@ func (c *BitbucketClient) DeleteRunner(runnerUUID string) (err error) {
 }
 
 func (c *BitbucketClient) PostRunner(requestBody PostRunnerRequest) (*Runner, error) {
-	url := c.baseURL + fmt.Sprintf(PostRunnerPath, c.workspaceUUID)
+	workspaceUUID, err := c.workspace()
+	if err != nil {
+		return nil, err
+	}
+
+	url := c.baseURL + fmt.Sprintf(PostRunnerPath, workspaceUUID)
 
 	bodyBytes, _ := json.Marshal(requestBody)
 
@@ -155,7 +293,12 @@ func (c *BitbucketClient) PostRunner(requestBody PostRunnerRequest) (*Runner, er
 }
 
 func (c *BitbucketClient) PutRunnerStatus(runnerUUID, newStatus string) error {
-	url := c.baseURL + fmt.Sprintf(PutRunnerStatusPath, c.workspaceUUID, runnerUUID)
+	workspaceUUID, err := c.workspace()
+	if err != nil {
+		return err
+	}
+
+	url := c.baseURL + fmt.Sprintf(PutRunnerStatusPath, workspaceUUID, pathUUID(runnerUUID))
 
 	requestBody := PutRunnerStatus{
 		Status: newStatus,
@@ -179,3 +322,40 @@ func (c *BitbucketClient) PutRunnerStatus(runnerUUID, newStatus string) error {
 
 	return nil
 }
+
+// UpdateRunner changes the name and labels of an existing runner.
+func (c *BitbucketClient) UpdateRunner(runnerUUID string, requestBody UpdateRunnerRequest) (*Runner, error) {
+	workspaceUUID, err := c.workspace()
+	if err != nil {
+		return nil, err
+	}
+
+	url := c.baseURL + fmt.Sprintf(PutRunnerPath, workspaceUUID, pathUUID(runnerUUID))
+
+	bodyBytes, _ := json.Marshal(requestBody)
+
+	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(bodyBytes))
+	req.Header.Set("Content-Type", contentTypeApplicationJSON)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to update runner, status: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var runner Runner
+	if err := json.Unmarshal(body, &runner); err != nil {
+		return nil, fmt.Errorf("error unmarshalling PUT runner response: %s", err.Error())
+	}
+
+	return &runner, nil
+}
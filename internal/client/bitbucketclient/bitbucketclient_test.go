@@ -168,6 +168,152 @@ func TestGetRunners(t *testing.T) {
 	}
 }
 
+func TestGetRunnersPages(t *testing.T) {
+	const (
+		baseURL       = "https://baseurl.com"
+		workspaceUUID = "e2f9c256-1843-4fd6-8456-2f8a1d94f8b5"
+	)
+
+	first := fmt.Sprintf("%s/internal/workspaces/%s/pipelines-config/runners?pagelen=%d", baseURL, workspaceUUID, Pagelen)
+	second := first + "&page=2"
+
+	page := func(body string) *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	tables := []struct {
+		client        func() *mocks.HTTPClient
+		name          string
+		expectedError string
+		expectedUUIDs []string
+	}{
+		{
+			name: "pages are followed",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", first).Return(page(`{"page":1,"size":3,"pagelen":2,"next":"`+second+`",`+
+					`"values":[{"uuid":"{1}"},{"uuid":"{2}"}]}`), nil).Once()
+				// {2} moved to the second page while the first was read.
+				m.On("Get", second).Return(page(`{"page":2,"size":3,"pagelen":2,`+
+					`"values":[{"uuid":"{2}"},{"uuid":"{3}"}]}`), nil).Once()
+
+				return &m
+			},
+			expectedUUIDs: []string{"{1}", "{2}", "{3}"},
+		},
+		{
+			name: "next page elsewhere",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", first).Return(page(`{"page":1,"size":3,"pagelen":2,"next":"https://evil.example/runners",`+
+					`"values":[{"uuid":"{1}"}]}`), nil).Once()
+
+				return &m
+			},
+			expectedError: "failed to fetch runners: unexpected next page https://evil.example/runners",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			httpClient := table.client()
+
+			resp, err := New(httpClient, baseURL, workspaceUUID).GetRunners()
+
+			httpClient.AssertExpectations(t)
+
+			if table.expectedError != "" {
+				assert.EqualError(t, err, table.expectedError)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, 3, resp.Size)
+			assert.Empty(t, resp.Next)
+
+			var uuids []string
+
+			for _, runner := range resp.Values {
+				uuids = append(uuids, runner.UUID)
+			}
+
+			assert.Equal(t, table.expectedUUIDs, uuids)
+		})
+	}
+}
+
+func TestNewForWorkspace(t *testing.T) {
+	const (
+		baseURL       = "https://baseurl.com"
+		workspaceUUID = "e2f9c256-1843-4fd6-8456-2f8a1d94f8b5"
+	)
+
+	runners := fmt.Sprintf("%s/internal/workspaces/%s/pipelines-config/runners?pagelen=%d", baseURL, workspaceUUID, Pagelen)
+	lookup := baseURL + "/2.0/workspaces/acme"
+
+	respond := func(status int, body string) *http.Response {
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	tables := []struct {
+		client        func() *mocks.HTTPClient
+		name          string
+		workspace     string
+		expectedError string
+	}{
+		{
+			name:      "uuid is used as is",
+			workspace: "{" + strings.ToUpper(workspaceUUID) + "}",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", runners).Return(respond(http.StatusOK, `{"size":0,"values":[]}`), nil).Once()
+
+				return &m
+			},
+		},
+		{
+			name:      "slug is looked up again after a failure",
+			workspace: "acme",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", lookup).Return(respond(http.StatusServiceUnavailable, `{}`), nil).Once()
+				m.On("Get", lookup).Return(respond(http.StatusOK, `{"uuid":"{`+workspaceUUID+`}","slug":"acme"}`), nil).Once()
+				m.On("Get", runners).Return(respond(http.StatusOK, `{"size":0,"values":[]}`), nil).Once()
+
+				return &m
+			},
+			expectedError: `failed to resolve workspace "acme", status: 503, body: {}`,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			httpClient := table.client()
+			client := NewForWorkspace(httpClient, baseURL, table.workspace)
+
+			_, err := client.GetRunners()
+			if table.expectedError != "" {
+				assert.EqualError(t, err, table.expectedError)
+
+				_, err = client.GetRunners()
+			}
+
+			assert.NoError(t, err)
+
+			uuid, err := client.WorkspaceUUID()
+			assert.NoError(t, err)
+			assert.Equal(t, "{"+workspaceUUID+"}", uuid)
+
+			httpClient.AssertExpectations(t)
+		})
+	}
+}
+
 func TestGetRunner(t *testing.T) {
 	const (
 		baseURL              = "https://baseurl.com"
@@ -578,3 +724,126 @@ func TestPutRunnerStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestRunnerPathAcceptsBracedUUIDs(t *testing.T) {
+	const (
+		baseURL       = "https://baseurl.com"
+		workspaceUUID = "{E2F9C256-1843-4FD6-8456-2F8A1D94F8B5}"
+		runnerUUID    = "{b6d86128-0946-4fc8-90bc-6e501c0e869c}"
+	)
+
+	url := baseURL + "/internal/workspaces/e2f9c256-1843-4fd6-8456-2f8a1d94f8b5/pipelines-config/runners/b6d86128-0946-4fc8-90bc-6e501c0e869c"
+
+	httpClient := &mocks.HTTPClient{}
+	httpClient.On("Get", url).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil).Once()
+
+	_, err := New(httpClient, baseURL, workspaceUUID).GetRunner(runnerUUID)
+
+	assert.NoError(t, err)
+
+	httpClient.AssertExpectations(t)
+}
+
+func TestUpdateRunner(t *testing.T) {
+	const (
+		baseURL       string = "https://baseurl.com"
+		workspaceUUID string = "e2f9c256-1843-4fd6-8456-2f8a1d94f8b5"
+		runnerUUID    string = "{b6d86128-0946-4fc8-90bc-6e501c0e869c}"
+		validResponse        = `{
+            "uuid": "{b6d86128-0946-4fc8-90bc-6e501c0e869c}",
+            "name": "a name",
+            "labels": ["self.hosted", "linux", "large"]
+          }`
+	)
+
+	validUpdateRunnerResponse := &Runner{}
+	_ = json.Unmarshal([]byte(validResponse), &validUpdateRunnerResponse)
+
+	url := fmt.Sprintf("%s/internal/workspaces/%s/pipelines-config/runners/b6d86128-0946-4fc8-90bc-6e501c0e869c", baseURL, workspaceUUID)
+
+	isUpdate := mock.MatchedBy(func(req *http.Request) bool {
+		body, _ := io.ReadAll(req.Body)
+
+		return req.Method == http.MethodPut && req.URL.String() == url &&
+			string(body) == `{"name":"a name","labels":["self.hosted","linux","large"]}`
+	})
+
+	tables := []struct {
+		client         func() *mocks.HTTPClient
+		expectedResult *Runner
+		expectedError  func() error
+		name           string
+	}{
+		{
+			name: "client returns an error",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Do", isUpdate).Return(&http.Response{}, fmt.Errorf("something went wrong")).Once()
+
+				return &m
+			},
+			expectedResult: nil,
+			expectedError: func() error {
+				return fmt.Errorf("something went wrong")
+			},
+		},
+		{
+			name: "response status code is not 200",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Do", isUpdate).Return(&http.Response{StatusCode: http.StatusBadRequest, Body: io.NopCloser(strings.NewReader("{}"))}, nil).Once()
+
+				return &m
+			},
+			expectedResult: nil,
+			expectedError: func() error {
+				return fmt.Errorf("failed to update runner, status: 400, body: {}")
+			},
+		},
+		{
+			name: "unable to unmarshal response body",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Do", isUpdate).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{"))}, nil).Once()
+
+				return &m
+			},
+			expectedResult: nil,
+			expectedError: func() error {
+				return fmt.Errorf("error unmarshalling PUT runner response: unexpected end of JSON input")
+			},
+		},
+		{
+			name: "happy path",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Do", isUpdate).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(validResponse))}, nil).Once()
+
+				return &m
+			},
+			expectedResult: validUpdateRunnerResponse,
+			expectedError: func() error {
+				return nil
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			httpClient := table.client()
+
+			c := New(httpClient, baseURL, workspaceUUID)
+
+			res, err := c.UpdateRunner(runnerUUID, UpdateRunnerRequest{Name: "a name", Labels: []string{"self.hosted", "linux", "large"}})
+
+			assert.Equal(t, table.expectedError(), err)
+			assert.Equal(t, table.expectedResult, res)
+
+			httpClient.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package bitbucketclient
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const runnersKey string = "runners"
+
+type cachedRunner struct {
+	fetchedAt time.Time
+	runner    Runner
+}
+
+// CachedClient puts a short lived cache in front of the runner reads of a
+// BitbucketClient. Concurrent reads of the same resource share a single
+// request, and every successful write drops the whole cache so callers see
+// their own changes on the next read.
+type CachedClient struct {
+	client    *BitbucketClient
+	now       func() time.Time
+	group     singleflight.Group
+	fetchedAt time.Time
+	runners   *GetRunnersResponse
+	byUUID    map[string]cachedRunner
+	ttl       time.Duration
+	// generation is bumped by every invalidation so that a read started
+	// before a write cannot store its stale result afterwards.
+	generation uint64
+	mu         sync.Mutex
+}
+
+func NewCachedClient(client *BitbucketClient, ttl time.Duration) *CachedClient {
+	return &CachedClient{
+		client: client,
+		now:    time.Now,
+		byUUID: map[string]cachedRunner{},
+		ttl:    ttl,
+	}
+}
+
+func (c *CachedClient) GetRunners() (*GetRunnersResponse, error) {
+	c.mu.Lock()
+	if c.runners != nil && c.now().Sub(c.fetchedAt) < c.ttl {
+		resp := copyRunnersResponse(c.runners)
+		c.mu.Unlock()
+
+		return resp, nil
+	}
+
+	generation := c.generation
+	c.mu.Unlock()
+
+	v, err, _ := c.group.Do(flightKey(runnersKey, generation), func() (interface{}, error) {
+		resp, err := c.client.GetRunners()
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		if c.generation == generation {
+			c.runners = resp
+			c.fetchedAt = c.now()
+		}
+		c.mu.Unlock()
+
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return copyRunnersResponse(v.(*GetRunnersResponse)), nil
+}
+
+func (c *CachedClient) GetRunner(runnerUUID string) (*Runner, error) {
+	key := NormalizeUUID(runnerUUID)
+
+	c.mu.Lock()
+	if runner, ok := c.lookup(key); ok {
+		c.mu.Unlock()
+
+		return runner, nil
+	}
+
+	generation := c.generation
+	c.mu.Unlock()
+
+	v, err, _ := c.group.Do(flightKey("runner:"+key, generation), func() (interface{}, error) {
+		runner, err := c.client.GetRunner(runnerUUID)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		if c.generation == generation {
+			c.byUUID[key] = cachedRunner{fetchedAt: c.now(), runner: copyRunner(*runner)}
+		}
+		c.mu.Unlock()
+
+		return runner, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	runner := copyRunner(*v.(*Runner))
+
+	return &runner, nil
+}
+
+// WorkspaceUUID returns the normalised UUID of the workspace.
+func (c *CachedClient) WorkspaceUUID() (string, error) {
+	return c.client.WorkspaceUUID()
+}
+
+func (c *CachedClient) PostRunner(requestBody PostRunnerRequest) (*Runner, error) {
+	runner, err := c.client.PostRunner(requestBody)
+	if err == nil {
+		c.Invalidate()
+	}
+
+	return runner, err
+}
+
+func (c *CachedClient) DeleteRunner(runnerUUID string) error {
+	err := c.client.DeleteRunner(runnerUUID)
+	if err == nil {
+		c.Invalidate()
+	}
+
+	return err
+}
+
+func (c *CachedClient) UpdateRunner(runnerUUID string, requestBody UpdateRunnerRequest) (*Runner, error) {
+	runner, err := c.client.UpdateRunner(runnerUUID, requestBody)
+	if err == nil {
+		c.Invalidate()
+	}
+
+	return runner, err
+}
+
+func (c *CachedClient) PutRunnerStatus(runnerUUID, newStatus string) error {
+	err := c.client.PutRunnerStatus(runnerUUID, newStatus)
+	if err == nil {
+		c.Invalidate()
+	}
+
+	return err
+}
+
+// Invalidate drops every cached response.
+func (c *CachedClient) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.runners = nil
+	c.byUUID = map[string]cachedRunner{}
+}
+
+// lookup returns a fresh copy of the runner, either from its own entry or
+// from the cached runner list. The caller must hold c.mu.
+func (c *CachedClient) lookup(key string) (*Runner, bool) {
+	now := c.now()
+
+	if entry, ok := c.byUUID[key]; ok && now.Sub(entry.fetchedAt) < c.ttl {
+		runner := copyRunner(entry.runner)
+
+		return &runner, true
+	}
+
+	if c.runners == nil || now.Sub(c.fetchedAt) >= c.ttl {
+		return nil, false
+	}
+
+	for i := range c.runners.Values {
+		if NormalizeUUID(c.runners.Values[i].UUID) == key {
+			runner := copyRunner(c.runners.Values[i])
+
+			return &runner, true
+		}
+	}
+
+	return nil, false
+}
+
+// flightKey keys in-flight reads by cache generation, so a read started after
+// a write never joins one started before it.
+func flightKey(key string, generation uint64) string {
+	return key + "@" + strconv.FormatUint(generation, 10)
+}
+
+// copyRunnersResponse copies resp deeply enough that callers cannot change
+// the cached value through it.
+func copyRunnersResponse(resp *GetRunnersResponse) *GetRunnersResponse {
+	cp := *resp
+	cp.Values = make([]Runner, len(resp.Values))
+
+	for i := range resp.Values {
+		cp.Values[i] = copyRunner(resp.Values[i])
+	}
+
+	return &cp
+}
+
+// copyRunner returns runner without any slice or pointer shared with it.
+func copyRunner(runner Runner) Runner {
+	runner.Labels = slices.Clone(runner.Labels)
+
+	if runner.State.Step != nil {
+		step := *runner.State.Step
+		runner.State.Step = &step
+	}
+
+	return runner
+}
@@ -0,0 +1,280 @@
+package bitbucketclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCachedClient(t *testing.T) {
+	const (
+		baseURL       = "https://baseurl.com"
+		workspaceUUID = "e2f9c256-1843-4fd6-8456-2f8a1d94f8b5"
+		runnerUUID    = "{b6d86128-0946-4fc8-90bc-6e501c0e869c}"
+		runners       = `{"values": [{"uuid": "{b6d86128-0946-4fc8-90bc-6e501c0e869c}", "name": "test"}], "size": 1}`
+		ttl           = 5 * time.Second
+	)
+
+	runnersURL := fmt.Sprintf("%s/internal/workspaces/%s/pipelines-config/runners?pagelen=%d", baseURL, workspaceUUID, Pagelen)
+	runnerURL := fmt.Sprintf("%s/internal/workspaces/%s/pipelines-config/runners/%s", baseURL, workspaceUUID, pathUUID(runnerUUID))
+
+	okResponse := func(body string) *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	tables := []struct {
+		client func() *mocks.HTTPClient
+		calls  func(c *CachedClient, advance func(time.Duration)) error
+		name   string
+	}{
+		{
+			name: "reads within the ttl are served from the cache",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", runnersURL).Return(okResponse(runners), nil).Once()
+
+				return &m
+			},
+			calls: func(c *CachedClient, advance func(time.Duration)) error {
+				_, _ = c.GetRunners()
+
+				advance(ttl - time.Second)
+
+				resp, err := c.GetRunners()
+				if err != nil {
+					return err
+				}
+
+				// GetRunner is answered from the cached list.
+				runner, err := c.GetRunner(strings.Trim(runnerUUID, "{}"))
+				if err != nil || runner.Name != "test" || len(resp.Values) != 1 {
+					return fmt.Errorf("unexpected cached values: %v %v", resp, runner)
+				}
+
+				return nil
+			},
+		},
+		{
+			name: "expired entries are fetched again",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", runnersURL).Return(okResponse(runners), nil).Once()
+				m.On("Get", runnersURL).Return(okResponse(runners), nil).Once()
+
+				return &m
+			},
+			calls: func(c *CachedClient, advance func(time.Duration)) error {
+				_, _ = c.GetRunners()
+
+				advance(ttl)
+
+				_, err := c.GetRunners()
+
+				return err
+			},
+		},
+		{
+			name: "errors are not cached",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", runnerURL).Return(&http.Response{}, fmt.Errorf("something went wrong")).Once()
+				m.On("Get", runnerURL).Return(okResponse(`{"uuid": "{b6d86128-0946-4fc8-90bc-6e501c0e869c}"}`), nil).Once()
+
+				return &m
+			},
+			calls: func(c *CachedClient, _ func(time.Duration)) error {
+				_, _ = c.GetRunner(runnerUUID)
+				_, err := c.GetRunner(runnerUUID)
+
+				return err
+			},
+		},
+		{
+			name: "successful writes invalidate the cache",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", runnersURL).Return(okResponse(runners), nil).Once()
+				m.On("Do", mock.AnythingOfType("*http.Request")).Return(&http.Response{StatusCode: http.StatusNoContent, Body: io.NopCloser(strings.NewReader(""))}, nil).Once()
+				m.On("Get", runnersURL).Return(okResponse(`{"values": []}`), nil).Once()
+
+				return &m
+			},
+			calls: func(c *CachedClient, _ func(time.Duration)) error {
+				_, _ = c.GetRunners()
+
+				if err := c.DeleteRunner(runnerUUID); err != nil {
+					return err
+				}
+
+				resp, err := c.GetRunners()
+				if err == nil && len(resp.Values) != 0 {
+					return fmt.Errorf("expected deleted runner to be gone, got %v", resp.Values)
+				}
+
+				return err
+			},
+		},
+		{
+			name: "failed writes keep the cache",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", runnersURL).Return(okResponse(runners), nil).Once()
+				m.On("Do", mock.AnythingOfType("*http.Request")).Return(&http.Response{StatusCode: http.StatusBadRequest, Body: io.NopCloser(strings.NewReader("{}"))}, nil).Once()
+
+				return &m
+			},
+			calls: func(c *CachedClient, _ func(time.Duration)) error {
+				_, _ = c.GetRunners()
+				_ = c.PutRunnerStatus(runnerUUID, RunnerStatusDisabled)
+
+				_, err := c.GetRunners()
+
+				return err
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			httpClient := table.client()
+			now := time.Date(2024, 11, 16, 9, 0, 0, 0, time.UTC)
+
+			c := NewCachedClient(New(httpClient, baseURL, workspaceUUID), ttl)
+			c.now = func() time.Time { return now }
+
+			assert.NoError(t, table.calls(c, func(d time.Duration) { now = now.Add(d) }))
+
+			httpClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCachedClientSingleFlight(t *testing.T) {
+	const (
+		baseURL       = "https://baseurl.com"
+		workspaceUUID = "e2f9c256-1843-4fd6-8456-2f8a1d94f8b5"
+		callers       = 10
+	)
+
+	release := make(chan time.Time)
+
+	httpClient := &mocks.HTTPClient{}
+	httpClient.On("Get", mock.Anything).
+		WaitUntil(release).
+		Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"values": []}`))}, nil).
+		Once()
+
+	c := NewCachedClient(New(httpClient, baseURL, workspaceUUID), time.Minute)
+
+	var wg sync.WaitGroup
+
+	for range callers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := c.GetRunners()
+
+			assert.NoError(t, err)
+		}()
+	}
+
+	// Give every caller time to join the in-flight request before it returns.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	httpClient.AssertExpectations(t)
+}
+
+func TestCachedClientReturnsCopies(t *testing.T) {
+	const runners = `{"values": [{"uuid": "{1}", "name": "test", "labels": ["self.hosted"], ` +
+		`"state": {"status": "ONLINE", "step": {"uuid": "{step}"}}}], "size": 1}`
+
+	httpClient := &mocks.HTTPClient{}
+	httpClient.On("Get", mock.Anything).
+		Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(runners))}, nil).
+		Once()
+
+	c := NewCachedClient(New(httpClient, "https://baseurl.com", "workspace"), time.Minute)
+
+	resp, err := c.GetRunners()
+	assert.NoError(t, err)
+
+	resp.Values[0].Labels[0] = "changed"
+	resp.Values[0].State.Step.UUID = "{changed}"
+
+	runner, err := c.GetRunner("{1}")
+	assert.NoError(t, err)
+
+	runner.Labels[0] = "changed"
+	runner.State.Step.UUID = "{changed}"
+
+	// Changes made by callers never reach the cache.
+	resp, err = c.GetRunners()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"self.hosted"}, resp.Values[0].Labels)
+	assert.Equal(t, "{step}", resp.Values[0].State.Step.UUID)
+
+	httpClient.AssertExpectations(t)
+}
+
+func TestCachedClientReadAfterWrite(t *testing.T) {
+	release := make(chan time.Time)
+
+	okResponse := func(body string) *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	httpClient := &mocks.HTTPClient{}
+	httpClient.On("Get", mock.Anything).
+		WaitUntil(release).
+		Return(okResponse(`{"values": [{"uuid": "{1}", "state": {"status": "ONLINE"}}]}`), nil).
+		Once()
+	httpClient.On("Do", mock.Anything).Return(okResponse(""), nil).Once()
+	httpClient.On("Get", mock.Anything).
+		Return(okResponse(`{"values": [{"uuid": "{1}", "state": {"status": "DISABLED"}}]}`), nil).
+		Once()
+
+	c := NewCachedClient(New(httpClient, "https://baseurl.com", "workspace"), time.Minute)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		_, err := c.GetRunners()
+
+		assert.NoError(t, err)
+	}()
+
+	// Let the read start before the write.
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, c.PutRunnerStatus("{1}", RunnerStatusDisabled))
+
+	// The read after the write does not join the one before it.
+	resp, err := c.GetRunners()
+	assert.NoError(t, err)
+	assert.Equal(t, RunnerStatusDisabled, resp.Values[0].State.Status)
+
+	close(release)
+	wg.Wait()
+
+	httpClient.AssertExpectations(t)
+}
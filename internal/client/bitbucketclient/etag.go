@@ -0,0 +1,148 @@
+package bitbucketclient
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// maxETagEntries bounds the responses kept, as every runner read through
+// GetRunner has its own URL and runners come and go.
+const maxETagEntries int = 256
+
+type etagEntry struct {
+	header http.Header
+	url    string
+	etag   string
+	body   []byte
+}
+
+// ETagClient is a ports.HTTPClient that turns repeated GET requests into
+// conditional requests. When the server answers 304 Not Modified the body of
+// the previous response is replayed as a 200, so callers never see the
+// difference. Servers that do not send an ETag are unaffected. The least
+// recently used responses are dropped beyond maxETagEntries.
+type ETagClient struct {
+	next    ports.HTTPClient
+	entries map[string]*list.Element
+	// recent orders the entries, most recently used first.
+	recent *list.List
+	mu     sync.Mutex
+}
+
+func NewETagClient(next ports.HTTPClient) *ETagClient {
+	return &ETagClient{
+		next:    next,
+		entries: map[string]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+func (c *ETagClient) Get(url string) (*http.Response, error) {
+	entry, ok := c.lookup(url)
+
+	if !ok {
+		resp, err := c.next.Get(url)
+		if err != nil {
+			return resp, err
+		}
+
+		return c.store(url, resp)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("If-None-Match", entry.etag)
+
+	resp, err := c.next.Do(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode != http.StatusNotModified {
+		return c.store(url, resp)
+	}
+
+	resp.Body.Close()
+
+	return &http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Header:     entry.header.Clone(),
+		Body:       io.NopCloser(bytes.NewReader(entry.body)),
+		Request:    req,
+	}, nil
+}
+
+func (c *ETagClient) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	return c.next.Post(url, contentType, body)
+}
+
+func (c *ETagClient) Do(req *http.Request) (*http.Response, error) {
+	return c.next.Do(req)
+}
+
+// store remembers successful responses that carry an ETag. The body has to be
+// read to be kept, so the caller gets a fresh reader over the same bytes.
+func (c *ETagClient) store(url string, resp *http.Response) (*http.Response, error) {
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		c.mu.Lock()
+		c.remove(url)
+		c.mu.Unlock()
+
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.remove(url)
+
+	c.entries[url] = c.recent.PushFront(etagEntry{header: resp.Header.Clone(), url: url, etag: etag, body: body})
+
+	for c.recent.Len() > maxETagEntries {
+		c.remove(c.recent.Back().Value.(etagEntry).url)
+	}
+
+	c.mu.Unlock()
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
+
+// lookup returns the entry of url and marks it as recently used.
+func (c *ETagClient) lookup(url string) (etagEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[url]
+	if !ok {
+		return etagEntry{}, false
+	}
+
+	c.recent.MoveToFront(element)
+
+	return element.Value.(etagEntry), true
+}
+
+// remove drops the entry of url. The caller must hold mu.
+func (c *ETagClient) remove(url string) {
+	if element, ok := c.entries[url]; ok {
+		c.recent.Remove(element)
+		delete(c.entries, url)
+	}
+}
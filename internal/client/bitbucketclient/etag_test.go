@@ -0,0 +1,135 @@
+package bitbucketclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestETagClient(t *testing.T) {
+	const (
+		url  = "https://baseurl.com/internal/workspaces/uuid/pipelines-config/runners?pagelen=100"
+		body = `{"values": []}`
+	)
+
+	withETag := func(etag, body string) *http.Response {
+		h := http.Header{}
+		h.Set("ETag", etag)
+
+		return &http.Response{StatusCode: http.StatusOK, Header: h, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	conditional := func(etag string) interface{} {
+		return mock.MatchedBy(func(req *http.Request) bool {
+			return req.Method == http.MethodGet && req.URL.String() == url && req.Header.Get("If-None-Match") == etag
+		})
+	}
+
+	tables := []struct {
+		client       func() *mocks.HTTPClient
+		name         string
+		expectedBody string
+	}{
+		{
+			name: "not modified replays the cached body",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(withETag(`"v1"`, body), nil).Once()
+				m.On("Do", conditional(`"v1"`)).Return(&http.Response{StatusCode: http.StatusNotModified, Body: io.NopCloser(strings.NewReader(""))}, nil).Once()
+
+				return &m
+			},
+			expectedBody: body,
+		},
+		{
+			name: "modified responses replace the cached entry",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(withETag(`"v1"`, body), nil).Once()
+				m.On("Do", conditional(`"v1"`)).Return(withETag(`"v2"`, `{"values": [{}]}`), nil).Once()
+
+				return &m
+			},
+			expectedBody: `{"values": [{}]}`,
+		},
+		{
+			name: "responses without etag are not cached",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil).Once()
+				m.On("Get", url).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil).Once()
+
+				return &m
+			},
+			expectedBody: body,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			httpClient := table.client()
+
+			c := NewETagClient(httpClient)
+
+			first, err := c.Get(url)
+			assert.NoError(t, err)
+
+			firstBody, _ := io.ReadAll(first.Body)
+			assert.Equal(t, body, string(firstBody))
+
+			second, err := c.Get(url)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, second.StatusCode)
+
+			secondBody, _ := io.ReadAll(second.Body)
+			assert.Equal(t, table.expectedBody, string(secondBody))
+
+			httpClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestETagClientEvictsLeastRecentlyUsed(t *testing.T) {
+	m := &mocks.HTTPClient{}
+	c := NewETagClient(m)
+
+	urls := make([]string, 0, maxETagEntries+1)
+
+	for i := range maxETagEntries + 1 {
+		url := fmt.Sprintf("https://baseurl.com/runners/%d", i)
+		h := http.Header{}
+		h.Set("ETag", `"v1"`)
+
+		m.On("Get", url).Return(&http.Response{StatusCode: http.StatusOK, Header: h, Body: io.NopCloser(strings.NewReader(url))}, nil).Once()
+
+		urls = append(urls, url)
+	}
+
+	for _, url := range urls[:maxETagEntries] {
+		_, err := c.Get(url)
+		assert.NoError(t, err)
+	}
+
+	// Reading the oldest entry again keeps it over the next one.
+	m.On("Do", mock.Anything).Return(&http.Response{StatusCode: http.StatusNotModified, Body: io.NopCloser(strings.NewReader(""))}, nil).Once()
+
+	_, err := c.Get(urls[0])
+	assert.NoError(t, err)
+
+	_, err = c.Get(urls[maxETagEntries])
+	assert.NoError(t, err)
+
+	assert.Len(t, c.entries, maxETagEntries)
+	assert.Contains(t, c.entries, urls[0])
+	assert.NotContains(t, c.entries, urls[1])
+	m.AssertExpectations(t)
+}
@@ -2,15 +2,29 @@ package bitbucketclient
 
 import "time"
 
+const (
+	RunnerStatusUnregistered string = "UNREGISTERED"
+	RunnerStatusOnline       string = "ONLINE"
+	RunnerStatusOffline      string = "OFFLINE"
+	RunnerStatusDisabled     string = "DISABLED"
+)
+
 type GetRunnersResponse struct {
+	// Next is the URL of the following page, empty on the last one.
+	Next    string   `json:"next,omitempty"`
 	Values  []Runner `json:"values"`
 	Page    int      `json:"page"`
 	Size    int      `json:"size"`
 	Pagelen int      `json:"pagelen"`
 }
 
+type Step struct {
+	UUID string `json:"uuid"`
+}
+
 type State struct {
 	UpdatedOn time.Time `json:"updated_on"`
+	Step      *Step     `json:"step,omitempty"`
 	Status    string    `json:"status"`
 	Cordoned  bool      `json:"cordoned"`
 }
@@ -19,6 +33,8 @@ type OauthClient struct {
 	ID            string `json:"id"`
 	TokenEndpoint string `json:"token_endpoint"`
 	Audience      string `json:"audience"`
+	// Secret is only returned once, in the response to PostRunner.
+	Secret string `json:"secret,omitempty"`
 }
 
 type Runner struct {
@@ -36,6 +52,11 @@ type PostRunnerRequest struct {
 	Labels []string `json:"labels"`
 }
 
+type UpdateRunnerRequest struct {
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
 type PutRunnerStatus struct {
 	Status string `json:"status"`
 }
@@ -0,0 +1,95 @@
+package bitbucketclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+const GetWorkspacePath string = "/2.0/workspaces/%s"
+
+type Workspace struct {
+	UUID string `json:"uuid"`
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// WorkspaceResolver turns workspace slugs, or UUIDs in any brace format, into
+// normalised workspace UUIDs using the public workspaces API. Results are
+// cached for the lifetime of the resolver.
+type WorkspaceResolver struct {
+	client  ports.HTTPClient
+	cache   map[string]string
+	baseURL string
+	mu      sync.Mutex
+}
+
+func NewWorkspaceResolver(client ports.HTTPClient, baseURL string) *WorkspaceResolver {
+	return &WorkspaceResolver{
+		client:  client,
+		cache:   map[string]string{},
+		baseURL: baseURL,
+	}
+}
+
+// Resolve returns the normalised UUID of workspace, which may be a slug or a
+// UUID with or without braces.
+func (r *WorkspaceResolver) Resolve(workspace string) (string, error) {
+	key := strings.ToLower(strings.TrimSpace(workspace))
+	if key == "" {
+		return "", fmt.Errorf("failed to resolve workspace: empty slug or uuid")
+	}
+
+	if IsUUID(key) {
+		key = NormalizeUUID(key)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if uuid, ok := r.cache[key]; ok {
+		return uuid, nil
+	}
+
+	resp, err := r.client.Get(r.baseURL + fmt.Sprintf(GetWorkspacePath, url.PathEscape(key)))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve workspace %q: %w", workspace, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve workspace %q: %w", workspace, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusForbidden:
+		return "", fmt.Errorf(
+			"failed to resolve workspace %q: not found or not accessible with the configured credentials, status: %d",
+			workspace, resp.StatusCode,
+		)
+	default:
+		return "", fmt.Errorf("failed to resolve workspace %q, status: %d, body: %s", workspace, resp.StatusCode, string(body))
+	}
+
+	var ws Workspace
+	if err := json.Unmarshal(body, &ws); err != nil {
+		return "", fmt.Errorf("error unmarshalling workspace response: %s", err.Error())
+	}
+
+	if !IsUUID(ws.UUID) {
+		return "", fmt.Errorf("failed to resolve workspace %q: response has no valid uuid", workspace)
+	}
+
+	uuid := NormalizeUUID(ws.UUID)
+	r.cache[key] = uuid
+
+	return uuid, nil
+}
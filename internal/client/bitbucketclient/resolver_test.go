@@ -0,0 +1,153 @@
+package bitbucketclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolve(t *testing.T) {
+	const (
+		baseURL       = "https://baseurl.com"
+		validResponse = `{"uuid": "{E2F9C256-1843-4FD6-8456-2F8A1D94F8B5}", "slug": "acme", "name": "Acme"}`
+		expectedUUID  = "{e2f9c256-1843-4fd6-8456-2f8a1d94f8b5}"
+	)
+
+	slugURL := baseURL + "/2.0/workspaces/acme"
+	uuidURL := baseURL + "/2.0/workspaces/%7Be2f9c256-1843-4fd6-8456-2f8a1d94f8b5%7D"
+
+	tables := []struct {
+		client        func() *mocks.HTTPClient
+		name          string
+		workspace     string
+		expectedUUID  string
+		expectedError string
+	}{
+		{
+			name:      "client returns an error",
+			workspace: "acme",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", slugURL).Return(&http.Response{}, fmt.Errorf("something went wrong")).Once()
+
+				return &m
+			},
+			expectedError: `failed to resolve workspace "acme": something went wrong`,
+		},
+		{
+			name:      "workspace not found",
+			workspace: "acme",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", slugURL).Return(&http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("{}"))}, nil).Once()
+
+				return &m
+			},
+			expectedError: `failed to resolve workspace "acme": not found or not accessible with the configured credentials, status: 404`,
+		},
+		{
+			name:      "unexpected status code",
+			workspace: "acme",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", slugURL).Return(&http.Response{StatusCode: http.StatusBadGateway, Body: io.NopCloser(strings.NewReader("{}"))}, nil).Once()
+
+				return &m
+			},
+			expectedError: `failed to resolve workspace "acme", status: 502, body: {}`,
+		},
+		{
+			name:      "response without uuid",
+			workspace: "acme",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", slugURL).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"slug": "acme"}`))}, nil).Once()
+
+				return &m
+			},
+			expectedError: `failed to resolve workspace "acme": response has no valid uuid`,
+		},
+		{
+			name:      "slug is resolved and cached",
+			workspace: "Acme",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", slugURL).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(validResponse))}, nil).Once()
+
+				return &m
+			},
+			expectedUUID: expectedUUID,
+		},
+		{
+			name:      "bare uuid is looked up in braces",
+			workspace: "E2F9C256-1843-4FD6-8456-2F8A1D94F8B5",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", uuidURL).Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(validResponse))}, nil).Once()
+
+				return &m
+			},
+			expectedUUID: expectedUUID,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			httpClient := table.client()
+
+			r := NewWorkspaceResolver(httpClient, baseURL)
+
+			uuid, err := r.Resolve(table.workspace)
+
+			if table.expectedError != "" {
+				assert.EqualError(t, err, table.expectedError)
+			} else {
+				assert.NoError(t, err)
+
+				// The second lookup is served from the cache; the mock only
+				// expects a single call.
+				cached, err := r.Resolve(table.workspace)
+
+				assert.NoError(t, err)
+				assert.Equal(t, uuid, cached)
+			}
+
+			assert.Equal(t, table.expectedUUID, uuid)
+
+			httpClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestNormalizeUUID(t *testing.T) {
+	tables := []struct {
+		name     string
+		uuid     string
+		expected string
+	}{
+		{name: "braced", uuid: "{b6d86128-0946-4fc8-90bc-6e501c0e869c}", expected: "{b6d86128-0946-4fc8-90bc-6e501c0e869c}"},
+		{name: "bare", uuid: "b6d86128-0946-4fc8-90bc-6e501c0e869c", expected: "{b6d86128-0946-4fc8-90bc-6e501c0e869c}"},
+		{name: "upper case with spaces", uuid: " {B6D86128-0946-4FC8-90BC-6E501C0E869C} ", expected: "{b6d86128-0946-4fc8-90bc-6e501c0e869c}"},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expected, NormalizeUUID(table.uuid))
+			assert.True(t, IsUUID(table.uuid))
+		})
+	}
+
+	assert.False(t, IsUUID("acme"))
+	assert.False(t, IsUUID("{b6d86128x0946-4fc8-90bc-6e501c0e869c}"))
+}
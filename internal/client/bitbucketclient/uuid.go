@@ -0,0 +1,40 @@
+package bitbucketclient
+
+import "strings"
+
+// NormalizeUUID returns uuid in the canonical Bitbucket form: lower case and
+// wrapped in curly braces, e.g. {b6d86128-0946-4fc8-90bc-6e501c0e869c}. It
+// accepts values with or without braces so they can be compared safely.
+func NormalizeUUID(uuid string) string {
+	return "{" + pathUUID(uuid) + "}"
+}
+
+// IsUUID reports whether s looks like a UUID, with or without braces.
+func IsUUID(s string) bool {
+	const uuidLen = 36
+
+	bare := pathUUID(s)
+	if len(bare) != uuidLen {
+		return false
+	}
+
+	for i, r := range bare {
+		switch i {
+		case 8, 13, 18, 23: //nolint:mnd
+			if r != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdef", r) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// pathUUID strips the braces so the UUID can be embedded in a URL path.
+func pathUUID(uuid string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(uuid), "{"), "}"))
+}
@@ -0,0 +1,253 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	RemainingHeader  string = "X-RateLimit-Remaining"
+	NearLimitHeader  string = "X-RateLimit-NearLimit"
+	RetryAfterHeader string = "Retry-After"
+	// defaultRetryAfter is used when a 429 response does not say how long to
+	// back off.
+	defaultRetryAfter time.Duration = time.Minute
+)
+
+type Config struct {
+	// Budget is the number of requests allowed per Period.
+	Budget int
+	Period time.Duration
+	// Burst is the size of the bucket, i.e. how many requests can be made
+	// back to back after a quiet period.
+	Burst int
+	// Reserve is the number of tokens polling calls must leave in the bucket,
+	// so mutating calls can still go through when the budget runs low.
+	Reserve int
+}
+
+// Client is a ports.HTTPClient that spends requests from a token bucket before
+// forwarding them. Mutating requests (POST, PUT, DELETE, ...) take priority
+// over polling: while one is waiting, GET requests are held back. The bucket
+// follows the rate limit headers returned by Bitbucket, so the client slows
+// down before the server starts rejecting requests.
+type Client struct {
+	// ctx bounds every wait, so a shutdown is never held up by the bucket
+	// or a 429 pause.
+	ctx         context.Context //nolint:containedctx
+	next        ports.HTTPClient
+	remaining   prometheus.Gauge
+	throttled   prometheus.Counter
+	now         func() time.Time
+	sleep       func(ctx context.Context, d time.Duration) error
+	last        time.Time
+	pausedUntil time.Time
+	tokens      float64
+	rate        float64
+	burst       float64
+	reserve     float64
+	mutations   int
+	mu          sync.Mutex
+}
+
+// New wraps next with a limiter. remaining reports the tokens left in the
+// bucket and throttled counts responses rejected by Bitbucket with 429. Waits
+// end with an error once ctx is done; Get and Post have no context of their
+// own, so ctx should be the lifetime of the process.
+func New(
+	ctx context.Context, next ports.HTTPClient, cfg Config, remaining prometheus.Gauge, throttled prometheus.Counter,
+) *Client {
+	c := &Client{
+		ctx:       ctx,
+		next:      next,
+		remaining: remaining,
+		throttled: throttled,
+		now:       time.Now,
+		sleep:     sleep,
+		tokens:    float64(cfg.Burst),
+		rate:      float64(cfg.Budget) / cfg.Period.Seconds(),
+		burst:     float64(cfg.Burst),
+		reserve:   float64(cfg.Reserve),
+	}
+
+	c.last = c.now()
+	c.remaining.Set(c.tokens)
+
+	return c
+}
+
+func (c *Client) Get(url string) (*http.Response, error) {
+	if err := c.acquire(c.ctx, false); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.next.Get(url)
+	c.observe(resp)
+
+	return resp, err
+}
+
+func (c *Client) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	if err := c.acquire(c.ctx, true); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.next.Post(url, contentType, body)
+	c.observe(resp)
+
+	return resp, err
+}
+
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	mutating := req.Method != http.MethodGet && req.Method != http.MethodHead
+
+	// Waits end with whichever of the request and the client context is
+	// done first.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+
+	if c.ctx.Err() != nil {
+		cancel()
+	}
+
+	if err := c.acquire(ctx, mutating); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.next.Do(req)
+	c.observe(resp)
+
+	return resp, err
+}
+
+// Remaining returns the number of tokens currently in the bucket.
+func (c *Client) Remaining() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refill(c.now())
+
+	return c.tokens
+}
+
+// acquire blocks until a token is available for the call.
+func (c *Client) acquire(ctx context.Context, mutating bool) error {
+	waiting := false
+
+	defer func() {
+		if waiting {
+			c.mu.Lock()
+			c.mutations--
+			c.mu.Unlock()
+		}
+	}()
+
+	for {
+		c.mu.Lock()
+
+		now := c.now()
+		c.refill(now)
+
+		wait := c.pausedUntil.Sub(now)
+
+		if wait <= 0 {
+			// Polling calls must leave the reserve, plus one token for every
+			// mutating call already queued, in the bucket.
+			need := 1.0
+			if !mutating {
+				need += c.reserve + float64(c.mutations)
+			}
+
+			if c.tokens >= need {
+				c.tokens--
+				c.remaining.Set(c.tokens)
+				c.mu.Unlock()
+
+				return nil
+			}
+
+			wait = time.Duration((need - c.tokens) / c.rate * float64(time.Second))
+		}
+
+		if mutating && !waiting {
+			waiting = true
+			c.mutations++
+		}
+
+		c.mu.Unlock()
+
+		if err := c.sleep(ctx, wait); err != nil {
+			return fmt.Errorf("rate limiter: %w", err)
+		}
+	}
+}
+
+func (c *Client) refill(now time.Time) {
+	if elapsed := now.Sub(c.last).Seconds(); elapsed > 0 {
+		c.tokens = min(c.burst, c.tokens+elapsed*c.rate)
+	}
+
+	c.last = now
+}
+
+// observe adapts the bucket to the rate limit headers of resp.
+func (c *Client) observe(resp *http.Response) {
+	if resp == nil || resp.Header == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.refill(now)
+
+	if remaining, err := strconv.Atoi(resp.Header.Get(RemainingHeader)); err == nil {
+		c.tokens = min(c.tokens, float64(remaining))
+	}
+
+	if strings.EqualFold(resp.Header.Get(NearLimitHeader), "true") {
+		c.tokens = min(c.tokens, c.reserve)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.throttled.Inc()
+
+		c.tokens = 0
+		c.pausedUntil = now.Add(retryAfter(resp.Header.Get(RetryAfterHeader)))
+	}
+
+	c.remaining.Set(c.tokens)
+}
+
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return defaultRetryAfter
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,278 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/mocks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const url string = "https://baseurl.com/internal/workspaces/uuid/pipelines-config/runners"
+
+// newTestClient returns a limiter driven by a fake clock: sleeping advances
+// the clock and records how long the caller waited.
+func newTestClient(next *mocks.HTTPClient, cfg Config) (*Client, *time.Duration) {
+	return newTestClientContext(context.Background(), next, cfg)
+}
+
+// newTestClientContext is newTestClient with waits bounded by ctx.
+func newTestClientContext(ctx context.Context, next *mocks.HTTPClient, cfg Config) (*Client, *time.Duration) {
+	now := time.Date(2024, 11, 16, 9, 0, 0, 0, time.UTC)
+	slept := time.Duration(0)
+
+	c := New(ctx, next, cfg, prometheus.NewGauge(prometheus.GaugeOpts{Name: "remaining"}), prometheus.NewCounter(prometheus.CounterOpts{Name: "throttled"}))
+	c.now = func() time.Time { return now }
+	c.last = now
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		now = now.Add(d)
+		slept += d
+
+		return nil
+	}
+
+	return c, &slept
+}
+
+func ok(h http.Header) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Header: h}
+}
+
+func header(key, value string) http.Header {
+	h := http.Header{}
+	h.Set(key, value)
+
+	return h
+}
+
+func TestLimiter(t *testing.T) {
+	cfg := Config{Budget: 3600, Period: time.Hour, Burst: 3, Reserve: 1}
+
+	tables := []struct {
+		calls         func(c *Client) error
+		client        func() *mocks.HTTPClient
+		name          string
+		expectedSlept time.Duration
+	}{
+		{
+			name: "burst is served without waiting",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(ok(nil), nil).Twice()
+
+				return &m
+			},
+			calls: func(c *Client) error {
+				_, _ = c.Get(url)
+				_, err := c.Get(url)
+
+				return err
+			},
+			expectedSlept: 0,
+		},
+		{
+			name: "polling waits for the reserve to refill",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(ok(nil), nil).Times(3)
+
+				return &m
+			},
+			calls: func(c *Client) error {
+				_, _ = c.Get(url)
+				_, _ = c.Get(url)
+				_, err := c.Get(url)
+
+				return err
+			},
+			expectedSlept: time.Second,
+		},
+		{
+			name: "mutating calls may use the reserve",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(ok(nil), nil).Twice()
+				m.On("Post", url, "application/json", mock.Anything).Return(ok(nil), nil).Once()
+
+				return &m
+			},
+			calls: func(c *Client) error {
+				_, _ = c.Get(url)
+				_, _ = c.Get(url)
+				_, err := c.Post(url, "application/json", strings.NewReader("{}"))
+
+				return err
+			},
+			expectedSlept: 0,
+		},
+		{
+			name: "polling yields to queued mutating calls",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(ok(nil), nil).Twice()
+
+				return &m
+			},
+			calls: func(c *Client) error {
+				c.mutations = 1
+
+				_, _ = c.Get(url)
+				_, err := c.Get(url)
+
+				return err
+			},
+			expectedSlept: time.Second,
+		},
+		{
+			name: "remaining header drains the bucket",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(ok(header(RemainingHeader, "0")), nil).Twice()
+
+				return &m
+			},
+			calls: func(c *Client) error {
+				_, _ = c.Get(url)
+				_, err := c.Get(url)
+
+				return err
+			},
+			expectedSlept: 2 * time.Second,
+		},
+		{
+			name: "too many requests pauses every call for retry-after",
+			client: func() *mocks.HTTPClient {
+				m := mocks.HTTPClient{}
+
+				m.On("Get", url).Return(&http.Response{
+					StatusCode: http.StatusTooManyRequests,
+					Header:     header(RetryAfterHeader, "30"),
+				}, nil).Once()
+				m.On("Do", mock.AnythingOfType("*http.Request")).Return(ok(nil), nil).Once()
+
+				return &m
+			},
+			calls: func(c *Client) error {
+				_, _ = c.Get(url)
+
+				req, _ := http.NewRequest(http.MethodDelete, url, nil)
+				_, err := c.Do(req)
+
+				return err
+			},
+			expectedSlept: 30 * time.Second,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			httpClient := table.client()
+
+			c, slept := newTestClient(httpClient, cfg)
+
+			assert.NoError(t, table.calls(c))
+			assert.Equal(t, table.expectedSlept, *slept)
+
+			httpClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestLimiterMetrics(t *testing.T) {
+	httpClient := &mocks.HTTPClient{}
+	httpClient.On("Get", url).Return(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}, nil).Once()
+
+	c, _ := newTestClient(httpClient, Config{Budget: 3600, Period: time.Hour, Burst: 10, Reserve: 1})
+
+	assert.InDelta(t, 10, testutil.ToFloat64(c.remaining), 0)
+
+	_, err := c.Get(url)
+
+	assert.NoError(t, err)
+	assert.InDelta(t, 0, testutil.ToFloat64(c.remaining), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(c.throttled), 0)
+	assert.Equal(t, c.now().Add(defaultRetryAfter), c.pausedUntil)
+}
+
+func TestLimiterContextCancelled(t *testing.T) {
+	httpClient := &mocks.HTTPClient{}
+
+	c, _ := newTestClient(httpClient, Config{Budget: 1, Period: time.Hour, Burst: 0})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	_, err := c.Do(req)
+
+	assert.Equal(t, fmt.Errorf("rate limiter: %w", context.Canceled), err)
+
+	httpClient.AssertExpectations(t)
+}
+
+func TestLimiterClientContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tables := []struct {
+		call func(c *Client) error
+		name string
+	}{
+		{
+			name: "get",
+			call: func(c *Client) error {
+				_, err := c.Get(url)
+
+				return err
+			},
+		},
+		{
+			name: "post",
+			call: func(c *Client) error {
+				_, err := c.Post(url, "application/json", strings.NewReader("{}"))
+
+				return err
+			},
+		},
+		{
+			name: "request without context",
+			call: func(c *Client) error {
+				req, _ := http.NewRequest(http.MethodDelete, url, nil)
+				_, err := c.Do(req)
+
+				return err
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			httpClient := &mocks.HTTPClient{}
+
+			// An empty bucket makes every call wait, and the shut down client
+			// gives up instead.
+			c, _ := newTestClientContext(ctx, httpClient, Config{Budget: 1, Period: time.Hour, Burst: 0})
+
+			assert.ErrorIs(t, table.call(c), context.Canceled)
+
+			httpClient.AssertExpectations(t)
+		})
+	}
+}
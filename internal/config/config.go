@@ -0,0 +1,680 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultBaseURL               string        = "https://api.bitbucket.org"
+	DefaultAccessTokenURL        string        = "https://bitbucket.org/site/oauth2/access_token"
+	DefaultInterval              time.Duration = 30 * time.Second
+	DefaultTargetUtilization     float64       = 0.8
+	DefaultRateLimitBudget       int           = 900
+	DefaultRateLimitPeriod       time.Duration = time.Hour
+	DefaultRateLimitBurst        int           = 30
+	DefaultRateLimitReserve      int           = 5
+	DefaultCacheTTL              time.Duration = 5 * time.Second
+	DefaultRegisteringTimeout    time.Duration = time.Minute
+	DefaultProvisioningTimeout   time.Duration = 10 * time.Minute
+	DefaultDrainingTimeout       time.Duration = 5 * time.Minute
+	DefaultDeprovisioningTimeout time.Duration = 5 * time.Minute
+	DefaultLeaseName             string        = "bitbucket-runner-autoscaler"
+	DefaultLeaseDuration         time.Duration = 15 * time.Second
+	DefaultRenewDeadline         time.Duration = 10 * time.Second
+	DefaultRetryPeriod           time.Duration = 2 * time.Second
+	DefaultPredictionLead        time.Duration = 15 * time.Minute
+	DefaultPredictionAlpha       float64       = 0.3
+)
+
+// Label drift policies decide what happens to runners whose labels no longer
+// match the pool configuration.
+const (
+	LabelDriftPatch   string = "patch"
+	LabelDriftReplace string = "replace"
+	LabelDriftIgnore  string = "ignore"
+
+	LeaderElectionKubernetes string = "kubernetes"
+	LeaderElectionFile       string = "file"
+)
+
+// poolNamePattern keeps pool names safe to embed in runner names.
+var poolNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`) //nolint:gochecknoglobals
+
+// envPattern matches the ${VAR} references expanded in the config file, and
+// the $$ escape for a literal dollar sign.
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`) //nolint:gochecknoglobals
+
+type Config struct {
+	// StateFile is where bookkeeping is kept across restarts. Without it
+	// state is only kept in memory.
+	StateFile      string         `yaml:"state_file"`
+	Workspaces     []Workspace    `yaml:"workspaces"`
+	Providers      []Provider     `yaml:"providers"`
+	Audit          Audit          `yaml:"audit"`
+	Admin          Admin          `yaml:"admin"`
+	LeaderElection LeaderElection `yaml:"leader_election"`
+	Interval       time.Duration  `yaml:"interval"`
+}
+
+// Audit selects where a record of every change to runners and compute is
+// written. Both sinks can be enabled at once.
+type Audit struct {
+	// File receives one JSON record per line, appended.
+	File string `yaml:"file"`
+	// Stdout writes the same records to standard output.
+	Stdout bool `yaml:"stdout"`
+}
+
+// Admin configures the admin API.
+type Admin struct {
+	// Token lets callers presenting it apply plans. Without it the admin
+	// API is read-only.
+	Token string `yaml:"token"`
+}
+
+// LeaderElection lets several replicas run for availability while only the
+// leader scales. Followers keep serving metrics and the admin API.
+type LeaderElection struct {
+	// Backend is LeaderElectionKubernetes or LeaderElectionFile. Empty
+	// disables leader election and the replica always leads.
+	Backend string `yaml:"backend"`
+	// Identity of this replica. Defaults to the hostname.
+	Identity string `yaml:"identity"`
+	// Name of the Kubernetes Lease.
+	Name string `yaml:"name"`
+	// Namespace of the Kubernetes Lease. Defaults to the namespace of the
+	// pod.
+	Namespace string `yaml:"namespace"`
+	// Path of the lock file, which must be on a filesystem shared by the
+	// replicas that supports flock.
+	Path          string        `yaml:"path"`
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	RenewDeadline time.Duration `yaml:"renew_deadline"`
+	RetryPeriod   time.Duration `yaml:"retry_period"`
+}
+
+// Workspace groups the credentials and pools of a single Bitbucket workspace.
+// Every workspace gets its own client and token source, so a broken one never
+// affects the others. Either Slug or UUID identifies the workspace; slugs are
+// resolved to UUIDs when the workspace is first reconciled.
+type Workspace struct {
+	Name           string    `yaml:"name"`
+	Slug           string    `yaml:"slug"`
+	UUID           string    `yaml:"uuid"`
+	BaseURL        string    `yaml:"base_url"`
+	AccessTokenURL string    `yaml:"access_token_url"`
+	ClientID       string    `yaml:"client_id"`
+	ClientSecret   string    `yaml:"client_secret"`
+	Pools          []Pool    `yaml:"pools"`
+	RateLimit      RateLimit `yaml:"rate_limit"`
+	// CacheTTL is how long runner reads are shared between callers.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// RateLimit is the client side request budget of a workspace. It should stay
+// below the limit Bitbucket enforces for the workspace credentials.
+type RateLimit struct {
+	Budget  int           `yaml:"budget"`
+	Period  time.Duration `yaml:"period"`
+	Burst   int           `yaml:"burst"`
+	Reserve int           `yaml:"reserve"`
+}
+
+type Pool struct {
+	Schedule   *Schedule   `yaml:"schedule"`
+	Prediction *Prediction `yaml:"prediction"`
+	// Consistency enables checking registrations against the compute of
+	// the pool providers.
+	Consistency *Consistency `yaml:"consistency"`
+	Name        string       `yaml:"name"`
+	Provider    string       `yaml:"provider"`
+	// LabelDrift is one of LabelDriftPatch, LabelDriftReplace or
+	// LabelDriftIgnore.
+	LabelDrift string   `yaml:"label_drift"`
+	Labels     []string `yaml:"labels"`
+	// Providers are tried in order when starting a runner, as an
+	// alternative to a single Provider.
+	Providers []PoolProvider `yaml:"providers"`
+	Min       int            `yaml:"min"`
+	Max       int            `yaml:"max"`
+	// Warm is how many idle runners are kept on top of busy ones, so new jobs
+	// do not wait for a runner to start.
+	Warm int `yaml:"warm"`
+	// MaxIdleAge is how old an idle runner may get before it is replaced by a
+	// fresh one. Zero disables recycling.
+	MaxIdleAge        time.Duration `yaml:"max_idle_age"`
+	TargetUtilization float64       `yaml:"target_utilization"`
+	Behavior          Behavior      `yaml:"behavior"`
+	Timeouts          Timeouts      `yaml:"timeouts"`
+	// Ephemeral runners run a single step and are then removed together
+	// with their compute.
+	Ephemeral bool `yaml:"ephemeral"`
+}
+
+// Behavior tunes how closely a pool follows demand, in the style of the
+// Kubernetes HorizontalPodAutoscaler. The zero value follows demand on every
+// reconcile.
+type Behavior struct {
+	ScaleUp   ScalingRules `yaml:"scale_up"`
+	ScaleDown ScalingRules `yaml:"scale_down"`
+	// MinRunnerLifetime is how long after creation a runner is protected from
+	// removal, so it gets a chance to come online and pick up work.
+	MinRunnerLifetime time.Duration `yaml:"min_runner_lifetime"`
+}
+
+// Timeouts bound how long a runner may stay in each lifecycle state before it
+// is marked failed and removed.
+type Timeouts struct {
+	Registering time.Duration `yaml:"registering"`
+	// Provisioning lasts until Bitbucket reports the runner ONLINE.
+	Provisioning time.Duration `yaml:"provisioning"`
+	// Draining is how long a draining runner may keep running its step
+	// before it is removed anyway.
+	Draining       time.Duration `yaml:"draining"`
+	Deprovisioning time.Duration `yaml:"deprovisioning"`
+}
+
+// ScalingRules limit scaling in one direction.
+type ScalingRules struct {
+	// StabilizationWindow is how long past recommendations are considered:
+	// scale up follows the lowest of them and scale down the highest, so
+	// short spikes and dips are ignored.
+	StabilizationWindow time.Duration `yaml:"stabilization_window"`
+	// Cooldown is the minimum time since the last scaling action, in either
+	// direction, before scaling this way again.
+	Cooldown time.Duration `yaml:"cooldown"`
+	// MaxStep caps how many runners are added or removed per reconcile. Zero
+	// means no limit.
+	MaxStep int `yaml:"max_step"`
+}
+
+// Schedule overrides the pool bounds at given times of the day or week.
+type Schedule struct {
+	// Timezone the start expressions and holidays are evaluated in, e.g.
+	// Europe/Rome. Defaults to UTC.
+	Timezone string    `yaml:"timezone"`
+	Profiles []Profile `yaml:"profiles"`
+	// Holidays are dates (YYYY-MM-DD) on which no profile applies.
+	Holidays []string `yaml:"holidays"`
+}
+
+// Prediction enables pre-warming runners ahead of the demand forecast from
+// the pool's own history.
+type Prediction struct {
+	// Timezone in which hours and weekdays are counted. Defaults to UTC.
+	Timezone string `yaml:"timezone"`
+	// Lead is how far ahead of the forecast runners are started.
+	Lead time.Duration `yaml:"lead"`
+	// Alpha in (0, 1] is the weight of the newest week in the forecast.
+	Alpha float64 `yaml:"alpha"`
+}
+
+// Profile replaces the pool min and max while it is active: from every time
+// matching the cron expression Start, for Duration. When several profiles are
+// active the first one listed wins.
+type Profile struct {
+	Min      *int          `yaml:"min"`
+	Max      *int          `yaml:"max"`
+	Warm     *int          `yaml:"warm"`
+	Name     string        `yaml:"name"`
+	Start    string        `yaml:"start"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+// Load reads the YAML configuration at path. Environment variables referenced
+// as ${VAR} are expanded before parsing so secrets can stay out of the file.
+// Any other dollar sign is kept, and $$ stands for a single one.
+func Load(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	return Parse(raw)
+}
+
+// expandEnv replaces every ${VAR} in s with the value of the environment
+// variable, and every $$ with $. Bare $VAR is left alone, so launch template
+// versions like $Latest and shell variables in scripts survive.
+func expandEnv(s string) string {
+	return envPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		return os.Getenv(match[2 : len(match)-1])
+	})
+}
+
+func Parse(raw []byte) (*Config, error) {
+	decoder := yaml.NewDecoder(strings.NewReader(expandEnv(string(raw))))
+	decoder.KnownFields(true)
+
+	var cfg Config
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	cfg.applyDefaults()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func (c *Config) applyDefaults() {
+	if c.Interval == 0 {
+		c.Interval = DefaultInterval
+	}
+
+	c.LeaderElection.applyDefaults()
+
+	for i := range c.Providers {
+		c.Providers[i].applyDefaults()
+	}
+
+	for i := range c.Workspaces {
+		w := &c.Workspaces[i]
+
+		if w.Name == "" {
+			w.Name = w.Slug
+		}
+
+		if w.BaseURL == "" {
+			w.BaseURL = DefaultBaseURL
+		}
+
+		if w.AccessTokenURL == "" {
+			w.AccessTokenURL = DefaultAccessTokenURL
+		}
+
+		if w.CacheTTL == 0 {
+			w.CacheTTL = DefaultCacheTTL
+		}
+
+		w.RateLimit.applyDefaults()
+
+		for j := range w.Pools {
+			if w.Pools[j].TargetUtilization == 0 {
+				w.Pools[j].TargetUtilization = DefaultTargetUtilization
+			}
+
+			if w.Pools[j].LabelDrift == "" {
+				w.Pools[j].LabelDrift = LabelDriftPatch
+			}
+
+			w.Pools[j].Timeouts.applyDefaults()
+
+			if consistency := w.Pools[j].Consistency; consistency != nil {
+				consistency.applyDefaults()
+			}
+
+			if prediction := w.Pools[j].Prediction; prediction != nil {
+				if prediction.Lead == 0 {
+					prediction.Lead = DefaultPredictionLead
+				}
+
+				if prediction.Alpha == 0 {
+					prediction.Alpha = DefaultPredictionAlpha
+				}
+			}
+		}
+	}
+}
+
+func (r *RateLimit) applyDefaults() {
+	if r.Budget == 0 {
+		r.Budget = DefaultRateLimitBudget
+	}
+
+	if r.Period == 0 {
+		r.Period = DefaultRateLimitPeriod
+	}
+
+	if r.Burst == 0 {
+		r.Burst = DefaultRateLimitBurst
+	}
+
+	if r.Reserve == 0 {
+		r.Reserve = DefaultRateLimitReserve
+	}
+}
+
+func (c *Config) Validate() error {
+	if len(c.Workspaces) == 0 {
+		return errors.New("invalid config: at least one workspace is required")
+	}
+
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid config: interval must be positive, got %s", c.Interval)
+	}
+
+	if err := c.LeaderElection.validate(); err != nil {
+		return fmt.Errorf("invalid config: leader_election: %w", err)
+	}
+
+	// A state file belongs to one replica, which would replay it on taking
+	// over although the previous leader changed the runners since.
+	if c.StateFile != "" && c.LeaderElection.Backend != "" {
+		return errors.New("invalid config: state_file cannot be combined with leader_election")
+	}
+
+	names := make(map[string]struct{}, len(c.Workspaces))
+
+	for i := range c.Workspaces {
+		w := &c.Workspaces[i]
+
+		if w.Name == "" {
+			return fmt.Errorf("invalid config: workspace #%d has no name", i)
+		}
+
+		if _, ok := names[w.Name]; ok {
+			return fmt.Errorf("invalid config: duplicate workspace %q", w.Name)
+		}
+
+		names[w.Name] = struct{}{}
+
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("invalid config: workspace %q: %w", w.Name, err)
+		}
+	}
+
+	if err := c.validateProviders(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	return nil
+}
+
+func (w *Workspace) validate() error {
+	if w.UUID == "" && w.Slug == "" {
+		return errors.New("slug or uuid is required")
+	}
+
+	if w.ClientID == "" || w.ClientSecret == "" {
+		return errors.New("client_id and client_secret are required")
+	}
+
+	if w.CacheTTL < 0 {
+		return fmt.Errorf("cache_ttl must be positive, got %s", w.CacheTTL)
+	}
+
+	if err := w.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rate_limit: %w", err)
+	}
+
+	pools := make(map[string]struct{}, len(w.Pools))
+
+	for i := range w.Pools {
+		p := &w.Pools[i]
+
+		if _, ok := pools[p.Name]; ok {
+			return fmt.Errorf("duplicate pool %q", p.Name)
+		}
+
+		pools[p.Name] = struct{}{}
+
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("pool %q: %w", p.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *RateLimit) validate() error {
+	if r.Budget < 0 || r.Period < 0 || r.Burst < 0 {
+		return errors.New("budget, period and burst must be positive")
+	}
+
+	if r.Reserve < 0 || r.Reserve >= r.Burst {
+		return fmt.Errorf("reserve must be between 0 and burst (%d), got %d", r.Burst, r.Reserve)
+	}
+
+	return nil
+}
+
+func (l *LeaderElection) applyDefaults() {
+	if l.Backend == "" {
+		return
+	}
+
+	if l.Identity == "" {
+		l.Identity, _ = os.Hostname()
+	}
+
+	if l.Name == "" {
+		l.Name = DefaultLeaseName
+	}
+
+	if l.LeaseDuration == 0 {
+		l.LeaseDuration = DefaultLeaseDuration
+	}
+
+	if l.RenewDeadline == 0 {
+		l.RenewDeadline = DefaultRenewDeadline
+	}
+
+	if l.RetryPeriod == 0 {
+		l.RetryPeriod = DefaultRetryPeriod
+	}
+}
+
+func (l *LeaderElection) validate() error {
+	switch l.Backend {
+	case "":
+		return nil
+	case LeaderElectionKubernetes:
+	case LeaderElectionFile:
+		if l.Path == "" {
+			return errors.New("path is required for the file backend")
+		}
+	default:
+		return fmt.Errorf("backend must be kubernetes or file, got %q", l.Backend)
+	}
+
+	if l.Identity == "" {
+		return errors.New("identity is required when the hostname is unknown")
+	}
+
+	if l.RetryPeriod <= 0 || l.RenewDeadline <= l.RetryPeriod || l.LeaseDuration <= l.RenewDeadline {
+		return fmt.Errorf(
+			"durations must satisfy 0 < retry_period < renew_deadline < lease_duration, got %s, %s and %s",
+			l.RetryPeriod, l.RenewDeadline, l.LeaseDuration,
+		)
+	}
+
+	return nil
+}
+
+func (t *Timeouts) applyDefaults() {
+	if t.Registering == 0 {
+		t.Registering = DefaultRegisteringTimeout
+	}
+
+	if t.Provisioning == 0 {
+		t.Provisioning = DefaultProvisioningTimeout
+	}
+
+	if t.Draining == 0 {
+		t.Draining = DefaultDrainingTimeout
+	}
+
+	if t.Deprovisioning == 0 {
+		t.Deprovisioning = DefaultDeprovisioningTimeout
+	}
+}
+
+func (p *Pool) validate() error {
+	if !poolNamePattern.MatchString(p.Name) {
+		return errors.New("name must be lowercase alphanumeric with dashes")
+	}
+
+	if p.Min < 0 || p.Max < p.Min || p.Max == 0 {
+		return fmt.Errorf("bounds must satisfy 0 <= min <= max and max > 0, got min %d max %d", p.Min, p.Max)
+	}
+
+	if p.Warm < 0 || p.Warm > p.Max {
+		return fmt.Errorf("warm must satisfy 0 <= warm <= max, got %d", p.Warm)
+	}
+
+	if p.MaxIdleAge < 0 {
+		return fmt.Errorf("max_idle_age must not be negative, got %s", p.MaxIdleAge)
+	}
+
+	if p.TargetUtilization <= 0 || p.TargetUtilization > 1 {
+		return fmt.Errorf("target_utilization must be in (0, 1], got %v", p.TargetUtilization)
+	}
+
+	switch p.LabelDrift {
+	case LabelDriftPatch, LabelDriftReplace, LabelDriftIgnore:
+	default:
+		return fmt.Errorf("label_drift must be one of patch, replace or ignore, got %q", p.LabelDrift)
+	}
+
+	if err := p.validateProviders(); err != nil {
+		return err
+	}
+
+	if p.Timeouts.Registering < 0 || p.Timeouts.Provisioning < 0 || p.Timeouts.Draining < 0 || p.Timeouts.Deprovisioning < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+
+	if err := p.Behavior.validate(); err != nil {
+		return fmt.Errorf("behavior: %w", err)
+	}
+
+	if p.Schedule != nil {
+		if err := p.Schedule.validate(p.Min, p.Max, p.Warm); err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+	}
+
+	if p.Prediction != nil {
+		if err := p.Prediction.validate(); err != nil {
+			return fmt.Errorf("prediction: %w", err)
+		}
+	}
+
+	if p.Consistency != nil {
+		if len(p.ProviderChain()) == 0 {
+			return errors.New("consistency requires a provider")
+		}
+
+		if err := p.Consistency.validate(); err != nil {
+			return fmt.Errorf("consistency: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (b *Behavior) validate() error {
+	if b.MinRunnerLifetime < 0 {
+		return fmt.Errorf("min_runner_lifetime must not be negative, got %s", b.MinRunnerLifetime)
+	}
+
+	if err := b.ScaleUp.validate(); err != nil {
+		return fmt.Errorf("scale_up: %w", err)
+	}
+
+	if err := b.ScaleDown.validate(); err != nil {
+		return fmt.Errorf("scale_down: %w", err)
+	}
+
+	return nil
+}
+
+func (r *ScalingRules) validate() error {
+	if r.StabilizationWindow < 0 || r.Cooldown < 0 || r.MaxStep < 0 {
+		return fmt.Errorf(
+			"stabilization_window, cooldown and max_step must not be negative, got %s, %s and %d",
+			r.StabilizationWindow, r.Cooldown, r.MaxStep,
+		)
+	}
+
+	return nil
+}
+
+func (p *Prediction) validate() error {
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", p.Timezone, err)
+	}
+
+	if p.Lead < 0 {
+		return fmt.Errorf("lead must be positive, got %s", p.Lead)
+	}
+
+	if p.Alpha <= 0 || p.Alpha > 1 {
+		return fmt.Errorf("alpha must be in (0, 1], got %v", p.Alpha)
+	}
+
+	return nil
+}
+
+func (s *Schedule) validate(poolMin, poolMax, poolWarm int) error {
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", s.Timezone, err)
+	}
+
+	for _, holiday := range s.Holidays {
+		if _, err := time.Parse(time.DateOnly, holiday); err != nil {
+			return fmt.Errorf("invalid holiday %q, expected YYYY-MM-DD", holiday)
+		}
+	}
+
+	names := make(map[string]struct{}, len(s.Profiles))
+
+	for _, profile := range s.Profiles {
+		if profile.Name == "" {
+			return errors.New("every profile needs a name")
+		}
+
+		if _, ok := names[profile.Name]; ok {
+			return fmt.Errorf("duplicate profile %q", profile.Name)
+		}
+
+		names[profile.Name] = struct{}{}
+
+		if _, err := cron.ParseStandard(profile.Start); err != nil {
+			return fmt.Errorf("profile %q: invalid start %q: %w", profile.Name, profile.Start, err)
+		}
+
+		if profile.Duration <= 0 {
+			return fmt.Errorf("profile %q: duration must be positive", profile.Name)
+		}
+
+		lower, upper, warm := poolMin, poolMax, poolWarm
+		if profile.Min != nil {
+			lower = *profile.Min
+		}
+
+		if profile.Max != nil {
+			upper = *profile.Max
+		}
+
+		if lower < 0 || upper < lower {
+			return fmt.Errorf("profile %q: bounds must satisfy 0 <= min <= max, got min %d max %d", profile.Name, lower, upper)
+		}
+
+		if profile.Warm != nil {
+			warm = *profile.Warm
+		}
+
+		if warm < 0 || warm > upper {
+			return fmt.Errorf("profile %q: warm must satisfy 0 <= warm <= max, got warm %d max %d", profile.Name, warm, upper)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,577 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	t.Setenv("ACME_SECRET", "s3cr3t")
+
+	const valid = `
+workspaces:
+  - slug: acme
+    client_id: id
+    client_secret: ${ACME_SECRET}
+    pools:
+      - name: linux
+        labels: [self.hosted, linux]
+        min: 1
+        max: 10
+`
+
+	tables := []struct {
+		name          string
+		raw           string
+		expectedError string
+	}{
+		{name: "happy path", raw: valid},
+		{name: "no workspaces", raw: "interval: 10s", expectedError: "invalid config: at least one workspace is required"},
+		{
+			name:          "unknown field",
+			raw:           "workspaces: []\nfoo: bar",
+			expectedError: "failed to parse config: yaml: unmarshal errors:\n  line 2: field foo not found in type config.Config",
+		},
+		{
+			name: "duplicate workspace",
+			raw: `
+workspaces:
+  - {name: acme, uuid: "{1}", client_id: id, client_secret: s}
+  - {name: acme, uuid: "{2}", client_id: id, client_secret: s}
+`,
+			expectedError: `invalid config: duplicate workspace "acme"`,
+		},
+		{
+			name: "missing slug and uuid",
+			raw: `
+workspaces:
+  - {name: acme, client_id: id, client_secret: s}
+`,
+			expectedError: `invalid config: workspace "acme": slug or uuid is required`,
+		},
+		{
+			name: "missing credentials",
+			raw: `
+workspaces:
+  - {name: acme, uuid: "{1}"}
+`,
+			expectedError: `invalid config: workspace "acme": client_id and client_secret are required`,
+		},
+		{
+			name: "reserve exceeds burst",
+			raw: `
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    rate_limit: {burst: 5, reserve: 5}
+`,
+			expectedError: `invalid config: workspace "acme": rate_limit: reserve must be between 0 and burst (5), got 5`,
+		},
+		{
+			name: "invalid pool bounds",
+			raw: `
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, min: 5, max: 2}
+`,
+			expectedError: `invalid config: workspace "acme": pool "linux": bounds must satisfy 0 <= min <= max and max > 0, got min 5 max 2`,
+		},
+		{
+			name: "invalid pool name",
+			raw: `
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: Linux_Pool, max: 2}
+`,
+			expectedError: `invalid config: workspace "acme": pool "Linux_Pool": name must be lowercase alphanumeric with dashes`,
+		},
+		{
+			name: "invalid prediction alpha",
+			raw: `
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, prediction: {alpha: 1.5}}
+`,
+			expectedError: `invalid config: workspace "acme": pool "linux": prediction: alpha must be in (0, 1], got 1.5`,
+		},
+		{
+			name: "profile warm above profile max",
+			raw: `
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - name: linux
+        max: 10
+        warm: 2
+        schedule:
+          profiles:
+            - {name: night, start: "0 20 * * *", duration: 10h, max: 1}
+`,
+			expectedError: `invalid config: workspace "acme": pool "linux": schedule: ` +
+				`profile "night": warm must satisfy 0 <= warm <= max, got warm 2 max 1`,
+		},
+		{
+			name: "negative scale down step",
+			raw: `
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, behavior: {scale_down: {max_step: -1}}}
+`,
+			expectedError: `invalid config: workspace "acme": pool "linux": behavior: scale_down: ` +
+				`stabilization_window, cooldown and max_step must not be negative, got 0s, 0s and -1`,
+		},
+		{
+			name:          "file leader election without path",
+			raw:           valid + "leader_election: {backend: file}\n",
+			expectedError: "invalid config: leader_election: path is required for the file backend",
+		},
+		{
+			name:          "unknown leader election backend",
+			raw:           valid + "leader_election: {backend: etcd}\n",
+			expectedError: `invalid config: leader_election: backend must be kubernetes or file, got "etcd"`,
+		},
+		{
+			name:          "state file with leader election",
+			raw:           valid + "state_file: state.db\nleader_election: {backend: kubernetes}\n",
+			expectedError: "invalid config: state_file cannot be combined with leader_election",
+		},
+		{
+			name: "renew deadline past lease duration",
+			raw:  valid + "leader_election: {backend: kubernetes, lease_duration: 5s}\n",
+			expectedError: "invalid config: leader_election: durations must satisfy " +
+				"0 < retry_period < renew_deadline < lease_duration, got 2s, 10s and 5s",
+		},
+		{
+			name:          "pool with unknown provider",
+			raw:           valid + "        provider: aws\n",
+			expectedError: `invalid config: workspace "acme": pool "linux": unknown provider "aws"`,
+		},
+		{
+			name:          "pool with unknown fallback provider",
+			raw:           valid + "        providers: [{name: aws}]\n",
+			expectedError: `invalid config: workspace "acme": pool "linux": unknown provider "aws"`,
+		},
+		{
+			name:          "pool with provider and providers",
+			raw:           valid + "        provider: aws\n        providers: [{name: gcp}]\n",
+			expectedError: `invalid config: workspace "acme": pool "linux": provider and providers are mutually exclusive`,
+		},
+		{
+			name:          "pool with duplicate provider",
+			raw:           valid + "        providers: [{name: aws}, {name: aws}]\n",
+			expectedError: `invalid config: workspace "acme": pool "linux": providers: duplicate provider "aws"`,
+		},
+		{
+			name:          "pool with negative provider cost",
+			raw:           valid + "        providers: [{name: aws, cost: -1}]\n",
+			expectedError: `invalid config: workspace "acme": pool "linux": providers: cost of "aws" must not be negative, got -1`,
+		},
+		{
+			name:          "consistency without provider",
+			raw:           valid + "        consistency: {}\n",
+			expectedError: `invalid config: workspace "acme": pool "linux": consistency requires a provider`,
+		},
+		{
+			name: "consistency with action not fit for the class",
+			raw:  valid + "        provider: aws\n        consistency: {unbacked: destroy_workload}\n",
+			expectedError: `invalid config: workspace "acme": pool "linux": consistency: ` +
+				`unbacked must be one of [reprovision delete_registration ignore], got "destroy_workload"`,
+		},
+		{
+			name:          "consistency with negative grace",
+			raw:           valid + "        provider: aws\n        consistency: {grace: -1m}\n",
+			expectedError: `invalid config: workspace "acme": pool "linux": consistency: grace and offline_after must not be negative, got -1m0s and 30m0s`,
+		},
+		{
+			name:          "unknown provider type",
+			raw:           valid + "providers: [{name: aws, type: ec3}]\n",
+			expectedError: `invalid config: provider "aws": unknown type "ec3"`,
+		},
+		{
+			name:          "ec2 without launch template",
+			raw:           valid + "providers: [{name: aws, type: ec2, ec2: {region: eu-west-1}}]\n",
+			expectedError: `invalid config: provider "aws": ec2: launch_template needs either id or name`,
+		},
+		{
+			name: "ec2 fallback on on-demand",
+			raw: valid + `providers:
+  - {name: aws, type: ec2, ec2: {region: eu-west-1, launch_template: {name: runner}, on_demand_fallback: true}}
+`,
+			expectedError: `invalid config: provider "aws": ec2: on_demand_fallback only applies to the spot market`,
+		},
+		{
+			name: "ec2 packing without ssm",
+			raw: valid + `providers:
+  - {name: aws, type: ec2, ec2: {region: eu-west-1, launch_template: {name: runner}, runners_per_instance: 2}}
+`,
+			expectedError: `invalid config: provider "aws": ec2: runners_per_instance above 1 requires ssm credentials`,
+		},
+		{
+			name:          "gce without instance template",
+			raw:           valid + "providers: [{name: gcp, type: gce, gce: {project: acme-ci, zone: europe-west1-b}}]\n",
+			expectedError: `invalid config: provider "gcp": gce: instance_template is required`,
+		},
+		{
+			name: "gce unknown provisioning",
+			raw: valid + `providers:
+  - {name: gcp, type: gce, gce: {project: acme-ci, zone: europe-west1-b, instance_template: runner, provisioning: cheap}}
+`,
+			expectedError: `invalid config: provider "gcp": gce: provisioning must be standard, spot or preemptible, got "cheap"`,
+		},
+		{
+			name: "gce negative provision timeout",
+			raw: valid + `providers:
+  - {name: gcp, type: gce, gce: {project: acme-ci, zone: europe-west1-b, instance_template: runner, provision_timeout: -1m}}
+`,
+			expectedError: `invalid config: provider "gcp": gce: provision_timeout must not be negative`,
+		},
+		{
+			name:          "vmss without settings",
+			raw:           valid + "providers: [{name: azure, type: vmss}]\n",
+			expectedError: `invalid config: provider "azure": vmss settings are required`,
+		},
+		{
+			name:          "vmss without scale set",
+			raw:           valid + "providers: [{name: azure, type: vmss, vmss: {subscription_id: sub, resource_group: ci}}]\n",
+			expectedError: `invalid config: provider "azure": vmss: subscription_id, resource_group and scale_set are required`,
+		},
+		{
+			name:          "nomad without address",
+			raw:           valid + "providers: [{name: nomad, type: nomad, nomad: {}}]\n",
+			expectedError: `invalid config: provider "nomad": nomad: address is required`,
+		},
+		{
+			name:          "nomad exec driver without config",
+			raw:           valid + "providers: [{name: nomad, type: nomad, nomad: {address: http://nomad:4646, driver: exec}}]\n",
+			expectedError: `invalid config: provider "nomad": nomad: config is required for driver "exec"`,
+		},
+		{
+			name:          "process without command",
+			raw:           valid + "providers: [{name: bare-metal, type: process, process: {work_dir: /srv/runners}}]\n",
+			expectedError: `invalid config: provider "bare-metal": process: command is required`,
+		},
+		{
+			name: "ssh duplicate host",
+			raw: valid + `providers:
+  - {name: vms, type: ssh, ssh: {private_key_file: k, known_hosts_file: h, hosts: [{address: a}, {address: a}]}}
+`,
+			expectedError: `invalid config: provider "vms": ssh: duplicate host "a"`,
+		},
+		{
+			name:          "ssh without known hosts",
+			raw:           valid + "providers: [{name: vms, type: ssh, ssh: {private_key_file: k, hosts: [{address: a}]}}]\n",
+			expectedError: `invalid config: provider "vms": ssh: private_key_file and known_hosts_file are required`,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(table.raw))
+
+			if table.expectedError != "" {
+				assert.EqualError(t, err, table.expectedError)
+				assert.Nil(t, cfg)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, DefaultInterval, cfg.Interval)
+			assert.Equal(t, "acme", cfg.Workspaces[0].Name)
+			assert.Equal(t, "s3cr3t", cfg.Workspaces[0].ClientSecret)
+			assert.Equal(t, DefaultBaseURL, cfg.Workspaces[0].BaseURL)
+			assert.Equal(t, DefaultAccessTokenURL, cfg.Workspaces[0].AccessTokenURL)
+			assert.Equal(t, DefaultCacheTTL, cfg.Workspaces[0].CacheTTL)
+			assert.Equal(t, RateLimit{
+				Budget:  DefaultRateLimitBudget,
+				Period:  DefaultRateLimitPeriod,
+				Burst:   DefaultRateLimitBurst,
+				Reserve: DefaultRateLimitReserve,
+			}, cfg.Workspaces[0].RateLimit)
+			assert.InDelta(t, DefaultTargetUtilization, cfg.Workspaces[0].Pools[0].TargetUtilization, 0)
+		})
+	}
+}
+
+func TestPredictionDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, prediction: {}}
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, &Prediction{Lead: DefaultPredictionLead, Alpha: DefaultPredictionAlpha}, cfg.Workspaces[0].Pools[0].Prediction)
+}
+
+func TestConsistencyDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, provider: aws, consistency: {offline: ignore}}
+providers:
+  - {name: aws, type: ec2, ec2: {region: eu-west-1, launch_template: {name: runner}}}
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, &Consistency{
+		Unbacked:     ConsistencyReprovision,
+		Orphaned:     ConsistencyDestroyWorkload,
+		Offline:      ConsistencyIgnore,
+		Grace:        DefaultConsistencyGrace,
+		OfflineAfter: DefaultConsistencyOfflineAfter,
+	}, cfg.Workspaces[0].Pools[0].Consistency)
+}
+
+func TestLeaderElectionDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2}
+leader_election:
+  backend: kubernetes
+  identity: autoscaler-0
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, LeaderElection{
+		Backend:       LeaderElectionKubernetes,
+		Identity:      "autoscaler-0",
+		Name:          DefaultLeaseName,
+		LeaseDuration: DefaultLeaseDuration,
+		RenewDeadline: DefaultRenewDeadline,
+		RetryPeriod:   DefaultRetryPeriod,
+	}, cfg.LeaderElection)
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("ACME_SECRET", "s3cr3t")
+
+	tables := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{name: "braced variable", raw: "secret: ${ACME_SECRET}", expected: "secret: s3cr3t"},
+		{name: "unset variable", raw: "secret: ${ACME_UNSET}", expected: "secret: "},
+		{name: "bare variable is kept", raw: "version: $Latest", expected: "version: $Latest"},
+		{name: "shell variables are kept", raw: `echo "$credentials" $1`, expected: `echo "$credentials" $1`},
+		{name: "escaped dollar", raw: "echo $${HOME} $$", expected: "echo ${HOME} $"},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expected, expandEnv(table.raw))
+		})
+	}
+}
+
+func TestParseKeepsLaunchTemplateVersion(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, provider: aws}
+providers:
+  - name: aws
+    type: ec2
+    ec2:
+      region: eu-west-1
+      launch_template: {id: lt-0123456789abcdef0, version: $Latest}
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "$Latest", cfg.Providers[0].EC2.LaunchTemplate.Version)
+}
+
+func TestEC2Defaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, provider: aws}
+providers:
+  - name: aws
+    type: ec2
+    ec2:
+      region: eu-west-1
+      launch_template: {id: lt-0123456789abcdef0}
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, &EC2{
+		Region:             "eu-west-1",
+		LaunchTemplate:     LaunchTemplate{ID: "lt-0123456789abcdef0"},
+		Credentials:        EC2CredentialsUserData,
+		SSMPrefix:          DefaultEC2SSMPrefix,
+		Market:             EC2MarketOnDemand,
+		RunnersPerInstance: 1,
+	}, cfg.Providers[0].EC2)
+}
+
+func TestNomadDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, provider: nomad}
+providers:
+  - name: nomad
+    type: nomad
+    nomad:
+      address: http://nomad.service.consul:4646
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, &Nomad{
+		Address:  "http://nomad.service.consul:4646",
+		Driver:   NomadDriverDocker,
+		Image:    DefaultNomadImage,
+		CPU:      DefaultNomadCPU,
+		MemoryMB: DefaultNomadMemoryMB,
+	}, cfg.Providers[0].Nomad)
+}
+
+func TestProcessDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, provider: bare-metal}
+providers:
+  - name: bare-metal
+    type: process
+    process:
+      command: [/opt/runner/start.sh]
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, &Process{
+		Command:     []string{"/opt/runner/start.sh"},
+		WorkDir:     DefaultProcessWorkDir,
+		LogDir:      DefaultProcessWorkDir,
+		StopTimeout: DefaultProcessStopTimeout,
+	}, cfg.Providers[0].Process)
+}
+
+func TestVMSSDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, provider: azure}
+providers:
+  - name: azure
+    type: vmss
+    vmss: {subscription_id: sub, resource_group: ci, scale_set: runners}
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, &VMSS{
+		SubscriptionID:   "sub",
+		ResourceGroup:    "ci",
+		ScaleSet:         "runners",
+		ProvisionTimeout: DefaultVMSSProvisionTimeout,
+	}, cfg.Providers[0].VMSS)
+}
+
+func TestSSHDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+workspaces:
+  - name: acme
+    uuid: "{1}"
+    client_id: id
+    client_secret: s
+    pools:
+      - {name: linux, max: 2, provider: vms}
+providers:
+  - name: vms
+    type: ssh
+    ssh:
+      private_key_file: /etc/key
+      known_hosts_file: /etc/known_hosts
+      runners_per_host: 2
+      hosts: [{address: build-01}, {address: build-02, max_runners: 4}]
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, &SSH{
+		User:           DefaultSSHUser,
+		PrivateKeyFile: "/etc/key",
+		KnownHostsFile: "/etc/known_hosts",
+		Hosts:          []SSHHost{{Address: "build-01", MaxRunners: 2}, {Address: "build-02", MaxRunners: 4}},
+		RunnersPerHost: 2,
+		ConnectTimeout: DefaultSSHConnectTimeout,
+	}, cfg.Providers[0].SSH)
+}
+
+func TestProviderChain(t *testing.T) {
+	tables := []struct {
+		name     string
+		expected []PoolProvider
+		pool     Pool
+	}{
+		{name: "no provider", pool: Pool{}},
+		{name: "single provider", pool: Pool{Provider: "aws"}, expected: []PoolProvider{{Name: "aws"}}},
+		{
+			name:     "fallback providers",
+			pool:     Pool{Providers: []PoolProvider{{Name: "k8s"}, {Name: "spot", Cost: 1}}},
+			expected: []PoolProvider{{Name: "k8s"}, {Name: "spot", Cost: 1}},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expected, table.pool.ProviderChain())
+		})
+	}
+}
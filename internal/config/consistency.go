@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Actions fixing a runner whose registration and compute disagree.
+const (
+	ConsistencyReprovision        string = "reprovision"
+	ConsistencyDeleteRegistration string = "delete_registration"
+	ConsistencyDestroyWorkload    string = "destroy_workload"
+	ConsistencyIgnore             string = "ignore"
+
+	DefaultConsistencyGrace        time.Duration = 15 * time.Minute
+	DefaultConsistencyOfflineAfter time.Duration = 30 * time.Minute
+)
+
+// Consistency checks the runners registered in Bitbucket against the compute
+// listed by the pool providers, and decides what happens to each kind of
+// mismatch.
+type Consistency struct {
+	// Unbacked is the action for registrations without compute.
+	Unbacked string `yaml:"unbacked"`
+	// Orphaned is the action for compute without a registration.
+	Orphaned string `yaml:"orphaned"`
+	// Offline is the action for runners whose compute is there but which
+	// have been offline for longer than OfflineAfter.
+	Offline string `yaml:"offline"`
+	// Grace is how old registrations and compute must be before they are
+	// checked, so runners being created are left alone.
+	Grace        time.Duration `yaml:"grace"`
+	OfflineAfter time.Duration `yaml:"offline_after"`
+}
+
+func (c *Consistency) applyDefaults() {
+	if c.Unbacked == "" {
+		c.Unbacked = ConsistencyReprovision
+	}
+
+	if c.Orphaned == "" {
+		c.Orphaned = ConsistencyDestroyWorkload
+	}
+
+	if c.Offline == "" {
+		c.Offline = ConsistencyReprovision
+	}
+
+	if c.Grace == 0 {
+		c.Grace = DefaultConsistencyGrace
+	}
+
+	if c.OfflineAfter == 0 {
+		c.OfflineAfter = DefaultConsistencyOfflineAfter
+	}
+}
+
+func (c *Consistency) validate() error {
+	for _, class := range []struct {
+		name    string
+		action  string
+		allowed []string
+	}{
+		{
+			name:    "unbacked",
+			action:  c.Unbacked,
+			allowed: []string{ConsistencyReprovision, ConsistencyDeleteRegistration, ConsistencyIgnore},
+		},
+		{
+			name:    "orphaned",
+			action:  c.Orphaned,
+			allowed: []string{ConsistencyDestroyWorkload, ConsistencyIgnore},
+		},
+		{
+			name:   "offline",
+			action: c.Offline,
+			allowed: []string{
+				ConsistencyReprovision, ConsistencyDeleteRegistration, ConsistencyDestroyWorkload, ConsistencyIgnore,
+			},
+		},
+	} {
+		if !slices.Contains(class.allowed, class.action) {
+			return fmt.Errorf("%s must be one of %v, got %q", class.name, class.allowed, class.action)
+		}
+	}
+
+	if c.Grace < 0 || c.OfflineAfter < 0 {
+		return fmt.Errorf("grace and offline_after must not be negative, got %s and %s", c.Grace, c.OfflineAfter)
+	}
+
+	return nil
+}
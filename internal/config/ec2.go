@@ -0,0 +1,109 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	EC2CredentialsUserData string = "user-data"
+	EC2CredentialsSSM      string = "ssm"
+
+	EC2MarketOnDemand string = "on-demand"
+	EC2MarketSpot     string = "spot"
+
+	DefaultEC2SSMPrefix string = "/bitbucket-runner-autoscaler"
+)
+
+// EC2 launches an instance per runner, or one per RunnersPerInstance runners,
+// from a launch template.
+type EC2 struct {
+	Region string `yaml:"region"`
+	// Endpoint overrides the EC2, SSM and SQS endpoints, for example to
+	// reach them through a VPC endpoint.
+	Endpoint       string         `yaml:"endpoint"`
+	LaunchTemplate LaunchTemplate `yaml:"launch_template"`
+	// InstanceType and SubnetID override the launch template.
+	InstanceType string `yaml:"instance_type"`
+	SubnetID     string `yaml:"subnet_id"`
+	// Credentials is how runner credentials reach the instance:
+	// EC2CredentialsUserData or EC2CredentialsSSM.
+	Credentials string `yaml:"credentials"`
+	// SSMPrefix is the path under which SecureString parameters holding
+	// the runner credentials are created.
+	SSMPrefix string `yaml:"ssm_prefix"`
+	// UserData is a Go template rendered into the instance user data. It
+	// defaults to a script starting the runner container.
+	UserData string `yaml:"user_data"`
+	// Market is EC2MarketOnDemand or EC2MarketSpot.
+	Market string `yaml:"market"`
+	// InterruptionQueueURL is an SQS queue receiving the spot interruption
+	// warnings and rebalance recommendations of EventBridge. Messages are
+	// deleted once handled, so the queue must not be shared.
+	InterruptionQueueURL string `yaml:"interruption_queue_url"`
+	// RunnersPerInstance packs several runners on one instance. Runners
+	// after the first are announced through tags and SSM, so it requires
+	// EC2CredentialsSSM and an image that starts them.
+	RunnersPerInstance int `yaml:"runners_per_instance"`
+	// OnDemandFallback launches an on-demand instance when spot capacity
+	// is not available.
+	OnDemandFallback bool `yaml:"on_demand_fallback"`
+}
+
+// LaunchTemplate is referenced by ID or by name. Version defaults to the
+// template default version.
+type LaunchTemplate struct {
+	ID      string `yaml:"id"`
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+}
+
+func (e *EC2) applyDefaults() {
+	if e.Credentials == "" {
+		e.Credentials = EC2CredentialsUserData
+	}
+
+	if e.SSMPrefix == "" {
+		e.SSMPrefix = DefaultEC2SSMPrefix
+	}
+
+	if e.Market == "" {
+		e.Market = EC2MarketOnDemand
+	}
+
+	if e.RunnersPerInstance == 0 {
+		e.RunnersPerInstance = 1
+	}
+}
+
+func (e *EC2) validate() error {
+	if e.Region == "" {
+		return errors.New("region is required")
+	}
+
+	if (e.LaunchTemplate.ID == "") == (e.LaunchTemplate.Name == "") {
+		return errors.New("launch_template needs either id or name")
+	}
+
+	if e.Credentials != EC2CredentialsUserData && e.Credentials != EC2CredentialsSSM {
+		return fmt.Errorf("credentials must be user-data or ssm, got %q", e.Credentials)
+	}
+
+	if e.Market != EC2MarketOnDemand && e.Market != EC2MarketSpot {
+		return fmt.Errorf("market must be on-demand or spot, got %q", e.Market)
+	}
+
+	if e.OnDemandFallback && e.Market != EC2MarketSpot {
+		return errors.New("on_demand_fallback only applies to the spot market")
+	}
+
+	if e.RunnersPerInstance < 1 {
+		return fmt.Errorf("runners_per_instance must be at least 1, got %d", e.RunnersPerInstance)
+	}
+
+	if e.RunnersPerInstance > 1 && e.Credentials != EC2CredentialsSSM {
+		return errors.New("runners_per_instance above 1 requires ssm credentials")
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const DefaultGCEProvisionTimeout time.Duration = 5 * time.Minute
+
+const (
+	GCEProvisioningStandard    string = "standard"
+	GCEProvisioningSpot        string = "spot"
+	GCEProvisioningPreemptible string = "preemptible"
+)
+
+// GCE creates an instance per runner from an instance template.
+type GCE struct {
+	Project string `yaml:"project"`
+	Zone    string `yaml:"zone"`
+	// InstanceTemplate is the name of a global instance template.
+	InstanceTemplate string `yaml:"instance_template"`
+	// Endpoint overrides the Compute Engine API endpoint.
+	Endpoint string `yaml:"endpoint"`
+	// MachineType overrides the instance template.
+	MachineType string `yaml:"machine_type"`
+	// StartupScript is a Go template rendered into the startup-script
+	// metadata. It defaults to a script starting the runner container with
+	// the credentials read from the metadata server.
+	StartupScript string `yaml:"startup_script"`
+	// Provisioning is GCEProvisioningStandard, GCEProvisioningSpot or
+	// GCEProvisioningPreemptible.
+	Provisioning string `yaml:"provisioning"`
+	// ProvisionTimeout bounds creating the instance and waiting for
+	// Compute Engine to find capacity for it, which can outlast a reconcile.
+	ProvisionTimeout time.Duration `yaml:"provision_timeout"`
+}
+
+func (g *GCE) applyDefaults() {
+	if g.Provisioning == "" {
+		g.Provisioning = GCEProvisioningStandard
+	}
+
+	if g.ProvisionTimeout == 0 {
+		g.ProvisionTimeout = DefaultGCEProvisionTimeout
+	}
+}
+
+func (g *GCE) validate() error {
+	if g.Project == "" || g.Zone == "" {
+		return errors.New("project and zone are required")
+	}
+
+	if g.InstanceTemplate == "" {
+		return errors.New("instance_template is required")
+	}
+
+	if g.ProvisionTimeout < 0 {
+		return errors.New("provision_timeout must not be negative")
+	}
+
+	switch g.Provisioning {
+	case GCEProvisioningStandard, GCEProvisioningSpot, GCEProvisioningPreemptible:
+		return nil
+	default:
+		return fmt.Errorf("provisioning must be standard, spot or preemptible, got %q", g.Provisioning)
+	}
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	NomadDriverDocker string = "docker"
+
+	DefaultNomadImage    string = "docker-public.packages.atlassian.com/sox/atlassian/bitbucket-pipelines-runner:1"
+	DefaultNomadCPU      int    = 1000
+	DefaultNomadMemoryMB int    = 2048
+)
+
+// Nomad submits a batch job per runner. The OAuth credentials are stored in
+// the Nomad variable of the job, which the task reads through a template, so
+// they never appear in the job specification.
+type Nomad struct {
+	// Config is the task driver configuration. For the docker driver it is
+	// merged over a default mounting the Docker socket and running Image.
+	Config map[string]any `yaml:"config"`
+	// Env is added to the task environment. Values are Go templates that
+	// can refer to the runner.
+	Env map[string]string `yaml:"env"`
+	// Address of the Nomad HTTP API.
+	Address string `yaml:"address"`
+	// Token is the ACL token the jobs and variables are written with.
+	Token       string   `yaml:"token"`
+	Namespace   string   `yaml:"namespace"`
+	Region      string   `yaml:"region"`
+	Driver      string   `yaml:"driver"`
+	Image       string   `yaml:"image"`
+	Datacenters []string `yaml:"datacenters"`
+	// CPU is in MHz.
+	CPU      int `yaml:"cpu"`
+	MemoryMB int `yaml:"memory_mb"`
+}
+
+func (n *Nomad) applyDefaults() {
+	if n.Driver == "" {
+		n.Driver = NomadDriverDocker
+	}
+
+	if n.Image == "" {
+		n.Image = DefaultNomadImage
+	}
+
+	if n.CPU == 0 {
+		n.CPU = DefaultNomadCPU
+	}
+
+	if n.MemoryMB == 0 {
+		n.MemoryMB = DefaultNomadMemoryMB
+	}
+}
+
+func (n *Nomad) validate() error {
+	if n.Address == "" {
+		return errors.New("address is required")
+	}
+
+	if n.Driver != NomadDriverDocker && len(n.Config) == 0 {
+		return fmt.Errorf("config is required for driver %q", n.Driver)
+	}
+
+	if n.CPU < 1 || n.MemoryMB < 1 {
+		return fmt.Errorf("cpu and memory_mb must be positive, got %d and %d", n.CPU, n.MemoryMB)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	DefaultProcessWorkDir     string        = "/var/lib/bitbucket-runner-autoscaler/runners"
+	DefaultProcessStopTimeout time.Duration = 30 * time.Second
+)
+
+// Process runs each runner as a child process of the autoscaler, for build
+// hosts without a container runtime or cloud API.
+type Process struct {
+	// Env is added to the environment of the process, next to the runner
+	// UUIDs and OAuth credentials. Values are Go templates that can refer
+	// to the runner.
+	Env map[string]string `yaml:"env"`
+	// InheritEnv names the variables of the autoscaler environment passed on
+	// to the process, besides PATH and HOME. Nothing else is, so the
+	// secrets of the autoscaler stay out of the runners.
+	InheritEnv []string `yaml:"inherit_env"`
+	// WorkDir holds a working directory per runner.
+	WorkDir string `yaml:"work_dir"`
+	// LogDir holds the output of every runner. It defaults to WorkDir.
+	LogDir string `yaml:"log_dir"`
+	// Command starts the runner, for example the runner JAR. Arguments are
+	// Go templates that can refer to the runner, but not to its
+	// credentials, which are only passed in the environment.
+	Command []string `yaml:"command"`
+	// StopTimeout is how long a runner has to exit after SIGTERM before it
+	// is killed.
+	StopTimeout time.Duration `yaml:"stop_timeout"`
+}
+
+func (p *Process) applyDefaults() {
+	if p.WorkDir == "" {
+		p.WorkDir = DefaultProcessWorkDir
+	}
+
+	if p.LogDir == "" {
+		p.LogDir = p.WorkDir
+	}
+
+	if p.StopTimeout == 0 {
+		p.StopTimeout = DefaultProcessStopTimeout
+	}
+}
+
+func (p *Process) validate() error {
+	if len(p.Command) == 0 {
+		return errors.New("command is required")
+	}
+
+	if p.StopTimeout < 0 {
+		return errors.New("stop_timeout must not be negative")
+	}
+
+	return nil
+}
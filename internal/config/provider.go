@@ -0,0 +1,194 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	ProviderEC2     string = "ec2"
+	ProviderGCE     string = "gce"
+	ProviderVMSS    string = "vmss"
+	ProviderNomad   string = "nomad"
+	ProviderProcess string = "process"
+	ProviderSSH     string = "ssh"
+)
+
+// Provider is a named compute backend that pools start their runners on.
+// Type selects the backend, whose settings go in the section of the same
+// name.
+type Provider struct {
+	EC2     *EC2     `yaml:"ec2"`
+	GCE     *GCE     `yaml:"gce"`
+	VMSS    *VMSS    `yaml:"vmss"`
+	Nomad   *Nomad   `yaml:"nomad"`
+	Process *Process `yaml:"process"`
+	SSH     *SSH     `yaml:"ssh"`
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+}
+
+func (p *Provider) applyDefaults() {
+	if p.EC2 != nil {
+		p.EC2.applyDefaults()
+	}
+
+	if p.GCE != nil {
+		p.GCE.applyDefaults()
+	}
+
+	if p.VMSS != nil {
+		p.VMSS.applyDefaults()
+	}
+
+	if p.Nomad != nil {
+		p.Nomad.applyDefaults()
+	}
+
+	if p.Process != nil {
+		p.Process.applyDefaults()
+	}
+
+	if p.SSH != nil {
+		p.SSH.applyDefaults()
+	}
+}
+
+func (p *Provider) validate() error {
+	switch p.Type {
+	case ProviderEC2:
+		if p.EC2 == nil {
+			return errors.New("ec2 settings are required")
+		}
+
+		if err := p.EC2.validate(); err != nil {
+			return fmt.Errorf("ec2: %w", err)
+		}
+	case ProviderGCE:
+		if p.GCE == nil {
+			return errors.New("gce settings are required")
+		}
+
+		if err := p.GCE.validate(); err != nil {
+			return fmt.Errorf("gce: %w", err)
+		}
+	case ProviderVMSS:
+		if p.VMSS == nil {
+			return errors.New("vmss settings are required")
+		}
+
+		if err := p.VMSS.validate(); err != nil {
+			return fmt.Errorf("vmss: %w", err)
+		}
+	case ProviderNomad:
+		if p.Nomad == nil {
+			return errors.New("nomad settings are required")
+		}
+
+		if err := p.Nomad.validate(); err != nil {
+			return fmt.Errorf("nomad: %w", err)
+		}
+	case ProviderProcess:
+		if p.Process == nil {
+			return errors.New("process settings are required")
+		}
+
+		if err := p.Process.validate(); err != nil {
+			return fmt.Errorf("process: %w", err)
+		}
+	case ProviderSSH:
+		if p.SSH == nil {
+			return errors.New("ssh settings are required")
+		}
+
+		if err := p.SSH.validate(); err != nil {
+			return fmt.Errorf("ssh: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", p.Type)
+	}
+
+	return nil
+}
+
+// validateProviders checks the providers and that every pool refers to one
+// of them.
+func (c *Config) validateProviders() error {
+	names := make(map[string]struct{}, len(c.Providers))
+
+	for i := range c.Providers {
+		p := &c.Providers[i]
+
+		if p.Name == "" {
+			return fmt.Errorf("provider #%d has no name", i)
+		}
+
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("duplicate provider %q", p.Name)
+		}
+
+		names[p.Name] = struct{}{}
+
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("provider %q: %w", p.Name, err)
+		}
+	}
+
+	for i := range c.Workspaces {
+		for _, pool := range c.Workspaces[i].Pools {
+			for _, provider := range pool.ProviderChain() {
+				if _, ok := names[provider.Name]; !ok {
+					return fmt.Errorf("workspace %q: pool %q: unknown provider %q",
+						c.Workspaces[i].Name, pool.Name, provider.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// PoolProvider is one of the providers a pool starts runners with.
+type PoolProvider struct {
+	Name string `yaml:"name"`
+	// Cost ranks the runners of the provider for removal, the most
+	// expensive going first. Providers of equal cost are ranked by their
+	// position, the last going first.
+	Cost float64 `yaml:"cost"`
+}
+
+// ProviderChain returns the providers of the pool in the order they are
+// tried, whether it has a single provider or several.
+func (p *Pool) ProviderChain() []PoolProvider {
+	if p.Provider != "" {
+		return []PoolProvider{{Name: p.Provider}}
+	}
+
+	return p.Providers
+}
+
+func (p *Pool) validateProviders() error {
+	if p.Provider != "" && len(p.Providers) > 0 {
+		return errors.New("provider and providers are mutually exclusive")
+	}
+
+	names := make(map[string]struct{}, len(p.Providers))
+
+	for i, provider := range p.Providers {
+		if provider.Name == "" {
+			return fmt.Errorf("providers: #%d has no name", i)
+		}
+
+		if _, ok := names[provider.Name]; ok {
+			return fmt.Errorf("providers: duplicate provider %q", provider.Name)
+		}
+
+		names[provider.Name] = struct{}{}
+
+		if provider.Cost < 0 {
+			return fmt.Errorf("providers: cost of %q must not be negative, got %v", provider.Name, provider.Cost)
+		}
+	}
+
+	return nil
+}
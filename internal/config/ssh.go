@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultSSHUser           string        = "root"
+	DefaultSSHConnectTimeout time.Duration = 10 * time.Second
+)
+
+// SSH treats a fixed fleet of hosts as runner slots, starting and stopping
+// runners on them over SSH. Scripts are Go templates piped into sh on the
+// host, so the credentials they contain never show up in a command line.
+type SSH struct {
+	// StartScript starts a runner. It defaults to running the runner
+	// container with Docker.
+	StartScript string `yaml:"start_script"`
+	// StopScript stops a runner and cleans up after it.
+	StopScript string `yaml:"stop_script"`
+	// ListScript prints the UUIDs of the runners on the host, one per
+	// line, so slots taken by anything else are counted. A UUID may be
+	// followed by the workspace and pool the runner was started for.
+	ListScript     string `yaml:"list_script"`
+	User           string `yaml:"user"`
+	PrivateKeyFile string `yaml:"private_key_file"`
+	// KnownHostsFile holds the host keys the hosts are verified against.
+	KnownHostsFile string    `yaml:"known_hosts_file"`
+	Hosts          []SSHHost `yaml:"hosts"`
+	// RunnersPerHost is the number of slots of hosts not setting their
+	// own.
+	RunnersPerHost int           `yaml:"runners_per_host"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+// SSHHost is a host of the fleet. Address is host or host:port.
+type SSHHost struct {
+	Address    string `yaml:"address"`
+	MaxRunners int    `yaml:"max_runners"`
+}
+
+func (s *SSH) applyDefaults() {
+	if s.User == "" {
+		s.User = DefaultSSHUser
+	}
+
+	if s.RunnersPerHost == 0 {
+		s.RunnersPerHost = 1
+	}
+
+	if s.ConnectTimeout == 0 {
+		s.ConnectTimeout = DefaultSSHConnectTimeout
+	}
+
+	for i := range s.Hosts {
+		if s.Hosts[i].MaxRunners == 0 {
+			s.Hosts[i].MaxRunners = s.RunnersPerHost
+		}
+	}
+}
+
+func (s *SSH) validate() error {
+	if len(s.Hosts) == 0 {
+		return errors.New("at least one host is required")
+	}
+
+	if s.PrivateKeyFile == "" || s.KnownHostsFile == "" {
+		return errors.New("private_key_file and known_hosts_file are required")
+	}
+
+	addresses := make(map[string]struct{}, len(s.Hosts))
+
+	for _, host := range s.Hosts {
+		if host.Address == "" {
+			return errors.New("host address is required")
+		}
+
+		if _, ok := addresses[host.Address]; ok {
+			return fmt.Errorf("duplicate host %q", host.Address)
+		}
+
+		addresses[host.Address] = struct{}{}
+
+		if host.MaxRunners < 1 {
+			return fmt.Errorf("host %q: max_runners must be at least 1, got %d", host.Address, host.MaxRunners)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+const DefaultVMSSProvisionTimeout time.Duration = 10 * time.Minute
+
+// VMSS scales a virtual machine scale set, one instance per runner. The
+// scale set must use uniform orchestration, a manual upgrade policy and no
+// overprovisioning, so that instances only come and go when the provider
+// asks for it.
+type VMSS struct {
+	SubscriptionID string `yaml:"subscription_id"`
+	ResourceGroup  string `yaml:"resource_group"`
+	ScaleSet       string `yaml:"scale_set"`
+	// Endpoint overrides the Azure Resource Manager endpoint, for example
+	// for a sovereign cloud.
+	Endpoint string `yaml:"endpoint"`
+	// CustomData is a Go template rendered into the custom data of the
+	// scale set model before it grows. It defaults to a script starting
+	// the runner container.
+	CustomData string `yaml:"custom_data"`
+	// ProvisionTimeout bounds growing the scale set and tagging the new
+	// instance, which can outlast a reconcile.
+	ProvisionTimeout time.Duration `yaml:"provision_timeout"`
+}
+
+func (v *VMSS) applyDefaults() {
+	if v.ProvisionTimeout == 0 {
+		v.ProvisionTimeout = DefaultVMSSProvisionTimeout
+	}
+}
+
+func (v *VMSS) validate() error {
+	if v.SubscriptionID == "" || v.ResourceGroup == "" || v.ScaleSet == "" {
+		return errors.New("subscription_id, resource_group and scale_set are required")
+	}
+
+	if v.ProvisionTimeout < 0 {
+		return errors.New("provision_timeout must not be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package ports
+
+import "time"
+
+// AuditRecord describes one call that changed runners or compute: who made
+// it, why, and how it went.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Request holds the arguments of the call, without secrets.
+	Request map[string]any `json:"request,omitempty"`
+	// Actor is what triggered the call, such as the reconciler or the user
+	// applying a plan.
+	Actor string `json:"actor"`
+	// Operation names the call, such as bitbucket.post_runner or
+	// provider.provision.
+	Operation  string `json:"operation"`
+	Workspace  string `json:"workspace"`
+	Pool       string `json:"pool"`
+	RunnerUUID string `json:"runner_uuid,omitempty"`
+	RunnerName string `json:"runner_name,omitempty"`
+	Reason     string `json:"reason"`
+	// Outcome is success or error.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Auditor keeps an append-only trail of AuditRecord.
+type Auditor interface {
+	Record(record AuditRecord) error
+	Close() error
+}
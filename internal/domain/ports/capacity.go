@@ -0,0 +1,11 @@
+package ports
+
+import "context"
+
+// CapacityReporter is implemented by providers with a finite amount of
+// compute, such as a fixed fleet of hosts or a cloud quota.
+type CapacityReporter interface {
+	// Capacity returns how many more runners the provider can place right
+	// now.
+	Capacity(ctx context.Context) (int, error)
+}
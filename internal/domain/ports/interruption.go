@@ -0,0 +1,40 @@
+package ports
+
+import (
+	"context"
+	"time"
+)
+
+// InterruptionKind tells how soon interrupted compute goes away.
+type InterruptionKind string
+
+const (
+	// InterruptionTermination means the compute is reclaimed shortly, two
+	// minutes after the notice for EC2 spot instances.
+	InterruptionTermination InterruptionKind = "termination"
+	// InterruptionRebalance means the compute is at elevated risk of being
+	// reclaimed.
+	InterruptionRebalance InterruptionKind = "rebalance"
+)
+
+// Interruption is notice that the compute backing a runner is about to be
+// reclaimed by the cloud provider.
+type Interruption struct {
+	// Time is when the notice was issued.
+	Time       time.Time        `json:"time"`
+	RunnerUUID string           `json:"runner_uuid"`
+	WorkloadID string           `json:"workload_id"`
+	Kind       InterruptionKind `json:"kind"`
+}
+
+// InterruptionSource is implemented by providers whose compute can be
+// reclaimed at short notice, such as spot instances.
+type InterruptionSource interface {
+	// Interruptions returns the notices for runners not deprovisioned yet.
+	// A notice is returned on every call until its runner is deprovisioned.
+	Interruptions(ctx context.Context) ([]Interruption, error)
+	// AckInterruptions is called once notices are saved with their pool,
+	// so the source may forget what it kept to deliver them again after a
+	// restart. Notices it does not know are ignored.
+	AckInterruptions(ctx context.Context, notices []Interruption) error
+}
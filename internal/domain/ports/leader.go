@@ -0,0 +1,14 @@
+package ports
+
+import "context"
+
+// LeaderElector decides which of several autoscaler replicas does the work.
+type LeaderElector interface {
+	// Run campaigns for leadership until ctx is cancelled. While this
+	// replica leads, lead runs with a context that is cancelled as soon as
+	// leadership is lost; Run then campaigns again.
+	Run(ctx context.Context, lead func(ctx context.Context)) error
+	IsLeader() bool
+	// Identity names this replica among the candidates.
+	Identity() string
+}
@@ -0,0 +1,46 @@
+package ports
+
+import (
+	"context"
+	"time"
+)
+
+// ProvisionRequest carries everything a provider needs to start the compute
+// backing a freshly registered Bitbucket runner.
+type ProvisionRequest struct {
+	Workspace         string
+	WorkspaceUUID     string
+	Pool              string
+	RunnerUUID        string
+	RunnerName        string
+	OAuthClientID     string
+	OAuthClientSecret string
+	TokenEndpoint     string
+	Audience          string
+	Labels            []string
+}
+
+// Workload is the provider side view of a runner: the instance, job or
+// process that actually runs the Bitbucket runner software.
+type Workload struct {
+	CreatedAt  time.Time `json:"created_at"`
+	ID         string    `json:"id"`
+	RunnerUUID string    `json:"runner_uuid"`
+	Pool       string    `json:"pool"`
+	Provider   string    `json:"provider"`
+}
+
+// Provider starts and stops the compute backing Bitbucket runners.
+type Provider interface {
+	Name() string
+	Provision(ctx context.Context, req ProvisionRequest) (*Workload, error)
+	Deprovision(ctx context.Context, runnerUUID string) error
+}
+
+// WorkloadLister is implemented by providers that can list the compute they
+// started, so it can be checked against the runners registered in Bitbucket.
+type WorkloadLister interface {
+	// Workloads returns a workload per runner started for pool of
+	// workspace.
+	Workloads(ctx context.Context, workspace, pool string) ([]Workload, error)
+}
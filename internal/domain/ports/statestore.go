@@ -0,0 +1,17 @@
+package ports
+
+import "errors"
+
+// ErrNotFound is returned by StateStore.Get for a missing key.
+var ErrNotFound = errors.New("not found")
+
+// StateStore persists autoscaler bookkeeping across restarts. Values are
+// opaque documents grouped in namespaces.
+type StateStore interface {
+	Get(namespace, key string) ([]byte, error)
+	Put(namespace, key string, value []byte) error
+	Delete(namespace, key string) error
+	// List returns every key and value of namespace.
+	List(namespace string) (map[string][]byte, error)
+	Close() error
+}
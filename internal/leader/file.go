@@ -0,0 +1,79 @@
+//go:build unix
+
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+)
+
+const lockFileMode = 0o600
+
+// File elects as leader the replica holding an exclusive flock on a file.
+// The kernel releases the lock when the process exits, so a crashed leader
+// is replaced within one retry period. Replicas must share the filesystem.
+type File struct {
+	cfg    config.LeaderElection
+	leader atomic.Bool
+}
+
+func NewFile(cfg config.LeaderElection) (*File, error) {
+	return &File{cfg: cfg}, nil
+}
+
+func (f *File) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	file, err := os.OpenFile(f.cfg.Path, os.O_CREATE|os.O_RDWR, lockFileMode)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	defer file.Close()
+
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("failed to lock %s: %w", f.cfg.Path, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(f.cfg.RetryPeriod):
+		}
+	}
+
+	defer func() {
+		f.leader.Store(false)
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	}()
+
+	f.leader.Store(true)
+
+	// Record who leads, for whoever looks at the file.
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(f.cfg.Identity+"\n"), 0)
+	}
+
+	// A flock is only lost with the process, so lead until shutdown.
+	lead(ctx)
+
+	return nil
+}
+
+func (f *File) IsLeader() bool {
+	return f.leader.Load()
+}
+
+func (f *File) Identity() string {
+	return f.cfg.Identity
+}
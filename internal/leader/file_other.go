@@ -0,0 +1,29 @@
+//go:build !unix
+
+package leader
+
+import (
+	"context"
+	"errors"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+)
+
+// File is only available where flock is.
+type File struct{}
+
+func NewFile(_ config.LeaderElection) (*File, error) {
+	return nil, errors.New("file leader election is not supported on this platform")
+}
+
+func (f *File) Run(_ context.Context, _ func(ctx context.Context)) error {
+	return nil
+}
+
+func (f *File) IsLeader() bool {
+	return false
+}
+
+func (f *File) Identity() string {
+	return ""
+}
@@ -0,0 +1,88 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Kubernetes elects a leader through a coordination.k8s.io Lease shared by
+// every replica.
+type Kubernetes struct {
+	client kubernetes.Interface
+	cfg    config.LeaderElection
+	// leading is held while lead runs. client-go starts OnStartedLeading
+	// in a goroutine without waiting for the previous term's to return.
+	leading sync.Mutex
+	leader  atomic.Bool
+}
+
+func NewKubernetes(client kubernetes.Interface, cfg config.LeaderElection) *Kubernetes {
+	return &Kubernetes{client: client, cfg: cfg}
+}
+
+func (k *Kubernetes) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: k.cfg.Name, Namespace: k.cfg.Namespace},
+			Client:     k.client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: k.cfg.Identity},
+		},
+		LeaseDuration: k.cfg.LeaseDuration,
+		RenewDeadline: k.cfg.RenewDeadline,
+		RetryPeriod:   k.cfg.RetryPeriod,
+		// Hand over at once on shutdown instead of making the other
+		// replica wait for the lease to expire.
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				k.leading.Lock()
+				defer k.leading.Unlock()
+
+				// The term may have ended while the previous one wound down.
+				if ctx.Err() != nil {
+					return
+				}
+
+				k.leader.Store(true)
+				defer k.leader.Store(false)
+
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				k.leader.Store(false)
+			},
+		},
+		Name: k.cfg.Name,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid leader election config: %w", err)
+	}
+
+	// Run returns whenever leadership is lost; campaign again until ctx is
+	// cancelled.
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+
+	// Wait for the last term to wind down.
+	k.leading.Lock()
+	k.leading.Unlock() //nolint:staticcheck // only waits for the holder
+
+	return nil
+}
+
+func (k *Kubernetes) IsLeader() bool {
+	return k.leader.Load()
+}
+
+func (k *Kubernetes) Identity() string {
+	return k.cfg.Identity
+}
@@ -0,0 +1,29 @@
+package leader
+
+import (
+	"context"
+)
+
+// Always is the elector of a replica running alone: it leads from the start
+// until ctx is cancelled.
+type Always struct {
+	identity string
+}
+
+func NewAlways(identity string) *Always {
+	return &Always{identity: identity}
+}
+
+func (a *Always) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	lead(ctx)
+
+	return nil
+}
+
+func (a *Always) IsLeader() bool {
+	return true
+}
+
+func (a *Always) Identity() string {
+	return a.identity
+}
@@ -0,0 +1,132 @@
+//go:build unix
+
+package leader
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHandover(t *testing.T) {
+	tables := []struct {
+		electors func(t *testing.T) (ports.LeaderElector, ports.LeaderElector)
+		name     string
+	}{
+		{
+			name: "kubernetes",
+			electors: func(_ *testing.T) (ports.LeaderElector, ports.LeaderElector) {
+				client := fake.NewSimpleClientset()
+				cfg := config.LeaderElection{
+					Name:          "autoscaler",
+					Namespace:     "ci",
+					LeaseDuration: time.Second,
+					RenewDeadline: 500 * time.Millisecond,
+					RetryPeriod:   100 * time.Millisecond,
+				}
+
+				first, second := cfg, cfg
+				first.Identity = "first"
+				second.Identity = "second"
+
+				return NewKubernetes(client, first), NewKubernetes(client, second)
+			},
+		},
+		{
+			name: "file",
+			electors: func(t *testing.T) (ports.LeaderElector, ports.LeaderElector) {
+				cfg := config.LeaderElection{
+					Path:        filepath.Join(t.TempDir(), "leader.lock"),
+					RetryPeriod: 100 * time.Millisecond,
+				}
+
+				first, second := cfg, cfg
+				first.Identity = "first"
+				second.Identity = "second"
+
+				firstFile, err := NewFile(first)
+				require.NoError(t, err)
+
+				secondFile, err := NewFile(second)
+				require.NoError(t, err)
+
+				return firstFile, secondFile
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			first, second := table.electors(t)
+
+			firstCtx, stopFirst := context.WithCancel(context.Background())
+			secondCtx, stopSecond := context.WithCancel(context.Background())
+
+			var wg sync.WaitGroup
+
+			led := make(chan string, 2)
+			run := func(ctx context.Context, elector ports.LeaderElector) {
+				defer wg.Done()
+
+				assert.NoError(t, elector.Run(ctx, func(ctx context.Context) {
+					led <- elector.Identity()
+					<-ctx.Done()
+				}))
+			}
+
+			wg.Add(1)
+
+			go run(firstCtx, first)
+
+			assert.Equal(t, "first", <-led)
+			assert.True(t, first.IsLeader())
+
+			wg.Add(1)
+
+			go run(secondCtx, second)
+
+			// The second replica waits while the first one leads.
+			time.Sleep(300 * time.Millisecond)
+			assert.False(t, second.IsLeader())
+
+			stopFirst()
+
+			select {
+			case identity := <-led:
+				assert.Equal(t, "second", identity)
+			case <-time.After(5 * time.Second):
+				t.Fatal("leadership was not handed over")
+			}
+
+			assert.True(t, second.IsLeader())
+
+			stopSecond()
+			wg.Wait()
+
+			assert.False(t, first.IsLeader())
+			assert.False(t, second.IsLeader())
+		})
+	}
+}
+
+func TestAlways(t *testing.T) {
+	elector := NewAlways("solo")
+
+	var led bool
+
+	require.NoError(t, elector.Run(context.Background(), func(_ context.Context) {
+		led = true
+	}))
+
+	assert.True(t, led)
+	assert.True(t, elector.IsLeader())
+	assert.Equal(t, "solo", elector.Identity())
+}
@@ -0,0 +1,336 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+)
+
+// State is the autoscaler's own view of a runner, as opposed to the status
+// reported by Bitbucket.
+type State string
+
+const (
+	// StateRequested means the autoscaler decided to create the runner.
+	StateRequested State = "requested"
+	// StateRegistering means the runner is being registered with Bitbucket.
+	StateRegistering State = "registering"
+	// StateProvisioning means the runner is registered and its compute is
+	// starting; it ends when Bitbucket reports the runner ONLINE.
+	StateProvisioning State = "provisioning"
+	// StateOnline means the runner is connected and can run steps.
+	StateOnline State = "online"
+	// StateDraining means the runner was selected for removal and is
+	// disabled so no new steps land on it. Its registration is deleted once
+	// it is idle. A runner found running a step after a restart, before it
+	// was disabled, goes back online.
+	StateDraining State = "draining"
+	// StateDeprovisioning means the registration is gone and the compute is
+	// being torn down.
+	StateDeprovisioning State = "deprovisioning"
+	// StateFailed means the runner did not make it through a state in time
+	// or an operation on it failed. Failed runners are removed.
+	StateFailed State = "failed"
+	// StateDeleted is terminal: registration and compute are gone.
+	StateDeleted State = "deleted"
+)
+
+// retention is how long deleted and failed runners are kept for debugging
+// once their registration is gone.
+const retention time.Duration = time.Hour
+
+// ErrInvalidTransition is returned for a transition the state machine does
+// not allow.
+var ErrInvalidTransition = errors.New("invalid transition")
+
+// allowed reports whether a runner may move from one state to another.
+func allowed(from, to State) bool {
+	switch from {
+	case StateRequested:
+		return to == StateRegistering || to == StateFailed
+	case StateRegistering:
+		return to == StateProvisioning || to == StateFailed
+	case StateProvisioning:
+		return to == StateOnline || to == StateDraining || to == StateFailed
+	case StateOnline:
+		return to == StateDraining || to == StateFailed
+	case StateDraining:
+		return to == StateOnline || to == StateDeprovisioning || to == StateFailed
+	case StateDeprovisioning:
+		return to == StateDeleted || to == StateFailed
+	case StateFailed:
+		return to == StateDraining || to == StateDeprovisioning || to == StateDeleted
+	default:
+		return false
+	}
+}
+
+// Transition is a recorded change of state.
+type Transition struct {
+	At         time.Time `json:"at"`
+	Pool       string    `json:"pool"`
+	Runner     string    `json:"runner"`
+	RunnerUUID string    `json:"runner_uuid,omitempty"`
+	From       State     `json:"from"`
+	To         State     `json:"to"`
+	Reason     string    `json:"reason"`
+}
+
+// Runner is the lifecycle of a single runner, with every transition it went
+// through.
+type Runner struct {
+	Since time.Time `json:"since"`
+	Pool  string    `json:"pool"`
+	Name  string    `json:"name"`
+	UUID  string    `json:"uuid,omitempty"`
+	// Provider is the provider backing the runner.
+	Provider string       `json:"provider,omitempty"`
+	State    State        `json:"state"`
+	Reason   string       `json:"reason"`
+	History  []Transition `json:"history"`
+}
+
+// Machine tracks the lifecycle of the runners of one pool, keyed by runner
+// name since the name is known before Bitbucket assigns a UUID.
+type Machine struct {
+	now      func() time.Time
+	runners  map[string]*Runner
+	pool     string
+	pending  []Transition
+	timeouts config.Timeouts
+	mu       sync.Mutex
+}
+
+// NewMachine returns an empty state machine for pool, reading time from now.
+func NewMachine(pool string, timeouts config.Timeouts, now func() time.Time) *Machine {
+	return &Machine{
+		now:      now,
+		runners:  map[string]*Runner{},
+		pool:     pool,
+		timeouts: timeouts,
+	}
+}
+
+// Restore replaces the tracked runners with runners loaded from a previous
+// run. Nothing is recorded, as the transitions already happened.
+func (m *Machine) Restore(runners []Runner) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.runners = make(map[string]*Runner, len(runners))
+
+	for _, runner := range runners {
+		restored := runner.copy()
+		m.runners[runner.Name] = &restored
+	}
+}
+
+// Request starts tracking a runner the autoscaler is about to create.
+func (m *Machine) Request(name, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.runners[name]; ok {
+		return fmt.Errorf("runner %s is already tracked", name)
+	}
+
+	m.runners[name] = &Runner{Pool: m.pool, Name: name}
+	m.record(m.runners[name], StateRequested, reason)
+
+	return nil
+}
+
+// Adopt starts tracking a runner that was created before the autoscaler
+// started, in state.
+func (m *Machine) Adopt(name, uuid string, state State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.runners[name]; ok {
+		return
+	}
+
+	m.runners[name] = &Runner{Pool: m.pool, Name: name, UUID: uuid}
+	m.record(m.runners[name], state, "adopted")
+}
+
+// Registered records the UUID Bitbucket assigned to a runner and moves it to
+// provisioning.
+func (m *Machine) Registered(name, uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	runner, ok := m.runners[name]
+	if !ok {
+		return fmt.Errorf("runner %s is not tracked", name)
+	}
+
+	runner.UUID = uuid
+
+	return m.transition(runner, StateProvisioning, "registered")
+}
+
+// Placed records the provider that started the compute of a runner.
+func (m *Machine) Placed(name, provider string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	runner, ok := m.runners[name]
+	if !ok {
+		return fmt.Errorf("runner %s is not tracked", name)
+	}
+
+	runner.Provider = provider
+
+	return nil
+}
+
+// Transition moves a runner to state to.
+func (m *Machine) Transition(name string, to State, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	runner, ok := m.runners[name]
+	if !ok {
+		return fmt.Errorf("runner %s is not tracked", name)
+	}
+
+	return m.transition(runner, to, reason)
+}
+
+// Get returns the lifecycle of the runner called name.
+func (m *Machine) Get(name string) (Runner, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	runner, ok := m.runners[name]
+	if !ok {
+		return Runner{}, false
+	}
+
+	return runner.copy(), true
+}
+
+// Find returns the lifecycle of the runner with the given UUID.
+func (m *Machine) Find(uuid string) (Runner, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, runner := range m.runners {
+		if runner.UUID == uuid {
+			return runner.copy(), true
+		}
+	}
+
+	return Runner{}, false
+}
+
+// Runners returns every tracked runner sorted by name.
+func (m *Machine) Runners() []Runner {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	runners := make([]Runner, 0, len(m.runners))
+
+	for _, runner := range m.runners {
+		runners = append(runners, runner.copy())
+	}
+
+	sort.Slice(runners, func(i, j int) bool {
+		return runners[i].Name < runners[j].Name
+	})
+
+	return runners
+}
+
+// Expire fails runners that stayed in a state longer than its timeout and
+// forgets runners that were deleted or failed more than an hour ago. Runners
+// for which registered reports true are never forgotten: their record is all
+// that keeps a failed runner still finishing its step from being adopted as
+// online again.
+func (m *Machine) Expire(registered func(name string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	for name, runner := range m.runners {
+		age := now.Sub(runner.Since)
+
+		if (runner.State == StateDeleted || runner.State == StateFailed) && age > retention && !registered(name) {
+			delete(m.runners, name)
+
+			continue
+		}
+
+		if timeout := m.timeout(runner.State); timeout > 0 && age > timeout {
+			_ = m.transition(runner, StateFailed, fmt.Sprintf("timed out in %s after %s", runner.State, timeout))
+		}
+	}
+}
+
+// Drain returns the transitions recorded since the last call, oldest first.
+func (m *Machine) Drain() []Transition {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := m.pending
+	m.pending = nil
+
+	return pending
+}
+
+func (m *Machine) timeout(state State) time.Duration {
+	switch state {
+	case StateRequested, StateRegistering:
+		return m.timeouts.Registering
+	case StateProvisioning:
+		return m.timeouts.Provisioning
+	case StateDeprovisioning:
+		return m.timeouts.Deprovisioning
+	default:
+		return 0
+	}
+}
+
+// transition checks and records a change of state. The caller must hold
+// m.mu.
+func (m *Machine) transition(runner *Runner, to State, reason string) error {
+	if !allowed(runner.State, to) {
+		return fmt.Errorf("%w of runner %s from %s to %s", ErrInvalidTransition, runner.Name, runner.State, to)
+	}
+
+	m.record(runner, to, reason)
+
+	return nil
+}
+
+func (m *Machine) record(runner *Runner, to State, reason string) {
+	t := Transition{
+		At:         m.now(),
+		Pool:       m.pool,
+		Runner:     runner.Name,
+		RunnerUUID: runner.UUID,
+		From:       runner.State,
+		To:         to,
+		Reason:     reason,
+	}
+
+	runner.Since = t.At
+	runner.State = to
+	runner.Reason = reason
+	runner.History = append(runner.History, t)
+
+	m.pending = append(m.pending, t)
+}
+
+func (r *Runner) copy() Runner {
+	c := *r
+	c.History = append([]Transition(nil), r.History...)
+
+	return c
+}
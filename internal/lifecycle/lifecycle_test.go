@@ -0,0 +1,121 @@
+package lifecycle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransition(t *testing.T) {
+	tables := []struct {
+		name          string
+		expectedError string
+		path          []State
+	}{
+		{
+			name: "created, used and removed",
+			path: []State{StateRegistering, StateProvisioning, StateOnline, StateDraining, StateDeprovisioning, StateDeleted},
+		},
+		{
+			name: "failed runners are cleaned up",
+			path: []State{StateRegistering, StateProvisioning, StateFailed, StateDraining, StateDeprovisioning, StateDeleted},
+		},
+		{
+			name: "adopted again while draining",
+			path: []State{StateRegistering, StateProvisioning, StateOnline, StateDraining, StateOnline},
+		},
+		{
+			name:          "online before registered",
+			path:          []State{StateOnline},
+			expectedError: "invalid transition of runner linux-00000001 from requested to online",
+		},
+		{
+			name:          "deleted is terminal",
+			path:          []State{StateFailed, StateDeleted, StateDraining},
+			expectedError: "invalid transition of runner linux-00000001 from deleted to draining",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			m := NewMachine("linux", config.Timeouts{}, time.Now)
+
+			require.NoError(t, m.Request("linux-00000001", "scale up"))
+
+			var err error
+
+			for _, state := range table.path {
+				if err = m.Transition("linux-00000001", state, "test"); err != nil {
+					break
+				}
+			}
+
+			if table.expectedError != "" {
+				assert.ErrorIs(t, err, ErrInvalidTransition)
+				assert.EqualError(t, err, table.expectedError)
+
+				return
+			}
+
+			assert.NoError(t, err)
+
+			runner, ok := m.Get("linux-00000001")
+
+			assert.True(t, ok)
+			assert.Equal(t, table.path[len(table.path)-1], runner.State)
+			assert.Len(t, runner.History, len(table.path)+1)
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+	m := NewMachine("linux", config.Timeouts{Provisioning: 10 * time.Minute}, func() time.Time { return now })
+
+	require.NoError(t, m.Request("linux-00000001", "scale up"))
+	require.NoError(t, m.Transition("linux-00000001", StateRegistering, "registering with Bitbucket"))
+	require.NoError(t, m.Registered("linux-00000001", "{1}"))
+	m.Adopt("linux-00000002", "{2}", StateOnline)
+
+	now = now.Add(11 * time.Minute)
+	m.Expire(func(string) bool { return true })
+
+	failed, _ := m.Find("{1}")
+	online, _ := m.Get("linux-00000002")
+
+	assert.Equal(t, StateFailed, failed.State)
+	assert.Equal(t, "timed out in provisioning after 10m0s", failed.Reason)
+	assert.Equal(t, StateOnline, online.State)
+
+	assert.Equal(t, []Transition{
+		{At: now.Add(-11 * time.Minute), Pool: "linux", Runner: "linux-00000001", To: StateRequested, Reason: "scale up"},
+		{
+			At: now.Add(-11 * time.Minute), Pool: "linux", Runner: "linux-00000001",
+			From: StateRequested, To: StateRegistering, Reason: "registering with Bitbucket",
+		},
+		{
+			At: now.Add(-11 * time.Minute), Pool: "linux", Runner: "linux-00000001", RunnerUUID: "{1}",
+			From: StateRegistering, To: StateProvisioning, Reason: "registered",
+		},
+		{At: now.Add(-11 * time.Minute), Pool: "linux", Runner: "linux-00000002", RunnerUUID: "{2}", To: StateOnline, Reason: "adopted"},
+		{
+			At: now, Pool: "linux", Runner: "linux-00000001", RunnerUUID: "{1}",
+			From: StateProvisioning, To: StateFailed, Reason: "timed out in provisioning after 10m0s",
+		},
+	}, m.Drain())
+	assert.Empty(t, m.Drain())
+
+	// Failed runners are kept as long as they are registered, then for
+	// debugging for a while, then forgotten.
+	now = now.Add(2 * time.Hour)
+	m.Expire(func(string) bool { return true })
+
+	assert.Len(t, m.Runners(), 2)
+
+	m.Expire(func(name string) bool { return name != "linux-00000001" })
+
+	assert.Len(t, m.Runners(), 1)
+}
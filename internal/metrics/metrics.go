@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace string = "bitbucket_runner_autoscaler"
+
+// Metrics holds every collector exported by the autoscaler. All series but
+// Leader are labelled with the workspace they belong to.
+type Metrics struct {
+	// Leader is 1 while this replica holds the leader election.
+	Leader         prometheus.Gauge
+	Runners        *prometheus.GaugeVec
+	DesiredRunners *prometheus.GaugeVec
+	// UnschedulableRunners is the demand the pool provider has no capacity
+	// for.
+	UnschedulableRunners *prometheus.GaugeVec
+	Reconciles           *prometheus.CounterVec
+	ReconcileDuration    *prometheus.HistogramVec
+	ScalingActions       *prometheus.CounterVec
+	RunnerTransitions    *prometheus.CounterVec
+	RateLimitBudget      *prometheus.GaugeVec
+	RateLimited          *prometheus.CounterVec
+	LabelDrift           *prometheus.GaugeVec
+	ActiveProfile        *prometheus.GaugeVec
+	PoolBounds           *prometheus.GaugeVec
+	DemandForecast       *prometheus.GaugeVec
+	DemandActual         *prometheus.GaugeVec
+	// DemandForecastError is the absolute error of the forecast for the last
+	// completed hour.
+	DemandForecastError *prometheus.GaugeVec
+	Interruptions       *prometheus.CounterVec
+	// ConsistencyMismatches is the number of runners whose registration and
+	// compute disagreed on the last check, by class.
+	ConsistencyMismatches *prometheus.GaugeVec
+	ConsistencyActions    *prometheus.CounterVec
+}
+
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		Leader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "leader",
+			Help:      "Whether this replica is the leader running reconciles, 1 or 0.",
+		}),
+		Runners: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "runners",
+			Help:      "Number of runners per pool, by Bitbucket status and whether they are busy.",
+		}, []string{"workspace", "pool", "status", "busy"}),
+		DesiredRunners: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "desired_runners",
+			Help:      "Number of runners the autoscaler wants in each pool.",
+		}, []string{"workspace", "pool"}),
+		UnschedulableRunners: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "unschedulable_runners",
+			Help:      "Runners wanted in each pool that its provider has no capacity for.",
+		}, []string{"workspace", "pool"}),
+		Reconciles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconciles_total",
+			Help:      "Reconcile loops run per workspace, by result.",
+		}, []string{"workspace", "result"}),
+		ReconcileDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "reconcile_duration_seconds",
+			Help:      "Time spent reconciling a workspace.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"workspace"}),
+		ScalingActions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scaling_actions_total",
+			Help:      "Scaling actions executed per pool, by action and result.",
+		}, []string{"workspace", "pool", "action", "result"}),
+		RunnerTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "runner_transitions_total",
+			Help:      "Runner lifecycle transitions per pool, by previous and new state.",
+		}, []string{"workspace", "pool", "from", "to"}),
+		RateLimitBudget: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rate_limit_remaining_requests",
+			Help:      "Requests left in the client side rate limit budget of each workspace.",
+		}, []string{"workspace"}),
+		RateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_responses_total",
+			Help:      "Bitbucket responses rejected with 429 Too Many Requests.",
+		}, []string{"workspace"}),
+		LabelDrift: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "label_drift_runners",
+			Help:      "Runners whose labels differ from the pool configuration.",
+		}, []string{"workspace", "pool"}),
+		ActiveProfile: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_profile",
+			Help:      "Scheduled profile currently applied to each pool, always 1.",
+		}, []string{"workspace", "pool", "profile"}),
+		PoolBounds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pool_bound_runners",
+			Help:      "Min, max and warm runners currently in force for each pool.",
+		}, []string{"workspace", "pool", "bound"}),
+		DemandForecast: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "demand_forecast_runners",
+			Help:      "Busy runners forecast one lead time ahead for each pool.",
+		}, []string{"workspace", "pool"}),
+		DemandActual: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "demand_actual_runners",
+			Help:      "Busy runners observed for each pool with prediction enabled.",
+		}, []string{"workspace", "pool"}),
+		DemandForecastError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "demand_forecast_error_runners",
+			Help:      "Absolute error between forecast and observed peak demand of the last completed hour.",
+		}, []string{"workspace", "pool"}),
+		Interruptions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "interruptions_total",
+			Help:      "Interruption notices received for the compute of runners, by kind.",
+		}, []string{"workspace", "pool", "kind"}),
+		ConsistencyMismatches: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "consistency_mismatch_runners",
+			Help:      "Runners whose registration and compute disagree, by class.",
+		}, []string{"workspace", "pool", "class"}),
+		ConsistencyActions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "consistency_actions_total",
+			Help:      "Actions taken to fix registrations and compute that disagree, by class, action and result.",
+		}, []string{"workspace", "pool", "class", "action", "result"}),
+	}
+
+	reg.MustRegister(
+		m.Leader,
+		m.Runners,
+		m.DesiredRunners,
+		m.UnschedulableRunners,
+		m.Reconciles,
+		m.ReconcileDuration,
+		m.ScalingActions,
+		m.RunnerTransitions,
+		m.RateLimitBudget,
+		m.RateLimited,
+		m.LabelDrift,
+		m.ActiveProfile,
+		m.PoolBounds,
+		m.DemandForecast,
+		m.DemandActual,
+		m.DemandForecastError,
+		m.Interruptions,
+		m.ConsistencyMismatches,
+		m.ConsistencyActions,
+	)
+
+	return m
+}
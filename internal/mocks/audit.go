@@ -0,0 +1,22 @@
+package mocks
+
+import (
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/mock"
+)
+
+type Auditor struct {
+	mock.Mock
+}
+
+func (m *Auditor) Record(record ports.AuditRecord) error {
+	args := m.Called(record)
+
+	return args.Error(0)
+}
+
+func (m *Auditor) Close() error {
+	args := m.Called()
+
+	return args.Error(0)
+}
@@ -0,0 +1,29 @@
+package mocks
+
+import (
+	"context"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type LeaderElector struct {
+	mock.Mock
+}
+
+func (m *LeaderElector) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	args := m.Called(ctx, lead)
+
+	return args.Error(0)
+}
+
+func (m *LeaderElector) IsLeader() bool {
+	args := m.Called()
+
+	return args.Bool(0)
+}
+
+func (m *LeaderElector) Identity() string {
+	args := m.Called()
+
+	return args.String(0)
+}
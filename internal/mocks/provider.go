@@ -0,0 +1,69 @@
+package mocks
+
+import (
+	"context"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/mock"
+)
+
+type Provider struct {
+	mock.Mock
+}
+
+func (m *Provider) Name() string {
+	args := m.Called()
+
+	return args.String(0)
+}
+
+func (m *Provider) Provision(ctx context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	args := m.Called(ctx, req)
+
+	return args.Get(0).(*ports.Workload), args.Error(1)
+}
+
+func (m *Provider) Deprovision(ctx context.Context, runnerUUID string) error {
+	args := m.Called(ctx, runnerUUID)
+
+	return args.Error(0)
+}
+
+// InterruptibleProvider is a Provider that also reports interruptions.
+type InterruptibleProvider struct {
+	Provider
+}
+
+func (m *InterruptibleProvider) Interruptions(ctx context.Context) ([]ports.Interruption, error) {
+	args := m.Called(ctx)
+
+	return args.Get(0).([]ports.Interruption), args.Error(1)
+}
+
+func (m *InterruptibleProvider) AckInterruptions(ctx context.Context, notices []ports.Interruption) error {
+	args := m.Called(ctx, notices)
+
+	return args.Error(0)
+}
+
+// LimitedProvider is a Provider that also reports its capacity.
+type LimitedProvider struct {
+	Provider
+}
+
+func (m *LimitedProvider) Capacity(ctx context.Context) (int, error) {
+	args := m.Called(ctx)
+
+	return args.Int(0), args.Error(1)
+}
+
+// ListingProvider is a Provider that also lists its workloads.
+type ListingProvider struct {
+	Provider
+}
+
+func (m *ListingProvider) Workloads(ctx context.Context, workspace, pool string) ([]ports.Workload, error) {
+	args := m.Called(ctx, workspace, pool)
+
+	return args.Get(0).([]ports.Workload), args.Error(1)
+}
@@ -0,0 +1,39 @@
+package mocks
+
+import (
+	"github.com/stretchr/testify/mock"
+)
+
+type StateStore struct {
+	mock.Mock
+}
+
+func (m *StateStore) Get(namespace, key string) ([]byte, error) {
+	args := m.Called(namespace, key)
+
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *StateStore) Put(namespace, key string, value []byte) error {
+	args := m.Called(namespace, key, value)
+
+	return args.Error(0)
+}
+
+func (m *StateStore) Delete(namespace, key string) error {
+	args := m.Called(namespace, key)
+
+	return args.Error(0)
+}
+
+func (m *StateStore) List(namespace string) (map[string][]byte, error) {
+	args := m.Called(namespace)
+
+	return args.Get(0).(map[string][]byte), args.Error(1)
+}
+
+func (m *StateStore) Close() error {
+	args := m.Called()
+
+	return args.Error(0)
+}
@@ -0,0 +1,137 @@
+package predictor
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	hoursPerWeek int = 7 * 24
+	// historyLen bounds the recorded history to four weeks of hourly samples.
+	historyLen int = 4 * hoursPerWeek
+)
+
+// Sample is the peak demand observed during one hour.
+type Sample struct {
+	Hour   time.Time `json:"hour"`
+	Demand float64   `json:"demand"`
+}
+
+// Predictor forecasts the demand of a pool with an hour-of-week seasonal
+// baseline. Every completed hour updates the baseline of its hour-of-week
+// bucket with exponential smoothing, so recent weeks weigh more than older
+// ones.
+type Predictor struct {
+	location  *time.Location
+	current   Sample
+	history   []Sample
+	baseline  [hoursPerWeek]float64
+	alpha     float64
+	lastError float64
+	mu        sync.Mutex
+	seen      [hoursPerWeek]bool
+}
+
+// New returns an empty predictor. alpha in (0, 1] is the weight given to the
+// newest week; location defines where hours and weekdays are counted.
+func New(alpha float64, location *time.Location) *Predictor {
+	return &Predictor{
+		location: location,
+		alpha:    alpha,
+	}
+}
+
+// Replay returns a predictor trained on recorded history, as returned by
+// History.
+func Replay(alpha float64, location *time.Location, history []Sample) *Predictor {
+	p := New(alpha, location)
+
+	for _, sample := range history {
+		p.Observe(sample.Hour, sample.Demand)
+	}
+
+	p.flush()
+
+	return p
+}
+
+// Observe records the demand seen at now. Samples older than the hour in
+// progress are ignored.
+func (p *Predictor) Observe(now time.Time, demand float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hour := now.Truncate(time.Hour)
+
+	switch {
+	case p.current.Hour.IsZero():
+		p.current = Sample{Hour: hour, Demand: demand}
+	case hour.After(p.current.Hour):
+		p.close(p.current)
+		p.current = Sample{Hour: hour, Demand: demand}
+	case hour.Equal(p.current.Hour):
+		p.current.Demand = max(p.current.Demand, demand)
+	}
+}
+
+// Forecast returns the expected peak demand of the hour containing at.
+func (p *Predictor) Forecast(at time.Time) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.baseline[p.bucket(at)]
+}
+
+// LastError returns the absolute difference between the forecast and the
+// observed peak of the last completed hour that had a forecast.
+func (p *Predictor) LastError() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lastError
+}
+
+// History returns the completed hourly samples, oldest first.
+func (p *Predictor) History() []Sample {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]Sample(nil), p.history...)
+}
+
+// flush closes the hour in progress. It is only used when replaying, where
+// the last sample is known to be complete.
+func (p *Predictor) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.current.Hour.IsZero() {
+		p.close(p.current)
+		p.current = Sample{}
+	}
+}
+
+// close folds a completed hour into the baseline. The caller must hold p.mu.
+func (p *Predictor) close(sample Sample) {
+	b := p.bucket(sample.Hour)
+
+	if p.seen[b] {
+		p.lastError = math.Abs(p.baseline[b] - sample.Demand)
+		p.baseline[b] = p.alpha*sample.Demand + (1-p.alpha)*p.baseline[b]
+	} else {
+		p.baseline[b] = sample.Demand
+		p.seen[b] = true
+	}
+
+	p.history = append(p.history, sample)
+	if len(p.history) > historyLen {
+		p.history = p.history[len(p.history)-historyLen:]
+	}
+}
+
+func (p *Predictor) bucket(t time.Time) int {
+	t = t.In(p.location)
+
+	return int(t.Weekday())*24 + t.Hour()
+}
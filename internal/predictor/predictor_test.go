@@ -0,0 +1,96 @@
+package predictor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// weeks builds hourly history starting on Monday 2 December 2024, where the
+// demand of each hour is given by demand.
+func weeks(n int, demand func(t time.Time) float64) []Sample {
+	start := time.Date(2024, 12, 2, 0, 0, 0, 0, time.UTC)
+
+	var history []Sample
+
+	for h := range n * hoursPerWeek {
+		hour := start.Add(time.Duration(h) * time.Hour)
+		history = append(history, Sample{Hour: hour, Demand: demand(hour)})
+	}
+
+	return history
+}
+
+func TestForecast(t *testing.T) {
+	morningRush := func(t time.Time) float64 {
+		if t.Weekday() >= time.Monday && t.Weekday() <= time.Friday && t.Hour() == 8 {
+			return 12
+		}
+
+		return 1
+	}
+
+	p := Replay(0.3, time.UTC, weeks(3, morningRush))
+
+	nextMonday := time.Date(2024, 12, 23, 8, 30, 0, 0, time.UTC)
+
+	tables := []struct {
+		at       time.Time
+		name     string
+		expected float64
+	}{
+		{name: "weekday morning rush", at: nextMonday, expected: 12},
+		{name: "weekday night", at: nextMonday.Add(-6 * time.Hour), expected: 1},
+		{name: "weekend morning", at: nextMonday.Add(-48 * time.Hour), expected: 1},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.InDelta(t, table.expected, p.Forecast(table.at), 1e-9)
+		})
+	}
+
+	assert.Len(t, p.History(), 3*hoursPerWeek)
+	assert.InDelta(t, 0, p.LastError(), 1e-9)
+}
+
+func TestObserve(t *testing.T) {
+	monday := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+
+	p := New(0.5, time.UTC)
+
+	// The peak of the hour is what counts, not the last sample.
+	p.Observe(monday.Add(5*time.Minute), 4)
+	p.Observe(monday.Add(30*time.Minute), 10)
+	p.Observe(monday.Add(55*time.Minute), 2)
+
+	// Nothing is forecast until the hour is complete.
+	assert.InDelta(t, 0, p.Forecast(monday), 0)
+
+	p.Observe(monday.Add(time.Hour), 0)
+
+	assert.InDelta(t, 10, p.Forecast(monday.Add(7*24*time.Hour)), 0)
+
+	// A week later the demand doubles: the baseline moves half way and the
+	// forecast error is recorded.
+	p.Observe(monday.Add(7*24*time.Hour), 20)
+	p.Observe(monday.Add(7*24*time.Hour+time.Hour), 0)
+
+	assert.InDelta(t, 15, p.Forecast(monday), 0)
+	assert.InDelta(t, 10, p.LastError(), 0)
+
+	// Late samples are ignored.
+	p.Observe(monday, 100)
+
+	assert.InDelta(t, 15, p.Forecast(monday), 0)
+}
+
+func TestBucketUsesLocation(t *testing.T) {
+	rome, _ := time.LoadLocation("Europe/Rome")
+
+	p := Replay(1, rome, []Sample{{Hour: time.Date(2024, 12, 2, 8, 0, 0, 0, rome), Demand: 5}})
+
+	assert.InDelta(t, 5, p.Forecast(time.Date(2024, 12, 9, 7, 15, 0, 0, time.UTC)), 0)
+	assert.InDelta(t, 0, p.Forecast(time.Date(2024, 12, 9, 8, 15, 0, 0, time.UTC)), 0)
+}
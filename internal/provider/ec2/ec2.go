@@ -0,0 +1,565 @@
+package ec2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awsec2 "github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// Tags set on every instance. Each runner on an instance gets its own
+// TagRunnerPrefix tag, so instances can be found from a runner UUID alone.
+const (
+	TagWorkspace    string = "bitbucket-runner-autoscaler:workspace"
+	TagPool         string = "bitbucket-runner-autoscaler:pool"
+	TagMarket       string = "bitbucket-runner-autoscaler:market"
+	TagRunnerPrefix string = "bitbucket-runner-autoscaler:runner:"
+)
+
+// defaultUserData starts the Bitbucket runner container. With SSM
+// credentials the secret is read from Parameter Store at boot, which needs
+// the AWS CLI and jq in the image.
+const defaultUserData string = `#!/bin/sh
+set -e
+{{- if .Parameter}}
+credentials=$(aws ssm get-parameter --with-decryption --name '{{.Parameter}}' --query Parameter.Value --output text)
+OAUTH_CLIENT_ID=$(echo "$credentials" | jq -r .oauth_client_id)
+OAUTH_CLIENT_SECRET=$(echo "$credentials" | jq -r .oauth_client_secret)
+{{- else}}
+OAUTH_CLIENT_ID='{{.OAuthClientID}}'
+OAUTH_CLIENT_SECRET='{{.OAuthClientSecret}}'
+{{- end}}
+docker run -d --restart unless-stopped --name runner \
+  -v /tmp:/tmp \
+  -v /var/run/docker.sock:/var/run/docker.sock \
+  -v /var/lib/docker/containers:/var/lib/docker/containers:ro \
+  -e ACCOUNT_UUID='{{.WorkspaceUUID}}' \
+  -e RUNNER_UUID='{{.RunnerUUID}}' \
+  -e RUNTIME_PREREQUISITES_ENABLED=true \
+  -e OAUTH_CLIENT_ID="$OAUTH_CLIENT_ID" \
+  -e OAUTH_CLIENT_SECRET="$OAUTH_CLIENT_SECRET" \
+  -e WORKING_DIRECTORY=/tmp \
+  docker-public.packages.atlassian.com/sox/atlassian/bitbucket-pipelines-runner:1
+`
+
+// capacityErrors are the RunInstances error codes after which an on-demand
+// instance is tried when spot capacity runs out.
+var capacityErrors = []string{ //nolint:gochecknoglobals
+	"InsufficientInstanceCapacity",
+	"InsufficientCapacity",
+	"MaxSpotInstanceCountExceeded",
+	"SpotMaxPriceTooLow",
+	"UnfulfillableCapacity",
+}
+
+// EC2API is the part of the EC2 API the provider uses, satisfied by
+// *ec2.Client.
+type EC2API interface {
+	RunInstances(
+		ctx context.Context, params *awsec2.RunInstancesInput, optFns ...func(*awsec2.Options),
+	) (*awsec2.RunInstancesOutput, error)
+	DescribeInstances(
+		ctx context.Context, params *awsec2.DescribeInstancesInput, optFns ...func(*awsec2.Options),
+	) (*awsec2.DescribeInstancesOutput, error)
+	TerminateInstances(
+		ctx context.Context, params *awsec2.TerminateInstancesInput, optFns ...func(*awsec2.Options),
+	) (*awsec2.TerminateInstancesOutput, error)
+	CreateTags(
+		ctx context.Context, params *awsec2.CreateTagsInput, optFns ...func(*awsec2.Options),
+	) (*awsec2.CreateTagsOutput, error)
+	DeleteTags(
+		ctx context.Context, params *awsec2.DeleteTagsInput, optFns ...func(*awsec2.Options),
+	) (*awsec2.DeleteTagsOutput, error)
+}
+
+// SSMAPI is the part of the SSM API the provider uses, satisfied by
+// *ssm.Client.
+type SSMAPI interface {
+	PutParameter(
+		ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options),
+	) (*ssm.PutParameterOutput, error)
+	DeleteParameter(
+		ctx context.Context, params *ssm.DeleteParameterInput, optFns ...func(*ssm.Options),
+	) (*ssm.DeleteParameterOutput, error)
+}
+
+// SQSAPI is the part of the SQS API the provider uses, satisfied by
+// *sqs.Client.
+type SQSAPI interface {
+	ReceiveMessage(
+		ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options),
+	) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(
+		ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options),
+	) (*sqs.DeleteMessageBatchOutput, error)
+}
+
+// Provider runs Bitbucket runners on EC2 instances launched from a launch
+// template.
+type Provider struct {
+	ec2      EC2API
+	ssm      SSMAPI
+	sqs      SQSAPI
+	userData *template.Template
+	// interruptions holds the notices of runners not deprovisioned yet,
+	// keyed by runner UUID.
+	interruptions map[string]ports.Interruption
+	// pending holds the interruption messages left in the queue until their
+	// notices are acknowledged, keyed by message ID.
+	pending map[string]*pendingMessage
+	name    string
+	cfg     config.EC2
+	// mu serializes provisioning, so runners packed on shared instances
+	// never exceed RunnersPerInstance.
+	mu sync.Mutex
+}
+
+// credentials is the SSM parameter value read by the instance.
+type credentials struct {
+	OAuthClientID     string `json:"oauth_client_id"`
+	OAuthClientSecret string `json:"oauth_client_secret"`
+	TokenEndpoint     string `json:"token_endpoint,omitempty"`
+	Audience          string `json:"audience,omitempty"`
+}
+
+// userDataInput is what the user data template can refer to. With SSM
+// credentials the OAuth fields are empty and Parameter is set instead.
+type userDataInput struct {
+	WorkspaceUUID     string
+	RunnerUUID        string
+	RunnerName        string
+	OAuthClientID     string
+	OAuthClientSecret string
+	TokenEndpoint     string
+	Audience          string
+	Parameter         string
+	Labels            []string
+}
+
+// New returns a provider calling EC2, SSM and SQS through the given clients.
+func New(name string, cfg config.EC2, ec2Client EC2API, ssmClient SSMAPI, sqsClient SQSAPI) (*Provider, error) {
+	text := cfg.UserData
+	if text == "" {
+		text = defaultUserData
+	}
+
+	userData, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_data template: %w", err)
+	}
+
+	return &Provider{
+		ec2:           ec2Client,
+		ssm:           ssmClient,
+		sqs:           sqsClient,
+		userData:      userData,
+		interruptions: map[string]ports.Interruption{},
+		pending:       map[string]*pendingMessage{},
+		name:          name,
+		cfg:           cfg,
+	}, nil
+}
+
+// Open returns a provider using the default AWS credential chain.
+func Open(ctx context.Context, name string, cfg config.EC2) (*Provider, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	var endpoint *string
+	if cfg.Endpoint != "" {
+		endpoint = aws.String(cfg.Endpoint)
+	}
+
+	return New(name, cfg,
+		awsec2.NewFromConfig(awsCfg, func(o *awsec2.Options) { o.BaseEndpoint = endpoint }),
+		ssm.NewFromConfig(awsCfg, func(o *ssm.Options) { o.BaseEndpoint = endpoint }),
+		sqs.NewFromConfig(awsCfg, func(o *sqs.Options) { o.BaseEndpoint = endpoint }),
+	)
+}
+
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// Provision starts the runner on an instance: a shared one with a free slot
+// if runners are packed, otherwise a new one.
+func (p *Provider) Provision(ctx context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cfg.Credentials == config.EC2CredentialsSSM {
+		if err := p.putCredentials(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+
+	workload, err := p.place(ctx, req)
+	if err != nil && p.cfg.Credentials == config.EC2CredentialsSSM {
+		err = errors.Join(err, p.deleteCredentials(ctx, req.RunnerUUID))
+	}
+
+	return workload, err
+}
+
+func (p *Provider) place(ctx context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	if p.cfg.RunnersPerInstance > 1 {
+		instance, err := p.findSlot(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if instance != nil {
+			_, err := p.ec2.CreateTags(ctx, &awsec2.CreateTagsInput{
+				Resources: []string{aws.ToString(instance.InstanceId)},
+				Tags:      []ec2types.Tag{{Key: aws.String(TagRunnerPrefix + req.RunnerUUID), Value: aws.String(req.RunnerName)}},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to add runner to instance %s: %w", aws.ToString(instance.InstanceId), err)
+			}
+
+			return p.workload(req, instance), nil
+		}
+	}
+
+	return p.launch(ctx, req)
+}
+
+// launch starts a new instance for req, falling back to on-demand if spot
+// capacity is short and the fallback is enabled.
+func (p *Provider) launch(ctx context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	input, err := p.runInstancesInput(req)
+	if err != nil {
+		return nil, err
+	}
+
+	market := p.cfg.Market
+
+	out, err := p.ec2.RunInstances(ctx, p.withMarket(input, market))
+	if err != nil && market == config.EC2MarketSpot && p.cfg.OnDemandFallback && isCapacityError(err) {
+		market = config.EC2MarketOnDemand
+
+		out, err = p.ec2.RunInstances(ctx, p.withMarket(input, market))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to launch %s instance: %w", market, err)
+	}
+
+	if len(out.Instances) == 0 {
+		return nil, errors.New("failed to launch instance: no instance returned")
+	}
+
+	return p.workload(req, &out.Instances[0]), nil
+}
+
+func (p *Provider) runInstancesInput(req ports.ProvisionRequest) (*awsec2.RunInstancesInput, error) {
+	template := &ec2types.LaunchTemplateSpecification{Version: nilIfEmpty(p.cfg.LaunchTemplate.Version)}
+
+	if p.cfg.LaunchTemplate.ID != "" {
+		template.LaunchTemplateId = aws.String(p.cfg.LaunchTemplate.ID)
+	} else {
+		template.LaunchTemplateName = aws.String(p.cfg.LaunchTemplate.Name)
+	}
+
+	tags := []ec2types.Tag{
+		{Key: aws.String(TagWorkspace), Value: aws.String(req.Workspace)},
+		{Key: aws.String(TagPool), Value: aws.String(req.Pool)},
+		{Key: aws.String(TagRunnerPrefix + req.RunnerUUID), Value: aws.String(req.RunnerName)},
+	}
+
+	input := &awsec2.RunInstancesInput{
+		LaunchTemplate: template,
+		MinCount:       aws.Int32(1),
+		MaxCount:       aws.Int32(1),
+		SubnetId:       nilIfEmpty(p.cfg.SubnetID),
+		TagSpecifications: []ec2types.TagSpecification{
+			{ResourceType: ec2types.ResourceTypeInstance, Tags: tags},
+			{ResourceType: ec2types.ResourceTypeVolume, Tags: tags},
+		},
+	}
+
+	if p.cfg.InstanceType != "" {
+		input.InstanceType = ec2types.InstanceType(p.cfg.InstanceType)
+	}
+
+	// Packed instances start their runners from tags, so the launch
+	// template keeps its own user data.
+	if p.cfg.RunnersPerInstance == 1 {
+		userData, err := p.renderUserData(req)
+		if err != nil {
+			return nil, err
+		}
+
+		input.UserData = aws.String(base64.StdEncoding.EncodeToString([]byte(userData)))
+	}
+
+	return input, nil
+}
+
+// withMarket returns a copy of input launching on market.
+func (p *Provider) withMarket(input *awsec2.RunInstancesInput, market string) *awsec2.RunInstancesInput {
+	withMarket := *input
+	withMarket.TagSpecifications = make([]ec2types.TagSpecification, len(input.TagSpecifications))
+
+	for i, spec := range input.TagSpecifications {
+		spec.Tags = append(slices.Clone(spec.Tags), ec2types.Tag{Key: aws.String(TagMarket), Value: aws.String(market)})
+		withMarket.TagSpecifications[i] = spec
+	}
+
+	if market == config.EC2MarketSpot {
+		withMarket.InstanceMarketOptions = &ec2types.InstanceMarketOptionsRequest{
+			MarketType: ec2types.MarketTypeSpot,
+			SpotOptions: &ec2types.SpotMarketOptions{
+				SpotInstanceType:             ec2types.SpotInstanceTypeOneTime,
+				InstanceInterruptionBehavior: ec2types.InstanceInterruptionBehaviorTerminate,
+			},
+		}
+	}
+
+	return &withMarket
+}
+
+func (p *Provider) renderUserData(req ports.ProvisionRequest) (string, error) {
+	input := userDataInput{
+		WorkspaceUUID: req.WorkspaceUUID,
+		RunnerUUID:    req.RunnerUUID,
+		RunnerName:    req.RunnerName,
+		TokenEndpoint: req.TokenEndpoint,
+		Audience:      req.Audience,
+		Labels:        req.Labels,
+	}
+
+	// User data can be read back by anyone allowed to describe the
+	// instance, so secrets only go there when SSM is not used.
+	if p.cfg.Credentials == config.EC2CredentialsSSM {
+		input.Parameter = p.parameter(req.RunnerUUID)
+	} else {
+		input.OAuthClientID = req.OAuthClientID
+		input.OAuthClientSecret = req.OAuthClientSecret
+	}
+
+	var b strings.Builder
+
+	if err := p.userData.Execute(&b, input); err != nil {
+		return "", fmt.Errorf("failed to render user data: %w", err)
+	}
+
+	return b.String(), nil
+}
+
+// findSlot returns a live instance of the pool with room for one more
+// runner, or nil.
+func (p *Provider) findSlot(ctx context.Context, req ports.ProvisionRequest) (*ec2types.Instance, error) {
+	instances, err := p.describe(ctx, []ec2types.Filter{
+		{Name: aws.String("tag:" + TagWorkspace), Values: []string{req.Workspace}},
+		{Name: aws.String("tag:" + TagPool), Values: []string{req.Pool}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range instances {
+		if len(runnerTags(&instances[i])) < p.cfg.RunnersPerInstance {
+			return &instances[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Deprovision removes the runner from its instance, and terminates the
+// instance once no runner is left on it. A runner without an instance is
+// already gone.
+func (p *Provider) Deprovision(ctx context.Context, runnerUUID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	instances, err := p.describe(ctx, []ec2types.Filter{
+		{Name: aws.String("tag-key"), Values: []string{TagRunnerPrefix + runnerUUID}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range instances {
+		instanceID := aws.ToString(instances[i].InstanceId)
+
+		if len(runnerTags(&instances[i])) > 1 {
+			_, err = p.ec2.DeleteTags(ctx, &awsec2.DeleteTagsInput{
+				Resources: []string{instanceID},
+				Tags:      []ec2types.Tag{{Key: aws.String(TagRunnerPrefix + runnerUUID)}},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to remove runner from instance %s: %w", instanceID, err)
+			}
+
+			continue
+		}
+
+		_, err = p.ec2.TerminateInstances(ctx, &awsec2.TerminateInstancesInput{InstanceIds: []string{instanceID}})
+		if err != nil {
+			return fmt.Errorf("failed to terminate instance %s: %w", instanceID, err)
+		}
+	}
+
+	delete(p.interruptions, runnerUUID)
+	p.forget(runnerUUID)
+
+	if p.cfg.Credentials == config.EC2CredentialsSSM {
+		return p.deleteCredentials(ctx, runnerUUID)
+	}
+
+	return nil
+}
+
+// Workloads returns a workload per runner tagged on the live instances of
+// pool.
+func (p *Provider) Workloads(ctx context.Context, workspace, pool string) ([]ports.Workload, error) {
+	instances, err := p.describe(ctx, []ec2types.Filter{
+		{Name: aws.String("tag:" + TagWorkspace), Values: []string{workspace}},
+		{Name: aws.String("tag:" + TagPool), Values: []string{pool}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var workloads []ports.Workload
+
+	for i := range instances {
+		for _, runnerUUID := range runnerTags(&instances[i]) {
+			req := ports.ProvisionRequest{Workspace: workspace, Pool: pool, RunnerUUID: runnerUUID}
+			workloads = append(workloads, *p.workload(req, &instances[i]))
+		}
+	}
+
+	return workloads, nil
+}
+
+// describe lists the instances matching filters that are not shutting down.
+func (p *Provider) describe(ctx context.Context, filters []ec2types.Filter) ([]ec2types.Instance, error) {
+	input := &awsec2.DescribeInstancesInput{
+		Filters: append(filters, ec2types.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: []string{"pending", "running", "stopping", "stopped"},
+		}),
+	}
+
+	var instances []ec2types.Instance
+
+	paginator := awsec2.NewDescribeInstancesPaginator(p.ec2, input)
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %w", err)
+		}
+
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+
+	return instances, nil
+}
+
+func (p *Provider) putCredentials(ctx context.Context, req ports.ProvisionRequest) error {
+	value, err := json.Marshal(credentials{
+		OAuthClientID:     req.OAuthClientID,
+		OAuthClientSecret: req.OAuthClientSecret,
+		TokenEndpoint:     req.TokenEndpoint,
+		Audience:          req.Audience,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = p.ssm.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(p.parameter(req.RunnerUUID)),
+		Value:     aws.String(string(value)),
+		Type:      ssmtypes.ParameterTypeSecureString,
+		Overwrite: aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store runner credentials: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Provider) deleteCredentials(ctx context.Context, runnerUUID string) error {
+	_, err := p.ssm.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(p.parameter(runnerUUID))})
+
+	var notFound *ssmtypes.ParameterNotFound
+	if err != nil && !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to delete runner credentials: %w", err)
+	}
+
+	return nil
+}
+
+// parameter is the SSM parameter holding the credentials of a runner.
+// Braces are not allowed in parameter names.
+func (p *Provider) parameter(runnerUUID string) string {
+	return strings.TrimSuffix(p.cfg.SSMPrefix, "/") + "/" + strings.Trim(runnerUUID, "{}")
+}
+
+func (p *Provider) workload(req ports.ProvisionRequest, instance *ec2types.Instance) *ports.Workload {
+	createdAt := aws.ToTime(instance.LaunchTime)
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	return &ports.Workload{
+		CreatedAt:  createdAt,
+		ID:         aws.ToString(instance.InstanceId),
+		RunnerUUID: req.RunnerUUID,
+		Pool:       req.Pool,
+		Provider:   p.name,
+	}
+}
+
+// runnerTags returns the runner tags of instance.
+func runnerTags(instance *ec2types.Instance) []string {
+	var runners []string
+
+	for _, tag := range instance.Tags {
+		if runner, ok := strings.CutPrefix(aws.ToString(tag.Key), TagRunnerPrefix); ok {
+			runners = append(runners, runner)
+		}
+	}
+
+	return runners
+}
+
+func isCapacityError(err error) bool {
+	var apiErr smithy.APIError
+
+	return errors.As(err, &apiErr) && slices.Contains(capacityErrors, apiErr.ErrorCode())
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return aws.String(s)
+}
@@ -0,0 +1,321 @@
+package ec2
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEC2Config() config.EC2 {
+	return config.EC2{
+		Region:             "eu-west-1",
+		LaunchTemplate:     config.LaunchTemplate{ID: "lt-0123456789abcdef0", Version: "$Latest"},
+		SubnetID:           "subnet-0123",
+		Credentials:        config.EC2CredentialsUserData,
+		SSMPrefix:          config.DefaultEC2SSMPrefix,
+		Market:             config.EC2MarketOnDemand,
+		RunnersPerInstance: 1,
+	}
+}
+
+func testRequest(n int) ports.ProvisionRequest {
+	return ports.ProvisionRequest{
+		Workspace:         "acme",
+		WorkspaceUUID:     "{workspace}",
+		Pool:              "linux",
+		RunnerUUID:        fmt.Sprintf("{%d}", n),
+		RunnerName:        fmt.Sprintf("linux-%08d", n),
+		OAuthClientID:     "client-id",
+		OAuthClientSecret: "client-secret",
+		Labels:            []string{"self.hosted", "linux"},
+	}
+}
+
+func TestProvision(t *testing.T) {
+	tables := []struct {
+		runErrors        map[string]string
+		change           func(cfg *config.EC2)
+		name             string
+		expectedMarket   string
+		expectedError    string
+		expectedLaunches int
+	}{
+		{
+			name:             "on-demand",
+			change:           func(_ *config.EC2) {},
+			expectedMarket:   config.EC2MarketOnDemand,
+			expectedLaunches: 1,
+		},
+		{
+			name: "spot",
+			change: func(cfg *config.EC2) {
+				cfg.Market = config.EC2MarketSpot
+			},
+			expectedMarket:   config.EC2MarketSpot,
+			expectedLaunches: 1,
+		},
+		{
+			name:      "spot capacity short falls back to on-demand",
+			runErrors: map[string]string{config.EC2MarketSpot: "InsufficientInstanceCapacity"},
+			change: func(cfg *config.EC2) {
+				cfg.Market = config.EC2MarketSpot
+				cfg.OnDemandFallback = true
+			},
+			expectedMarket:   config.EC2MarketOnDemand,
+			expectedLaunches: 1,
+		},
+		{
+			name:      "spot capacity short without fallback",
+			runErrors: map[string]string{config.EC2MarketSpot: "InsufficientInstanceCapacity"},
+			change: func(cfg *config.EC2) {
+				cfg.Market = config.EC2MarketSpot
+			},
+			expectedError: "failed to launch spot instance",
+		},
+		{
+			name:      "other errors do not fall back",
+			runErrors: map[string]string{config.EC2MarketSpot: "InvalidLaunchTemplateId.NotFound"},
+			change: func(cfg *config.EC2) {
+				cfg.Market = config.EC2MarketSpot
+				cfg.OnDemandFallback = true
+			},
+			expectedError: "InvalidLaunchTemplateId.NotFound",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			standIn, ec2Client, ssmClient, sqsClient := newStandIn(t)
+			standIn.runErrors = table.runErrors
+
+			cfg := testEC2Config()
+			table.change(&cfg)
+
+			provider, err := New("aws", cfg, ec2Client, ssmClient, sqsClient)
+			require.NoError(t, err)
+
+			workload, err := provider.Provision(context.Background(), testRequest(1))
+
+			if table.expectedError != "" {
+				assert.ErrorContains(t, err, table.expectedError)
+				assert.Empty(t, standIn.live())
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, standIn.launches, table.expectedLaunches)
+
+			launch := standIn.launches[0]
+			assert.Equal(t, "lt-0123456789abcdef0", launch.Get("LaunchTemplate.LaunchTemplateId"))
+			assert.Equal(t, "subnet-0123", launch.Get("SubnetId"))
+
+			instances := standIn.live()
+			require.Len(t, instances, 1)
+
+			instance := instances[0]
+			assert.Equal(t, ports.Workload{
+				CreatedAt:  workload.CreatedAt,
+				ID:         instance.id,
+				RunnerUUID: "{1}",
+				Pool:       "linux",
+				Provider:   "aws",
+			}, *workload)
+			assert.Equal(t, table.expectedMarket, instance.market)
+			assert.Equal(t, map[string]string{
+				TagWorkspace:            "acme",
+				TagPool:                 "linux",
+				TagMarket:               table.expectedMarket,
+				TagRunnerPrefix + "{1}": "linux-00000001",
+			}, instance.tags)
+
+			userData, err := base64.StdEncoding.DecodeString(instance.userData)
+			require.NoError(t, err)
+			assert.Contains(t, string(userData), "RUNNER_UUID='{1}'")
+			assert.Contains(t, string(userData), "OAUTH_CLIENT_SECRET='client-secret'")
+
+			require.NoError(t, provider.Deprovision(context.Background(), "{1}"))
+			assert.Empty(t, standIn.live())
+		})
+	}
+}
+
+func TestProvisionSSMPacked(t *testing.T) {
+	standIn, ec2Client, ssmClient, sqsClient := newStandIn(t)
+
+	cfg := testEC2Config()
+	cfg.Credentials = config.EC2CredentialsSSM
+	cfg.RunnersPerInstance = 2
+
+	provider, err := New("aws", cfg, ec2Client, ssmClient, sqsClient)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	for n := 1; n <= 3; n++ {
+		_, err := provider.Provision(ctx, testRequest(n))
+		require.NoError(t, err)
+	}
+
+	// Three runners two to an instance take two instances.
+	assert.Len(t, standIn.live(), 2)
+	assert.Len(t, standIn.launches, 2)
+	assert.Empty(t, standIn.launches[0].Get("UserData"))
+	assert.Equal(t, map[string]string{
+		"/bitbucket-runner-autoscaler/1": `{"oauth_client_id":"client-id","oauth_client_secret":"client-secret"}`,
+		"/bitbucket-runner-autoscaler/2": `{"oauth_client_id":"client-id","oauth_client_secret":"client-secret"}`,
+		"/bitbucket-runner-autoscaler/3": `{"oauth_client_id":"client-id","oauth_client_secret":"client-secret"}`,
+	}, standIn.parameters)
+
+	// The first runner leaves a shared instance running.
+	require.NoError(t, provider.Deprovision(ctx, "{1}"))
+	assert.Len(t, standIn.live(), 2)
+	assert.NotContains(t, standIn.parameters, "/bitbucket-runner-autoscaler/1")
+
+	// The freed slot is reused before launching anything.
+	_, err = provider.Provision(ctx, testRequest(4))
+	require.NoError(t, err)
+	assert.Len(t, standIn.launches, 2)
+
+	for _, runnerUUID := range []string{"{2}", "{4}"} {
+		require.NoError(t, provider.Deprovision(ctx, runnerUUID))
+	}
+
+	assert.Len(t, standIn.live(), 1)
+
+	require.NoError(t, provider.Deprovision(ctx, "{3}"))
+	assert.Empty(t, standIn.live())
+	assert.Empty(t, standIn.parameters)
+
+	// Runners without an instance are already gone.
+	require.NoError(t, provider.Deprovision(ctx, "{3}"))
+}
+
+func TestWorkloads(t *testing.T) {
+	_, ec2Client, ssmClient, sqsClient := newStandIn(t)
+
+	cfg := testEC2Config()
+	cfg.RunnersPerInstance = 2
+
+	provider, err := New("aws", cfg, ec2Client, ssmClient, sqsClient)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	for n := 1; n <= 3; n++ {
+		_, err := provider.Provision(ctx, testRequest(n))
+		require.NoError(t, err)
+	}
+
+	other := testRequest(4)
+	other.Pool = "windows"
+
+	_, err = provider.Provision(ctx, other)
+	require.NoError(t, err)
+
+	workloads, err := provider.Workloads(ctx, "acme", "linux")
+	require.NoError(t, err)
+
+	runners := map[string]string{}
+
+	for _, workload := range workloads {
+		assert.Equal(t, "linux", workload.Pool)
+		assert.Equal(t, "aws", workload.Provider)
+		assert.False(t, workload.CreatedAt.IsZero())
+
+		runners[workload.RunnerUUID] = workload.ID
+	}
+
+	// Runners sharing an instance each get a workload.
+	require.Len(t, runners, 3)
+	assert.Equal(t, runners["{1}"], runners["{2}"])
+	assert.NotEqual(t, runners["{1}"], runners["{3}"])
+
+	require.NoError(t, provider.Deprovision(ctx, "{3}"))
+
+	workloads, err = provider.Workloads(ctx, "acme", "linux")
+	require.NoError(t, err)
+	assert.Len(t, workloads, 2)
+}
+
+func TestInterruptions(t *testing.T) {
+	standIn, ec2Client, ssmClient, sqsClient := newStandIn(t)
+
+	cfg := testEC2Config()
+	cfg.Market = config.EC2MarketSpot
+	cfg.InterruptionQueueURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/interruptions"
+
+	provider, err := New("aws", cfg, ec2Client, ssmClient, sqsClient)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	first, err := provider.Provision(ctx, testRequest(1))
+	require.NoError(t, err)
+
+	second, err := provider.Provision(ctx, testRequest(2))
+	require.NoError(t, err)
+
+	notices, err := provider.Interruptions(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, notices)
+
+	standIn.send("EC2 Instance Rebalance Recommendation", second.ID)
+	standIn.send("EC2 Instance State-change Notification", second.ID)
+	standIn.send("EC2 Spot Instance Interruption Warning", first.ID)
+	standIn.send("EC2 Spot Instance Interruption Warning", "i-0000000000000000f")
+	standIn.queue = append(standIn.queue, "not an event")
+
+	at := time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC)
+	expected := []ports.Interruption{
+		{Time: at, RunnerUUID: "{1}", WorkloadID: first.ID, Kind: ports.InterruptionTermination},
+		{Time: at, RunnerUUID: "{2}", WorkloadID: second.ID, Kind: ports.InterruptionRebalance},
+	}
+
+	notices, err = provider.Interruptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, expected, notices)
+	assert.Empty(t, standIn.queue)
+
+	// Only the messages about runners stay in the queue, until their
+	// notices are acknowledged.
+	assert.Len(t, standIn.inflight, 2)
+
+	require.NoError(t, provider.AckInterruptions(ctx, expected[:1]))
+	assert.Len(t, standIn.inflight, 1)
+
+	require.NoError(t, provider.AckInterruptions(ctx, expected))
+	assert.Empty(t, standIn.inflight)
+
+	// Notices are repeated until their runner is deprovisioned, and a
+	// termination warning supersedes a rebalance recommendation.
+	standIn.send("EC2 Spot Instance Interruption Warning", second.ID)
+	expected[1].Kind = ports.InterruptionTermination
+
+	notices, err = provider.Interruptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, expected, notices)
+
+	assert.Len(t, standIn.inflight, 1)
+
+	require.NoError(t, provider.Deprovision(ctx, "{1}"))
+
+	notices, err = provider.Interruptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, expected[1:], notices)
+
+	// A deprovisioned runner needs no acknowledgement.
+	require.NoError(t, provider.Deprovision(ctx, "{2}"))
+
+	notices, err = provider.Interruptions(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, notices)
+	assert.Empty(t, standIn.inflight)
+}
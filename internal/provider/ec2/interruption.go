@@ -0,0 +1,269 @@
+package ec2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// EventBridge detail types of the events read from the interruption queue.
+const (
+	eventSpotInterruption string = "EC2 Spot Instance Interruption Warning"
+	eventRebalance        string = "EC2 Instance Rebalance Recommendation"
+)
+
+// maxMessages is the most messages SQS returns per receive.
+const maxMessages int32 = 10
+
+// event is the part of an EventBridge event the provider reads.
+type event struct {
+	Time       time.Time `json:"time"`
+	DetailType string    `json:"detail-type"`
+	Detail     struct {
+		InstanceID string `json:"instance-id"`
+	} `json:"detail"`
+}
+
+// pendingMessage is an interruption message kept in the queue until the
+// notices it carries are acknowledged, so that it is received again if the
+// autoscaler restarts before saving them.
+type pendingMessage struct {
+	// runners holds the runner UUIDs whose notices are not acknowledged
+	// yet.
+	runners       map[string]struct{}
+	receiptHandle string
+}
+
+// Interruptions reads the interruption queue and returns the notices of the
+// runners on interrupted instances, until the runners are deprovisioned.
+// Messages about runners stay in the queue until their notices are
+// acknowledged, and the others are deleted. Without a queue configured there
+// are none.
+func (p *Provider) Interruptions(ctx context.Context) ([]ports.Interruption, error) {
+	if p.cfg.InterruptionQueueURL == "" {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		out, err := p.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(p.cfg.InterruptionQueueURL),
+			MaxNumberOfMessages: maxMessages,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive interruptions: %w", err)
+		}
+
+		if len(out.Messages) == 0 {
+			break
+		}
+
+		if err := p.interrupt(ctx, out.Messages); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	notices := make([]ports.Interruption, 0, len(p.interruptions))
+
+	for _, notice := range p.interruptions {
+		notices = append(notices, notice)
+	}
+
+	slices.SortFunc(notices, func(a, b ports.Interruption) int {
+		return strings.Compare(a.RunnerUUID, b.RunnerUUID)
+	})
+
+	return notices, nil
+}
+
+// interrupt records a notice for every runner on the instances the messages
+// are about, and keeps the messages pending until the notices are
+// acknowledged. Messages that are not interruption events, or about no
+// runner, are pending on nothing and deleted on the next flush.
+func (p *Provider) interrupt(ctx context.Context, messages []sqstypes.Message) error {
+	events := map[string]event{}
+	// received maps instance IDs to the pending messages about them.
+	received := map[string][]*pendingMessage{}
+
+	for _, message := range messages {
+		messageID := aws.ToString(message.MessageId)
+
+		// A message received again after its visibility timeout keeps
+		// what it is pending on.
+		if pending, ok := p.pending[messageID]; ok {
+			pending.receiptHandle = aws.ToString(message.ReceiptHandle)
+
+			continue
+		}
+
+		pending := &pendingMessage{runners: map[string]struct{}{}, receiptHandle: aws.ToString(message.ReceiptHandle)}
+		p.pending[messageID] = pending
+
+		var e event
+
+		if err := json.Unmarshal([]byte(aws.ToString(message.Body)), &e); err != nil {
+			continue
+		}
+
+		if (e.DetailType != eventSpotInterruption && e.DetailType != eventRebalance) || e.Detail.InstanceID == "" {
+			continue
+		}
+
+		received[e.Detail.InstanceID] = append(received[e.Detail.InstanceID], pending)
+
+		// A termination warning outweighs a rebalance recommendation.
+		if previous, ok := events[e.Detail.InstanceID]; !ok || previous.DetailType == eventRebalance {
+			events[e.Detail.InstanceID] = e
+		}
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	instanceIDs := make([]string, 0, len(events))
+
+	for instanceID := range events {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+
+	instances, err := p.describe(ctx, []ec2types.Filter{
+		{Name: aws.String("instance-id"), Values: instanceIDs},
+		{Name: aws.String("tag-key"), Values: []string{TagPool}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range instances {
+		instanceID := aws.ToString(instances[i].InstanceId)
+		e := events[instanceID]
+
+		kind := ports.InterruptionRebalance
+		if e.DetailType == eventSpotInterruption {
+			kind = ports.InterruptionTermination
+		}
+
+		for _, runnerUUID := range runnerTags(&instances[i]) {
+			for _, pending := range received[instanceID] {
+				pending.runners[runnerUUID] = struct{}{}
+			}
+
+			if previous, ok := p.interruptions[runnerUUID]; ok && previous.Kind == ports.InterruptionTermination {
+				continue
+			}
+
+			p.interruptions[runnerUUID] = ports.Interruption{
+				Time:       e.Time,
+				RunnerUUID: runnerUUID,
+				WorkloadID: instanceID,
+				Kind:       kind,
+			}
+		}
+	}
+
+	return nil
+}
+
+// AckInterruptions deletes the messages whose notices are all acknowledged
+// from the queue, so they are not received again.
+func (p *Provider) AckInterruptions(ctx context.Context, notices []ports.Interruption) error {
+	if p.cfg.InterruptionQueueURL == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, notice := range notices {
+		p.forget(notice.RunnerUUID)
+	}
+
+	return p.flush(ctx)
+}
+
+// forget stops the pending messages from waiting on the notice of the runner.
+func (p *Provider) forget(runnerUUID string) {
+	for _, pending := range p.pending {
+		delete(pending.runners, runnerUUID)
+	}
+}
+
+// flush deletes the pending messages no longer waiting on any notice from the
+// queue, in batches as large as SQS takes. Messages that could not be deleted
+// stay pending.
+func (p *Provider) flush(ctx context.Context) error {
+	var messageIDs []string
+
+	for messageID, pending := range p.pending {
+		if len(pending.runners) == 0 {
+			messageIDs = append(messageIDs, messageID)
+		}
+	}
+
+	slices.Sort(messageIDs)
+
+	for batch := range slices.Chunk(messageIDs, int(maxMessages)) {
+		if err := p.deleteMessages(ctx, batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteMessages removes pending messages from the queue, so they are not
+// received again.
+func (p *Provider) deleteMessages(ctx context.Context, messageIDs []string) error {
+	entries := make([]sqstypes.DeleteMessageBatchRequestEntry, 0, len(messageIDs))
+
+	for i, messageID := range messageIDs {
+		entries = append(entries, sqstypes.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String(p.pending[messageID].receiptHandle),
+		})
+	}
+
+	out, err := p.sqs.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(p.cfg.InterruptionQueueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete interruption messages: %w", err)
+	}
+
+	failed := make(map[string]string, len(out.Failed))
+
+	for _, entry := range out.Failed {
+		failed[aws.ToString(entry.Id)] = aws.ToString(entry.Message)
+	}
+
+	for i, messageID := range messageIDs {
+		if _, ok := failed[strconv.Itoa(i)]; !ok {
+			delete(p.pending, messageID)
+		}
+	}
+
+	if len(out.Failed) > 0 {
+		return fmt.Errorf("failed to delete %d interruption messages: %s",
+			len(out.Failed), aws.ToString(out.Failed[0].Message))
+	}
+
+	return nil
+}
@@ -0,0 +1,456 @@
+package ec2
+
+import (
+	"crypto/md5" //nolint:gosec
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awscredentials "github.com/aws/aws-sdk-go-v2/credentials"
+	awsec2 "github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// standIn is a local stand-in for the EC2, SSM and SQS APIs, speaking their
+// wire protocols so the provider is tested through the real SDK clients.
+type standIn struct {
+	instances  map[string]*standInInstance
+	parameters map[string]string
+	// inflight holds the received messages not deleted yet, by receipt
+	// handle.
+	inflight map[string]string
+	queue    []string
+	// runErrors holds the error code RunInstances returns per market.
+	runErrors map[string]string
+	launches  []url.Values
+	next      int
+	mu        sync.Mutex
+}
+
+type standInInstance struct {
+	tags     map[string]string
+	id       string
+	state    string
+	market   string
+	userData string
+}
+
+func newStandIn(t *testing.T) (*standIn, *awsec2.Client, *ssm.Client, *sqs.Client) {
+	t.Helper()
+
+	s := &standIn{
+		instances:  map[string]*standInInstance{},
+		parameters: map[string]string{},
+		inflight:   map[string]string{},
+		runErrors:  map[string]string{},
+	}
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	creds := awscredentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", "")
+
+	ec2Client := awsec2.New(awsec2.Options{
+		Region:           "eu-west-1",
+		BaseEndpoint:     aws.String(srv.URL),
+		Credentials:      creds,
+		RetryMaxAttempts: 1,
+	})
+	ssmClient := ssm.New(ssm.Options{
+		Region:           "eu-west-1",
+		BaseEndpoint:     aws.String(srv.URL),
+		Credentials:      creds,
+		RetryMaxAttempts: 1,
+	})
+	sqsClient := sqs.New(sqs.Options{
+		Region:           "eu-west-1",
+		BaseEndpoint:     aws.String(srv.URL),
+		Credentials:      creds,
+		RetryMaxAttempts: 1,
+	})
+
+	return s, ec2Client, ssmClient, sqsClient
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if operation, ok := strings.CutPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS."); ok {
+		s.serveSQS(w, r, operation)
+
+		return
+	}
+
+	if operation, ok := strings.CutPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM."); ok {
+		s.serveSSM(w, r, operation)
+
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	switch r.Form.Get("Action") {
+	case "RunInstances":
+		s.runInstances(w, r.Form)
+	case "DescribeInstances":
+		s.describeInstances(w, r.Form)
+	case "TerminateInstances":
+		for _, id := range list(r.Form, "InstanceId") {
+			if instance, ok := s.instances[id]; ok {
+				instance.state = "shutting-down"
+			}
+		}
+
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"TerminateInstancesResponse"`
+		}{})
+	case "CreateTags", "DeleteTags":
+		for _, id := range list(r.Form, "ResourceId") {
+			for _, tag := range groups(r.Form, "Tag") {
+				if r.Form.Get("Action") == "CreateTags" {
+					s.instances[id].tags[tag.Get("Key")] = tag.Get("Value")
+				} else {
+					delete(s.instances[id].tags, tag.Get("Key"))
+				}
+			}
+		}
+
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CreateTagsResponse"`
+			Return  bool     `xml:"return"`
+		}{Return: true})
+	default:
+		writeEC2Error(w, http.StatusBadRequest, "InvalidAction", r.Form.Get("Action"))
+	}
+}
+
+func (s *standIn) runInstances(w http.ResponseWriter, form url.Values) {
+	market := "on-demand"
+	if form.Get("InstanceMarketOptions.MarketType") == "spot" {
+		market = "spot"
+	}
+
+	if code := s.runErrors[market]; code != "" {
+		writeEC2Error(w, http.StatusInternalServerError, code, "There is no capacity available.")
+
+		return
+	}
+
+	s.launches = append(s.launches, form)
+	s.next++
+
+	instance := &standInInstance{
+		tags:   map[string]string{},
+		id:     fmt.Sprintf("i-%017d", s.next),
+		state:  "pending",
+		market: market,
+	}
+
+	if userData := form.Get("UserData"); userData != "" {
+		instance.userData = userData
+	}
+
+	for _, spec := range groups(form, "TagSpecification") {
+		if spec.Get("ResourceType") == "instance" {
+			for _, tag := range groups(spec, "Tag") {
+				instance.tags[tag.Get("Key")] = tag.Get("Value")
+			}
+		}
+	}
+
+	s.instances[instance.id] = instance
+
+	writeXML(w, struct {
+		XMLName   xml.Name      `xml:"RunInstancesResponse"`
+		Instances []xmlInstance `xml:"instancesSet>item"`
+	}{Instances: []xmlInstance{instance.xml()}})
+}
+
+func (s *standIn) describeInstances(w http.ResponseWriter, form url.Values) {
+	var matched []xmlInstance
+
+	ids := make([]string, 0, len(s.instances))
+
+	for id := range s.instances {
+		ids = append(ids, id)
+	}
+
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		instance := s.instances[id]
+
+		if !slices.ContainsFunc(groups(form, "Filter"), func(filter url.Values) bool {
+			return !instance.matches(filter.Get("Name"), list(filter, "Value"))
+		}) {
+			matched = append(matched, instance.xml())
+		}
+	}
+
+	type reservation struct {
+		Instances []xmlInstance `xml:"instancesSet>item"`
+	}
+
+	response := struct {
+		XMLName      xml.Name      `xml:"DescribeInstancesResponse"`
+		Reservations []reservation `xml:"reservationSet>item"`
+	}{}
+
+	if len(matched) > 0 {
+		response.Reservations = []reservation{{Instances: matched}}
+	}
+
+	writeXML(w, response)
+}
+
+func (s *standIn) serveSSM(w http.ResponseWriter, r *http.Request, operation string) {
+	var input struct {
+		Name  string
+		Value string
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+	switch operation {
+	case "PutParameter":
+		s.parameters[input.Name] = input.Value
+
+		_, _ = w.Write([]byte(`{"Version":1,"Tier":"Standard"}`))
+	case "DeleteParameter":
+		if _, ok := s.parameters[input.Name]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"ParameterNotFound","message":"not found"}`))
+
+			return
+		}
+
+		delete(s.parameters, input.Name)
+
+		_, _ = w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"__type":"InvalidAction"}`))
+	}
+}
+
+func (s *standIn) serveSQS(w http.ResponseWriter, r *http.Request, operation string) {
+	var input struct {
+		Entries []struct {
+			ID            string `json:"Id"`
+			ReceiptHandle string
+		}
+		MaxNumberOfMessages int
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+	type message struct {
+		MessageID     string `json:"MessageId"`
+		ReceiptHandle string
+		MD5OfBody     string
+		Body          string
+	}
+
+	type result struct {
+		ID string `json:"Id"`
+	}
+
+	switch operation {
+	case "ReceiveMessage":
+		messages := []message{}
+
+		for len(s.queue) > 0 && len(messages) < input.MaxNumberOfMessages {
+			body := s.queue[0]
+			s.queue = s.queue[1:]
+			s.next++
+
+			sum := md5.Sum([]byte(body)) //nolint:gosec
+			handle := "receipt-" + strconv.Itoa(s.next)
+			s.inflight[handle] = body
+
+			messages = append(messages, message{
+				MessageID:     strconv.Itoa(s.next),
+				ReceiptHandle: handle,
+				MD5OfBody:     hex.EncodeToString(sum[:]),
+				Body:          body,
+			})
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"Messages": messages})
+	case "DeleteMessageBatch":
+		successful := []result{}
+
+		for _, entry := range input.Entries {
+			delete(s.inflight, entry.ReceiptHandle)
+			successful = append(successful, result{ID: entry.ID})
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"Successful": successful, "Failed": []result{}})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"__type":"InvalidAction"}`))
+	}
+}
+
+// send queues an EventBridge event about instanceID.
+func (s *standIn) send(detailType, instanceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, _ := json.Marshal(map[string]any{
+		"version":     "0",
+		"detail-type": detailType,
+		"source":      "aws.ec2",
+		"time":        "2024-12-02T08:00:00Z",
+		"detail":      map[string]string{"instance-id": instanceID, "instance-action": "terminate"},
+	})
+
+	s.queue = append(s.queue, string(raw))
+}
+
+// live returns the instances that are not shutting down.
+func (s *standIn) live() []*standInInstance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var live []*standInInstance
+
+	for _, instance := range s.instances {
+		if instance.state != "shutting-down" {
+			live = append(live, instance)
+		}
+	}
+
+	return live
+}
+
+func (i *standInInstance) matches(name string, values []string) bool {
+	switch {
+	case name == "instance-state-name":
+		return slices.Contains(values, i.state)
+	case name == "instance-id":
+		return slices.Contains(values, i.id)
+	case name == "tag-key":
+		return slices.ContainsFunc(values, func(key string) bool {
+			_, ok := i.tags[key]
+
+			return ok
+		})
+	case strings.HasPrefix(name, "tag:"):
+		value, ok := i.tags[strings.TrimPrefix(name, "tag:")]
+
+		return ok && slices.Contains(values, value)
+	default:
+		return false
+	}
+}
+
+type xmlTag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type xmlInstance struct {
+	InstanceID string   `xml:"instanceId"`
+	LaunchTime string   `xml:"launchTime"`
+	Lifecycle  string   `xml:"instanceLifecycle,omitempty"`
+	State      string   `xml:"instanceState>name"`
+	Tags       []xmlTag `xml:"tagSet>item"`
+}
+
+func (i *standInInstance) xml() xmlInstance {
+	instance := xmlInstance{
+		InstanceID: i.id,
+		LaunchTime: time.Date(2024, 12, 2, 8, 0, 0, 0, time.UTC).Format(time.RFC3339),
+		State:      i.state,
+	}
+
+	if i.market == "spot" {
+		instance.Lifecycle = "spot"
+	}
+
+	for key, value := range i.tags {
+		instance.Tags = append(instance.Tags, xmlTag{Key: key, Value: value})
+	}
+
+	return instance
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "text/xml")
+
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeEC2Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+
+	_, _ = fmt.Fprintf(w,
+		"<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors><RequestID>1</RequestID></Response>",
+		code, message)
+}
+
+// groups returns the members of the EC2 query list prefix, such as
+// Filter.1.Name and Filter.1.Value.1, keyed without the prefix and index.
+func groups(form url.Values, prefix string) []url.Values {
+	var members []url.Values
+
+	for n := 1; ; n++ {
+		member := url.Values{}
+		head := prefix + "." + strconv.Itoa(n) + "."
+
+		for key, values := range form {
+			if rest, ok := strings.CutPrefix(key, head); ok {
+				member[rest] = values
+			}
+		}
+
+		if len(member) == 0 {
+			return members
+		}
+
+		members = append(members, member)
+	}
+}
+
+// list returns the values of the EC2 query list prefix, such as
+// InstanceId.1 and InstanceId.2.
+func list(form url.Values, prefix string) []string {
+	var values []string
+
+	for n := 1; form.Has(prefix + "." + strconv.Itoa(n)); n++ {
+		values = append(values, form.Get(prefix+"."+strconv.Itoa(n)))
+	}
+
+	return values
+}
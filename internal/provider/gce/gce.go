@@ -0,0 +1,394 @@
+package gce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Labels set on every instance. Label values only allow lowercase letters,
+// digits, dashes and underscores, so runner UUIDs are stored without braces.
+const (
+	LabelWorkspace string = "bitbucket-runner-autoscaler-workspace"
+	LabelPool      string = "bitbucket-runner-autoscaler-pool"
+	LabelRunner    string = "bitbucket-runner-autoscaler-runner"
+)
+
+// Metadata keys the runner credentials are handed over with.
+const (
+	MetadataWorkspaceUUID     string = "bitbucket-workspace-uuid"
+	MetadataRunnerUUID        string = "bitbucket-runner-uuid"
+	MetadataOAuthClientID     string = "bitbucket-oauth-client-id"
+	MetadataOAuthClientSecret string = "bitbucket-oauth-client-secret"
+	MetadataStartupScript     string = "startup-script"
+)
+
+// defaultStartupScript starts the Bitbucket runner container with the
+// credentials read from the metadata server, so they never appear in the
+// script itself.
+const defaultStartupScript string = `#!/bin/sh
+set -e
+metadata() {
+  curl -sf -H 'Metadata-Flavor: Google' "http://metadata.google.internal/computeMetadata/v1/instance/attributes/$1"
+}
+docker run -d --restart unless-stopped --name runner \
+  -v /tmp:/tmp \
+  -v /var/run/docker.sock:/var/run/docker.sock \
+  -v /var/lib/docker/containers:/var/lib/docker/containers:ro \
+  -e ACCOUNT_UUID="$(metadata ` + MetadataWorkspaceUUID + `)" \
+  -e RUNNER_UUID="$(metadata ` + MetadataRunnerUUID + `)" \
+  -e RUNTIME_PREREQUISITES_ENABLED=true \
+  -e OAUTH_CLIENT_ID="$(metadata ` + MetadataOAuthClientID + `)" \
+  -e OAUTH_CLIENT_SECRET="$(metadata ` + MetadataOAuthClientSecret + `)" \
+  -e WORKING_DIRECTORY=/tmp \
+  docker-public.packages.atlassian.com/sox/atlassian/bitbucket-pipelines-runner:1
+`
+
+// cleanupTimeout bounds deleting the instance of a failed provisioning, which
+// runs even when the provisioning timed out.
+const cleanupTimeout time.Duration = 2 * time.Minute
+
+// maxNameLen is the longest instance name Compute Engine accepts.
+const maxNameLen int = 63
+
+// Provider runs Bitbucket runners on Compute Engine instances created from an
+// instance template.
+type Provider struct {
+	service       *compute.Service
+	startupScript *template.Template
+	name          string
+	cfg           config.GCE
+}
+
+// startupScriptInput is what the startup script template can refer to.
+// Credentials are left out: the script reads them from the metadata server.
+type startupScriptInput struct {
+	WorkspaceUUID string
+	RunnerUUID    string
+	RunnerName    string
+	Labels        []string
+}
+
+// New returns a provider calling Compute Engine through service.
+func New(name string, cfg config.GCE, service *compute.Service) (*Provider, error) {
+	text := cfg.StartupScript
+	if text == "" {
+		text = defaultStartupScript
+	}
+
+	startupScript, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid startup_script template: %w", err)
+	}
+
+	return &Provider{service: service, startupScript: startupScript, name: name, cfg: cfg}, nil
+}
+
+// Open returns a provider using the application default credentials.
+func Open(ctx context.Context, name string, cfg config.GCE) (*Provider, error) {
+	var opts []option.ClientOption
+	if cfg.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.Endpoint))
+	}
+
+	service, err := compute.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compute client: %w", err)
+	}
+
+	return New(name, cfg, service)
+}
+
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// Provision creates an instance for the runner from the instance template and
+// waits until Compute Engine has found capacity for it. Provisioning is
+// bounded by its own timeout rather than by ctx, as waiting for capacity can
+// outlast a reconcile. The instance is deleted again if it never came up.
+func (p *Provider) Provision(ctx context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	provisionCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.cfg.ProvisionTimeout)
+	defer cancel()
+
+	instance, err := p.instance(provisionCtx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := p.service.Instances.Insert(p.cfg.Project, p.cfg.Zone, instance).
+		SourceInstanceTemplate(p.templateURL()).
+		Context(provisionCtx).
+		Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create instance %s: %w", instance.Name, err)
+	}
+
+	if err := p.wait(provisionCtx, op); err != nil {
+		err = fmt.Errorf("failed to create instance %s: %w", instance.Name, err)
+
+		return nil, errors.Join(err, p.rollback(ctx, instance.Name))
+	}
+
+	return &ports.Workload{
+		CreatedAt:  time.Now(),
+		ID:         instance.Name,
+		RunnerUUID: req.RunnerUUID,
+		Pool:       req.Pool,
+		Provider:   p.name,
+	}, nil
+}
+
+// instance is the part of the instance overriding the template. Metadata and
+// labels given on creation replace those of the template, so the template
+// ones are carried over.
+func (p *Provider) instance(ctx context.Context, req ports.ProvisionRequest) (*compute.Instance, error) {
+	tmpl, err := p.service.InstanceTemplates.Get(p.cfg.Project, p.cfg.InstanceTemplate).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance template %s: %w", p.cfg.InstanceTemplate, err)
+	}
+
+	var b strings.Builder
+
+	err = p.startupScript.Execute(&b, startupScriptInput{
+		WorkspaceUUID: req.WorkspaceUUID,
+		RunnerUUID:    req.RunnerUUID,
+		RunnerName:    req.RunnerName,
+		Labels:        req.Labels,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render startup script: %w", err)
+	}
+
+	overrides := map[string]string{
+		MetadataWorkspaceUUID:     req.WorkspaceUUID,
+		MetadataRunnerUUID:        req.RunnerUUID,
+		MetadataOAuthClientID:     req.OAuthClientID,
+		MetadataOAuthClientSecret: req.OAuthClientSecret,
+		MetadataStartupScript:     b.String(),
+	}
+
+	metadata := &compute.Metadata{}
+	labels := map[string]string{}
+
+	if props := tmpl.Properties; props != nil {
+		if props.Metadata != nil {
+			for _, item := range props.Metadata.Items {
+				if _, ok := overrides[item.Key]; !ok {
+					metadata.Items = append(metadata.Items, item)
+				}
+			}
+		}
+
+		for key, value := range props.Labels {
+			labels[key] = value
+		}
+	}
+
+	for _, key := range []string{
+		MetadataWorkspaceUUID, MetadataRunnerUUID, MetadataOAuthClientID, MetadataOAuthClientSecret, MetadataStartupScript,
+	} {
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: key, Value: googleapi.String(overrides[key])})
+	}
+
+	labels[LabelWorkspace] = labelValue(req.Workspace)
+	labels[LabelPool] = labelValue(req.Pool)
+	labels[LabelRunner] = labelValue(req.RunnerUUID)
+
+	instance := &compute.Instance{
+		Name:       instanceName(req.RunnerName),
+		Labels:     labels,
+		Metadata:   metadata,
+		Scheduling: p.scheduling(),
+	}
+
+	if p.cfg.MachineType != "" {
+		instance.MachineType = fmt.Sprintf("zones/%s/machineTypes/%s", p.cfg.Zone, p.cfg.MachineType)
+	}
+
+	return instance, nil
+}
+
+// scheduling returns the scheduling of spot and preemptible instances, which
+// are deleted rather than restarted when Compute Engine reclaims them. Standard
+// instances keep the scheduling of the template.
+func (p *Provider) scheduling() *compute.Scheduling {
+	switch p.cfg.Provisioning {
+	case config.GCEProvisioningSpot:
+		return &compute.Scheduling{
+			ProvisioningModel:         "SPOT",
+			InstanceTerminationAction: "DELETE",
+			OnHostMaintenance:         "TERMINATE",
+			AutomaticRestart:          googleapi.Bool(false),
+		}
+	case config.GCEProvisioningPreemptible:
+		return &compute.Scheduling{
+			Preemptible:       true,
+			OnHostMaintenance: "TERMINATE",
+			AutomaticRestart:  googleapi.Bool(false),
+		}
+	default:
+		return nil
+	}
+}
+
+// Deprovision deletes the instances labelled with the runner UUID. A runner
+// without an instance is already gone.
+func (p *Provider) Deprovision(ctx context.Context, runnerUUID string) error {
+	var names []string
+
+	err := p.service.Instances.List(p.cfg.Project, p.cfg.Zone).
+		Filter(fmt.Sprintf("labels.%s = %q", LabelRunner, labelValue(runnerUUID))).
+		Pages(ctx, func(page *compute.InstanceList) error {
+			for _, instance := range page.Items {
+				names = append(names, instance.Name)
+			}
+
+			return nil
+		})
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	for _, name := range names {
+		_, err := p.service.Instances.Delete(p.cfg.Project, p.cfg.Zone, name).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete instance %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// rollback deletes the instance of a failed provisioning, if Compute Engine
+// created it. It runs even if ctx is done, so that no instance is left behind.
+func (p *Provider) rollback(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	_, err := p.service.Instances.Delete(p.cfg.Project, p.cfg.Zone, name).Context(ctx).Do()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete instance %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Workloads returns a workload per instance labelled with workspace and pool.
+// The runner UUID is read from the metadata, as the label lost its braces.
+func (p *Provider) Workloads(ctx context.Context, workspace, pool string) ([]ports.Workload, error) {
+	var workloads []ports.Workload
+
+	err := p.service.Instances.List(p.cfg.Project, p.cfg.Zone).
+		Filter(fmt.Sprintf("labels.%s = %q AND labels.%s = %q",
+			LabelWorkspace, labelValue(workspace), LabelPool, labelValue(pool))).
+		Pages(ctx, func(page *compute.InstanceList) error {
+			for _, instance := range page.Items {
+				createdAt, _ := time.Parse(time.RFC3339, instance.CreationTimestamp)
+
+				workloads = append(workloads, ports.Workload{
+					CreatedAt:  createdAt,
+					ID:         instance.Name,
+					RunnerUUID: runnerUUID(instance),
+					Pool:       pool,
+					Provider:   p.name,
+				})
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	return workloads, nil
+}
+
+// wait blocks until op is done and returns the error it ended with.
+func (p *Provider) wait(ctx context.Context, op *compute.Operation) error {
+	for op.Status != "DONE" {
+		var err error
+
+		op, err = p.service.ZoneOperations.Wait(p.cfg.Project, p.cfg.Zone, op.Name).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to wait for operation: %w", err)
+		}
+	}
+
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+
+	errs := make([]error, 0, len(op.Error.Errors))
+
+	for _, e := range op.Error.Errors {
+		errs = append(errs, fmt.Errorf("%s: %s", e.Code, e.Message))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Provider) templateURL() string {
+	return fmt.Sprintf("projects/%s/global/instanceTemplates/%s", p.cfg.Project, p.cfg.InstanceTemplate)
+}
+
+// instanceName turns a runner name into a valid instance name: lowercase
+// letters, digits and dashes, starting with a letter.
+func instanceName(runnerName string) string {
+	name := strings.Trim(labelValue(runnerName), "-_")
+	name = strings.ReplaceAll(name, "_", "-")
+
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "runner-" + name
+	}
+
+	return strings.TrimRight(name[:min(len(name), maxNameLen)], "-")
+}
+
+// labelValue turns s into a valid label value.
+func labelValue(s string) string {
+	value := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		case r == '{', r == '}':
+			return -1
+		default:
+			return '-'
+		}
+	}, s)
+
+	return value[:min(len(value), maxNameLen)]
+}
+
+// runnerUUID returns the runner UUID of instance, falling back to its label
+// when the metadata lacks it.
+func runnerUUID(instance *compute.Instance) string {
+	if instance.Metadata != nil {
+		for _, item := range instance.Metadata.Items {
+			if item.Key == MetadataRunnerUUID && item.Value != nil {
+				return *item.Value
+			}
+		}
+	}
+
+	return instance.Labels[LabelRunner]
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
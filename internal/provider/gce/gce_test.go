@@ -0,0 +1,208 @@
+package gce
+
+import (
+	"context"
+	"testing"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func testRequest() ports.ProvisionRequest {
+	return ports.ProvisionRequest{
+		Workspace:         "acme",
+		WorkspaceUUID:     "{workspace}",
+		Pool:              "Linux",
+		RunnerUUID:        "{5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}",
+		RunnerName:        "Linux-0a1b2c3d",
+		OAuthClientID:     "client-id",
+		OAuthClientSecret: "s3cr3t",
+		Labels:            []string{"self.hosted", "linux"},
+	}
+}
+
+func TestProvision(t *testing.T) {
+	tables := []struct {
+		insertErrors       map[string]string
+		expectedScheduling *compute.Scheduling
+		name               string
+		provisioning       string
+		waitError          string
+		machineType        string
+		expectedMachine    string
+		expectedError      string
+	}{
+		{
+			name:         "standard instance keeps the template scheduling",
+			provisioning: config.GCEProvisioningStandard,
+		},
+		{
+			name:            "machine type overrides the template",
+			provisioning:    config.GCEProvisioningStandard,
+			machineType:     "e2-standard-4",
+			expectedMachine: "zones/europe-west1-b/machineTypes/e2-standard-4",
+		},
+		{
+			name:         "spot",
+			provisioning: config.GCEProvisioningSpot,
+			expectedScheduling: &compute.Scheduling{
+				ProvisioningModel:         "SPOT",
+				InstanceTerminationAction: "DELETE",
+				OnHostMaintenance:         "TERMINATE",
+				AutomaticRestart:          googleapi.Bool(false),
+			},
+		},
+		{
+			name:         "preemptible",
+			provisioning: config.GCEProvisioningPreemptible,
+			expectedScheduling: &compute.Scheduling{
+				Preemptible:       true,
+				OnHostMaintenance: "TERMINATE",
+				AutomaticRestart:  googleapi.Bool(false),
+			},
+		},
+		{
+			name:          "spot capacity short",
+			provisioning:  config.GCEProvisioningSpot,
+			insertErrors:  map[string]string{"SPOT": "ZONE_RESOURCE_POOL_EXHAUSTED"},
+			expectedError: "failed to create instance linux-0a1b2c3d: ZONE_RESOURCE_POOL_EXHAUSTED",
+		},
+		{
+			name:          "instance deleted when waiting fails",
+			provisioning:  config.GCEProvisioningStandard,
+			waitError:     "backend unavailable",
+			expectedError: "failed to create instance linux-0a1b2c3d: failed to wait for operation",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			standIn, service := newStandIn(t)
+			standIn.insertErrors = table.insertErrors
+			standIn.waitError = table.waitError
+			standIn.templates["runner"] = &compute.InstanceTemplate{
+				Name: "runner",
+				Properties: &compute.InstanceProperties{
+					Labels: map[string]string{"team": "platform"},
+					Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+						{Key: "ssh-keys", Value: googleapi.String("admin:ssh-ed25519 AAAA")},
+						{Key: MetadataStartupScript, Value: googleapi.String("echo from template")},
+					}},
+				},
+			}
+
+			provider, err := New("gcp", config.GCE{
+				Project:          "acme-ci",
+				Zone:             "europe-west1-b",
+				InstanceTemplate: "runner",
+				MachineType:      table.machineType,
+				Provisioning:     table.provisioning,
+				ProvisionTimeout: config.DefaultGCEProvisionTimeout,
+			}, service)
+			require.NoError(t, err)
+
+			workload, err := provider.Provision(context.Background(), testRequest())
+
+			if table.expectedError != "" {
+				assert.ErrorContains(t, err, table.expectedError)
+				assert.Empty(t, standIn.instances)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "linux-0a1b2c3d", workload.ID)
+			assert.Equal(t, "gcp", workload.Provider)
+
+			instance := standIn.instances["linux-0a1b2c3d"]
+			require.NotNil(t, instance)
+
+			assert.Equal(t, "projects/acme-ci/global/instanceTemplates/runner", standIn.sources[instance.Name])
+			assert.Equal(t, table.expectedMachine, instance.MachineType)
+			assert.Equal(t, table.expectedScheduling, instance.Scheduling)
+			assert.Equal(t, map[string]string{
+				"team":         "platform",
+				LabelWorkspace: "acme",
+				LabelPool:      "linux",
+				LabelRunner:    "5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50",
+			}, instance.Labels)
+
+			metadata := map[string]string{}
+
+			for _, item := range instance.Metadata.Items {
+				metadata[item.Key] = *item.Value
+			}
+
+			assert.Equal(t, "admin:ssh-ed25519 AAAA", metadata["ssh-keys"])
+			assert.Equal(t, "{5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}", metadata[MetadataRunnerUUID])
+			assert.Equal(t, "{workspace}", metadata[MetadataWorkspaceUUID])
+			assert.Equal(t, "client-id", metadata[MetadataOAuthClientID])
+			assert.Equal(t, "s3cr3t", metadata[MetadataOAuthClientSecret])
+			assert.Contains(t, metadata[MetadataStartupScript], "metadata "+MetadataOAuthClientSecret)
+			assert.NotContains(t, metadata[MetadataStartupScript], "s3cr3t")
+
+			require.NoError(t, provider.Deprovision(context.Background(), "{5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}"))
+			assert.Empty(t, standIn.instances)
+
+			// Runners without an instance are already gone.
+			require.NoError(t, provider.Deprovision(context.Background(), "{5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}"))
+		})
+	}
+}
+
+func TestWorkloads(t *testing.T) {
+	standIn, service := newStandIn(t)
+	standIn.templates["runner"] = &compute.InstanceTemplate{Name: "runner", Properties: &compute.InstanceProperties{}}
+
+	provider, err := New("gcp", config.GCE{
+		Project:          "acme-ci",
+		Zone:             "europe-west1-b",
+		InstanceTemplate: "runner",
+		ProvisionTimeout: config.DefaultGCEProvisionTimeout,
+	}, service)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	_, err = provider.Provision(ctx, testRequest())
+	require.NoError(t, err)
+
+	other := testRequest()
+	other.Pool = "windows"
+	other.RunnerUUID = "{7d0e4b1a-2c3f-4a5b-8c6d-9e0f1a2b3c4d}"
+	other.RunnerName = "windows-0a1b2c3d"
+
+	_, err = provider.Provision(ctx, other)
+	require.NoError(t, err)
+
+	workloads, err := provider.Workloads(ctx, "acme", "Linux")
+	require.NoError(t, err)
+	require.Len(t, workloads, 1)
+
+	assert.Equal(t, "linux-0a1b2c3d", workloads[0].ID)
+	assert.Equal(t, "{5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}", workloads[0].RunnerUUID)
+	assert.Equal(t, "Linux", workloads[0].Pool)
+	assert.Equal(t, "gcp", workloads[0].Provider)
+	assert.False(t, workloads[0].CreatedAt.IsZero())
+}
+
+func TestInstanceName(t *testing.T) {
+	tables := []struct {
+		runnerName string
+		expected   string
+	}{
+		{runnerName: "linux-0a1b2c3d", expected: "linux-0a1b2c3d"},
+		{runnerName: "Linux_Big-0a1b2c3d", expected: "linux-big-0a1b2c3d"},
+		{runnerName: "2xl-0a1b2c3d", expected: "runner-2xl-0a1b2c3d"},
+	}
+
+	for _, table := range tables {
+		t.Run(table.runnerName, func(t *testing.T) {
+			assert.Equal(t, table.expected, instanceName(table.runnerName))
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// filterPattern matches a label filter the provider lists instances with.
+// Several are joined with AND.
+var filterPattern = regexp.MustCompile(`^labels\.(\S+) = "(.*)"$`)
+
+// standIn is a local stand-in for the Compute Engine REST API, keeping
+// instances and operations in memory.
+type standIn struct {
+	templates  map[string]*compute.InstanceTemplate
+	instances  map[string]*compute.Instance
+	operations map[string]*compute.Operation
+	// insertErrors holds the error code an insert ends with, per
+	// provisioning model.
+	insertErrors map[string]string
+	// sources records the template of every inserted instance.
+	sources map[string]string
+	// waitError fails waiting for operations.
+	waitError string
+	next      int
+	mu        sync.Mutex
+}
+
+func newStandIn(t *testing.T) (*standIn, *compute.Service) {
+	t.Helper()
+
+	s := &standIn{
+		templates:    map[string]*compute.InstanceTemplate{},
+		instances:    map[string]*compute.Instance{},
+		operations:   map[string]*compute.Operation{},
+		insertErrors: map[string]string{},
+		sources:      map[string]string{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /compute/v1/projects/{project}/global/instanceTemplates/{template}", s.getTemplate)
+	mux.HandleFunc("POST /compute/v1/projects/{project}/zones/{zone}/instances", s.insertInstance)
+	mux.HandleFunc("GET /compute/v1/projects/{project}/zones/{zone}/instances", s.listInstances)
+	mux.HandleFunc("DELETE /compute/v1/projects/{project}/zones/{zone}/instances/{instance}", s.deleteInstance)
+	mux.HandleFunc("POST /compute/v1/projects/{project}/zones/{zone}/operations/{operation}/wait", s.waitOperation)
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	service, err := compute.NewService(context.Background(),
+		option.WithEndpoint(srv.URL+"/compute/v1/"),
+		option.WithoutAuthentication(),
+	)
+	require.NoError(t, err)
+
+	return s, service
+}
+
+func (s *standIn) getTemplate(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpl, ok := s.templates[r.PathValue("template")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "instance template not found")
+
+		return
+	}
+
+	writeJSON(w, tmpl)
+}
+
+func (s *standIn) insertInstance(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var instance compute.Instance
+
+	if err := json.NewDecoder(r.Body).Decode(&instance); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	if _, ok := s.instances[instance.Name]; ok {
+		writeError(w, http.StatusConflict, "instance already exists")
+
+		return
+	}
+
+	// Like Compute Engine, capacity errors only show once the operation is
+	// done.
+	op := s.operation()
+
+	model := "STANDARD"
+	if instance.Scheduling != nil && instance.Scheduling.ProvisioningModel != "" {
+		model = instance.Scheduling.ProvisioningModel
+	}
+
+	if code := s.insertErrors[model]; code != "" {
+		op.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{
+			{Code: code, Message: "The zone does not have enough resources available."},
+		}}
+	} else {
+		instance.Status = "PROVISIONING"
+		instance.CreationTimestamp = "2024-12-02T08:00:00.000-08:00"
+		s.instances[instance.Name] = &instance
+		s.sources[instance.Name] = r.URL.Query().Get("sourceInstanceTemplate")
+	}
+
+	writeJSON(w, &compute.Operation{Name: op.Name, Status: "RUNNING"})
+}
+
+func (s *standIn) listInstances(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches [][]string
+
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		for _, term := range strings.Split(filter, " AND ") {
+			matches = append(matches, filterPattern.FindStringSubmatch(term))
+		}
+	}
+
+	list := &compute.InstanceList{}
+
+	for _, instance := range s.instances {
+		if !slices.ContainsFunc(matches, func(match []string) bool {
+			return match == nil || instance.Labels[match[1]] != match[2]
+		}) {
+			list.Items = append(list.Items, instance)
+		}
+	}
+
+	writeJSON(w, list)
+}
+
+func (s *standIn) deleteInstance(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.instances[r.PathValue("instance")]; !ok {
+		writeError(w, http.StatusNotFound, "instance not found")
+
+		return
+	}
+
+	delete(s.instances, r.PathValue("instance"))
+
+	writeJSON(w, &compute.Operation{Name: s.operation().Name, Status: "RUNNING"})
+}
+
+func (s *standIn) waitOperation(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.operations[r.PathValue("operation")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "operation not found")
+
+		return
+	}
+
+	if s.waitError != "" {
+		writeError(w, http.StatusServiceUnavailable, s.waitError)
+
+		return
+	}
+
+	op.Status = "DONE"
+
+	writeJSON(w, op)
+}
+
+func (s *standIn) operation() *compute.Operation {
+	s.next++
+
+	op := &compute.Operation{Name: "operation-" + strconv.Itoa(s.next)}
+	s.operations[op.Name] = op
+
+	return op
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"code": status, "message": message},
+	})
+}
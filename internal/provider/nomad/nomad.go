@@ -0,0 +1,316 @@
+package nomad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// Meta keys set on every job.
+const (
+	MetaWorkspace string = "bitbucket-runner-autoscaler-workspace"
+	MetaPool      string = "bitbucket-runner-autoscaler-pool"
+	MetaRunner    string = "bitbucket-runner-autoscaler-runner"
+)
+
+// Keys of the job variable holding the runner credentials.
+const (
+	VariableOAuthClientID     string = "oauth_client_id"
+	VariableOAuthClientSecret string = "oauth_client_secret"
+)
+
+// taskName names both the task group and the task of every job.
+const taskName string = "runner"
+
+// maxJobIDLen keeps job IDs, and the variable paths derived from them, well
+// within what Nomad accepts.
+const maxJobIDLen int = 128
+
+// defaultDockerConfig is the docker driver configuration the runner needs.
+// Job steps run as sibling containers through the host Docker socket.
+//
+//nolint:gochecknoglobals
+var defaultDockerConfig = map[string]any{
+	"volumes": []string{
+		"/tmp:/tmp",
+		"/var/run/docker.sock:/var/run/docker.sock",
+		"/var/lib/docker/containers:/var/lib/docker/containers:ro",
+	},
+}
+
+// Provider runs Bitbucket runners as Nomad batch jobs, one job per runner.
+type Provider struct {
+	client *api.Client
+	env    map[string]*template.Template
+	name   string
+	cfg    config.Nomad
+}
+
+// envInput is what the env templates can refer to. Credentials are left out:
+// the task reads them from the job variable.
+type envInput struct {
+	Workspace     string
+	WorkspaceUUID string
+	Pool          string
+	RunnerUUID    string
+	RunnerName    string
+	Labels        []string
+}
+
+// New returns a provider calling Nomad through client.
+func New(name string, cfg config.Nomad, client *api.Client) (*Provider, error) {
+	env := make(map[string]*template.Template, len(cfg.Env))
+
+	for key, text := range cfg.Env {
+		tmpl, err := template.New(key).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid env %s template: %w", key, err)
+		}
+
+		env[key] = tmpl
+	}
+
+	return &Provider{client: client, env: env, name: name, cfg: cfg}, nil
+}
+
+// Open returns a provider for the Nomad cluster at cfg.Address. The usual
+// NOMAD_* environment variables configure TLS.
+func Open(_ context.Context, name string, cfg config.Nomad) (*Provider, error) {
+	clientCfg := api.DefaultConfig()
+	clientCfg.Address = cfg.Address
+	clientCfg.SecretID = cfg.Token
+	clientCfg.Namespace = cfg.Namespace
+	clientCfg.Region = cfg.Region
+
+	client, err := api.NewClient(clientCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create nomad client: %w", err)
+	}
+
+	return New(name, cfg, client)
+}
+
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// Provision stores the runner credentials in the job variable and submits
+// the job. The variable is deleted again if the job cannot be submitted.
+func (p *Provider) Provision(ctx context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	job, err := p.job(req)
+	if err != nil {
+		return nil, err
+	}
+
+	jobID := *job.ID
+
+	_, _, err = p.client.Variables().Create(&api.Variable{
+		Path: variablePath(jobID),
+		Items: api.VariableItems{
+			VariableOAuthClientID:     req.OAuthClientID,
+			VariableOAuthClientSecret: req.OAuthClientSecret,
+		},
+	}, p.writeOptions(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to store credentials of job %s: %w", jobID, err)
+	}
+
+	if _, _, err := p.client.Jobs().Register(job, p.writeOptions(ctx)); err != nil {
+		err = fmt.Errorf("failed to register job %s: %w", jobID, err)
+
+		return nil, errors.Join(err, p.deleteVariable(ctx, jobID))
+	}
+
+	return &ports.Workload{
+		CreatedAt:  time.Now(),
+		ID:         jobID,
+		RunnerUUID: req.RunnerUUID,
+		Pool:       req.Pool,
+		Provider:   p.name,
+	}, nil
+}
+
+func (p *Provider) job(req ports.ProvisionRequest) (*api.Job, error) {
+	jobID := jobID(req.RunnerName)
+
+	env := map[string]string{
+		"ACCOUNT_UUID":                  req.WorkspaceUUID,
+		"RUNNER_UUID":                   req.RunnerUUID,
+		"RUNTIME_PREREQUISITES_ENABLED": "true",
+		"WORKING_DIRECTORY":             "/tmp",
+	}
+
+	input := envInput{
+		Workspace:     req.Workspace,
+		WorkspaceUUID: req.WorkspaceUUID,
+		Pool:          req.Pool,
+		RunnerUUID:    req.RunnerUUID,
+		RunnerName:    req.RunnerName,
+		Labels:        req.Labels,
+	}
+
+	for key, tmpl := range p.env {
+		var b strings.Builder
+
+		if err := tmpl.Execute(&b, input); err != nil {
+			return nil, fmt.Errorf("failed to render env %s: %w", key, err)
+		}
+
+		env[key] = b.String()
+	}
+
+	task := api.NewTask(taskName, p.cfg.Driver).
+		Require(&api.Resources{CPU: pointerOf(p.cfg.CPU), MemoryMB: pointerOf(p.cfg.MemoryMB)})
+	task.Env = env
+	task.Config = map[string]any{}
+
+	if p.cfg.Driver == config.NomadDriverDocker {
+		maps.Copy(task.Config, defaultDockerConfig)
+		task.Config["image"] = p.cfg.Image
+	}
+
+	maps.Copy(task.Config, p.cfg.Config)
+
+	// Rendered into the secrets directory, which only the task can read,
+	// and exported into the task environment.
+	task.Templates = []*api.Template{{
+		EmbeddedTmpl: pointerOf(fmt.Sprintf(`{{ with nomadVar %q }}
+OAUTH_CLIENT_ID={{ .%s }}
+OAUTH_CLIENT_SECRET={{ .%s }}
+{{ end }}`, variablePath(jobID), VariableOAuthClientID, VariableOAuthClientSecret)),
+		DestPath: pointerOf("secrets/runner.env"),
+		Envvars:  pointerOf(true),
+	}}
+
+	job := api.NewBatchJob(jobID, req.RunnerName, p.cfg.Region, api.JobDefaultPriority)
+	job.Datacenters = p.cfg.Datacenters
+	job.Meta = map[string]string{
+		MetaWorkspace: req.Workspace,
+		MetaPool:      req.Pool,
+		MetaRunner:    req.RunnerUUID,
+	}
+
+	if p.cfg.Namespace != "" {
+		job.Namespace = pointerOf(p.cfg.Namespace)
+	}
+
+	job.AddTaskGroup(api.NewTaskGroup(taskName, 1).AddTask(task))
+
+	return job, nil
+}
+
+// Deprovision stops and purges the jobs whose meta holds the runner UUID,
+// and deletes their variables. A runner without a job is already gone.
+func (p *Provider) Deprovision(ctx context.Context, runnerUUID string) error {
+	jobs, _, err := p.client.Jobs().ListOptions(
+		&api.JobListOptions{Fields: &api.JobListFields{Meta: true}},
+		(&api.QueryOptions{Filter: fmt.Sprintf("Meta[%q] == %q", MetaRunner, runnerUUID)}).WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	for _, job := range jobs {
+		if _, _, err := p.client.Jobs().Deregister(job.ID, true, p.writeOptions(ctx)); err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to purge job %s: %w", job.ID, err)
+		}
+
+		if err := p.deleteVariable(ctx, job.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Workloads returns a workload per job of pool that has not ended. A dead
+// job no longer backs its runner, whether it finished or was stopped.
+func (p *Provider) Workloads(ctx context.Context, workspace, pool string) ([]ports.Workload, error) {
+	jobs, _, err := p.client.Jobs().ListOptions(
+		&api.JobListOptions{Fields: &api.JobListFields{Meta: true}},
+		(&api.QueryOptions{Filter: fmt.Sprintf("Meta[%q] == %q and Meta[%q] == %q",
+			MetaWorkspace, workspace, MetaPool, pool)}).WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	workloads := make([]ports.Workload, 0, len(jobs))
+
+	for _, job := range jobs {
+		if job.Status == "dead" {
+			continue
+		}
+
+		var createdAt time.Time
+		if job.SubmitTime > 0 {
+			createdAt = time.Unix(0, job.SubmitTime)
+		}
+
+		workloads = append(workloads, ports.Workload{
+			CreatedAt:  createdAt,
+			ID:         job.ID,
+			RunnerUUID: job.Meta[MetaRunner],
+			Pool:       pool,
+			Provider:   p.name,
+		})
+	}
+
+	return workloads, nil
+}
+
+func (p *Provider) deleteVariable(ctx context.Context, jobID string) error {
+	if _, err := p.client.Variables().Delete(variablePath(jobID), p.writeOptions(ctx)); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete credentials of job %s: %w", jobID, err)
+	}
+
+	return nil
+}
+
+func (p *Provider) writeOptions(ctx context.Context) *api.WriteOptions {
+	return (&api.WriteOptions{}).WithContext(ctx)
+}
+
+// variablePath is the variable every task of the job can read without a
+// policy of its own.
+func variablePath(jobID string) string {
+	return "nomad/jobs/" + jobID
+}
+
+// jobID turns a runner name into a job ID: lowercase letters, digits and
+// dashes, prefixed so runner jobs stand out among the others.
+func jobID(runnerName string) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, runnerName)
+
+	id = "bitbucket-runner-" + id
+
+	return id[:min(len(id), maxJobIDLen)]
+}
+
+func isNotFound(err error) bool {
+	var respErr api.UnexpectedResponseError
+
+	return errors.As(err, &respErr) && respErr.StatusCode() == http.StatusNotFound
+}
+
+func pointerOf[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,221 @@
+package nomad
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const runnerUUID = "{5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}"
+
+func testRequest() ports.ProvisionRequest {
+	return ports.ProvisionRequest{
+		Workspace:         "acme",
+		WorkspaceUUID:     "{workspace}",
+		Pool:              "linux",
+		RunnerUUID:        runnerUUID,
+		RunnerName:        "Linux-0a1b2c3d",
+		OAuthClientID:     "client-id",
+		OAuthClientSecret: "s3cr3t",
+		Labels:            []string{"self.hosted", "linux"},
+	}
+}
+
+func testConfig() config.Nomad {
+	return config.Nomad{
+		Address:     "http://nomad:4646",
+		Namespace:   "ci",
+		Driver:      config.NomadDriverDocker,
+		Image:       config.DefaultNomadImage,
+		Datacenters: []string{"dc1"},
+		CPU:         config.DefaultNomadCPU,
+		MemoryMB:    config.DefaultNomadMemoryMB,
+	}
+}
+
+func TestProvision(t *testing.T) {
+	tables := []struct {
+		env            map[string]string
+		driverConfig   map[string]any
+		expectedEnv    map[string]string
+		expectedConfig map[string]any
+		name           string
+		registerError  string
+		expectedError  string
+	}{
+		{
+			name: "default docker task",
+			expectedEnv: map[string]string{
+				"ACCOUNT_UUID":                  "{workspace}",
+				"RUNNER_UUID":                   runnerUUID,
+				"RUNTIME_PREREQUISITES_ENABLED": "true",
+				"WORKING_DIRECTORY":             "/tmp",
+			},
+			expectedConfig: map[string]any{
+				"image": config.DefaultNomadImage,
+				"volumes": []any{
+					"/tmp:/tmp",
+					"/var/run/docker.sock:/var/run/docker.sock",
+					"/var/lib/docker/containers:/var/lib/docker/containers:ro",
+				},
+			},
+		},
+		{
+			name: "templated env and driver config",
+			env: map[string]string{
+				"RUNNER_NAME":       "{{.RunnerName}}",
+				"WORKING_DIRECTORY": "/scratch/{{.Pool}}",
+			},
+			driverConfig: map[string]any{"volumes": []any{"/scratch:/scratch"}, "privileged": true},
+			expectedEnv: map[string]string{
+				"ACCOUNT_UUID":                  "{workspace}",
+				"RUNNER_UUID":                   runnerUUID,
+				"RUNNER_NAME":                   "Linux-0a1b2c3d",
+				"RUNTIME_PREREQUISITES_ENABLED": "true",
+				"WORKING_DIRECTORY":             "/scratch/linux",
+			},
+			expectedConfig: map[string]any{
+				"image":      config.DefaultNomadImage,
+				"volumes":    []any{"/scratch:/scratch"},
+				"privileged": true,
+			},
+		},
+		{
+			name:          "registration fails",
+			registerError: "permission denied",
+			expectedError: "failed to register job bitbucket-runner-linux-0a1b2c3d",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			standIn, client := newStandIn(t)
+			standIn.registerError = table.registerError
+
+			cfg := testConfig()
+			cfg.Env = table.env
+			cfg.Config = table.driverConfig
+
+			provider, err := New("nomad", cfg, client)
+			require.NoError(t, err)
+
+			workload, err := provider.Provision(context.Background(), testRequest())
+
+			if table.expectedError != "" {
+				assert.ErrorContains(t, err, table.expectedError)
+				assert.Empty(t, standIn.jobs)
+				// The credentials are not left behind.
+				assert.Empty(t, standIn.variables)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "bitbucket-runner-linux-0a1b2c3d", workload.ID)
+			assert.Equal(t, "nomad", workload.Provider)
+			assert.Equal(t, "ci", standIn.namespaces["/v1/jobs"])
+
+			job := standIn.jobs[workload.ID]
+			require.NotNil(t, job)
+
+			assert.Equal(t, api.JobTypeBatch, *job.Type)
+			assert.Equal(t, []string{"dc1"}, job.Datacenters)
+			assert.Equal(t, map[string]string{
+				MetaWorkspace: "acme",
+				MetaPool:      "linux",
+				MetaRunner:    runnerUUID,
+			}, job.Meta)
+
+			require.Len(t, job.TaskGroups, 1)
+			require.Len(t, job.TaskGroups[0].Tasks, 1)
+
+			task := job.TaskGroups[0].Tasks[0]
+			assert.Equal(t, config.NomadDriverDocker, task.Driver)
+			assert.Equal(t, table.expectedEnv, task.Env)
+			assert.Equal(t, table.expectedConfig, task.Config)
+			assert.Equal(t, config.DefaultNomadCPU, *task.Resources.CPU)
+			assert.Equal(t, config.DefaultNomadMemoryMB, *task.Resources.MemoryMB)
+
+			// The secret only reaches the task through the job variable.
+			assert.Equal(t, api.VariableItems{
+				VariableOAuthClientID:     "client-id",
+				VariableOAuthClientSecret: "s3cr3t",
+			}, standIn.variables["nomad/jobs/bitbucket-runner-linux-0a1b2c3d"])
+
+			require.Len(t, task.Templates, 1)
+			assert.Contains(t, *task.Templates[0].EmbeddedTmpl, `nomadVar "nomad/jobs/bitbucket-runner-linux-0a1b2c3d"`)
+			assert.True(t, *task.Templates[0].Envvars)
+
+			raw, err := json.Marshal(job)
+			require.NoError(t, err)
+			assert.NotContains(t, string(raw), "s3cr3t")
+
+			// A job of another runner must be left alone.
+			standIn.jobs["other"] = &api.Job{
+				ID: pointerOf("other"), Name: pointerOf("other"), Type: pointerOf(api.JobTypeBatch),
+				Meta: map[string]string{MetaRunner: "{other}"},
+			}
+
+			require.NoError(t, provider.Deprovision(context.Background(), runnerUUID))
+			assert.Equal(t, []string{workload.ID}, standIn.purged)
+			assert.Contains(t, standIn.jobs, "other")
+			assert.Empty(t, standIn.variables)
+
+			// Runners without a job are already gone.
+			require.NoError(t, provider.Deprovision(context.Background(), runnerUUID))
+			assert.Equal(t, []string{workload.ID}, standIn.purged)
+		})
+	}
+}
+
+func TestWorkloads(t *testing.T) {
+	standIn, client := newStandIn(t)
+
+	provider, err := New("nomad", testConfig(), client)
+	require.NoError(t, err)
+
+	workload, err := provider.Provision(context.Background(), testRequest())
+	require.NoError(t, err)
+
+	// Jobs of other pools and dead jobs are no workloads.
+	standIn.jobs["windows"] = &api.Job{
+		ID: pointerOf("windows"), Name: pointerOf("windows"), Type: pointerOf(api.JobTypeBatch),
+		Meta: map[string]string{MetaWorkspace: "acme", MetaPool: "windows", MetaRunner: "{windows}"},
+	}
+	standIn.jobs["dead"] = &api.Job{
+		ID: pointerOf("dead"), Name: pointerOf("dead"), Type: pointerOf(api.JobTypeBatch),
+		Status: pointerOf("dead"),
+		Meta:   map[string]string{MetaWorkspace: "acme", MetaPool: "linux", MetaRunner: "{dead}"},
+	}
+
+	workloads, err := provider.Workloads(context.Background(), "acme", "linux")
+	require.NoError(t, err)
+	require.Len(t, workloads, 1)
+
+	assert.Equal(t, workload.ID, workloads[0].ID)
+	assert.Equal(t, runnerUUID, workloads[0].RunnerUUID)
+	assert.Equal(t, "linux", workloads[0].Pool)
+	assert.Equal(t, "nomad", workloads[0].Provider)
+}
+
+func TestJobID(t *testing.T) {
+	tables := []struct {
+		runnerName string
+		expected   string
+	}{
+		{runnerName: "linux-0a1b2c3d", expected: "bitbucket-runner-linux-0a1b2c3d"},
+		{runnerName: "Linux_Big.0a1b2c3d", expected: "bitbucket-runner-linux-big-0a1b2c3d"},
+	}
+
+	for _, table := range tables {
+		t.Run(table.runnerName, func(t *testing.T) {
+			assert.Equal(t, table.expected, jobID(table.runnerName))
+		})
+	}
+}
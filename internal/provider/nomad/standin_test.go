@@ -0,0 +1,185 @@
+package nomad
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/require"
+)
+
+// filterPattern matches a meta filter the provider lists jobs with. Several
+// are joined with and.
+var filterPattern = regexp.MustCompile(`^Meta\["(.+)"\] == "(.*)"$`)
+
+// standIn is a local stand-in for the Nomad HTTP API, keeping jobs and
+// variables in memory.
+type standIn struct {
+	jobs      map[string]*api.Job
+	variables map[string]api.VariableItems
+	// registerError fails job registration with this message.
+	registerError string
+	// namespaces records the namespace of every request, by path.
+	namespaces map[string]string
+	purged     []string
+	index      int
+	mu         sync.Mutex
+}
+
+func newStandIn(t *testing.T) (*standIn, *api.Client) {
+	t.Helper()
+
+	s := &standIn{
+		jobs:       map[string]*api.Job{},
+		variables:  map[string]api.VariableItems{},
+		namespaces: map[string]string{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /v1/jobs", s.registerJob)
+	mux.HandleFunc("GET /v1/jobs", s.listJobs)
+	mux.HandleFunc("DELETE /v1/job/{job}", s.deregisterJob)
+	mux.HandleFunc("PUT /v1/var/{path...}", s.putVariable)
+	mux.HandleFunc("DELETE /v1/var/{path...}", s.deleteVariable)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.namespaces[r.URL.Path] = r.URL.Query().Get("namespace")
+		s.index++
+		w.Header().Set("X-Nomad-Index", strconv.Itoa(s.index))
+		s.mu.Unlock()
+
+		w.Header().Set("X-Nomad-KnownLeader", "true")
+		w.Header().Set("X-Nomad-LastContact", "0")
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	cfg.Namespace = "ci"
+
+	client, err := api.NewClient(cfg)
+	require.NoError(t, err)
+
+	return s, client
+}
+
+func (s *standIn) registerJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var req api.JobRegisterRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if s.registerError != "" {
+		http.Error(w, s.registerError, http.StatusInternalServerError)
+
+		return
+	}
+
+	s.jobs[*req.Job.ID] = req.Job
+
+	writeJSON(w, &api.JobRegisterResponse{EvalID: "eval-" + *req.Job.ID})
+}
+
+func (s *standIn) listJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches [][]string
+
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		for _, term := range strings.Split(filter, " and ") {
+			matches = append(matches, filterPattern.FindStringSubmatch(term))
+		}
+	}
+
+	withMeta := r.URL.Query().Get("meta") == "true"
+
+	stubs := []*api.JobListStub{}
+
+	for _, job := range s.jobs {
+		if slices.ContainsFunc(matches, func(match []string) bool {
+			return match == nil || job.Meta[match[1]] != match[2]
+		}) {
+			continue
+		}
+
+		stub := &api.JobListStub{ID: *job.ID, Name: *job.Name, Type: *job.Type}
+		if job.Status != nil {
+			stub.Status = *job.Status
+		}
+
+		if withMeta {
+			stub.Meta = job.Meta
+		}
+
+		stubs = append(stubs, stub)
+	}
+
+	writeJSON(w, stubs)
+}
+
+func (s *standIn) deregisterJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("job")
+	if _, ok := s.jobs[id]; !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+
+		return
+	}
+
+	if r.URL.Query().Get("purge") == "true" {
+		delete(s.jobs, id)
+		s.purged = append(s.purged, id)
+	}
+
+	writeJSON(w, &api.JobDeregisterResponse{EvalID: "eval-" + id})
+}
+
+func (s *standIn) putVariable(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var variable api.Variable
+
+	if err := json.NewDecoder(r.Body).Decode(&variable); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	s.variables[r.PathValue("path")] = variable.Items
+
+	writeJSON(w, &variable)
+}
+
+func (s *standIn) deleteVariable(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.variables, r.PathValue("path"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,466 @@
+//go:build unix
+
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+const (
+	// pollInterval is how often a stopping runner is checked for.
+	pollInterval time.Duration = 100 * time.Millisecond
+	// killTimeout is how long a killed runner has to go.
+	killTimeout time.Duration = 5 * time.Second
+)
+
+// inheritedEnv is passed on to every runner, on top of InheritEnv.
+var inheritedEnv = []string{"PATH", "HOME"} //nolint:gochecknoglobals
+
+// Provider runs Bitbucket runners as child processes, each in its own
+// process group and working directory, with its output appended to a log
+// file.
+type Provider struct {
+	// children holds the runners started by this provider, keyed by runner
+	// UUID.
+	children map[string]*child
+	env      map[string]*template.Template
+	command  []*template.Template
+	name     string
+	cfg      config.Process
+	mu       sync.Mutex
+}
+
+type child struct {
+	cmd *exec.Cmd
+	// done is closed once the process has exited.
+	done chan struct{}
+}
+
+// pidFile is what the PID file of a runner records: the PID, then the
+// workspace and pool the runner was started for, one per line. Files
+// written before the workspace and pool were recorded only hold the PID.
+type pidFile struct {
+	workspace string
+	pool      string
+	pid       int
+}
+
+// templateInput is what the command and env templates can refer to.
+// Credentials are left out: they are only passed in the environment.
+type templateInput struct {
+	Workspace     string
+	WorkspaceUUID string
+	Pool          string
+	RunnerUUID    string
+	RunnerName    string
+	WorkDir       string
+	Labels        []string
+}
+
+// New returns a provider starting the command of cfg.
+func New(name string, cfg config.Process) (*Provider, error) {
+	// Orphaned runners are recognised by their absolute working directory.
+	for _, dir := range []*string{&cfg.WorkDir, &cfg.LogDir} {
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid directory %s: %w", *dir, err)
+		}
+
+		*dir = abs
+	}
+
+	command := make([]*template.Template, 0, len(cfg.Command))
+
+	for i, text := range cfg.Command {
+		tmpl, err := template.New(strconv.Itoa(i)).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command template: %w", err)
+		}
+
+		command = append(command, tmpl)
+	}
+
+	env := make(map[string]*template.Template, len(cfg.Env))
+
+	for key, text := range cfg.Env {
+		tmpl, err := template.New(key).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid env %s template: %w", key, err)
+		}
+
+		env[key] = tmpl
+	}
+
+	return &Provider{children: map[string]*child{}, env: env, command: command, name: name, cfg: cfg}, nil
+}
+
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// Provision starts the runner in a fresh working directory and records its
+// PID next to it, so it can still be stopped after the autoscaler restarts.
+// The process is reaped, and forgotten, as soon as it exits.
+func (p *Provider) Provision(_ context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dir := p.workDir(req.RunnerUUID)
+
+	args, env, err := p.render(req, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create working directory: %w", err)
+	}
+
+	if err := os.MkdirAll(p.cfg.LogDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	logFile, err := os.OpenFile(p.logPath(req.RunnerUUID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	// The process outlives the request that started it.
+	cmd := exec.Command(args[0], args[1:]...) //nolint:gosec,noctx // the command comes from the config
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		_ = logFile.Close()
+
+		return nil, fmt.Errorf("failed to start runner: %w", err)
+	}
+
+	c := &child{cmd: cmd, done: make(chan struct{})}
+
+	go func() {
+		_ = cmd.Wait()
+		_ = logFile.Close()
+
+		close(c.done)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.children[req.RunnerUUID] == c {
+			delete(p.children, req.RunnerUUID)
+		}
+	}()
+
+	pid := strconv.Itoa(cmd.Process.Pid)
+	record := pid + "\n" + req.Workspace + "\n" + req.Pool + "\n"
+
+	if err := os.WriteFile(p.pidPath(req.RunnerUUID), []byte(record), 0o640); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to record runner PID: %w", err), p.stop(context.Background(), c))
+	}
+
+	p.children[req.RunnerUUID] = c
+
+	return &ports.Workload{
+		CreatedAt:  time.Now(),
+		ID:         pid,
+		RunnerUUID: req.RunnerUUID,
+		Pool:       req.Pool,
+		Provider:   p.name,
+	}, nil
+}
+
+func (p *Provider) render(req ports.ProvisionRequest, dir string) ([]string, []string, error) {
+	input := templateInput{
+		Workspace:     req.Workspace,
+		WorkspaceUUID: req.WorkspaceUUID,
+		Pool:          req.Pool,
+		RunnerUUID:    req.RunnerUUID,
+		RunnerName:    req.RunnerName,
+		WorkDir:       dir,
+		Labels:        req.Labels,
+	}
+
+	args := make([]string, 0, len(p.command))
+
+	for _, tmpl := range p.command {
+		var b strings.Builder
+
+		if err := tmpl.Execute(&b, input); err != nil {
+			return nil, nil, fmt.Errorf("failed to render command: %w", err)
+		}
+
+		args = append(args, b.String())
+	}
+
+	var env []string
+
+	for _, key := range slices.Concat(inheritedEnv, p.cfg.InheritEnv) {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+
+	env = append(env,
+		"ACCOUNT_UUID="+req.WorkspaceUUID,
+		"RUNNER_UUID="+req.RunnerUUID,
+		"OAUTH_CLIENT_ID="+req.OAuthClientID,
+		"OAUTH_CLIENT_SECRET="+req.OAuthClientSecret,
+		"RUNTIME_PREREQUISITES_ENABLED=true",
+		"WORKING_DIRECTORY="+dir,
+	)
+
+	for key, tmpl := range p.env {
+		var b strings.Builder
+
+		if err := tmpl.Execute(&b, input); err != nil {
+			return nil, nil, fmt.Errorf("failed to render env %s: %w", key, err)
+		}
+
+		env = append(env, key+"="+b.String())
+	}
+
+	return args, env, nil
+}
+
+// Deprovision stops the runner, with SIGTERM and then SIGKILL once
+// StopTimeout has passed, and removes its working directory. Its log file
+// is kept. A runner without a process is already gone. Other runners can be
+// started and stopped while it stops.
+func (p *Provider) Deprovision(ctx context.Context, runnerUUID string) error {
+	p.mu.Lock()
+	c, ok := p.children[runnerUUID]
+	p.mu.Unlock()
+
+	if ok {
+		if err := p.stop(ctx, c); err != nil {
+			return err
+		}
+	} else if err := p.stopOrphan(ctx, runnerUUID); err != nil {
+		return err
+	}
+
+	if err := os.Remove(p.pidPath(runnerUUID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove PID file: %w", err)
+	}
+
+	if err := os.RemoveAll(p.workDir(runnerUUID)); err != nil {
+		return fmt.Errorf("failed to remove working directory: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Provider) stop(ctx context.Context, c *child) error {
+	return p.terminate(ctx, c.cmd.Process.Pid, func() bool {
+		select {
+		case <-c.done:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// stopOrphan stops a runner started before the autoscaler restarted, found
+// through its PID file.
+func (p *Provider) stopOrphan(ctx context.Context, runnerUUID string) error {
+	record, err := p.readPID(runnerUUID)
+	if err != nil || record == nil {
+		return err
+	}
+
+	if !p.owned(runnerUUID, record.pid) {
+		return nil
+	}
+
+	return p.terminate(ctx, record.pid, func() bool { return !p.owned(runnerUUID, record.pid) })
+}
+
+// Workloads returns a workload per runner of pool of workspace whose process
+// still runs, including those started before the autoscaler restarted.
+// Runners whose PID file lacks their workspace and pool are left out.
+func (p *Provider) Workloads(_ context.Context, workspace, pool string) ([]ports.Workload, error) {
+	entries, err := os.ReadDir(p.cfg.WorkDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runners: %w", err)
+	}
+
+	var workloads []ports.Workload
+
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".pid")
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		runnerUUID := "{" + id + "}"
+
+		record, err := p.readPID(runnerUUID)
+		if err != nil {
+			return nil, err
+		}
+
+		if record == nil || record.workspace != workspace || record.pool != pool || !p.running(runnerUUID, record.pid) {
+			continue
+		}
+
+		var createdAt time.Time
+		if info, err := entry.Info(); err == nil {
+			createdAt = info.ModTime()
+		}
+
+		workloads = append(workloads, ports.Workload{
+			CreatedAt:  createdAt,
+			ID:         strconv.Itoa(record.pid),
+			RunnerUUID: runnerUUID,
+			Pool:       pool,
+			Provider:   p.name,
+		})
+	}
+
+	return workloads, nil
+}
+
+// readPID reads the PID file of the runner. A runner without one returns
+// nil.
+func (p *Provider) readPID(runnerUUID string) (*pidFile, error) {
+	raw, err := os.ReadFile(p.pidPath(runnerUUID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PID file: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PID file: %w", err)
+	}
+
+	record := &pidFile{pid: pid}
+	if len(lines) == 3 {
+		record.workspace, record.pool = lines[1], lines[2]
+	}
+
+	return record, nil
+}
+
+// running reports whether the process of the runner has not exited yet.
+func (p *Provider) running(runnerUUID string, pid int) bool {
+	p.mu.Lock()
+	c, ok := p.children[runnerUUID]
+	p.mu.Unlock()
+
+	if !ok {
+		return p.owned(runnerUUID, pid)
+	}
+
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// owned reports whether pid runs in the working directory of the runner. The
+// PID of a runner not started by this provider is only trusted then.
+func (p *Provider) owned(runnerUUID string, pid int) bool {
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+
+	return err == nil && cwd == p.workDir(runnerUUID)
+}
+
+// terminate signals the process group of pid until exited reports the
+// process gone. It outlives ctx, so that a runner ignoring SIGTERM is always
+// killed.
+func (p *Provider) terminate(ctx context.Context, pid int, exited func() bool) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.cfg.StopTimeout+killTimeout)
+	defer cancel()
+
+	// The PID of a reaped process may be in use again.
+	if exited() {
+		return nil
+	}
+
+	if err := signalGroup(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(p.cfg.StopTimeout)
+	killed := false
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for !exited() {
+		if !killed && time.Now().After(deadline) {
+			if err := signalGroup(pid, syscall.SIGKILL); err != nil {
+				return err
+			}
+
+			killed = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to stop runner %d: %w", pid, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (p *Provider) workDir(runnerUUID string) string {
+	return filepath.Join(p.cfg.WorkDir, fileName(runnerUUID))
+}
+
+func (p *Provider) pidPath(runnerUUID string) string {
+	return filepath.Join(p.cfg.WorkDir, fileName(runnerUUID)+".pid")
+}
+
+func (p *Provider) logPath(runnerUUID string) string {
+	return filepath.Join(p.cfg.LogDir, fileName(runnerUUID)+".log")
+}
+
+// signalGroup sends sig to the process group led by pid. A group that is gone
+// already is not an error.
+func signalGroup(pid int, sig syscall.Signal) error {
+	if err := syscall.Kill(-pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to signal runner %d: %w", pid, err)
+	}
+
+	return nil
+}
+
+// fileName is the runner UUID without braces.
+func fileName(runnerUUID string) string {
+	return strings.Trim(runnerUUID, "{}")
+}
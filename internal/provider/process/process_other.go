@@ -0,0 +1,34 @@
+//go:build !unix
+
+package process
+
+import (
+	"context"
+	"errors"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// Provider is only available where process groups are.
+type Provider struct{}
+
+func New(_ string, _ config.Process) (*Provider, error) {
+	return nil, errors.New("the process provider is not supported on this platform")
+}
+
+func (p *Provider) Name() string {
+	return ""
+}
+
+func (p *Provider) Provision(_ context.Context, _ ports.ProvisionRequest) (*ports.Workload, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (p *Provider) Deprovision(_ context.Context, _ string) error {
+	return errors.ErrUnsupported
+}
+
+func (p *Provider) Workloads(_ context.Context, _, _ string) ([]ports.Workload, error) {
+	return nil, errors.ErrUnsupported
+}
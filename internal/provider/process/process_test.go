@@ -0,0 +1,294 @@
+//go:build unix
+
+package process
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const runnerUUID = "{5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}"
+
+// fakeRunnerEnv makes the test binary act as the runner, in the mode it is
+// set to.
+const fakeRunnerEnv = "FAKE_RUNNER"
+
+// secretEnv stands for a secret of the autoscaler environment.
+const secretEnv = "AUTOSCALER_SECRET"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(fakeRunnerEnv); mode != "" {
+		fakeRunner(mode)
+	}
+
+	os.Exit(m.Run())
+}
+
+// fakeRunner reports what it was started with and waits to be stopped. A
+// "graceful" runner exits on SIGTERM, a "stubborn" one ignores it.
+func fakeRunner(mode string) {
+	cwd, _ := os.Getwd()
+
+	fmt.Printf("started %s in %s with %s\n", os.Getenv("RUNNER_UUID"), cwd, strings.Join(os.Args[1:], " "))
+	fmt.Fprintf(os.Stderr, "runner name %s\n", os.Getenv("RUNNER_NAME"))
+	fmt.Fprintf(os.Stderr, "autoscaler secret %q\n", os.Getenv(secretEnv))
+
+	_ = os.WriteFile("credentials", []byte(os.Getenv("OAUTH_CLIENT_ID")+":"+os.Getenv("OAUTH_CLIENT_SECRET")), 0o600)
+
+	signals := make(chan os.Signal, 1)
+
+	if mode == "stubborn" {
+		signal.Ignore(syscall.SIGTERM)
+	} else {
+		signal.Notify(signals, syscall.SIGTERM)
+	}
+
+	<-signals
+	fmt.Println("stopping")
+	os.Exit(0)
+}
+
+func testRequest() ports.ProvisionRequest {
+	return ports.ProvisionRequest{
+		Workspace:         "acme",
+		WorkspaceUUID:     "{workspace}",
+		Pool:              "linux",
+		RunnerUUID:        runnerUUID,
+		RunnerName:        "linux-0a1b2c3d",
+		OAuthClientID:     "client-id",
+		OAuthClientSecret: "s3cr3t",
+	}
+}
+
+func testConfig(t *testing.T, mode string) config.Process {
+	t.Helper()
+	t.Setenv(fakeRunnerEnv, mode)
+	t.Setenv(secretEnv, "hunter2")
+
+	return config.Process{
+		Env:         map[string]string{"RUNNER_NAME": "{{.RunnerName}}"},
+		InheritEnv:  []string{fakeRunnerEnv},
+		Command:     []string{os.Args[0], "--pool", "{{.Pool}}"},
+		WorkDir:     filepath.Join(t.TempDir(), "runners"),
+		LogDir:      filepath.Join(t.TempDir(), "logs"),
+		StopTimeout: 5 * time.Second,
+	}
+}
+
+// waitForLog waits until the log of the runner contains s.
+func waitForLog(t *testing.T, cfg config.Process, s string) string {
+	t.Helper()
+
+	var log string
+
+	assert.Eventually(t, func() bool {
+		raw, _ := os.ReadFile(filepath.Join(cfg.LogDir, strings.Trim(runnerUUID, "{}")+".log"))
+		log = string(raw)
+
+		return strings.Contains(log, s)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return log
+}
+
+func TestProvision(t *testing.T) {
+	tables := []struct {
+		name        string
+		mode        string
+		stopTimeout time.Duration
+		graceful    bool
+		cancelled   bool
+	}{
+		{name: "runner exits on SIGTERM", mode: "graceful", stopTimeout: 5 * time.Second, graceful: true},
+		{name: "runner ignoring SIGTERM is killed", mode: "stubborn", stopTimeout: 200 * time.Millisecond},
+		{
+			name:        "runner is killed after the reconcile ended",
+			mode:        "stubborn",
+			stopTimeout: 200 * time.Millisecond,
+			cancelled:   true,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			cfg := testConfig(t, table.mode)
+			cfg.StopTimeout = table.stopTimeout
+
+			provider, err := New("bare-metal", cfg)
+			require.NoError(t, err)
+
+			workload, err := provider.Provision(context.Background(), testRequest())
+			require.NoError(t, err)
+			assert.Equal(t, "bare-metal", workload.Provider)
+
+			dir := filepath.Join(cfg.WorkDir, strings.Trim(runnerUUID, "{}"))
+
+			log := waitForLog(t, cfg, "runner name linux-0a1b2c3d")
+			assert.Contains(t, log, fmt.Sprintf("started %s in %s with --pool linux", runnerUUID, dir))
+			assert.NotContains(t, log, "s3cr3t")
+			assert.Contains(t, log, `autoscaler secret ""`)
+
+			pid, err := os.ReadFile(dir + ".pid")
+			require.NoError(t, err)
+			assert.Equal(t, workload.ID+"\nacme\nlinux\n", string(pid))
+
+			assert.Eventually(t, func() bool {
+				credentials, _ := os.ReadFile(filepath.Join(dir, "credentials"))
+
+				return string(credentials) == "client-id:s3cr3t"
+			}, 5*time.Second, 10*time.Millisecond)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if table.cancelled {
+				cancel()
+			}
+
+			start := time.Now()
+
+			require.NoError(t, provider.Deprovision(ctx, runnerUUID))
+			cancel()
+			assert.Less(t, time.Since(start), cfg.StopTimeout+time.Second)
+
+			log = waitForLog(t, cfg, "runner name")
+			assert.Equal(t, table.graceful, strings.Contains(log, "stopping"))
+			assert.NoDirExists(t, dir)
+			assert.NoFileExists(t, dir+".pid")
+
+			// Runners without a process are already gone.
+			require.NoError(t, provider.Deprovision(context.Background(), runnerUUID))
+		})
+	}
+}
+
+func TestDeprovisionAfterRestart(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("orphaned runners are only recognised through /proc")
+	}
+
+	cfg := testConfig(t, "graceful")
+
+	previous, err := New("bare-metal", cfg)
+	require.NoError(t, err)
+
+	workload, err := previous.Provision(context.Background(), testRequest())
+	require.NoError(t, err)
+	waitForLog(t, cfg, "started")
+
+	previous.mu.Lock()
+	c := previous.children[runnerUUID]
+	previous.mu.Unlock()
+
+	// A provider started afterwards finds the runner through its PID file.
+	provider, err := New("bare-metal", cfg)
+	require.NoError(t, err)
+
+	workloads, err := provider.Workloads(context.Background(), "acme", "linux")
+	require.NoError(t, err)
+	require.Len(t, workloads, 1)
+	assert.Equal(t, workload.ID, workloads[0].ID)
+	assert.Equal(t, runnerUUID, workloads[0].RunnerUUID)
+
+	require.NoError(t, provider.Deprovision(context.Background(), runnerUUID))
+	waitForLog(t, cfg, "stopping")
+
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runner still running")
+	}
+}
+
+func TestWorkloads(t *testing.T) {
+	cfg := testConfig(t, "graceful")
+
+	provider, err := New("bare-metal", cfg)
+	require.NoError(t, err)
+
+	workloads, err := provider.Workloads(context.Background(), "acme", "linux")
+	require.NoError(t, err)
+	assert.Empty(t, workloads)
+
+	workload, err := provider.Provision(context.Background(), testRequest())
+	require.NoError(t, err)
+	waitForLog(t, cfg, "started")
+
+	tables := []struct {
+		name      string
+		workspace string
+		pool      string
+		expected  int
+	}{
+		{name: "runner of the pool", workspace: "acme", pool: "linux", expected: 1},
+		{name: "other pool", workspace: "acme", pool: "windows"},
+		{name: "other workspace", workspace: "globex", pool: "linux"},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			workloads, err := provider.Workloads(context.Background(), table.workspace, table.pool)
+			require.NoError(t, err)
+			assert.Len(t, workloads, table.expected)
+		})
+	}
+
+	// A runner exiting by itself is reaped and no longer listed.
+	pid, err := strconv.Atoi(workload.ID)
+	require.NoError(t, err)
+	require.NoError(t, syscall.Kill(pid, syscall.SIGTERM))
+
+	assert.Eventually(t, func() bool {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+
+		return len(provider.children) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	workloads, err = provider.Workloads(context.Background(), "acme", "linux")
+	require.NoError(t, err)
+	assert.Empty(t, workloads)
+}
+
+func TestDeprovisionDoesNotBlock(t *testing.T) {
+	cfg := testConfig(t, "stubborn")
+	cfg.StopTimeout = 2 * time.Second
+
+	provider, err := New("bare-metal", cfg)
+	require.NoError(t, err)
+
+	_, err = provider.Provision(context.Background(), testRequest())
+	require.NoError(t, err)
+	waitForLog(t, cfg, "started")
+
+	stopped := make(chan error, 1)
+
+	go func() { stopped <- provider.Deprovision(context.Background(), runnerUUID) }()
+
+	// Another runner starts while the first one is given time to exit.
+	time.Sleep(200 * time.Millisecond)
+
+	other := testRequest()
+	other.RunnerUUID = "{6f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}"
+
+	start := time.Now()
+
+	_, err = provider.Provision(context.Background(), other)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	require.NoError(t, <-stopped)
+	require.NoError(t, provider.Deprovision(context.Background(), other.RunnerUUID))
+}
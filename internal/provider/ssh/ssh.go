@@ -0,0 +1,470 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Container labels set by the default start script. Runners are found by
+// LabelRunner, and attributed to their pool by the other two.
+const (
+	LabelRunner    string = "bitbucket-runner-autoscaler.runner"
+	LabelWorkspace string = "bitbucket-runner-autoscaler.workspace"
+	LabelPool      string = "bitbucket-runner-autoscaler.pool"
+)
+
+// listInterval is how long the listing of a host is trusted. Hosts are
+// listed again afterwards, so runners started or removed on the host by
+// anything else free or take slots.
+const listInterval time.Duration = 10 * time.Second
+
+// defaultStartScript starts the runner container with its own working
+// directory, so several runners can share a host. The credentials go through
+// an env file rather than the docker command line.
+const defaultStartScript string = `set -e
+name='bitbucket-runner-{{.RunnerID}}'
+dir="/tmp/$name"
+docker rm -f "$name" >/dev/null 2>&1 || true
+mkdir -p "$dir"
+env=$(mktemp)
+trap 'rm -f "$env"' EXIT
+cat > "$env" <<'EOF'
+ACCOUNT_UUID={{.WorkspaceUUID}}
+RUNNER_UUID={{.RunnerUUID}}
+OAUTH_CLIENT_ID={{.OAuthClientID}}
+OAUTH_CLIENT_SECRET={{.OAuthClientSecret}}
+RUNTIME_PREREQUISITES_ENABLED=true
+EOF
+docker run -d --restart unless-stopped --name "$name" \
+  --label ` + LabelRunner + `='{{.RunnerUUID}}' \
+  --label ` + LabelWorkspace + `='{{.Workspace}}' \
+  --label ` + LabelPool + `='{{.Pool}}' \
+  --env-file "$env" \
+  -e WORKING_DIRECTORY="$dir" \
+  -v "$dir:$dir" \
+  -v /var/run/docker.sock:/var/run/docker.sock \
+  -v /var/lib/docker/containers:/var/lib/docker/containers:ro \
+  docker-public.packages.atlassian.com/sox/atlassian/bitbucket-pipelines-runner:1
+`
+
+const defaultStopScript string = `name='bitbucket-runner-{{.RunnerID}}'
+docker stop -t 30 "$name" >/dev/null 2>&1
+docker rm -f "$name" >/dev/null 2>&1
+rm -rf "/tmp/$name"
+true
+`
+
+// defaultListScript escapes the docker format template from the Go template
+// it is rendered with.
+const defaultListScript string = `docker ps -a --filter label=` + LabelRunner + ` --format '` +
+	`{{"{{"}}.Label "` + LabelRunner + `"{{"}}"}} ` +
+	`{{"{{"}}.Label "` + LabelWorkspace + `"{{"}}"}} ` +
+	`{{"{{"}}.Label "` + LabelPool + `"{{"}}"}}'
+`
+
+// Provider runs Bitbucket runners on a fixed fleet of hosts reached over
+// SSH. Every host has a number of slots, and new runners go to the host with
+// the most free slots.
+type Provider struct {
+	clientConfig *ssh.ClientConfig
+	start        *template.Template
+	stop         *template.Template
+	list         *template.Template
+	now          func() time.Time
+	name         string
+	hosts        []*host
+	mu           sync.Mutex
+}
+
+type host struct {
+	// listedAt is when runners was last known to match the host, zero
+	// until the host could be listed.
+	listedAt time.Time
+	// runners maps the UUIDs of the runners on the host to their slot.
+	runners    map[string]slot
+	address    string
+	maxRunners int
+}
+
+// slot is a runner on a host. Runners listed without workspace and pool
+// cannot be attributed to a pool, and the start time is only known for
+// runners this provider started.
+type slot struct {
+	startedAt time.Time
+	workspace string
+	pool      string
+}
+
+// scriptInput is what the scripts can refer to. RunnerID is the runner UUID
+// without braces, for use in names.
+type scriptInput struct {
+	Workspace         string
+	WorkspaceUUID     string
+	Pool              string
+	RunnerUUID        string
+	RunnerID          string
+	RunnerName        string
+	OAuthClientID     string
+	OAuthClientSecret string
+	TokenEndpoint     string
+	Audience          string
+	Labels            []string
+}
+
+// New returns a provider logging in to the hosts of cfg with clientConfig.
+func New(name string, cfg config.SSH, clientConfig *ssh.ClientConfig) (*Provider, error) {
+	p := &Provider{clientConfig: clientConfig, now: time.Now, name: name}
+
+	for _, script := range []struct {
+		tmpl  **template.Template
+		name  string
+		text  string
+		value string
+	}{
+		{tmpl: &p.start, name: "start_script", text: defaultStartScript, value: cfg.StartScript},
+		{tmpl: &p.stop, name: "stop_script", text: defaultStopScript, value: cfg.StopScript},
+		{tmpl: &p.list, name: "list_script", text: defaultListScript, value: cfg.ListScript},
+	} {
+		text := script.value
+		if text == "" {
+			text = script.text
+		}
+
+		tmpl, err := template.New(script.name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template: %w", script.name, err)
+		}
+
+		*script.tmpl = tmpl
+	}
+
+	for _, h := range cfg.Hosts {
+		address := h.Address
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "22")
+		}
+
+		p.hosts = append(p.hosts, &host{runners: map[string]slot{}, address: address, maxRunners: h.MaxRunners})
+	}
+
+	return p, nil
+}
+
+// Open returns a provider authenticating with the private key of cfg and
+// verifying hosts against its known hosts file.
+func Open(_ context.Context, name string, cfg config.SSH) (*Provider, error) {
+	key, err := os.ReadFile(cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	return New(name, cfg, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         cfg.ConnectTimeout,
+	})
+}
+
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// Provision starts the runner on the host with the most free slots, trying
+// the next one if a host cannot be reached or the start script fails.
+func (p *Provider) Provision(ctx context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	script, err := render(p.start, req)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := p.syncAll(ctx)
+
+	for _, h := range p.candidates() {
+		if _, err := p.run(ctx, h, script); err != nil {
+			h.listedAt = time.Time{}
+			errs = append(errs, fmt.Errorf("failed to start runner on %s: %w", h.address, err))
+
+			continue
+		}
+
+		now := p.now()
+		h.runners[req.RunnerUUID] = slot{startedAt: now, workspace: req.Workspace, pool: req.Pool}
+
+		return &ports.Workload{
+			CreatedAt:  now,
+			ID:         h.address,
+			RunnerUUID: req.RunnerUUID,
+			Pool:       req.Pool,
+			Provider:   p.name,
+		}, nil
+	}
+
+	return nil, errors.Join(append([]error{errors.New("no free slot on any host")}, errs...)...)
+}
+
+// Capacity returns the free slots of the hosts whose runners are known. It
+// only fails when no host could be listed.
+func (p *Provider) Capacity(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	errs := p.syncAll(ctx)
+	free, synced := 0, 0
+
+	for _, h := range p.hosts {
+		if h.synced() {
+			free += max(h.free(), 0)
+			synced++
+		}
+	}
+
+	if synced == 0 && len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+
+	return free, nil
+}
+
+// candidates returns the synced hosts with a free slot, the emptiest first.
+// Hosts with as many free slots keep their configured order.
+func (p *Provider) candidates() []*host {
+	var hosts []*host
+
+	for _, h := range p.hosts {
+		if h.synced() && h.free() > 0 {
+			hosts = append(hosts, h)
+		}
+	}
+
+	slices.SortStableFunc(hosts, func(a, b *host) int { return b.free() - a.free() })
+
+	return hosts
+}
+
+// Deprovision runs the stop script on the host of the runner and frees its
+// slot. A runner on no host is already gone.
+func (p *Provider) Deprovision(ctx context.Context, runnerUUID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := p.find(runnerUUID)
+	if h == nil {
+		if err := errors.Join(p.syncAll(ctx)...); err != nil {
+			return err
+		}
+
+		if h = p.find(runnerUUID); h == nil {
+			return nil
+		}
+	}
+
+	script, err := render(p.stop, ports.ProvisionRequest{RunnerUUID: runnerUUID})
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.run(ctx, h, script); err != nil {
+		return fmt.Errorf("failed to stop runner on %s: %w", h.address, err)
+	}
+
+	delete(h.runners, runnerUUID)
+
+	return nil
+}
+
+func (p *Provider) find(runnerUUID string) *host {
+	for _, h := range p.hosts {
+		if _, ok := h.runners[runnerUUID]; ok {
+			return h
+		}
+	}
+
+	return nil
+}
+
+// Workloads returns a workload per runner listed on the hosts for pool of
+// workspace. It fails if any host cannot be listed, as the runners on it
+// would otherwise look gone.
+func (p *Provider) Workloads(ctx context.Context, workspace, pool string) ([]ports.Workload, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := errors.Join(p.syncAll(ctx)...); err != nil {
+		return nil, err
+	}
+
+	var workloads []ports.Workload
+
+	for _, h := range p.hosts {
+		for runnerUUID, s := range h.runners {
+			if s.workspace != workspace || s.pool != pool {
+				continue
+			}
+
+			workloads = append(workloads, ports.Workload{
+				CreatedAt:  s.startedAt,
+				ID:         h.address,
+				RunnerUUID: runnerUUID,
+				Pool:       pool,
+				Provider:   p.name,
+			})
+		}
+	}
+
+	return workloads, nil
+}
+
+// syncAll lists the runners of the hosts whose listing is missing or older
+// than listInterval. Hosts that cannot be listed become unsynced, and are
+// left out until they can.
+func (p *Provider) syncAll(ctx context.Context) []error {
+	var errs []error
+
+	script, err := render(p.list, ports.ProvisionRequest{})
+	if err != nil {
+		return []error{err}
+	}
+
+	for _, h := range p.hosts {
+		if h.synced() && p.now().Sub(h.listedAt) < listInterval {
+			continue
+		}
+
+		out, err := p.run(ctx, h, script)
+		if err != nil {
+			h.listedAt = time.Time{}
+			errs = append(errs, fmt.Errorf("failed to list runners on %s: %w", h.address, err))
+
+			continue
+		}
+
+		runners := map[string]slot{}
+
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+
+			// Runners started here keep their start time and pool.
+			s := h.runners[fields[0]]
+			if len(fields) >= 3 {
+				s.workspace, s.pool = fields[1], fields[2]
+			}
+
+			runners[fields[0]] = s
+		}
+
+		h.runners = runners
+		h.listedAt = p.now()
+	}
+
+	return errs
+}
+
+// run pipes script into sh on the host and returns its output.
+func (p *Provider) run(ctx context.Context, h *host, script string) ([]byte, error) {
+	dialer := net.Dialer{Timeout: p.clientConfig.Timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", h.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	// Unblock the SSH handshake and session once ctx is done.
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, h.address, p.clientConfig)
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("failed to log in: %w", err)
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session: %w", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+
+	session.Stdin = strings.NewReader(script)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	if err := session.Run("sh -s"); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (h *host) synced() bool {
+	return !h.listedAt.IsZero()
+}
+
+func (h *host) free() int {
+	return h.maxRunners - len(h.runners)
+}
+
+func render(tmpl *template.Template, req ports.ProvisionRequest) (string, error) {
+	var b strings.Builder
+
+	err := tmpl.Execute(&b, scriptInput{
+		Workspace:         req.Workspace,
+		WorkspaceUUID:     req.WorkspaceUUID,
+		Pool:              req.Pool,
+		RunnerUUID:        req.RunnerUUID,
+		RunnerID:          strings.Trim(req.RunnerUUID, "{}"),
+		RunnerName:        req.RunnerName,
+		OAuthClientID:     req.OAuthClientID,
+		OAuthClientSecret: req.OAuthClientSecret,
+		TokenEndpoint:     req.TokenEndpoint,
+		Audience:          req.Audience,
+		Labels:            req.Labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", tmpl.Name(), err)
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,263 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRequest(i int) ports.ProvisionRequest {
+	return ports.ProvisionRequest{
+		Workspace:         "acme",
+		WorkspaceUUID:     "{workspace}",
+		Pool:              "linux",
+		RunnerUUID:        fmt.Sprintf("{00000000-0000-0000-0000-00000000000%d}", i),
+		RunnerName:        fmt.Sprintf("linux-%d", i),
+		OAuthClientID:     "client-id",
+		OAuthClientSecret: "s3cr3t",
+	}
+}
+
+func openFleet(t *testing.T, f *fleet, maxRunners ...int) *Provider {
+	t.Helper()
+
+	cfg := config.SSH{
+		StartScript:    "start {{.RunnerUUID}} {{.OAuthClientSecret}} {{.Workspace}} {{.Pool}}",
+		StopScript:     "stop {{.RunnerUUID}}",
+		ListScript:     "list",
+		User:           "runner",
+		PrivateKeyFile: f.privateKeyFile,
+		KnownHostsFile: f.knownHostsFile,
+	}
+
+	for i, h := range f.hosts {
+		cfg.Hosts = append(cfg.Hosts, config.SSHHost{Address: h.address(), MaxRunners: maxRunners[i]})
+	}
+
+	provider, err := Open(context.Background(), "fleet", cfg)
+	require.NoError(t, err)
+
+	return provider
+}
+
+func TestProvision(t *testing.T) {
+	tables := []struct {
+		existing      map[int][]int
+		down          map[int]bool
+		failStart     map[int]bool
+		name          string
+		expectedError string
+		maxRunners    []int
+		expected      []int
+	}{
+		{
+			name:       "spreads runners over the emptiest hosts",
+			maxRunners: []int{2, 2},
+			expected:   []int{0, 1, 0, 1},
+		},
+		{
+			name:       "bigger hosts take more runners",
+			maxRunners: []int{1, 3},
+			expected:   []int{1, 1, 0, 1},
+		},
+		{
+			name:       "runners started before count",
+			maxRunners: []int{2, 2},
+			existing:   map[int][]int{0: {8, 9}},
+			expected:   []int{1, 1},
+		},
+		{
+			name:       "unreachable hosts are skipped",
+			maxRunners: []int{2, 2},
+			down:       map[int]bool{0: true},
+			expected:   []int{1, 1},
+		},
+		{
+			name:       "failed starts move on to the next host",
+			maxRunners: []int{2, 2},
+			failStart:  map[int]bool{0: true},
+			expected:   []int{1, 1},
+		},
+		{
+			name:          "fleet full",
+			maxRunners:    []int{1, 1},
+			expected:      []int{0, 1},
+			expectedError: "no free slot on any host",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			f := newFleet(t, len(table.maxRunners))
+
+			for i, uuids := range table.existing {
+				for _, uuid := range uuids {
+					f.hosts[i].runners[testRequest(uuid).RunnerUUID] = "old"
+				}
+			}
+
+			for i := range table.down {
+				require.NoError(t, f.hosts[i].listener.Close())
+			}
+
+			for i := range table.failStart {
+				f.hosts[i].failStart = true
+			}
+
+			provider := openFleet(t, f, table.maxRunners...)
+
+			for i, expected := range table.expected {
+				workload, err := provider.Provision(context.Background(), testRequest(i))
+				require.NoError(t, err)
+				assert.Equal(t, f.hosts[expected].address(), workload.ID, "runner %d", i)
+				assert.Equal(t, "s3cr3t", f.hosts[expected].runners[testRequest(i).RunnerUUID])
+			}
+
+			_, err := provider.Provision(context.Background(), testRequest(len(table.expected)))
+			if table.expectedError == "" {
+				return
+			}
+
+			assert.ErrorContains(t, err, table.expectedError)
+		})
+	}
+}
+
+func TestDeprovision(t *testing.T) {
+	f := newFleet(t, 2)
+	provider := openFleet(t, f, 1, 1)
+
+	for i := range 2 {
+		_, err := provider.Provision(context.Background(), testRequest(i))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, provider.Deprovision(context.Background(), testRequest(0).RunnerUUID))
+	assert.Empty(t, f.hosts[0].runners)
+	assert.Len(t, f.hosts[1].runners, 1)
+
+	// The freed slot is taken again.
+	workload, err := provider.Provision(context.Background(), testRequest(2))
+	require.NoError(t, err)
+	assert.Equal(t, f.hosts[0].address(), workload.ID)
+
+	// A provider started afterwards finds runners by listing the hosts.
+	restarted := openFleet(t, f, 1, 1)
+	require.NoError(t, restarted.Deprovision(context.Background(), testRequest(1).RunnerUUID))
+	assert.Empty(t, f.hosts[1].runners)
+
+	// Runners on no host are already gone.
+	require.NoError(t, restarted.Deprovision(context.Background(), testRequest(1).RunnerUUID))
+
+	// Credentials only travel in the script, never in the command.
+	for _, h := range f.hosts {
+		for _, command := range h.commands {
+			assert.Equal(t, "sh -s", command)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	f := newFleet(t, 3)
+	f.hosts[0].runners[testRequest(9).RunnerUUID] = "old"
+	require.NoError(t, f.hosts[2].listener.Close())
+
+	provider := openFleet(t, f, 2, 3, 4)
+
+	free, err := provider.Capacity(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, free)
+
+	_, err = provider.Provision(context.Background(), testRequest(1))
+	require.NoError(t, err)
+
+	free, err = provider.Capacity(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, free)
+
+	// Without any host to list there is nothing to tell.
+	unreachable := newFleet(t, 1)
+	require.NoError(t, unreachable.hosts[0].listener.Close())
+
+	_, err = openFleet(t, unreachable, 1).Capacity(context.Background())
+	assert.ErrorContains(t, err, "failed to list runners")
+}
+
+func TestWorkloads(t *testing.T) {
+	f := newFleet(t, 2)
+
+	// Runners started for another pool, or by an older start script, are
+	// not the pool's.
+	f.hosts[0].runners[testRequest(8).RunnerUUID] = "old"
+	f.hosts[1].runners[testRequest(9).RunnerUUID] = "old"
+	f.hosts[1].pools[testRequest(9).RunnerUUID] = "acme windows"
+
+	provider := openFleet(t, f, 2, 2)
+	now := time.Now()
+	provider.now = func() time.Time { return now }
+
+	for i := range 2 {
+		_, err := provider.Provision(context.Background(), testRequest(i))
+		require.NoError(t, err)
+	}
+
+	workloads, err := provider.Workloads(context.Background(), "acme", "linux")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ports.Workload{
+		{CreatedAt: now, ID: f.hosts[0].address(), RunnerUUID: testRequest(0).RunnerUUID, Pool: "linux", Provider: "fleet"},
+		{CreatedAt: now, ID: f.hosts[1].address(), RunnerUUID: testRequest(1).RunnerUUID, Pool: "linux", Provider: "fleet"},
+	}, workloads)
+
+	// A runner removed behind the provider's back is noticed once the
+	// listing is outdated, and its slot is free again.
+	f.hosts[1].mu.Lock()
+	delete(f.hosts[1].runners, testRequest(1).RunnerUUID)
+	f.hosts[1].mu.Unlock()
+
+	free, err := provider.Capacity(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, free)
+
+	now = now.Add(listInterval)
+
+	free, err = provider.Capacity(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, free)
+
+	workloads, err = provider.Workloads(context.Background(), "acme", "linux")
+	require.NoError(t, err)
+	assert.Len(t, workloads, 1)
+
+	// Without every host listed, the runners on the others would look gone.
+	require.NoError(t, f.hosts[1].listener.Close())
+
+	now = now.Add(listInterval)
+
+	_, err = provider.Workloads(context.Background(), "acme", "linux")
+	assert.ErrorContains(t, err, "failed to list runners on "+f.hosts[1].address())
+}
+
+func TestDefaultScripts(t *testing.T) {
+	provider, err := New("fleet", config.SSH{}, nil)
+	require.NoError(t, err)
+
+	req := testRequest(1)
+
+	start, err := render(provider.start, req)
+	require.NoError(t, err)
+	assert.Contains(t, start, "name='bitbucket-runner-00000000-0000-0000-0000-000000000001'")
+	assert.Contains(t, start, "OAUTH_CLIENT_SECRET=s3cr3t\nRUNTIME_PREREQUISITES_ENABLED=true\nEOF\n")
+	assert.Equal(t, 1, strings.Count(start, "s3cr3t"))
+
+	list, err := render(provider.list, req)
+	require.NoError(t, err)
+	assert.Equal(t, "docker ps -a --filter label="+LabelRunner+
+		` --format '{{.Label "`+LabelRunner+`"}} {{.Label "`+LabelWorkspace+`"}} {{.Label "`+LabelPool+`"}}'`+"\n", list)
+}
@@ -0,0 +1,209 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeHost is an in-process SSH server acting as a build host. It runs the
+// scripts piped into it line by line, understanding three commands:
+// "start <uuid> <secret> [<workspace> <pool>]", "stop <uuid>" and "list".
+type fakeHost struct {
+	listener net.Listener
+	// runners holds the secret each runner was started with.
+	runners map[string]string
+	// pools holds the workspace and pool each runner was started for.
+	pools map[string]string
+	// commands records the command of every session.
+	commands []string
+	// scripts records the script of every session.
+	scripts []string
+	// failStart makes the start command exit with an error.
+	failStart bool
+	mu        sync.Mutex
+}
+
+// fleet is a set of fake hosts sharing a host key, with a client key and a
+// known hosts file to reach them.
+type fleet struct {
+	privateKeyFile string
+	knownHostsFile string
+	hosts          []*fakeHost
+}
+
+func newFleet(t *testing.T, n int) *fleet {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+
+	clientPub, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	authorized, err := ssh.NewPublicKey(clientPub)
+	require.NoError(t, err)
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+
+			return &ssh.Permissions{}, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	dir := t.TempDir()
+	f := &fleet{
+		privateKeyFile: filepath.Join(dir, "id_ed25519"),
+		knownHostsFile: filepath.Join(dir, "known_hosts"),
+	}
+
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(f.privateKeyFile, pem.EncodeToMemory(block), 0o600))
+
+	var knownHosts strings.Builder
+
+	for range n {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = listener.Close() })
+
+		h := &fakeHost{listener: listener, runners: map[string]string{}, pools: map[string]string{}}
+		f.hosts = append(f.hosts, h)
+
+		knownHosts.WriteString(knownhosts.Line([]string{h.address()}, hostSigner.PublicKey()) + "\n")
+
+		go h.serve(serverConfig)
+	}
+
+	require.NoError(t, os.WriteFile(f.knownHostsFile, []byte(knownHosts.String()), 0o600))
+
+	return f
+}
+
+func (h *fakeHost) address() string {
+	return h.listener.Addr().String()
+}
+
+func (h *fakeHost) serve(cfg *ssh.ServerConfig) {
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+			if err != nil {
+				return
+			}
+
+			go ssh.DiscardRequests(reqs)
+
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+
+					continue
+				}
+
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+
+				go h.session(channel, requests)
+			}
+		}()
+	}
+}
+
+func (h *fakeHost) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+
+			continue
+		}
+
+		var payload struct{ Command string }
+
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			_ = req.Reply(false, nil)
+
+			return
+		}
+
+		_ = req.Reply(true, nil)
+
+		script, _ := io.ReadAll(channel)
+		status := h.run(payload.Command, string(script), channel, channel.Stderr())
+
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+
+		return
+	}
+}
+
+func (h *fakeHost) run(command, script string, stdout, stderr io.Writer) uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.commands = append(h.commands, command)
+	h.scripts = append(h.scripts, script)
+
+	for _, line := range strings.Split(strings.TrimSpace(script), "\n") {
+		fields := strings.Fields(line)
+
+		switch {
+		case (len(fields) == 3 || len(fields) == 5) && fields[0] == "start":
+			if h.failStart {
+				fmt.Fprintln(stderr, "docker: Cannot connect to the Docker daemon")
+
+				return 1
+			}
+
+			h.runners[fields[1]] = fields[2]
+
+			if len(fields) == 5 {
+				h.pools[fields[1]] = fields[3] + " " + fields[4]
+			}
+		case len(fields) == 2 && fields[0] == "stop":
+			delete(h.runners, fields[1])
+			delete(h.pools, fields[1])
+		case len(fields) == 1 && fields[0] == "list":
+			for uuid := range h.runners {
+				fmt.Fprintln(stdout, uuid, h.pools[uuid])
+			}
+		default:
+			fmt.Fprintf(stderr, "sh: %s: not found\n", line)
+
+			return 127
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,259 @@
+package vmss
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v6"
+	"github.com/stretchr/testify/require"
+)
+
+const scaleSetPath = "/subscriptions/{subscription}/resourceGroups/{group}/providers/Microsoft.Compute/" +
+	"virtualMachineScaleSets/{scaleSet}"
+
+// standIn is a local stand-in for the Azure Resource Manager endpoints of a
+// single scale set. Every operation completes synchronously, so pollers are
+// done after the first response.
+type standIn struct {
+	vms map[string]*armcompute.VirtualMachineScaleSetVM
+	// customData holds the decoded custom data each instance was created
+	// with.
+	customData map[string]string
+	// scaleError is the error code scaling out ends with. The instance is
+	// still created, failed, like Azure does.
+	scaleError string
+	// model is the decoded custom data of the scale set model.
+	model string
+	// upgradeMode is the upgrade policy of the scale set, manual unless
+	// set.
+	upgradeMode armcompute.UpgradeMode
+	deleted     []string
+	capacity    int64
+	next        int
+	mu          sync.Mutex
+	// overprovision turns overprovisioning on.
+	overprovision bool
+}
+
+// fakeCredential hands out tokens the stand-in never checks.
+type fakeCredential struct{}
+
+func (fakeCredential) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func newStandIn(t *testing.T) (*standIn, *armcompute.ClientFactory) {
+	t.Helper()
+
+	s := &standIn{
+		vms:         map[string]*armcompute.VirtualMachineScaleSetVM{},
+		customData:  map[string]string{},
+		upgradeMode: armcompute.UpgradeModeManual,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+scaleSetPath, s.getScaleSet)
+	mux.HandleFunc("PATCH "+scaleSetPath, s.updateScaleSet)
+	mux.HandleFunc("POST "+scaleSetPath+"/delete", s.deleteInstances)
+	mux.HandleFunc("GET "+scaleSetPath+"/virtualMachines", s.listVMs)
+	mux.HandleFunc("GET "+scaleSetPath+"/virtualMachines/{instance}", s.getVM)
+	mux.HandleFunc("PUT "+scaleSetPath+"/virtualMachines/{instance}", s.updateVM)
+
+	// The bearer token policy refuses plain HTTP.
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	factory, err := armcompute.NewClientFactory("sub", fakeCredential{}, &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {Endpoint: srv.URL, Audience: srv.URL},
+			}},
+			Retry:     policy.RetryOptions{MaxRetries: -1},
+			Transport: srv.Client(),
+		},
+	})
+	require.NoError(t, err)
+
+	return s, factory
+}
+
+// add creates an instance as if the scale set had grown by itself.
+func (s *standIn) add(tags map[string]*string) string {
+	s.next++
+	id := strconv.Itoa(s.next)
+
+	s.vms[id] = &armcompute.VirtualMachineScaleSetVM{
+		InstanceID: to.Ptr(id),
+		Name:       to.Ptr("runners_" + id),
+		Location:   to.Ptr("westeurope"),
+		Tags:       tags,
+	}
+	s.customData[id] = s.model
+	s.capacity++
+
+	return id
+}
+
+func (s *standIn) getScaleSet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, &armcompute.VirtualMachineScaleSet{
+		Name:     to.Ptr(r.PathValue("scaleSet")),
+		Location: to.Ptr("westeurope"),
+		SKU:      &armcompute.SKU{Name: to.Ptr("Standard_D2s_v5"), Capacity: to.Ptr(s.capacity)},
+		Properties: &armcompute.VirtualMachineScaleSetProperties{
+			OrchestrationMode: to.Ptr(armcompute.OrchestrationModeUniform),
+			UpgradePolicy:     &armcompute.UpgradePolicy{Mode: to.Ptr(s.upgradeMode)},
+			Overprovision:     to.Ptr(s.overprovision),
+		},
+	})
+}
+
+func (s *standIn) updateScaleSet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var update armcompute.VirtualMachineScaleSetUpdate
+
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+
+		return
+	}
+
+	if props := update.Properties; props != nil && props.VirtualMachineProfile != nil &&
+		props.VirtualMachineProfile.OSProfile != nil && props.VirtualMachineProfile.OSProfile.CustomData != nil {
+		data, err := base64.StdEncoding.DecodeString(*props.VirtualMachineProfile.OSProfile.CustomData)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidParameter", err.Error())
+
+			return
+		}
+
+		s.model = string(data)
+	}
+
+	scaling := update.SKU != nil && update.SKU.Capacity != nil
+
+	if scaling {
+		for s.capacity < *update.SKU.Capacity {
+			s.add(nil)
+		}
+	}
+
+	if scaling && s.scaleError != "" {
+		writeError(w, http.StatusConflict, s.scaleError, "Operation could not be completed as it results in exceeding quota.")
+
+		return
+	}
+
+	writeJSON(w, &armcompute.VirtualMachineScaleSet{
+		Name:       to.Ptr(r.PathValue("scaleSet")),
+		Location:   to.Ptr("westeurope"),
+		SKU:        &armcompute.SKU{Capacity: to.Ptr(s.capacity)},
+		Properties: &armcompute.VirtualMachineScaleSetProperties{ProvisioningState: to.Ptr("Succeeded")},
+	})
+}
+
+func (s *standIn) deleteInstances(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids armcompute.VirtualMachineScaleSetVMInstanceRequiredIDs
+
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+
+		return
+	}
+
+	for _, id := range ids.InstanceIDs {
+		if _, ok := s.vms[*id]; ok {
+			delete(s.vms, *id)
+			s.deleted = append(s.deleted, *id)
+			s.capacity--
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *standIn) listVMs(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := &armcompute.VirtualMachineScaleSetVMListResult{Value: []*armcompute.VirtualMachineScaleSetVM{}}
+
+	for _, vm := range s.vms {
+		list.Value = append(list.Value, vm)
+	}
+
+	writeJSON(w, list)
+}
+
+func (s *standIn) getVM(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[r.PathValue("instance")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound", "instance not found")
+
+		return
+	}
+
+	writeJSON(w, vm)
+}
+
+func (s *standIn) updateVM(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("instance")
+	if _, ok := s.vms[id]; !ok {
+		writeError(w, http.StatusNotFound, "NotFound", "instance not found")
+
+		return
+	}
+
+	var vm armcompute.VirtualMachineScaleSetVM
+
+	if err := json.NewDecoder(r.Body).Decode(&vm); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+
+		return
+	}
+
+	vm.InstanceID = to.Ptr(id)
+	s.vms[id] = &vm
+
+	writeJSON(w, &vm)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"code": code, "message": message},
+	})
+}
@@ -0,0 +1,472 @@
+package vmss
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v6"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// Tags set on every instance of the scale set that runs a runner.
+const (
+	TagWorkspace string = "bitbucket-runner-autoscaler:workspace"
+	TagPool      string = "bitbucket-runner-autoscaler:pool"
+	TagRunner    string = "bitbucket-runner-autoscaler:runner"
+)
+
+// defaultCustomData starts the Bitbucket runner container. Azure never
+// returns custom data through its API, but the script stays readable on the
+// instance itself.
+const defaultCustomData string = `#!/bin/sh
+set -e
+docker run -d --restart unless-stopped --name runner \
+  -v /tmp:/tmp \
+  -v /var/run/docker.sock:/var/run/docker.sock \
+  -v /var/lib/docker/containers:/var/lib/docker/containers:ro \
+  -e ACCOUNT_UUID='{{.WorkspaceUUID}}' \
+  -e RUNNER_UUID='{{.RunnerUUID}}' \
+  -e RUNTIME_PREREQUISITES_ENABLED=true \
+  -e OAUTH_CLIENT_ID='{{.OAuthClientID}}' \
+  -e OAUTH_CLIENT_SECRET='{{.OAuthClientSecret}}' \
+  -e WORKING_DIRECTORY=/tmp \
+  docker-public.packages.atlassian.com/sox/atlassian/bitbucket-pipelines-runner:1
+`
+
+// clearedCustomData replaces the custom data of the scale set model once an
+// instance was added, so that the runner credentials do not stay in it.
+const clearedCustomData string = "#!/bin/sh\n"
+
+// cleanupTimeout bounds clearing the scale set model and deleting the
+// instances of a failed provisioning, which run even when the provisioning
+// timed out.
+const cleanupTimeout time.Duration = 2 * time.Minute
+
+// Provider runs Bitbucket runners on the instances of a virtual machine
+// scale set. Each runner grows the scale set by one instance, tagged with
+// the runner UUID, and shrinks it by deleting that very instance.
+type Provider struct {
+	scaleSets  *armcompute.VirtualMachineScaleSetsClient
+	vms        *armcompute.VirtualMachineScaleSetVMsClient
+	customData *template.Template
+	name       string
+	cfg        config.VMSS
+	// mu serializes scaling: the custom data of the scale set model holds
+	// the credentials of the runner being provisioned until the instance
+	// was added, and new instances are told apart by listing the scale set
+	// before and after.
+	mu sync.Mutex
+}
+
+// customDataInput is what the custom data template can refer to.
+type customDataInput struct {
+	WorkspaceUUID     string
+	RunnerUUID        string
+	RunnerName        string
+	OAuthClientID     string
+	OAuthClientSecret string
+	TokenEndpoint     string
+	Audience          string
+	Labels            []string
+}
+
+// New returns a provider calling Azure Resource Manager through the clients
+// of factory.
+func New(name string, cfg config.VMSS, factory *armcompute.ClientFactory) (*Provider, error) {
+	text := cfg.CustomData
+	if text == "" {
+		text = defaultCustomData
+	}
+
+	customData, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid custom_data template: %w", err)
+	}
+
+	return &Provider{
+		scaleSets:  factory.NewVirtualMachineScaleSetsClient(),
+		vms:        factory.NewVirtualMachineScaleSetVMsClient(),
+		customData: customData,
+		name:       name,
+		cfg:        cfg,
+	}, nil
+}
+
+// Open returns a provider using the default Azure credential chain.
+func Open(ctx context.Context, name string, cfg config.VMSS) (*Provider, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Azure credentials: %w", err)
+	}
+
+	var opts *arm.ClientOptions
+
+	if cfg.Endpoint != "" {
+		opts = &arm.ClientOptions{ClientOptions: policy.ClientOptions{Cloud: cloud.Configuration{
+			ActiveDirectoryAuthorityHost: cloud.AzurePublic.ActiveDirectoryAuthorityHost,
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {Endpoint: cfg.Endpoint, Audience: cfg.Endpoint},
+			},
+		}}}
+	}
+
+	factory, err := armcompute.NewClientFactory(cfg.SubscriptionID, credential, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compute client: %w", err)
+	}
+
+	provider, err := New(name, cfg, factory)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := provider.verify(ctx); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// verify checks that instances only come and go when the provider asks for
+// it: an automatic or rolling upgrade policy would reimage instances running
+// a step, and overprovisioning adds instances nobody asked for.
+func (p *Provider) verify(ctx context.Context) error {
+	resp, err := p.scaleSets.Get(ctx, p.cfg.ResourceGroup, p.cfg.ScaleSet, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read scale set %s: %w", p.cfg.ScaleSet, err)
+	}
+
+	props := resp.Properties
+	if props == nil {
+		props = &armcompute.VirtualMachineScaleSetProperties{}
+	}
+
+	// Azure defaults to a manual upgrade policy and uniform orchestration,
+	// but to overprovisioning.
+	switch {
+	case props.OrchestrationMode != nil && *props.OrchestrationMode != armcompute.OrchestrationModeUniform:
+		return fmt.Errorf("scale set %s must use uniform orchestration, got %s", p.cfg.ScaleSet, *props.OrchestrationMode)
+	case props.UpgradePolicy != nil && props.UpgradePolicy.Mode != nil &&
+		*props.UpgradePolicy.Mode != armcompute.UpgradeModeManual:
+		return fmt.Errorf("scale set %s must use a manual upgrade policy, got %s", p.cfg.ScaleSet, *props.UpgradePolicy.Mode)
+	case props.Overprovision == nil || *props.Overprovision:
+		return fmt.Errorf("scale set %s must not overprovision", p.cfg.ScaleSet)
+	default:
+		return nil
+	}
+}
+
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// Provision grows the scale set by one instance booting with the runner
+// credentials in its custom data, and tags that instance with the runner
+// UUID. Provisioning is bounded by its own timeout rather than by ctx, as
+// adding an instance often outlasts a reconcile. The credentials are cleared
+// from the scale set model afterwards, and instances the scale set gained
+// are deleted again if any step fails.
+func (p *Provider) Provision(ctx context.Context, req ports.ProvisionRequest) (*ports.Workload, error) {
+	customData, err := p.renderCustomData(req)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	provisionCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.cfg.ProvisionTimeout)
+	defer cancel()
+
+	before, err := p.list(provisionCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceID, err := p.scaleOut(provisionCtx, before, customData)
+	err = errors.Join(err, p.clearCustomData(ctx))
+
+	if err == nil {
+		err = p.tag(provisionCtx, instanceID, req)
+	}
+
+	if err != nil {
+		return nil, errors.Join(err, p.rollback(ctx, before))
+	}
+
+	return &ports.Workload{
+		CreatedAt:  time.Now(),
+		ID:         instanceID,
+		RunnerUUID: req.RunnerUUID,
+		Pool:       req.Pool,
+		Provider:   p.name,
+	}, nil
+}
+
+// scaleOut adds one instance created with customData and returns its ID.
+func (p *Provider) scaleOut(
+	ctx context.Context, before map[string]*armcompute.VirtualMachineScaleSetVM, customData string,
+) (string, error) {
+	scaleSet, err := p.scaleSets.Get(ctx, p.cfg.ResourceGroup, p.cfg.ScaleSet, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read scale set %s: %w", p.cfg.ScaleSet, err)
+	}
+
+	var capacity int64
+	if scaleSet.SKU != nil && scaleSet.SKU.Capacity != nil {
+		capacity = *scaleSet.SKU.Capacity
+	}
+
+	update := armcompute.VirtualMachineScaleSetUpdate{
+		SKU: &armcompute.SKU{Capacity: to.Ptr(capacity + 1)},
+		Properties: &armcompute.VirtualMachineScaleSetUpdateProperties{
+			VirtualMachineProfile: &armcompute.VirtualMachineScaleSetUpdateVMProfile{
+				OSProfile: &armcompute.VirtualMachineScaleSetUpdateOSProfile{
+					CustomData: to.Ptr(base64.StdEncoding.EncodeToString([]byte(customData))),
+				},
+			},
+		},
+	}
+
+	poller, err := p.scaleSets.BeginUpdate(ctx, p.cfg.ResourceGroup, p.cfg.ScaleSet, update, nil)
+	if err == nil {
+		_, err = poller.PollUntilDone(ctx, nil)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to scale out %s: %w", p.cfg.ScaleSet, err)
+	}
+
+	after, err := p.list(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for id, vm := range after {
+		if _, ok := before[id]; !ok && vm.Tags[TagRunner] == nil {
+			return id, nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to scale out %s: no new instance found", p.cfg.ScaleSet)
+}
+
+// tag marks the instance as running the runner of req.
+func (p *Provider) tag(ctx context.Context, instanceID string, req ports.ProvisionRequest) error {
+	resp, err := p.vms.Get(ctx, p.cfg.ResourceGroup, p.cfg.ScaleSet, instanceID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read instance %s: %w", instanceID, err)
+	}
+
+	vm := resp.VirtualMachineScaleSetVM
+	if vm.Tags == nil {
+		vm.Tags = map[string]*string{}
+	}
+
+	vm.Tags[TagWorkspace] = to.Ptr(req.Workspace)
+	vm.Tags[TagPool] = to.Ptr(req.Pool)
+	vm.Tags[TagRunner] = to.Ptr(req.RunnerUUID)
+
+	poller, err := p.vms.BeginUpdate(ctx, p.cfg.ResourceGroup, p.cfg.ScaleSet, instanceID, vm, nil)
+	if err == nil {
+		_, err = poller.PollUntilDone(ctx, nil)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to tag instance %s: %w", instanceID, err)
+	}
+
+	return nil
+}
+
+// clearCustomData takes the runner credentials out of the scale set model.
+// It runs even if ctx is done, so that they never stay there.
+func (p *Provider) clearCustomData(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	update := armcompute.VirtualMachineScaleSetUpdate{
+		Properties: &armcompute.VirtualMachineScaleSetUpdateProperties{
+			VirtualMachineProfile: &armcompute.VirtualMachineScaleSetUpdateVMProfile{
+				OSProfile: &armcompute.VirtualMachineScaleSetUpdateOSProfile{
+					CustomData: to.Ptr(base64.StdEncoding.EncodeToString([]byte(clearedCustomData))),
+				},
+			},
+		},
+	}
+
+	poller, err := p.scaleSets.BeginUpdate(ctx, p.cfg.ResourceGroup, p.cfg.ScaleSet, update, nil)
+	if err == nil {
+		_, err = poller.PollUntilDone(ctx, nil)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to clear custom data of %s: %w", p.cfg.ScaleSet, err)
+	}
+
+	return nil
+}
+
+// rollback deletes the untagged instances that are not in before. It runs
+// even if ctx is done, so that no instance is left behind.
+func (p *Provider) rollback(ctx context.Context, before map[string]*armcompute.VirtualMachineScaleSetVM) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	after, err := p.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+
+	for id, vm := range after {
+		if _, ok := before[id]; !ok && vm.Tags[TagRunner] == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return p.delete(ctx, ids)
+}
+
+// Deprovision deletes the instance tagged with the runner UUID, which also
+// shrinks the scale set by one. A runner without an instance is already
+// gone.
+func (p *Provider) Deprovision(ctx context.Context, runnerUUID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vms, err := p.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+
+	for id, vm := range vms {
+		if value := vm.Tags[TagRunner]; value != nil && strings.EqualFold(*value, runnerUUID) {
+			ids = append(ids, id)
+		}
+	}
+
+	return p.delete(ctx, ids)
+}
+
+// Workloads returns a workload per instance tagged with a runner of pool.
+// Instances still being provisioned are not tagged yet and left out.
+func (p *Provider) Workloads(ctx context.Context, workspace, pool string) ([]ports.Workload, error) {
+	vms, err := p.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var workloads []ports.Workload
+
+	for id, vm := range vms {
+		if !hasTag(vm, TagWorkspace, workspace) || !hasTag(vm, TagPool, pool) || vm.Tags[TagRunner] == nil {
+			continue
+		}
+
+		var createdAt time.Time
+		if vm.Properties != nil && vm.Properties.TimeCreated != nil {
+			createdAt = *vm.Properties.TimeCreated
+		}
+
+		workloads = append(workloads, ports.Workload{
+			CreatedAt:  createdAt,
+			ID:         id,
+			RunnerUUID: *vm.Tags[TagRunner],
+			Pool:       pool,
+			Provider:   p.name,
+		})
+	}
+
+	return workloads, nil
+}
+
+func (p *Provider) delete(ctx context.Context, instanceIDs []string) error {
+	if len(instanceIDs) == 0 {
+		return nil
+	}
+
+	ids := armcompute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIDs: to.SliceOfPtrs(instanceIDs...)}
+
+	poller, err := p.scaleSets.BeginDeleteInstances(ctx, p.cfg.ResourceGroup, p.cfg.ScaleSet, ids, nil)
+	if err == nil {
+		_, err = poller.PollUntilDone(ctx, nil)
+	}
+
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete instances %s: %w", strings.Join(instanceIDs, ", "), err)
+	}
+
+	return nil
+}
+
+// list returns the instances of the scale set by instance ID.
+func (p *Provider) list(ctx context.Context) (map[string]*armcompute.VirtualMachineScaleSetVM, error) {
+	vms := map[string]*armcompute.VirtualMachineScaleSetVM{}
+	pager := p.vms.NewListPager(p.cfg.ResourceGroup, p.cfg.ScaleSet, nil)
+
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list instances of %s: %w", p.cfg.ScaleSet, err)
+		}
+
+		for _, vm := range page.Value {
+			if vm.InstanceID != nil {
+				vms[*vm.InstanceID] = vm
+			}
+		}
+	}
+
+	return vms, nil
+}
+
+func (p *Provider) renderCustomData(req ports.ProvisionRequest) (string, error) {
+	var b strings.Builder
+
+	err := p.customData.Execute(&b, customDataInput{
+		WorkspaceUUID:     req.WorkspaceUUID,
+		RunnerUUID:        req.RunnerUUID,
+		RunnerName:        req.RunnerName,
+		OAuthClientID:     req.OAuthClientID,
+		OAuthClientSecret: req.OAuthClientSecret,
+		TokenEndpoint:     req.TokenEndpoint,
+		Audience:          req.Audience,
+		Labels:            req.Labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render custom data: %w", err)
+	}
+
+	return b.String(), nil
+}
+
+// hasTag reports whether vm is tagged with key set to value.
+func hasTag(vm *armcompute.VirtualMachineScaleSetVM, key, value string) bool {
+	tag := vm.Tags[key]
+
+	return tag != nil && *tag == value
+}
+
+func isNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
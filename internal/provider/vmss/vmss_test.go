@@ -0,0 +1,215 @@
+package vmss
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v6"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const runnerUUID = "{5f1c8e6a-0b1d-4c39-9a0e-3c3b1d2e4f50}"
+
+func testRequest() ports.ProvisionRequest {
+	return ports.ProvisionRequest{
+		Workspace:         "acme",
+		WorkspaceUUID:     "{workspace}",
+		Pool:              "linux",
+		RunnerUUID:        runnerUUID,
+		RunnerName:        "linux-0a1b2c3d",
+		OAuthClientID:     "client-id",
+		OAuthClientSecret: "s3cr3t",
+		Labels:            []string{"self.hosted", "linux"},
+	}
+}
+
+func testConfig() config.VMSS {
+	return config.VMSS{
+		SubscriptionID:   "sub",
+		ResourceGroup:    "ci",
+		ScaleSet:         "runners",
+		ProvisionTimeout: config.DefaultVMSSProvisionTimeout,
+	}
+}
+
+func TestProvision(t *testing.T) {
+	tables := []struct {
+		name          string
+		customData    string
+		scaleError    string
+		expectedError string
+		expectedData  []string
+	}{
+		{
+			name: "default custom data",
+			expectedData: []string{
+				"RUNNER_UUID='" + runnerUUID + "'",
+				"ACCOUNT_UUID='{workspace}'",
+				"OAUTH_CLIENT_ID='client-id'",
+				"OAUTH_CLIENT_SECRET='s3cr3t'",
+			},
+		},
+		{
+			name:         "custom data template",
+			customData:   "#cloud-config\nrunner: {{.RunnerName}} {{.OAuthClientSecret}}\n",
+			expectedData: []string{"runner: linux-0a1b2c3d s3cr3t"},
+		},
+		{
+			name:          "quota exceeded",
+			scaleError:    "OperationNotAllowed",
+			expectedError: "failed to scale out runners",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			standIn, factory := newStandIn(t)
+			standIn.scaleError = table.scaleError
+
+			// An instance of another runner must be left alone.
+			other := standIn.add(map[string]*string{TagRunner: to.Ptr("{other}")})
+
+			cfg := testConfig()
+			cfg.CustomData = table.customData
+
+			provider, err := New("azure", cfg, factory)
+			require.NoError(t, err)
+
+			// Provisioning outlives the reconcile that started it.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			workload, err := provider.Provision(ctx, testRequest())
+
+			// The credentials do not stay in the scale set model.
+			assert.Equal(t, clearedCustomData, standIn.model)
+
+			if table.expectedError != "" {
+				assert.ErrorContains(t, err, table.expectedError)
+				assert.ErrorContains(t, err, table.scaleError)
+				// The failed instance is deleted again.
+				assert.Len(t, standIn.vms, 1)
+				assert.Equal(t, int64(1), standIn.capacity)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "azure", workload.Provider)
+			assert.Equal(t, runnerUUID, workload.RunnerUUID)
+			assert.Equal(t, int64(2), standIn.capacity)
+
+			vm := standIn.vms[workload.ID]
+			require.NotNil(t, vm)
+
+			assert.Equal(t, map[string]*string{
+				TagWorkspace: to.Ptr("acme"),
+				TagPool:      to.Ptr("linux"),
+				TagRunner:    to.Ptr(runnerUUID),
+			}, vm.Tags)
+
+			for _, expected := range table.expectedData {
+				assert.Contains(t, standIn.customData[workload.ID], expected)
+			}
+
+			require.NoError(t, provider.Deprovision(context.Background(), runnerUUID))
+			assert.Equal(t, []string{workload.ID}, standIn.deleted)
+			assert.Contains(t, standIn.vms, other)
+			assert.Equal(t, int64(1), standIn.capacity)
+
+			// Runners without an instance are already gone.
+			require.NoError(t, provider.Deprovision(context.Background(), runnerUUID))
+			assert.Equal(t, []string{workload.ID}, standIn.deleted)
+		})
+	}
+}
+
+func TestWorkloads(t *testing.T) {
+	standIn, factory := newStandIn(t)
+
+	// Only tagged instances of the pool are workloads.
+	standIn.add(map[string]*string{
+		TagWorkspace: to.Ptr("acme"), TagPool: to.Ptr("windows"), TagRunner: to.Ptr("{other}"),
+	})
+	standIn.add(nil)
+
+	provider, err := New("azure", testConfig(), factory)
+	require.NoError(t, err)
+
+	workload, err := provider.Provision(context.Background(), testRequest())
+	require.NoError(t, err)
+
+	workloads, err := provider.Workloads(context.Background(), "acme", "linux")
+	require.NoError(t, err)
+	require.Len(t, workloads, 1)
+
+	assert.Equal(t, workload.ID, workloads[0].ID)
+	assert.Equal(t, runnerUUID, workloads[0].RunnerUUID)
+	assert.Equal(t, "linux", workloads[0].Pool)
+	assert.Equal(t, "azure", workloads[0].Provider)
+}
+
+func TestNewInvalidCustomData(t *testing.T) {
+	_, factory := newStandIn(t)
+
+	cfg := testConfig()
+	cfg.CustomData = "{{.RunnerUUID"
+
+	_, err := New("azure", cfg, factory)
+	assert.ErrorContains(t, err, "invalid custom_data template")
+}
+
+func TestVerify(t *testing.T) {
+	tables := []struct {
+		name          string
+		upgradeMode   armcompute.UpgradeMode
+		expectedError string
+		overprovision bool
+	}{
+		{
+			name:        "manual upgrade policy",
+			upgradeMode: armcompute.UpgradeModeManual,
+		},
+		{
+			name:          "automatic upgrade policy",
+			upgradeMode:   armcompute.UpgradeModeAutomatic,
+			expectedError: "scale set runners must use a manual upgrade policy, got Automatic",
+		},
+		{
+			name:          "rolling upgrade policy",
+			upgradeMode:   armcompute.UpgradeModeRolling,
+			expectedError: "scale set runners must use a manual upgrade policy, got Rolling",
+		},
+		{
+			name:          "overprovisioning",
+			upgradeMode:   armcompute.UpgradeModeManual,
+			overprovision: true,
+			expectedError: "scale set runners must not overprovision",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			standIn, factory := newStandIn(t)
+			standIn.upgradeMode = table.upgradeMode
+			standIn.overprovision = table.overprovision
+
+			provider, err := New("azure", testConfig(), factory)
+			require.NoError(t, err)
+
+			err = provider.verify(context.Background())
+
+			if table.expectedError != "" {
+				assert.EqualError(t, err, table.expectedError)
+
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
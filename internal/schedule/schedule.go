@@ -0,0 +1,125 @@
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/robfig/cron/v3"
+)
+
+// DefaultProfile is reported when no scheduled profile is active.
+const DefaultProfile string = "default"
+
+// Bounds are the min and max runners of a pool at a point in time, and how
+// many idle runners it keeps warm on top of demand.
+type Bounds struct {
+	Profile string
+	Min     int
+	Max     int
+	Warm    int
+}
+
+type profile struct {
+	start    cron.Schedule
+	min      *int
+	max      *int
+	warm     *int
+	name     string
+	duration time.Duration
+}
+
+// Schedule resolves the bounds of a pool from its scheduled profiles.
+type Schedule struct {
+	location *time.Location
+	holidays map[string]struct{}
+	profiles []profile
+	defaults Bounds
+}
+
+// New builds the schedule of a pool whose own bounds are defaults. A nil cfg
+// yields a schedule that always returns defaults.
+func New(cfg *config.Schedule, defaults Bounds) (*Schedule, error) {
+	defaults.Profile = DefaultProfile
+
+	s := &Schedule{
+		location: time.UTC,
+		holidays: map[string]struct{}{},
+		defaults: defaults,
+	}
+
+	if cfg == nil {
+		return s, nil
+	}
+
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", cfg.Timezone, err)
+	}
+
+	s.location = location
+
+	for _, holiday := range cfg.Holidays {
+		s.holidays[holiday] = struct{}{}
+	}
+
+	for _, p := range cfg.Profiles {
+		start, err := cron.ParseStandard(p.Start)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: invalid start %q: %w", p.Name, p.Start, err)
+		}
+
+		s.profiles = append(s.profiles, profile{
+			start:    start,
+			min:      p.Min,
+			max:      p.Max,
+			warm:     p.Warm,
+			name:     p.Name,
+			duration: p.Duration,
+		})
+	}
+
+	return s, nil
+}
+
+// At returns the bounds in force at now.
+func (s *Schedule) At(now time.Time) Bounds {
+	now = now.In(s.location)
+
+	if _, ok := s.holidays[now.Format(time.DateOnly)]; ok {
+		return s.defaults
+	}
+
+	for _, p := range s.profiles {
+		if !p.activeAt(now) {
+			continue
+		}
+
+		bounds := s.defaults
+		bounds.Profile = p.name
+
+		if p.min != nil {
+			bounds.Min = *p.min
+		}
+
+		if p.max != nil {
+			bounds.Max = *p.max
+		}
+
+		if p.warm != nil {
+			bounds.Warm = *p.warm
+		}
+
+		return bounds
+	}
+
+	return s.defaults
+}
+
+// activeAt reports whether a start time of the profile falls within the last
+// duration before now, i.e. now is inside [start, start+duration).
+func (p *profile) activeAt(now time.Time) bool {
+	start := p.start.Next(now.Add(-p.duration))
+
+	return !start.After(now)
+}
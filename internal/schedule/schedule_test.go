@@ -0,0 +1,88 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestAt(t *testing.T) {
+	cfg := &config.Schedule{
+		Timezone: "Europe/Rome",
+		Holidays: []string{"2024-12-25"},
+		Profiles: []config.Profile{
+			{Name: "release-night", Start: "0 18 * * WED", Duration: 8 * time.Hour, Min: intPtr(4)},
+			{Name: "working-hours", Start: "0 8 * * MON-FRI", Duration: 11 * time.Hour, Min: intPtr(10), Max: intPtr(30), Warm: intPtr(3)},
+		},
+	}
+
+	s, err := New(cfg, Bounds{Min: 0, Max: 20, Warm: 1})
+	assert.NoError(t, err)
+
+	rome, _ := time.LoadLocation("Europe/Rome")
+
+	tables := []struct {
+		now      time.Time
+		name     string
+		expected Bounds
+	}{
+		{
+			name:     "weekday morning in Rome",
+			now:      time.Date(2024, 12, 2, 8, 0, 0, 0, rome),
+			expected: Bounds{Profile: "working-hours", Min: 10, Max: 30, Warm: 3},
+		},
+		{
+			name:     "evaluated in the schedule timezone",
+			now:      time.Date(2024, 12, 2, 7, 30, 0, 0, time.UTC),
+			expected: Bounds{Profile: "working-hours", Min: 10, Max: 30, Warm: 3},
+		},
+		{
+			name:     "end of the window is exclusive",
+			now:      time.Date(2024, 12, 2, 19, 0, 0, 0, rome),
+			expected: Bounds{Profile: DefaultProfile, Min: 0, Max: 20, Warm: 1},
+		},
+		{
+			name:     "weekend",
+			now:      time.Date(2024, 12, 7, 10, 0, 0, 0, rome),
+			expected: Bounds{Profile: DefaultProfile, Min: 0, Max: 20, Warm: 1},
+		},
+		{
+			name:     "holiday",
+			now:      time.Date(2024, 12, 25, 10, 0, 0, 0, rome),
+			expected: Bounds{Profile: DefaultProfile, Min: 0, Max: 20, Warm: 1},
+		},
+		{
+			name:     "window spanning midnight keeps pool max",
+			now:      time.Date(2024, 12, 5, 0, 30, 0, 0, rome),
+			expected: Bounds{Profile: "release-night", Min: 4, Max: 20, Warm: 1},
+		},
+		{
+			name:     "first listed profile wins",
+			now:      time.Date(2024, 12, 4, 18, 30, 0, 0, rome),
+			expected: Bounds{Profile: "release-night", Min: 4, Max: 20, Warm: 1},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expected, s.At(table.now))
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	s, err := New(nil, Bounds{Min: 1, Max: 5})
+
+	assert.NoError(t, err)
+	assert.Equal(t, Bounds{Profile: DefaultProfile, Min: 1, Max: 5}, s.At(time.Now()))
+
+	_, err = New(&config.Schedule{Profiles: []config.Profile{{Name: "bad", Start: "every day"}}}, Bounds{Max: 1})
+
+	assert.ErrorContains(t, err, `profile "bad": invalid start "every day"`)
+}
@@ -0,0 +1,112 @@
+package statestore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	fileMode    = 0o600
+	openTimeout = 5 * time.Second
+)
+
+// Bolt is a StateStore backed by a single BoltDB file, with one bucket per
+// namespace. Every write is committed to disk before it returns.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens or creates the state file at path. It fails if another
+// process holds the file for longer than a few seconds.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, fileMode, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state file %s: %w", path, err)
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+func (b *Bolt) Get(namespace, key string) ([]byte, error) {
+	var value []byte
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(namespace)); bucket != nil {
+			if v := bucket.Get([]byte(key)); v != nil {
+				value = append([]byte(nil), v...)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s/%s: %w", namespace, key, err)
+	}
+
+	if value == nil {
+		return nil, fmt.Errorf("%s/%s: %w", namespace, key, ports.ErrNotFound)
+	}
+
+	return value, nil
+}
+
+func (b *Bolt) Put(namespace, key string, value []byte) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(key), value)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s/%s: %w", namespace, key, err)
+	}
+
+	return nil
+}
+
+func (b *Bolt) Delete(namespace, key string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.Delete([]byte(key))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s/%s: %w", namespace, key, err)
+	}
+
+	return nil
+}
+
+func (b *Bolt) List(namespace string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			values[string(k)] = append([]byte(nil), v...)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", namespace, err)
+	}
+
+	return values, nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,70 @@
+package statestore
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+)
+
+// Memory is a StateStore that lives as long as the process. It is meant for
+// tests and for running without a state file.
+type Memory struct {
+	namespaces map[string]map[string][]byte
+	mu         sync.RWMutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{namespaces: map[string]map[string][]byte{}}
+}
+
+func (m *Memory) Get(namespace, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.namespaces[namespace][key]
+	if !ok {
+		return nil, fmt.Errorf("%s/%s: %w", namespace, key, ports.ErrNotFound)
+	}
+
+	return append([]byte(nil), value...), nil
+}
+
+func (m *Memory) Put(namespace, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.namespaces[namespace] == nil {
+		m.namespaces[namespace] = map[string][]byte{}
+	}
+
+	m.namespaces[namespace][key] = append([]byte(nil), value...)
+
+	return nil
+}
+
+func (m *Memory) Delete(namespace, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.namespaces[namespace], key)
+
+	return nil
+}
+
+func (m *Memory) List(namespace string) (map[string][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	values := make(map[string][]byte, len(m.namespaces[namespace]))
+
+	for key, value := range m.namespaces[namespace] {
+		values[key] = append([]byte(nil), value...)
+	}
+
+	return values, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,85 @@
+package statestore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/marcodellorto/bitbucket-runner-autoscaler/internal/domain/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStore(t *testing.T) {
+	tables := []struct {
+		open func(t *testing.T) ports.StateStore
+		name string
+	}{
+		{
+			name: "memory",
+			open: func(_ *testing.T) ports.StateStore {
+				return NewMemory()
+			},
+		},
+		{
+			name: "bolt",
+			open: func(t *testing.T) ports.StateStore {
+				store, err := OpenBolt(filepath.Join(t.TempDir(), "state.db"))
+				require.NoError(t, err)
+
+				return store
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			store := table.open(t)
+			defer store.Close()
+
+			_, err := store.Get("acme", "linux")
+			assert.ErrorIs(t, err, ports.ErrNotFound)
+
+			assert.NoError(t, store.Put("acme", "linux", []byte(`{"v":1}`)))
+			assert.NoError(t, store.Put("acme", "linux", []byte(`{"v":2}`)))
+			assert.NoError(t, store.Put("acme", "arm", []byte(`{"v":3}`)))
+			assert.NoError(t, store.Put("other", "linux", []byte(`{"v":4}`)))
+
+			value, err := store.Get("acme", "linux")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(`{"v":2}`), value)
+
+			values, err := store.List("acme")
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]byte{"linux": []byte(`{"v":2}`), "arm": []byte(`{"v":3}`)}, values)
+
+			assert.NoError(t, store.Delete("acme", "arm"))
+			assert.NoError(t, store.Delete("missing", "arm"))
+
+			values, err = store.List("acme")
+			assert.NoError(t, err)
+			assert.Len(t, values, 1)
+
+			values, err = store.List("missing")
+			assert.NoError(t, err)
+			assert.Empty(t, values)
+		})
+	}
+}
+
+func TestBoltSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	store, err := OpenBolt(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("acme", "linux", []byte("draining")))
+	require.NoError(t, store.Close())
+
+	store, err = OpenBolt(path)
+	require.NoError(t, err)
+
+	defer store.Close()
+
+	value, err := store.Get("acme", "linux")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("draining"), value)
+}